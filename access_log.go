@@ -0,0 +1,334 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"go.aporeto.io/elemental"
+	"go.uber.org/zap"
+)
+
+// An AccessLogKind represents the kind of an AccessLogRecord.
+type AccessLogKind string
+
+// Various values of AccessLogKind.
+const (
+	AccessLogKindRequest          AccessLogKind = "request"
+	AccessLogKindPushSessionStart AccessLogKind = "push-session-start"
+	AccessLogKindPushSessionStop  AccessLogKind = "push-session-stop"
+)
+
+// An AccessLogFormat represents the format used by an
+// AccessLogger writing into an io.Writer.
+type AccessLogFormat int
+
+// Various values of AccessLogFormat.
+const (
+	// AccessLogFormatJSON writes one JSON object per line.
+	AccessLogFormatJSON AccessLogFormat = iota
+
+	// AccessLogFormatCommon writes records in the Common Log Format.
+	AccessLogFormatCommon
+)
+
+// An AccessLogRecord contains the information about a request,
+// or about the start or the stop of a push session.
+type AccessLogRecord struct {
+	Timestamp  time.Time           `json:"timestamp"`
+	Kind       AccessLogKind       `json:"kind"`
+	RequestID  string              `json:"requestID,omitempty"`
+	SessionID  string              `json:"sessionID,omitempty"`
+	ClientIP   string              `json:"clientIP,omitempty"`
+	Claims     map[string]string   `json:"claims,omitempty"`
+	Method     string              `json:"method,omitempty"`
+	Path       string              `json:"path,omitempty"`
+	Protocol   string              `json:"protocol,omitempty"`
+	Namespace  string              `json:"namespace,omitempty"`
+	Identity   string              `json:"identity,omitempty"`
+	Operation  elemental.Operation `json:"operation,omitempty"`
+	Version    int                 `json:"version"`
+	StatusCode int                 `json:"statusCode"`
+	Bytes      int64               `json:"bytes"`
+	Duration   time.Duration       `json:"duration"`
+	TraceID    string              `json:"traceID,omitempty"`
+}
+
+// An AccessLogger writes AccessLogRecords.
+type AccessLogger interface {
+	LogAccess(record *AccessLogRecord)
+}
+
+type writerAccessLogger struct {
+	writer io.Writer
+	format AccessLogFormat
+	lock   sync.Mutex
+}
+
+// NewWriterAccessLogger returns an AccessLogger writing the records in the
+// given io.Writer, like a file, using the given format.
+func NewWriterAccessLogger(w io.Writer, format AccessLogFormat) AccessLogger {
+
+	return &writerAccessLogger{
+		writer: w,
+		format: format,
+	}
+}
+
+func (l *writerAccessLogger) LogAccess(record *AccessLogRecord) {
+
+	var data []byte
+
+	switch l.format {
+
+	case AccessLogFormatCommon:
+		data = []byte(formatCommonLog(record))
+
+	default:
+		var err error
+		if data, err = json.Marshal(record); err != nil {
+			zap.L().Error("Unable to encode access log record", zap.Error(err))
+			return
+		}
+		data = append(data, '\n')
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, err := l.writer.Write(data); err != nil {
+		zap.L().Error("Unable to write access log record", zap.Error(err))
+	}
+}
+
+// formatCommonLog formats the given record in the Common Log Format:
+//
+//	host ident authuser [date] "method path protocol" status bytes
+func formatCommonLog(record *AccessLogRecord) string {
+
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d\n",
+		orDash(record.ClientIP),
+		record.Timestamp.Format("02/Jan/2006:15:04:05 -0700"),
+		orDash(record.Method),
+		orDash(record.Path),
+		orDash(record.Protocol),
+		record.StatusCode,
+		record.Bytes,
+	)
+}
+
+type zapAccessLogger struct {
+	logger *zap.Logger
+}
+
+// NewZapAccessLogger returns an AccessLogger writing
+// the records as structured logs in the given zap.Logger.
+func NewZapAccessLogger(logger *zap.Logger) AccessLogger {
+
+	return &zapAccessLogger{
+		logger: logger,
+	}
+}
+
+func (l *zapAccessLogger) LogAccess(record *AccessLogRecord) {
+
+	fields := []zap.Field{
+		zap.Time("timestamp", record.Timestamp),
+		zap.String("kind", string(record.Kind)),
+		zap.String("clientIP", record.ClientIP),
+		zap.String("method", record.Method),
+		zap.String("path", record.Path),
+		zap.Int("statusCode", record.StatusCode),
+		zap.Int64("bytes", record.Bytes),
+		zap.Duration("duration", record.Duration),
+	}
+
+	if record.RequestID != "" {
+		fields = append(fields, zap.String("requestID", record.RequestID))
+	}
+
+	if record.SessionID != "" {
+		fields = append(fields, zap.String("sessionID", record.SessionID))
+	}
+
+	if len(record.Claims) > 0 {
+		fields = append(fields, zap.Any("claims", record.Claims))
+	}
+
+	if record.Identity != "" {
+		fields = append(fields,
+			zap.String("namespace", record.Namespace),
+			zap.String("identity", record.Identity),
+			zap.String("operation", string(record.Operation)),
+			zap.Int("version", record.Version),
+		)
+	}
+
+	if record.TraceID != "" {
+		fields = append(fields, zap.String("traceID", record.TraceID))
+	}
+
+	l.logger.Info("access", fields...)
+}
+
+// An AccessLogOption represents an option that can be passed to OptAccessLog.
+type AccessLogOption func(*accessLogConfig)
+
+type accessLogConfig struct {
+	sampleEvery uint64
+	claims      []string
+}
+
+// AccessLogOptSampleSuccess only logs one successful request out of every
+// given number. Requests that failed, and push sessions, are always logged.
+// The default is to log all requests.
+func AccessLogOptSampleSuccess(every int) AccessLogOption {
+
+	if every <= 0 {
+		panic("every must be greater than 0")
+	}
+
+	return func(c *accessLogConfig) {
+		c.sampleEvery = uint64(every)
+	}
+}
+
+// AccessLogOptClaims sets the keys of the claims to add in the records.
+// By default, no claim is logged.
+func AccessLogOptClaims(keys ...string) AccessLogOption {
+	return func(c *accessLogConfig) {
+		c.claims = keys
+	}
+}
+
+type accessLog struct {
+	logger      AccessLogger
+	sampleEvery uint64
+	claims      []string
+	successes   uint64
+}
+
+func newAccessLog(logger AccessLogger, options ...AccessLogOption) *accessLog {
+
+	cfg := accessLogConfig{
+		sampleEvery: 1,
+	}
+
+	for _, opt := range options {
+		opt(&cfg)
+	}
+
+	return &accessLog{
+		logger:      logger,
+		sampleEvery: cfg.sampleEvery,
+		claims:      cfg.claims,
+	}
+}
+
+// log logs the given record, unless it is a successful
+// request that has not been sampled.
+func (a *accessLog) log(record *AccessLogRecord) {
+
+	if record.Kind == AccessLogKindRequest &&
+		record.StatusCode > 0 && record.StatusCode < http.StatusBadRequest &&
+		a.sampleEvery > 1 &&
+		(atomic.AddUint64(&a.successes, 1)-1)%a.sampleEvery != 0 {
+		return
+	}
+
+	a.logger.LogAccess(record)
+}
+
+// claimsSubset returns the configured subset of the given claims.
+func (a *accessLog) claimsSubset(claims map[string]string) map[string]string {
+
+	if len(a.claims) == 0 || len(claims) == 0 {
+		return nil
+	}
+
+	out := make(map[string]string, len(a.claims))
+	for _, k := range a.claims {
+		if v, ok := claims[k]; ok {
+			out[k] = v
+		}
+	}
+
+	return out
+}
+
+// accessLogTraceID returns the ID of the trace of the given
+// context, from OpenTelemetry or from OpenTracing.
+func accessLogTraceID(ctx context.Context) string {
+
+	if span := otelSpanFromContext(ctx); span != nil {
+		return span.SpanContext().TraceID().String()
+	}
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		if id := extractSpanID(span); id != "unknown" {
+			return id
+		}
+	}
+
+	return ""
+}
+
+// accessLogResponseWriter is an http.ResponseWriter
+// recording the status code and the number of bytes written.
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int64
+}
+
+func (w *accessLogResponseWriter) WriteHeader(code int) {
+
+	if w.statusCode == 0 {
+		w.statusCode = code
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogResponseWriter) Write(data []byte) (int, error) {
+
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+
+	return n, err
+}
+
+func (w *accessLogResponseWriter) Flush() {
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
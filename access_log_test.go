@@ -0,0 +1,258 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-zoo/bone"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/elemental"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type testAccessLogger struct {
+	records []*AccessLogRecord
+	sync.Mutex
+}
+
+func (l *testAccessLogger) LogAccess(record *AccessLogRecord) {
+	l.Lock()
+	l.records = append(l.records, record)
+	l.Unlock()
+}
+
+func TestAccessLog_WriterAccessLogger(t *testing.T) {
+
+	ts := time.Date(2019, time.March, 4, 10, 11, 12, 0, time.UTC)
+
+	Convey("Given I have a record", t, func() {
+
+		record := &AccessLogRecord{
+			Timestamp:  ts,
+			Kind:       AccessLogKindRequest,
+			RequestID:  "rid",
+			ClientIP:   "10.0.0.1",
+			Method:     http.MethodGet,
+			Path:       "/lists",
+			Protocol:   "HTTP/1.1",
+			Identity:   "list",
+			Operation:  elemental.OperationRetrieveMany,
+			Version:    1,
+			StatusCode: http.StatusOK,
+			Bytes:      42,
+			Duration:   time.Second,
+		}
+
+		buf := &bytes.Buffer{}
+
+		Convey("When I log it as JSON", func() {
+
+			NewWriterAccessLogger(buf, AccessLogFormatJSON).LogAccess(record)
+
+			Convey("Then the output should be correct", func() {
+				So(bytes.Count(buf.Bytes(), []byte("\n")), ShouldEqual, 1)
+
+				out := &AccessLogRecord{}
+				So(json.Unmarshal(buf.Bytes(), out), ShouldBeNil)
+				So(out, ShouldResemble, record)
+			})
+		})
+
+		Convey("When I log it in the Common Log Format", func() {
+
+			NewWriterAccessLogger(buf, AccessLogFormatCommon).LogAccess(record)
+
+			Convey("Then the output should be correct", func() {
+				So(buf.String(), ShouldEqual, `10.0.0.1 - - [04/Mar/2019:10:11:12 +0000] "GET /lists HTTP/1.1" 200 42`+"\n")
+			})
+		})
+
+		Convey("When I log an empty record in the Common Log Format", func() {
+
+			NewWriterAccessLogger(buf, AccessLogFormatCommon).LogAccess(&AccessLogRecord{Timestamp: ts})
+
+			Convey("Then the output should be correct", func() {
+				So(buf.String(), ShouldEqual, `- - - [04/Mar/2019:10:11:12 +0000] "- - -" 0 0`+"\n")
+			})
+		})
+	})
+}
+
+func TestAccessLog_ZapAccessLogger(t *testing.T) {
+
+	Convey("Given I have a zap access logger", t, func() {
+
+		core, logs := observer.New(zapcore.InfoLevel)
+		l := NewZapAccessLogger(zap.New(core))
+
+		Convey("When I log a record", func() {
+
+			l.LogAccess(&AccessLogRecord{
+				Kind:       AccessLogKindRequest,
+				RequestID:  "rid",
+				Claims:     map[string]string{"a": "b"},
+				Identity:   "list",
+				Operation:  elemental.OperationCreate,
+				StatusCode: http.StatusCreated,
+				TraceID:    "tid",
+			})
+
+			Convey("Then the entry should be correct", func() {
+				So(logs.Len(), ShouldEqual, 1)
+
+				entry := logs.All()[0]
+				So(entry.Message, ShouldEqual, "access")
+
+				fields := entry.ContextMap()
+				So(fields["kind"], ShouldEqual, "request")
+				So(fields["requestID"], ShouldEqual, "rid")
+				So(fields["identity"], ShouldEqual, "list")
+				So(fields["operation"], ShouldEqual, "create")
+				So(fields["statusCode"], ShouldEqual, int64(http.StatusCreated))
+				So(fields["traceID"], ShouldEqual, "tid")
+				So(fields["claims"], ShouldResemble, map[string]string{"a": "b"})
+				So(fields, ShouldNotContainKey, "sessionID")
+			})
+		})
+	})
+}
+
+func TestAccessLog_Sampling(t *testing.T) {
+
+	Convey("Given I have an access log sampling 1 success out of 3", t, func() {
+
+		l := &testAccessLogger{}
+		a := newAccessLog(l, AccessLogOptSampleSuccess(3))
+
+		Convey("When I log 6 successful requests, 2 failed ones and a push session", func() {
+
+			for i := 0; i < 6; i++ {
+				a.log(&AccessLogRecord{Kind: AccessLogKindRequest, StatusCode: http.StatusOK})
+			}
+			a.log(&AccessLogRecord{Kind: AccessLogKindRequest, StatusCode: http.StatusNotFound})
+			a.log(&AccessLogRecord{Kind: AccessLogKindRequest, StatusCode: http.StatusInternalServerError})
+			a.log(&AccessLogRecord{Kind: AccessLogKindPushSessionStart, StatusCode: http.StatusSwitchingProtocols})
+
+			Convey("Then 5 records should have been logged", func() {
+				So(len(l.records), ShouldEqual, 5)
+				So(l.records[2].StatusCode, ShouldEqual, http.StatusNotFound)
+				So(l.records[3].StatusCode, ShouldEqual, http.StatusInternalServerError)
+				So(l.records[4].Kind, ShouldEqual, AccessLogKindPushSessionStart)
+			})
+		})
+	})
+
+	Convey("Calling AccessLogOptSampleSuccess with 0 should panic", t, func() {
+		So(func() { AccessLogOptSampleSuccess(0) }, ShouldPanicWith, "every must be greater than 0")
+	})
+}
+
+func TestAccessLog_claimsSubset(t *testing.T) {
+
+	Convey("Given I have an access log with no claims configured", t, func() {
+
+		a := newAccessLog(&testAccessLogger{})
+
+		Convey("Then claimsSubset should return nil", func() {
+			So(a.claimsSubset(map[string]string{"a": "b"}), ShouldBeNil)
+		})
+	})
+
+	Convey("Given I have an access log with claims configured", t, func() {
+
+		a := newAccessLog(&testAccessLogger{}, AccessLogOptClaims("a", "c"))
+
+		Convey("Then claimsSubset should only return the configured claims", func() {
+			So(a.claimsSubset(map[string]string{"a": "b", "x": "y"}), ShouldResemble, map[string]string{"a": "b"})
+			So(a.claimsSubset(nil), ShouldBeNil)
+		})
+	})
+}
+
+func TestAccessLog_responseWriter(t *testing.T) {
+
+	Convey("Given I have an access log response writer", t, func() {
+
+		rec := httptest.NewRecorder()
+		w := &accessLogResponseWriter{ResponseWriter: rec}
+
+		Convey("When I write without calling WriteHeader", func() {
+
+			_, _ = w.Write([]byte("hello"))
+			_, _ = w.Write([]byte(" world"))
+			w.Flush()
+
+			Convey("Then the status and bytes should be recorded", func() {
+				So(w.statusCode, ShouldEqual, http.StatusOK)
+				So(w.bytes, ShouldEqual, 11)
+				So(rec.Flushed, ShouldBeTrue)
+			})
+		})
+
+		Convey("When I call WriteHeader then write", func() {
+
+			w.WriteHeader(http.StatusTeapot)
+			_, _ = w.Write([]byte("hello"))
+
+			Convey("Then the status and bytes should be recorded", func() {
+				So(w.statusCode, ShouldEqual, http.StatusTeapot)
+				So(w.bytes, ShouldEqual, 5)
+				So(rec.Code, ShouldEqual, http.StatusTeapot)
+			})
+		})
+	})
+}
+
+func TestAccessLog_pushSessions(t *testing.T) {
+
+	Convey("Given I have a push server with an access log", t, func() {
+
+		l := &testAccessLogger{}
+
+		cfg := config{}
+		cfg.accessLog.log = newAccessLog(l)
+
+		srv := newPushServer(cfg, bone.New(), nil)
+
+		req, _ := http.NewRequest(http.MethodGet, "http://server/events", nil)
+		req.RemoteAddr = "10.0.0.2:4242"
+		session := newWSPushSession(req, cfg, nil, elemental.EncodingTypeJSON, elemental.EncodingTypeJSON)
+
+		Convey("When I register and unregister a session", func() {
+
+			srv.registerSession(session)
+			srv.unregisterSession(session)
+
+			Convey("Then the start and stop should be logged", func() {
+				So(len(l.records), ShouldEqual, 2)
+
+				So(l.records[0].Kind, ShouldEqual, AccessLogKindPushSessionStart)
+				So(l.records[0].SessionID, ShouldEqual, session.Identifier())
+				So(l.records[0].Path, ShouldEqual, "/events")
+				So(l.records[0].StatusCode, ShouldEqual, http.StatusSwitchingProtocols)
+
+				So(l.records[1].Kind, ShouldEqual, AccessLogKindPushSessionStop)
+				So(l.records[1].SessionID, ShouldEqual, session.Identifier())
+				So(l.records[1].Duration, ShouldBeGreaterThan, 0)
+			})
+		})
+	})
+}
@@ -0,0 +1,380 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.aporeto.io/elemental"
+	"go.uber.org/zap"
+)
+
+const redactedValue = "[redacted]"
+
+// An AuditRecord is the structured representation of
+// an audited operation.
+type AuditRecord struct {
+	Timestamp      time.Time           `msgpack:"timestamp" json:"timestamp"`
+	RequestID      string              `msgpack:"requestID,omitempty" json:"requestID,omitempty"`
+	Claims         []string            `msgpack:"claims,omitempty" json:"claims,omitempty"`
+	ClientIP       string              `msgpack:"clientIP,omitempty" json:"clientIP,omitempty"`
+	Namespace      string              `msgpack:"namespace,omitempty" json:"namespace,omitempty"`
+	Identity       string              `msgpack:"identity,omitempty" json:"identity,omitempty"`
+	Operation      elemental.Operation `msgpack:"operation,omitempty" json:"operation,omitempty"`
+	ObjectID       string              `msgpack:"objectID,omitempty" json:"objectID,omitempty"`
+	ParentIdentity string              `msgpack:"parentIdentity,omitempty" json:"parentIdentity,omitempty"`
+	ParentID       string              `msgpack:"parentID,omitempty" json:"parentID,omitempty"`
+	StatusCode     int                 `msgpack:"statusCode" json:"statusCode"`
+	Error          string              `msgpack:"error,omitempty" json:"error,omitempty"`
+	Duration       time.Duration       `msgpack:"duration" json:"duration"`
+	Data           map[string]any      `msgpack:"data,omitempty" json:"data,omitempty"`
+	Changes        []AttributeChange   `msgpack:"changes,omitempty" json:"changes,omitempty"`
+}
+
+// NewAuditRecord returns a new *AuditRecord built from the
+// given Context and error.
+//
+// If the operation succeeded and is an update or a patch, and the
+// previous version of the object has been set using
+// PreviousDataHolder.SetPreviousData, the record will contain the
+// changes made to the object. For a delete, the previous version
+// defaults to the output data.
+func NewAuditRecord(ctx Context, err error) *AuditRecord {
+
+	now := time.Now()
+
+	record := &AuditRecord{
+		Timestamp: now,
+		Claims:    ctx.Claims(),
+	}
+
+	if sc, ok := ctx.(interface{ startedAt() time.Time }); ok {
+		record.Duration = now.Sub(sc.startedAt())
+	}
+
+	if req := ctx.Request(); req != nil {
+		record.RequestID = req.RequestID
+		record.ClientIP = req.ClientIP
+		record.Namespace = req.Namespace
+		record.Identity = req.Identity.Name
+		record.Operation = req.Operation
+		record.ObjectID = req.ObjectID
+		record.ParentIdentity = req.ParentIdentity.Name
+		record.ParentID = req.ParentID
+	}
+
+	if err != nil {
+		record.Error = err.Error()
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			record.StatusCode = http.StatusRequestTimeout
+		} else {
+			record.StatusCode = elemental.NewErrors(err).Code()
+		}
+		return record
+	}
+
+	record.Changes = auditChanges(ctx)
+
+	record.StatusCode = ctx.StatusCode()
+	if ctx.OutputData() == nil && (record.StatusCode == 0 || record.StatusCode == http.StatusOK) {
+		record.StatusCode = http.StatusNoContent
+	} else if record.StatusCode == 0 {
+		record.StatusCode = http.StatusOK
+	}
+
+	return record
+}
+
+func auditChanges(ctx Context) []AttributeChange {
+
+	if ctx.Request() == nil {
+		return nil
+	}
+
+	// The dispatchers compute the changes before resetting the
+	// secret attributes of the output data.
+	if cc, ok := ctx.(interface {
+		computedChanges() ([]AttributeChange, bool)
+	}); ok {
+		if changes, computed := cc.computedChanges(); computed {
+			return changes
+		}
+	}
+
+	var previous any
+	if holder, ok := ctx.(PreviousDataHolder); ok {
+		previous = holder.PreviousData()
+	}
+
+	switch ctx.Request().Operation {
+
+	case elemental.OperationUpdate, elemental.OperationPatch:
+		if previous == nil {
+			return nil
+		}
+		current := ctx.OutputData()
+		if current == nil {
+			current = ctx.InputData()
+		}
+		return ComputeChanges(previous, current)
+
+	case elemental.OperationDelete:
+		// Delete processors usually return the deleted object.
+		if previous == nil {
+			previous = ctx.OutputData()
+		}
+		return ComputeChanges(previous, nil)
+	}
+
+	return nil
+}
+
+// An AuditSink is the interface of an object
+// that can store AuditRecords.
+type AuditSink interface {
+
+	// Write writes the given record.
+	Write(*AuditRecord) error
+
+	// Close releases the resources used by the sink.
+	Close() error
+}
+
+// An AuditTrail is an Auditer that converts the audited
+// Contexts into AuditRecords and asynchronously writes
+// them into an AuditSink.
+type AuditTrail interface {
+	Auditer
+
+	// Dropped returns the number of records that have
+	// been dropped because the queue was full.
+	Dropped() uint64
+
+	// Close stops accepting new records, flushes the
+	// pending ones and closes the AuditSink.
+	Close() error
+}
+
+// An AuditTrailOption represents an option to an AuditTrail.
+type AuditTrailOption func(*auditTrail)
+
+// AuditTrailOptQueueSize sets the number of records that can
+// be buffered before they are written to the sink.
+// The default is 1024.
+func AuditTrailOptQueueSize(size int) AuditTrailOption {
+
+	if size <= 0 {
+		panic("size must be greater than 0")
+	}
+
+	return func(a *auditTrail) {
+		a.queueSize = size
+	}
+}
+
+// AuditTrailOptBlockTimeout sets how long Audit is allowed to wait for
+// room in the queue before dropping the record. The default is 0,
+// meaning records are dropped immediately when the queue is full so
+// auditing never slows down requests.
+func AuditTrailOptBlockTimeout(timeout time.Duration) AuditTrailOption {
+	return func(a *auditTrail) {
+		a.blockTimeout = timeout
+	}
+}
+
+// AuditTrailOptIncludeData makes the AuditTrail add the input
+// data of create, update and patch operations to the records.
+// Secret and encrypted attributes are always redacted.
+func AuditTrailOptIncludeData(include bool) AuditTrailOption {
+	return func(a *auditTrail) {
+		a.includeData = include
+	}
+}
+
+// AuditTrailOptRedactedAttributes sets additional attributes
+// that will be redacted from the data of the records,
+// on top of the secret and encrypted ones.
+func AuditTrailOptRedactedAttributes(attributes ...string) AuditTrailOption {
+	return func(a *auditTrail) {
+		a.redactedAttributes = map[string]struct{}{}
+		for _, attr := range attributes {
+			a.redactedAttributes[attr] = struct{}{}
+		}
+	}
+}
+
+type auditTrail struct {
+	sink               AuditSink
+	queue              chan *AuditRecord
+	queueSize          int
+	blockTimeout       time.Duration
+	includeData        bool
+	redactedAttributes map[string]struct{}
+	dropped            uint64
+	closed             bool
+	lock               sync.RWMutex
+	done               chan struct{}
+}
+
+// NewAuditTrail returns a new AuditTrail that writes
+// records into the given AuditSink.
+func NewAuditTrail(sink AuditSink, options ...AuditTrailOption) AuditTrail {
+
+	if sink == nil {
+		panic("sink must not be nil")
+	}
+
+	a := &auditTrail{
+		sink:      sink,
+		queueSize: 1024,
+		done:      make(chan struct{}),
+	}
+
+	for _, opt := range options {
+		opt(a)
+	}
+
+	a.queue = make(chan *AuditRecord, a.queueSize)
+
+	go a.run()
+
+	return a
+}
+
+func (a *auditTrail) Audit(ctx Context, err error) {
+
+	record := NewAuditRecord(ctx, err)
+
+	if a.includeData && ctx.Request() != nil {
+		switch ctx.Request().Operation {
+		case elemental.OperationCreate, elemental.OperationUpdate, elemental.OperationPatch:
+			record.Data = redactData(ctx.InputData(), a.redactedAttributes)
+		}
+	}
+
+	redactChanges(record.Changes, a.redactedAttributes)
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if a.closed {
+		atomic.AddUint64(&a.dropped, 1)
+		return
+	}
+
+	select {
+	case a.queue <- record:
+		return
+	default:
+	}
+
+	if a.blockTimeout > 0 {
+		timer := time.NewTimer(a.blockTimeout)
+		defer timer.Stop()
+
+		select {
+		case a.queue <- record:
+			return
+		case <-timer.C:
+		}
+	}
+
+	atomic.AddUint64(&a.dropped, 1)
+	zap.L().Warn("Audit queue full. record dropped",
+		zap.String("requestID", record.RequestID),
+		zap.String("identity", record.Identity),
+		zap.String("operation", string(record.Operation)),
+	)
+}
+
+func (a *auditTrail) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+func (a *auditTrail) Close() error {
+
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.queue)
+	a.lock.Unlock()
+
+	<-a.done
+
+	return a.sink.Close()
+}
+
+func (a *auditTrail) run() {
+
+	defer close(a.done)
+
+	for record := range a.queue {
+		if err := a.sink.Write(record); err != nil {
+			zap.L().Error("Unable to write audit record",
+				zap.String("requestID", record.RequestID),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// redactData converts the given data into a map and replaces
+// the values of the secret, encrypted and additionally given
+// attributes.
+func redactData(data any, additional map[string]struct{}) map[string]any {
+
+	out := toDataMap(data)
+	if out == nil {
+		return nil
+	}
+
+	for attr := range secretAttributes(data) {
+		if _, ok := out[attr]; ok {
+			out[attr] = redactedValue
+		}
+	}
+
+	for attr := range additional {
+		if _, ok := out[attr]; ok {
+			out[attr] = redactedValue
+		}
+	}
+
+	return out
+}
+
+// redactChanges replaces the values of the changes
+// affecting the given attributes.
+func redactChanges(changes []AttributeChange, attributes map[string]struct{}) {
+
+	for i, change := range changes {
+
+		if _, ok := attributes[change.Attribute]; !ok {
+			continue
+		}
+
+		if change.Before != nil {
+			changes[i].Before = redactedValue
+		}
+
+		if change.After != nil {
+			changes[i].After = redactedValue
+		}
+	}
+}
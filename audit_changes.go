@@ -0,0 +1,184 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+
+	"go.aporeto.io/elemental"
+)
+
+// PushChangesHeader is the header of the publications of the push
+// events containing the JSON encoded list of AttributeChanges made
+// to the object. See OptPushServerEnableChanges.
+const PushChangesHeader = "Bahamut-Changes"
+
+// An AttributeChange represents the change of the value
+// of a single attribute of an object.
+type AttributeChange struct {
+	Attribute string `msgpack:"attribute" json:"attribute"`
+	Before    any    `msgpack:"before,omitempty" json:"before,omitempty"`
+	After     any    `msgpack:"after,omitempty" json:"after,omitempty"`
+}
+
+// ComputeChanges returns the list of attributes that differ between
+// before and after, sorted by attribute name. Any of them can be nil,
+// in which case all the attributes of the other one are reported.
+//
+// The values of the secret and encrypted attributes are redacted,
+// but their change is still reported.
+func ComputeChanges(before any, after any) []AttributeChange {
+
+	beforeMap := toDataMap(before)
+	afterMap := toDataMap(after)
+
+	if beforeMap == nil && afterMap == nil {
+		return nil
+	}
+
+	secrets := secretAttributes(before)
+	for k := range secretAttributes(after) {
+		secrets[k] = struct{}{}
+	}
+
+	names := map[string]struct{}{}
+	for k := range beforeMap {
+		names[k] = struct{}{}
+	}
+	for k := range afterMap {
+		names[k] = struct{}{}
+	}
+
+	var changes []AttributeChange
+
+	for name := range names {
+
+		b, inBefore := beforeMap[name]
+		a, inAfter := afterMap[name]
+
+		if inBefore && inAfter && reflect.DeepEqual(a, b) {
+			continue
+		}
+
+		if _, ok := secrets[name]; ok {
+			if inBefore {
+				b = redactedValue
+			}
+			if inAfter {
+				a = redactedValue
+			}
+		}
+
+		changes = append(changes, AttributeChange{
+			Attribute: name,
+			Before:    b,
+			After:     a,
+		})
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Attribute < changes[j].Attribute })
+
+	return changes
+}
+
+// toDataMap converts the given data into a map using
+// its json representation.
+func toDataMap(data any) map[string]any {
+
+	if data == nil {
+		return nil
+	}
+
+	// The map is copied, as the returned one
+	// may be redacted by the caller.
+	if m, ok := data.(map[string]any); ok {
+		out := make(map[string]any, len(m))
+		for k, v := range m {
+			out[k] = v
+		}
+		return out
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil
+	}
+
+	out := map[string]any{}
+	if err := json.Unmarshal(encoded, &out); err != nil {
+		return nil
+	}
+
+	return out
+}
+
+// secretAttributes returns the exposed names of the secret
+// and encrypted attributes of the given data.
+func secretAttributes(data any) map[string]struct{} {
+
+	out := map[string]struct{}{}
+
+	spec, ok := data.(elemental.AttributeSpecifiable)
+	if !ok {
+		return out
+	}
+
+	for _, attrSpec := range spec.AttributeSpecifications() {
+		if attrSpec.Secret || attrSpec.Encrypted {
+			out[attrSpec.Name] = struct{}{}
+		}
+	}
+
+	return out
+}
+
+type pushChangesContextKey struct{}
+
+// pushChanges contains the changes to attach
+// to the publication of the given event.
+type pushChanges struct {
+	event   *elemental.Event
+	changes []AttributeChange
+}
+
+// contextWithPushChanges returns a context carrying the
+// changes to attach to the publication of the given event.
+func contextWithPushChanges(ctx context.Context, event *elemental.Event, changes []AttributeChange) context.Context {
+
+	if event == nil || len(changes) == 0 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, pushChangesContextKey{}, pushChanges{event: event, changes: changes})
+}
+
+// setPushChangesHeader sets the PushChangesHeader of the given publication
+// if the given context carries changes for the given event.
+func setPushChangesHeader(ctx context.Context, event *elemental.Event, publication *Publication) error {
+
+	pc, ok := ctx.Value(pushChangesContextKey{}).(pushChanges)
+	if !ok || pc.event != event {
+		return nil
+	}
+
+	data, err := json.Marshal(pc.changes)
+	if err != nil {
+		return err
+	}
+
+	publication.SetHeader(PushChangesHeader, string(data))
+
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/elemental"
+)
+
+func TestAuditChanges_ComputeChanges(t *testing.T) {
+
+	Convey("Given I have two versions of an object", t, func() {
+
+		before := &auditTestObject{Name: "a", Password: "p1", Token: "t"}
+		after := &auditTestObject{Name: "b", Password: "p2", Token: "t"}
+
+		Convey("When I compute the changes", func() {
+
+			changes := ComputeChanges(before, after)
+
+			Convey("Then the changes should be correct and secrets redacted", func() {
+				So(changes, ShouldResemble, []AttributeChange{
+					{Attribute: "name", Before: "a", After: "b"},
+					{Attribute: "password", Before: redactedValue, After: redactedValue},
+				})
+			})
+		})
+
+		Convey("When I compute the changes with a map snapshot as before", func() {
+
+			changes := ComputeChanges(map[string]any{"name": "a", "password": "p2", "token": "t"}, after)
+
+			Convey("Then the secrets from the after object should be redacted", func() {
+				So(changes, ShouldResemble, []AttributeChange{
+					{Attribute: "name", Before: "a", After: "b"},
+				})
+			})
+		})
+
+		Convey("When I compute the changes with nothing after", func() {
+
+			changes := ComputeChanges(before, nil)
+
+			Convey("Then all attributes should be reported", func() {
+				So(changes, ShouldResemble, []AttributeChange{
+					{Attribute: "name", Before: "a"},
+					{Attribute: "password", Before: redactedValue},
+					{Attribute: "token", Before: redactedValue},
+				})
+			})
+		})
+
+		Convey("When I compute the changes of identical objects", func() {
+
+			changes := ComputeChanges(before, before)
+
+			Convey("Then there should be no change", func() {
+				So(changes, ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Given I have nothing to compare", t, func() {
+		So(ComputeChanges(nil, nil), ShouldBeNil)
+	})
+
+	Convey("Given I have nested values", t, func() {
+
+		changes := ComputeChanges(
+			map[string]any{"tags": []any{"a"}, "same": map[string]any{"k": "v"}},
+			map[string]any{"tags": []any{"a", "b"}, "same": map[string]any{"k": "v"}},
+		)
+
+		Convey("Then only the nested value that changed should be reported", func() {
+			So(changes, ShouldResemble, []AttributeChange{
+				{Attribute: "tags", Before: []any{"a"}, After: []any{"a", "b"}},
+			})
+		})
+	})
+}
+
+func TestAuditChanges_redactChanges(t *testing.T) {
+
+	Convey("Given I have some changes", t, func() {
+
+		changes := []AttributeChange{
+			{Attribute: "name", Before: "a", After: "b"},
+			{Attribute: "email", Before: "a@a.com"},
+		}
+
+		Convey("When I redact them", func() {
+
+			redactChanges(changes, map[string]struct{}{"email": {}})
+
+			Convey("Then only the given attributes should be redacted", func() {
+				So(changes, ShouldResemble, []AttributeChange{
+					{Attribute: "name", Before: "a", After: "b"},
+					{Attribute: "email", Before: redactedValue},
+				})
+			})
+		})
+	})
+}
+
+func TestAuditChanges_setPushChangesHeader(t *testing.T) {
+
+	Convey("Given I have an event and a context carrying its changes", t, func() {
+
+		event := &elemental.Event{Identity: "thing", Type: elemental.EventUpdate}
+		changes := []AttributeChange{{Attribute: "name", Before: "a", After: "b"}}
+		ctx := contextWithPushChanges(context.Background(), event, changes)
+
+		Convey("When I set the header of the publication of the event", func() {
+
+			pub := NewPublication("topic")
+			err := setPushChangesHeader(ctx, event, pub)
+
+			Convey("Then the changes should be attached", func() {
+				So(err, ShouldBeNil)
+				So(pub.Header(PushChangesHeader), ShouldEqual, `[{"attribute":"name","before":"a","after":"b"}]`)
+			})
+		})
+
+		Convey("When I set the header of the publication of another event", func() {
+
+			pub := NewPublication("topic")
+			err := setPushChangesHeader(ctx, &elemental.Event{Identity: "thing"}, pub)
+
+			Convey("Then the changes should not be attached", func() {
+				So(err, ShouldBeNil)
+				So(pub.Header(PushChangesHeader), ShouldEqual, "")
+			})
+		})
+	})
+
+	Convey("Given I have a context without changes", t, func() {
+
+		event := &elemental.Event{Identity: "thing"}
+		ctx := contextWithPushChanges(context.Background(), event, nil)
+
+		Convey("Then no header should be set", func() {
+			pub := NewPublication("topic")
+			So(setPushChangesHeader(ctx, event, pub), ShouldBeNil)
+			So(pub.Header(PushChangesHeader), ShouldEqual, "")
+		})
+	})
+}
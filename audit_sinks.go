@@ -0,0 +1,215 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+type auditFileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	closed     bool
+	lock       sync.Mutex
+}
+
+// NewAuditFileSink returns an AuditSink that writes records as JSON lines
+// in the file located at the given path.
+//
+// When the file grows over maxSize bytes, it is rotated: the current file
+// is renamed path.1, the previous path.1 becomes path.2 and so on, keeping
+// at most maxBackups files. A maxSize of 0 disables the rotation. As the
+// records would otherwise be lost, maxBackups must be at least 1 when the
+// rotation is enabled.
+//
+// If the rotation fails, the error is logged and the records keep being
+// written in the current file until the rotation succeeds.
+func NewAuditFileSink(path string, maxSize int64, maxBackups int) (AuditSink, error) {
+
+	if maxSize > 0 && maxBackups < 1 {
+		return nil, fmt.Errorf("maxBackups must be at least 1 when maxSize is set")
+	}
+
+	s := &auditFileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *auditFileSink) Write(record *AuditRecord) error {
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("unable to encode audit record: %w", err)
+	}
+	data = append(data, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("audit file sink is closed")
+	}
+
+	// The file may not have been reopened after a failed rotation.
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(data)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			if s.file == nil {
+				return err
+			}
+			zap.L().Warn("Unable to rotate audit file", zap.String("path", s.path), zap.Error(err))
+		}
+	}
+
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+
+	return err
+}
+
+func (s *auditFileSink) Close() error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
+
+func (s *auditFileSink) open() error {
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open audit file: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to stat audit file: %w", err)
+	}
+
+	s.file = f
+	s.size = info.Size()
+
+	return nil
+}
+
+// rotate rotates the audit file. The audit file is reopened
+// even if the rotation failed, so the records are not lost.
+func (s *auditFileSink) rotate() error {
+
+	err := s.file.Close()
+	s.file = nil
+
+	if err != nil {
+		err = fmt.Errorf("unable to close audit file: %w", err)
+	} else {
+		err = s.shiftBackups()
+	}
+
+	if oerr := s.open(); oerr != nil {
+		if err != nil {
+			return fmt.Errorf("%s: %w", err, oerr)
+		}
+		return oerr
+	}
+
+	return err
+}
+
+// shiftBackups renames the audit file and its backups,
+// removing the oldest one.
+func (s *auditFileSink) shiftBackups() error {
+
+	if err := os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove oldest audit file: %w", err)
+	}
+
+	for i := s.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to rotate audit file: %w", err)
+		}
+	}
+
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return fmt.Errorf("unable to rotate audit file: %w", err)
+	}
+
+	return nil
+}
+
+type auditPubSubSink struct {
+	client PubSubClient
+	topic  string
+}
+
+// NewAuditPubSubSink returns an AuditSink that publishes records
+// in the given topic using the given PubSubClient. Closing the sink
+// does not disconnect the PubSubClient.
+func NewAuditPubSubSink(client PubSubClient, topic string) AuditSink {
+
+	if client == nil {
+		panic("client must not be nil")
+	}
+
+	return &auditPubSubSink{
+		client: client,
+		topic:  topic,
+	}
+}
+
+func (s *auditPubSubSink) Write(record *AuditRecord) error {
+
+	publication := NewPublication(s.topic)
+	if err := publication.Encode(record); err != nil {
+		return fmt.Errorf("unable to encode audit record: %w", err)
+	}
+
+	return s.client.Publish(publication)
+}
+
+func (s *auditPubSubSink) Close() error {
+	return nil
+}
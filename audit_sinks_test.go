@@ -0,0 +1,211 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func readAuditFile(path string) []*AuditRecord {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close() // nolint
+
+	var out []*AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r := &AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			panic(err)
+		}
+		out = append(out, r)
+	}
+
+	return out
+}
+
+func TestAuditSinks_FileSink(t *testing.T) {
+
+	Convey("Given I have a file sink with no rotation", t, func() {
+
+		path := filepath.Join(t.TempDir(), "audit.log")
+		sink, err := NewAuditFileSink(path, 0, 0)
+		So(err, ShouldBeNil)
+
+		Convey("When I write records", func() {
+
+			So(sink.Write(&AuditRecord{RequestID: "a"}), ShouldBeNil)
+			So(sink.Write(&AuditRecord{RequestID: "b"}), ShouldBeNil)
+			So(sink.Close(), ShouldBeNil)
+
+			Convey("Then the file should contain the records as json lines", func() {
+				records := readAuditFile(path)
+				So(len(records), ShouldEqual, 2)
+				So(records[0].RequestID, ShouldEqual, "a")
+				So(records[1].RequestID, ShouldEqual, "b")
+			})
+
+			Convey("Then writing after close should fail", func() {
+				So(sink.Write(&AuditRecord{}), ShouldNotBeNil)
+				So(sink.Close(), ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Given I have a file sink with rotation", t, func() {
+
+		path := filepath.Join(t.TempDir(), "audit.log")
+
+		data, _ := json.Marshal(&AuditRecord{RequestID: "x"})
+		lineSize := int64(len(data) + 1)
+
+		sink, err := NewAuditFileSink(path, lineSize*2, 2)
+		So(err, ShouldBeNil)
+
+		Convey("When I write more records than the max size", func() {
+
+			for _, id := range []string{"1", "2", "3", "4", "5", "6", "7"} {
+				So(sink.Write(&AuditRecord{RequestID: id}), ShouldBeNil)
+			}
+			So(sink.Close(), ShouldBeNil)
+
+			Convey("Then the files should be rotated", func() {
+
+				current := readAuditFile(path)
+				So(len(current), ShouldEqual, 1)
+				So(current[0].RequestID, ShouldEqual, "7")
+
+				b1 := readAuditFile(path + ".1")
+				So(len(b1), ShouldEqual, 2)
+				So(b1[0].RequestID, ShouldEqual, "5")
+
+				b2 := readAuditFile(path + ".2")
+				So(len(b2), ShouldEqual, 2)
+				So(b2[0].RequestID, ShouldEqual, "3")
+
+				_, err := os.Stat(path + ".3")
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+	})
+
+	Convey("Given I create a file sink with rotation and no backups", t, func() {
+
+		sink, err := NewAuditFileSink(filepath.Join(t.TempDir(), "audit.log"), 1, 0)
+
+		Convey("Then it should fail", func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "maxBackups must be at least 1 when maxSize is set")
+			So(sink, ShouldBeNil)
+		})
+	})
+
+	Convey("Given I have a file sink whose rotation fails", t, func() {
+
+		path := filepath.Join(t.TempDir(), "audit.log")
+
+		// A non empty directory cannot be removed
+		// to make room for the new backup.
+		So(os.MkdirAll(filepath.Join(path+".1", "blocker"), 0700), ShouldBeNil)
+
+		sink, err := NewAuditFileSink(path, 1, 1)
+		So(err, ShouldBeNil)
+
+		Convey("When I write records", func() {
+
+			So(sink.Write(&AuditRecord{RequestID: "1"}), ShouldBeNil)
+			So(sink.Write(&AuditRecord{RequestID: "2"}), ShouldBeNil)
+
+			Convey("Then the records should be kept in the current file", func() {
+				current := readAuditFile(path)
+				So(len(current), ShouldEqual, 2)
+				So(current[1].RequestID, ShouldEqual, "2")
+			})
+
+			Convey("When the rotation is possible again", func() {
+
+				So(os.RemoveAll(path+".1"), ShouldBeNil)
+				So(sink.Write(&AuditRecord{RequestID: "3"}), ShouldBeNil)
+				So(sink.Close(), ShouldBeNil)
+
+				Convey("Then the file should be rotated", func() {
+					So(len(readAuditFile(path+".1")), ShouldEqual, 2)
+					current := readAuditFile(path)
+					So(len(current), ShouldEqual, 1)
+					So(current[0].RequestID, ShouldEqual, "3")
+				})
+			})
+		})
+	})
+
+	Convey("Given I create a file sink in a non existing directory", t, func() {
+
+		sink, err := NewAuditFileSink(filepath.Join(t.TempDir(), "nope", "audit.log"), 0, 0)
+
+		Convey("Then it should fail", func() {
+			So(err, ShouldNotBeNil)
+			So(sink, ShouldBeNil)
+		})
+	})
+}
+
+func TestAuditSinks_PubSubSink(t *testing.T) {
+
+	Convey("Given I call NewAuditPubSubSink with a nil client", t, func() {
+		So(func() { NewAuditPubSubSink(nil, "audit") }, ShouldPanicWith, "client must not be nil")
+	})
+
+	Convey("Given I have a pubsub sink", t, func() {
+
+		ps := NewLocalPubSubClient()
+		_ = ps.Connect(context.Background())
+		defer func() { _ = ps.Disconnect() }()
+
+		pubs := make(chan *Publication)
+		unsub := ps.Subscribe(pubs, nil, "audit")
+		defer unsub()
+		time.Sleep(30 * time.Millisecond)
+
+		sink := NewAuditPubSubSink(ps, "audit")
+
+		Convey("When I write a record", func() {
+
+			So(sink.Write(&AuditRecord{RequestID: "rid", StatusCode: 200}), ShouldBeNil)
+
+			var pub *Publication
+			select {
+			case pub = <-pubs:
+			case <-time.After(time.Second):
+			}
+
+			Convey("Then the record should be published", func() {
+				So(pub, ShouldNotBeNil)
+				r := &AuditRecord{}
+				So(pub.Decode(r), ShouldBeNil)
+				So(r.RequestID, ShouldEqual, "rid")
+				So(r.StatusCode, ShouldEqual, 200)
+				So(sink.Close(), ShouldBeNil)
+			})
+		})
+	})
+}
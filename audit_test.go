@@ -0,0 +1,420 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/elemental"
+)
+
+type auditTestObject struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+}
+
+func (o *auditTestObject) SpecificationForAttribute(name string) elemental.AttributeSpecification {
+	return o.AttributeSpecifications()[name]
+}
+
+func (o *auditTestObject) AttributeSpecifications() map[string]elemental.AttributeSpecification {
+	return map[string]elemental.AttributeSpecification{
+		"Name":     {Name: "name"},
+		"Password": {Name: "password", Secret: true},
+		"Token":    {Name: "token", Encrypted: true},
+	}
+}
+
+func (o *auditTestObject) ValueForAttribute(name string) any {
+	return nil
+}
+
+type auditTestSink struct {
+	records []*AuditRecord
+	closed  bool
+	block   chan struct{}
+	err     error
+	lock    sync.Mutex
+}
+
+func (s *auditTestSink) Write(r *AuditRecord) error {
+
+	if s.block != nil {
+		<-s.block
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.records = append(s.records, r)
+
+	return s.err
+}
+
+func (s *auditTestSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestAudit_NewAuditRecord(t *testing.T) {
+
+	Convey("Given I have a context", t, func() {
+
+		req := elemental.NewRequest()
+		req.RequestID = "rid"
+		req.ClientIP = "10.0.0.1"
+		req.Namespace = "/ns"
+		req.Identity = elemental.MakeIdentity("list", "lists")
+		req.Operation = elemental.OperationUpdate
+		req.ObjectID = "oid"
+		req.ParentIdentity = elemental.MakeIdentity("user", "users")
+		req.ParentID = "pid"
+
+		ctx := newContext(context.Background(), req)
+		ctx.SetClaims([]string{"@auth:subject=alice"})
+		ctx.startTime = time.Now().Add(-time.Second)
+
+		Convey("When I create a record with no error and no output", func() {
+
+			r := NewAuditRecord(ctx, nil)
+
+			Convey("Then the record should be correct", func() {
+				So(r.RequestID, ShouldEqual, "rid")
+				So(r.ClientIP, ShouldEqual, "10.0.0.1")
+				So(r.Namespace, ShouldEqual, "/ns")
+				So(r.Identity, ShouldEqual, "list")
+				So(r.Operation, ShouldEqual, elemental.OperationUpdate)
+				So(r.ObjectID, ShouldEqual, "oid")
+				So(r.ParentIdentity, ShouldEqual, "user")
+				So(r.ParentID, ShouldEqual, "pid")
+				So(r.Claims, ShouldResemble, []string{"@auth:subject=alice"})
+				So(r.StatusCode, ShouldEqual, http.StatusNoContent)
+				So(r.Error, ShouldBeEmpty)
+				So(r.Duration, ShouldBeGreaterThanOrEqualTo, time.Second)
+			})
+		})
+
+		Convey("When I create a record with output data", func() {
+
+			ctx.SetOutputData("hello")
+			r := NewAuditRecord(ctx, nil)
+
+			Convey("Then the status code should be 200", func() {
+				So(r.StatusCode, ShouldEqual, http.StatusOK)
+			})
+		})
+
+		Convey("When I create a record with a custom status code", func() {
+
+			ctx.SetOutputData("hello")
+			ctx.SetStatusCode(http.StatusAccepted)
+			r := NewAuditRecord(ctx, nil)
+
+			Convey("Then the status code should be correct", func() {
+				So(r.StatusCode, ShouldEqual, http.StatusAccepted)
+			})
+		})
+
+		Convey("When I create a record with an elemental error", func() {
+
+			r := NewAuditRecord(ctx, elemental.NewError("Forbidden", "nope", "test", http.StatusForbidden))
+
+			Convey("Then the status code and error should be correct", func() {
+				So(r.StatusCode, ShouldEqual, http.StatusForbidden)
+				So(r.Error, ShouldNotBeEmpty)
+			})
+		})
+
+		Convey("When I create a record with a canceled context error", func() {
+
+			r := NewAuditRecord(ctx, context.Canceled)
+
+			Convey("Then the status code should be correct", func() {
+				So(r.StatusCode, ShouldEqual, http.StatusRequestTimeout)
+			})
+		})
+	})
+
+	Convey("Given I have a context for an update with previous data", t, func() {
+
+		req := elemental.NewRequest()
+		req.Operation = elemental.OperationUpdate
+
+		ctx := NewMockContext(context.Background())
+		ctx.MockRequest = req
+		ctx.SetPreviousData(&auditTestObject{Name: "a"})
+		ctx.SetInputData(&auditTestObject{Name: "b"})
+
+		Convey("When I create a record", func() {
+
+			r := NewAuditRecord(ctx, nil)
+
+			Convey("Then the changes should be computed against the input data", func() {
+				So(r.Changes, ShouldResemble, []AttributeChange{{Attribute: "name", Before: "a", After: "b"}})
+			})
+		})
+
+		Convey("When I create a record with output data", func() {
+
+			ctx.SetOutputData(&auditTestObject{Name: "c"})
+			r := NewAuditRecord(ctx, nil)
+
+			Convey("Then the changes should be computed against the output data", func() {
+				So(r.Changes, ShouldResemble, []AttributeChange{{Attribute: "name", Before: "a", After: "c"}})
+			})
+		})
+
+		Convey("When I create a record with an error", func() {
+
+			r := NewAuditRecord(ctx, errors.New("boom"))
+
+			Convey("Then there should be no changes", func() {
+				So(r.Changes, ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Given I have a context whose changes have been computed before resetting the secrets", t, func() {
+
+		req := elemental.NewRequest()
+		req.Operation = elemental.OperationUpdate
+
+		ctx := newContext(context.Background(), req)
+		ctx.SetPreviousData(&auditTestObject{Name: "a", Password: "secret"})
+
+		out := &auditTestObject{Name: "b", Password: "secret"}
+		ctx.SetOutputData(out)
+		ctx.snapshotChanges()
+		out.Password = ""
+
+		Convey("When I create a record", func() {
+
+			r := NewAuditRecord(ctx, nil)
+
+			Convey("Then the secret attribute should not be reported as changed", func() {
+				So(r.Changes, ShouldResemble, []AttributeChange{{Attribute: "name", Before: "a", After: "b"}})
+			})
+		})
+	})
+
+	Convey("Given I have a context for an update without previous data", t, func() {
+
+		req := elemental.NewRequest()
+		req.Operation = elemental.OperationPatch
+
+		ctx := NewMockContext(context.Background())
+		ctx.MockRequest = req
+		ctx.SetInputData(&auditTestObject{Name: "b"})
+
+		Convey("Then the record should have no changes", func() {
+			So(NewAuditRecord(ctx, nil).Changes, ShouldBeNil)
+		})
+	})
+
+	Convey("Given I have a context for a delete", t, func() {
+
+		req := elemental.NewRequest()
+		req.Operation = elemental.OperationDelete
+
+		ctx := NewMockContext(context.Background())
+		ctx.MockRequest = req
+		ctx.SetOutputData(&auditTestObject{Name: "a"})
+
+		Convey("Then the changes should be computed from the output data", func() {
+			So(NewAuditRecord(ctx, nil).Changes, ShouldResemble, []AttributeChange{
+				{Attribute: "name", Before: "a"},
+				{Attribute: "password", Before: redactedValue},
+				{Attribute: "token", Before: redactedValue},
+			})
+		})
+	})
+
+	Convey("Given I have a mock context with no request", t, func() {
+
+		ctx := NewMockContext(context.Background())
+
+		r := NewAuditRecord(ctx, errors.New("boom"))
+
+		Convey("Then the record should be correct", func() {
+			So(r.StatusCode, ShouldEqual, http.StatusInternalServerError)
+			So(r.Error, ShouldNotBeEmpty)
+			So(r.Duration, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestAudit_redactData(t *testing.T) {
+
+	Convey("Given I have an object with secret attributes", t, func() {
+
+		o := &auditTestObject{Name: "n", Password: "p", Token: "t"}
+
+		Convey("When I redact it", func() {
+
+			out := redactData(o, nil)
+
+			Convey("Then secret and encrypted attributes should be redacted", func() {
+				So(out, ShouldResemble, map[string]any{
+					"name":     "n",
+					"password": redactedValue,
+					"token":    redactedValue,
+				})
+			})
+
+			Convey("Then the original object should be untouched", func() {
+				So(o.Password, ShouldEqual, "p")
+				So(o.Token, ShouldEqual, "t")
+			})
+		})
+
+		Convey("When I redact it with additional attributes", func() {
+
+			out := redactData(o, map[string]struct{}{"name": {}, "notthere": {}})
+
+			Convey("Then the additional attributes should be redacted", func() {
+				So(out, ShouldResemble, map[string]any{
+					"name":     redactedValue,
+					"password": redactedValue,
+					"token":    redactedValue,
+				})
+			})
+		})
+	})
+
+	Convey("Given I have a map", t, func() {
+
+		m := map[string]any{"name": "n", "password": "p"}
+
+		Convey("When I redact it", func() {
+
+			out := redactData(m, map[string]struct{}{"password": {}})
+
+			Convey("Then the copy should be redacted and the original map untouched", func() {
+				So(out["password"], ShouldEqual, redactedValue)
+				So(m["password"], ShouldEqual, "p")
+			})
+		})
+	})
+
+	Convey("Given I have nil data", t, func() {
+		So(redactData(nil, nil), ShouldBeNil)
+	})
+
+	Convey("Given I have data that is not an object", t, func() {
+		So(redactData("hello", nil), ShouldBeNil)
+	})
+}
+
+func TestAudit_AuditTrail(t *testing.T) {
+
+	Convey("Given I call NewAuditTrail with a nil sink", t, func() {
+		So(func() { NewAuditTrail(nil) }, ShouldPanicWith, "sink must not be nil")
+	})
+
+	Convey("Given I call AuditTrailOptQueueSize with an invalid size", t, func() {
+		So(func() { AuditTrailOptQueueSize(0) }, ShouldPanicWith, "size must be greater than 0")
+	})
+
+	Convey("Given I have an AuditTrail including data", t, func() {
+
+		sink := &auditTestSink{}
+		trail := NewAuditTrail(sink, AuditTrailOptIncludeData(true), AuditTrailOptRedactedAttributes("name"))
+
+		req := elemental.NewRequest()
+		req.Operation = elemental.OperationCreate
+
+		ctx := newContext(context.Background(), req)
+		ctx.SetInputData(&auditTestObject{Name: "n", Password: "p"})
+
+		Convey("When I audit a context and close the trail", func() {
+
+			trail.Audit(ctx, nil)
+			err := trail.Close()
+
+			Convey("Then the record should be written and the sink closed", func() {
+				So(err, ShouldBeNil)
+				So(len(sink.records), ShouldEqual, 1)
+				So(sink.records[0].Data, ShouldResemble, map[string]any{
+					"name":     redactedValue,
+					"password": redactedValue,
+					"token":    redactedValue,
+				})
+				So(sink.closed, ShouldBeTrue)
+			})
+
+			Convey("When I audit again", func() {
+
+				trail.Audit(ctx, nil)
+
+				Convey("Then the record should be dropped", func() {
+					So(trail.Dropped(), ShouldEqual, 1)
+					So(len(sink.records), ShouldEqual, 1)
+				})
+			})
+
+			Convey("Then calling Close again should work", func() {
+				So(trail.Close(), ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Given I have an AuditTrail with a blocked sink", t, func() {
+
+		sink := &auditTestSink{block: make(chan struct{})}
+		trail := NewAuditTrail(sink, AuditTrailOptQueueSize(1), AuditTrailOptBlockTimeout(10*time.Millisecond))
+
+		ctx := newContext(context.Background(), elemental.NewRequest())
+
+		Convey("When I audit more records than the queue can hold", func() {
+
+			// first is consumed by the blocked writer, second fills the queue.
+			trail.Audit(ctx, nil)
+			time.Sleep(20 * time.Millisecond)
+			trail.Audit(ctx, nil)
+
+			start := time.Now()
+			trail.Audit(ctx, nil)
+			elapsed := time.Since(start)
+
+			close(sink.block)
+			_ = trail.Close()
+
+			Convey("Then the extra record should be dropped after the timeout", func() {
+				So(trail.Dropped(), ShouldEqual, 1)
+				So(elapsed, ShouldBeGreaterThanOrEqualTo, 10*time.Millisecond)
+				So(len(sink.records), ShouldEqual, 2)
+			})
+		})
+	})
+
+	Convey("Given I have an AuditTrail with a failing sink", t, func() {
+
+		sink := &auditTestSink{err: errors.New("boom")}
+		trail := NewAuditTrail(sink)
+
+		trail.Audit(newContext(context.Background(), elemental.NewRequest()), nil)
+		_ = trail.Close()
+
+		Convey("Then the error should not stop the trail", func() {
+			So(len(sink.records), ShouldEqual, 1)
+			So(sink.closed, ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,304 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package introspection
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/karlseguin/ccache/v2"
+	"go.aporeto.io/bahamut"
+	"go.aporeto.io/elemental"
+	"go.uber.org/zap"
+)
+
+// Audience represents the aud field of an introspection
+// response, that can either be a single string or an
+// array of strings.
+type Audience []string
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (a *Audience) UnmarshalJSON(data []byte) error {
+
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		if single != "" {
+			*a = Audience{single}
+		}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+
+	*a = multiple
+
+	return nil
+}
+
+// A Response represents the response of an RFC 7662
+// token introspection endpoint.
+type Response struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Exp       int64    `json:"exp,omitempty"`
+	Iat       int64    `json:"iat,omitempty"`
+	Nbf       int64    `json:"nbf,omitempty"`
+	Sub       string   `json:"sub,omitempty"`
+	Aud       Audience `json:"aud,omitempty"`
+	Iss       string   `json:"iss,omitempty"`
+	Jti       string   `json:"jti,omitempty"`
+
+	// Extra contains all the fields returned by the
+	// introspection endpoint, including the standard ones.
+	Extra map[string]any `json:"-"`
+}
+
+// Scopes returns the list of scopes.
+func (r *Response) Scopes() []string {
+	return strings.Fields(r.Scope)
+}
+
+// DefaultClaimsMapper is the default ClaimsMapperFunc. It converts
+// the standard fields of the given Response into bahamut claims.
+func DefaultClaimsMapper(r *Response) []string {
+
+	claims := []string{"@auth:realm=oauth2"}
+
+	if r.Sub != "" {
+		claims = append(claims, "@auth:subject="+r.Sub)
+	}
+
+	if r.ClientID != "" {
+		claims = append(claims, "@auth:clientid="+r.ClientID)
+	}
+
+	if r.Username != "" {
+		claims = append(claims, "@auth:username="+r.Username)
+	}
+
+	if r.Iss != "" {
+		claims = append(claims, "@auth:issuer="+r.Iss)
+	}
+
+	for _, aud := range r.Aud {
+		claims = append(claims, "@auth:audience="+aud)
+	}
+
+	for _, scope := range r.Scopes() {
+		claims = append(claims, "@auth:scope="+scope)
+	}
+
+	return claims
+}
+
+type cacheEntry struct {
+	active bool
+	claims []string
+}
+
+// An Authenticator is a bahamut.RequestAuthenticator and a bahamut.SessionAuthenticator
+// that validates tokens using an RFC 7662 introspection endpoint.
+type Authenticator struct {
+	endpoint string
+	cache    *ccache.Cache
+	cfg      config
+}
+
+// NewAuthenticator returns a new *Authenticator that will use the
+// introspection endpoint located at the given URL.
+func NewAuthenticator(endpoint string, options ...Option) *Authenticator {
+
+	if _, err := url.ParseRequestURI(endpoint); err != nil {
+		panic(fmt.Sprintf("invalid introspection endpoint '%s': %s", endpoint, err))
+	}
+
+	cfg := newConfig()
+	for _, opt := range options {
+		opt(&cfg)
+	}
+
+	return &Authenticator{
+		endpoint: endpoint,
+		cache:    ccache.New(ccache.Configure().MaxSize(cfg.cacheSize)),
+		cfg:      cfg,
+	}
+}
+
+// AuthenticateRequest authenticates the request from the given bahamut.Context.
+// If the request carries no token, it returns bahamut.AuthActionContinue.
+func (a *Authenticator) AuthenticateRequest(ctx bahamut.Context) (bahamut.AuthAction, error) {
+
+	return a.authenticate(ctx.Context(), ctx.Request().Password, ctx.SetClaims)
+}
+
+// AuthenticateSession authenticates the given session.
+// If the session carries no token, it returns bahamut.AuthActionContinue.
+func (a *Authenticator) AuthenticateSession(session bahamut.Session) (bahamut.AuthAction, error) {
+
+	return a.authenticate(session.Context(), session.Token(), session.SetClaims)
+}
+
+// Invalidate removes the cached introspection result for the given token.
+func (a *Authenticator) Invalidate(token string) {
+	a.cache.Delete(cacheKey(token))
+}
+
+func (a *Authenticator) authenticate(ctx context.Context, token string, claimSetter func([]string)) (bahamut.AuthAction, error) {
+
+	if token == "" {
+		return bahamut.AuthActionContinue, nil
+	}
+
+	key := cacheKey(token)
+
+	if item := a.cache.Get(key); item != nil && !item.Expired() {
+		return a.decide(item.Value().(*cacheEntry), claimSetter), nil
+	}
+
+	resp, err := a.introspect(ctx, token)
+	if err != nil {
+		return a.handleFailure(err)
+	}
+
+	entry, ttl := a.makeEntry(resp, time.Now())
+	if ttl > 0 {
+		a.cache.Set(key, entry, ttl)
+	}
+
+	return a.decide(entry, claimSetter), nil
+}
+
+func (a *Authenticator) decide(entry *cacheEntry, claimSetter func([]string)) bahamut.AuthAction {
+
+	if !entry.active {
+		return bahamut.AuthActionKO
+	}
+
+	claimSetter(entry.claims)
+
+	return bahamut.AuthActionOK
+}
+
+func (a *Authenticator) makeEntry(resp *Response, now time.Time) (*cacheEntry, time.Duration) {
+
+	if !resp.Active {
+		return &cacheEntry{}, a.cfg.inactiveCacheDuration
+	}
+
+	if resp.Nbf != 0 && now.Before(time.Unix(resp.Nbf, 0)) {
+		return &cacheEntry{}, 0
+	}
+
+	ttl := a.cfg.maxCacheDuration
+	if resp.Exp != 0 {
+		remaining := time.Unix(resp.Exp, 0).Sub(now)
+		if remaining <= 0 {
+			return &cacheEntry{}, a.cfg.inactiveCacheDuration
+		}
+		if remaining < ttl {
+			ttl = remaining
+		}
+	}
+
+	return &cacheEntry{active: true, claims: a.cfg.claimsMapper(resp)}, ttl
+}
+
+func (a *Authenticator) handleFailure(err error) (bahamut.AuthAction, error) {
+
+	zap.L().Warn("Unable to introspect token",
+		zap.String("endpoint", a.endpoint),
+		zap.Error(err),
+	)
+
+	switch a.cfg.failurePolicy {
+	case FailurePolicyReject:
+		return bahamut.AuthActionKO, nil
+	case FailurePolicyContinue:
+		return bahamut.AuthActionContinue, nil
+	default:
+		return bahamut.AuthActionKO, elemental.NewError(
+			"Service Unavailable",
+			"Unable to verify the token at the moment. Please retry later.",
+			"bahamut",
+			http.StatusServiceUnavailable,
+		)
+	}
+}
+
+func (a *Authenticator) introspect(ctx context.Context, token string) (*Response, error) {
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	form := url.Values{"token": []string{token}}
+	if a.cfg.tokenTypeHint != "" {
+		form.Set("token_type_hint", a.cfg.tokenTypeHint)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("unable to build introspection request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if a.cfg.clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(a.cfg.clientID), url.QueryEscape(a.cfg.clientSecret))
+	}
+
+	resp, err := a.cfg.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to send introspection request: %w", err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected introspection response status: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read introspection response: %w", err)
+	}
+
+	r := &Response{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("unable to decode introspection response: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &r.Extra); err != nil {
+		return nil, fmt.Errorf("unable to decode introspection response: %w", err)
+	}
+
+	return r, nil
+}
+
+func cacheKey(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
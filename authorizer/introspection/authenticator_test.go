@@ -0,0 +1,410 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package introspection
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/bahamut"
+	"go.aporeto.io/elemental"
+)
+
+func makeIntrospectionServer(calls *int64, handler func(token string) (int, any)) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		atomic.AddInt64(calls, 1)
+
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		code, body := handler(r.PostForm.Get("token"))
+		w.WriteHeader(code)
+		if body != nil {
+			_ = json.NewEncoder(w).Encode(body)
+		}
+	}))
+}
+
+func makeContext(token string) *bahamut.MockContext {
+
+	ctx := bahamut.NewMockContext(context.Background())
+	ctx.MockRequest = elemental.NewRequest()
+	ctx.MockRequest.Password = token
+
+	return ctx
+}
+
+func TestAudience_UnmarshalJSON(t *testing.T) {
+
+	Convey("Given I have an Audience", t, func() {
+
+		var aud Audience
+
+		Convey("When I unmarshal a string", func() {
+			err := json.Unmarshal([]byte(`"a"`), &aud)
+			So(err, ShouldBeNil)
+			So(aud, ShouldResemble, Audience{"a"})
+		})
+
+		Convey("When I unmarshal an array", func() {
+			err := json.Unmarshal([]byte(`["a","b"]`), &aud)
+			So(err, ShouldBeNil)
+			So(aud, ShouldResemble, Audience{"a", "b"})
+		})
+
+		Convey("When I unmarshal something invalid", func() {
+			err := json.Unmarshal([]byte(`42`), &aud)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestDefaultClaimsMapper(t *testing.T) {
+
+	Convey("Given I have a full Response", t, func() {
+
+		r := &Response{
+			Active:   true,
+			Sub:      "sub",
+			ClientID: "client",
+			Username: "user",
+			Iss:      "https://issuer",
+			Aud:      Audience{"a", "b"},
+			Scope:    "read write",
+		}
+
+		Convey("Then the claims should be correct", func() {
+			So(DefaultClaimsMapper(r), ShouldResemble, []string{
+				"@auth:realm=oauth2",
+				"@auth:subject=sub",
+				"@auth:clientid=client",
+				"@auth:username=user",
+				"@auth:issuer=https://issuer",
+				"@auth:audience=a",
+				"@auth:audience=b",
+				"@auth:scope=read",
+				"@auth:scope=write",
+			})
+		})
+	})
+}
+
+func TestAuthenticator_New(t *testing.T) {
+
+	Convey("Given I call NewAuthenticator with an invalid endpoint", t, func() {
+		So(func() { NewAuthenticator("not a url") }, ShouldPanic)
+	})
+
+	Convey("Given I call NewAuthenticator with options", t, func() {
+
+		a := NewAuthenticator("https://idp/introspect", OptionFailurePolicy(FailurePolicyReject))
+
+		Convey("Then it should be correctly initialized", func() {
+			So(a.endpoint, ShouldEqual, "https://idp/introspect")
+			So(a.cfg.failurePolicy, ShouldEqual, FailurePolicyReject)
+			So(a.cache, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestAuthenticator_AuthenticateRequest(t *testing.T) {
+
+	Convey("Given I have an introspection server", t, func() {
+
+		var calls int64
+		var receivedUser, receivedPass, receivedHint string
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&calls, 1)
+			receivedUser, receivedPass, _ = r.BasicAuth()
+			_ = r.ParseForm()
+			receivedHint = r.PostForm.Get("token_type_hint")
+
+			switch r.PostForm.Get("token") {
+			case "good":
+				_ = json.NewEncoder(w).Encode(map[string]any{
+					"active":    true,
+					"sub":       "alice",
+					"exp":       time.Now().Add(time.Hour).Unix(),
+					"scope":     "read",
+					"tenant_id": "acme",
+				})
+			case "expired":
+				_ = json.NewEncoder(w).Encode(map[string]any{
+					"active": true,
+					"sub":    "alice",
+					"exp":    time.Now().Add(-time.Hour).Unix(),
+				})
+			default:
+				_ = json.NewEncoder(w).Encode(map[string]any{"active": false})
+			}
+		}))
+		defer ts.Close()
+
+		a := NewAuthenticator(
+			ts.URL,
+			OptionClientCredentials("client", "secret"),
+			OptionClaimsMapper(func(r *Response) []string {
+				return append(DefaultClaimsMapper(r), fmt.Sprintf("@auth:tenant=%s", r.Extra["tenant_id"]))
+			}),
+		)
+
+		Convey("When I authenticate a request with no token", func() {
+
+			ctx := makeContext("")
+			action, err := a.AuthenticateRequest(ctx)
+
+			Convey("Then the action should be continue", func() {
+				So(err, ShouldBeNil)
+				So(action, ShouldEqual, bahamut.AuthActionContinue)
+				So(atomic.LoadInt64(&calls), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I authenticate a request with an active token", func() {
+
+			ctx := makeContext("good")
+			action, err := a.AuthenticateRequest(ctx)
+
+			Convey("Then the action should be OK", func() {
+				So(err, ShouldBeNil)
+				So(action, ShouldEqual, bahamut.AuthActionOK)
+			})
+
+			Convey("Then the introspection request should be correct", func() {
+				So(receivedUser, ShouldEqual, "client")
+				So(receivedPass, ShouldEqual, "secret")
+				So(receivedHint, ShouldEqual, "access_token")
+			})
+
+			Convey("Then the claims should be set", func() {
+				So(ctx.MockClaims, ShouldResemble, []string{
+					"@auth:realm=oauth2",
+					"@auth:subject=alice",
+					"@auth:scope=read",
+					"@auth:tenant=acme",
+				})
+			})
+
+			Convey("When I authenticate the same token again", func() {
+
+				ctx := makeContext("good")
+				action, err := a.AuthenticateRequest(ctx)
+
+				Convey("Then the result should come from the cache", func() {
+					So(err, ShouldBeNil)
+					So(action, ShouldEqual, bahamut.AuthActionOK)
+					So(ctx.MockClaims, ShouldNotBeEmpty)
+					So(atomic.LoadInt64(&calls), ShouldEqual, 1)
+				})
+			})
+
+			Convey("When I invalidate the token and authenticate again", func() {
+
+				a.Invalidate("good")
+				_, _ = a.AuthenticateRequest(makeContext("good"))
+
+				Convey("Then the introspection endpoint should be called again", func() {
+					So(atomic.LoadInt64(&calls), ShouldEqual, 2)
+				})
+			})
+		})
+
+		Convey("When I authenticate a request with an inactive token twice", func() {
+
+			ctx := makeContext("bad")
+			action1, err1 := a.AuthenticateRequest(ctx)
+			action2, err2 := a.AuthenticateRequest(ctx)
+
+			Convey("Then the action should be KO and cached", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+				So(action1, ShouldEqual, bahamut.AuthActionKO)
+				So(action2, ShouldEqual, bahamut.AuthActionKO)
+				So(ctx.MockClaims, ShouldBeNil)
+				So(atomic.LoadInt64(&calls), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When I authenticate a request with an expired token", func() {
+
+			action, err := a.AuthenticateRequest(makeContext("expired"))
+
+			Convey("Then the action should be KO", func() {
+				So(err, ShouldBeNil)
+				So(action, ShouldEqual, bahamut.AuthActionKO)
+			})
+		})
+	})
+}
+
+func TestAuthenticator_AuthenticateSession(t *testing.T) {
+
+	Convey("Given I have an introspection server", t, func() {
+
+		var calls int64
+		ts := makeIntrospectionServer(&calls, func(token string) (int, any) {
+			return http.StatusOK, map[string]any{"active": token == "good", "client_id": "c"}
+		})
+		defer ts.Close()
+
+		a := NewAuthenticator(ts.URL)
+
+		Convey("When I authenticate a session with an active token", func() {
+
+			session := bahamut.NewMockSession()
+			session.MockToken = "good"
+
+			action, err := a.AuthenticateSession(session)
+
+			Convey("Then the action should be OK", func() {
+				So(err, ShouldBeNil)
+				So(action, ShouldEqual, bahamut.AuthActionOK)
+				So(session.MockClaims, ShouldResemble, []string{"@auth:realm=oauth2", "@auth:clientid=c"})
+			})
+		})
+
+		Convey("When I authenticate a session with no token", func() {
+
+			action, err := a.AuthenticateSession(bahamut.NewMockSession())
+
+			Convey("Then the action should be continue", func() {
+				So(err, ShouldBeNil)
+				So(action, ShouldEqual, bahamut.AuthActionContinue)
+			})
+		})
+	})
+}
+
+func TestAuthenticator_FailurePolicies(t *testing.T) {
+
+	Convey("Given I have an introspection server that is failing", t, func() {
+
+		var calls int64
+		ts := makeIntrospectionServer(&calls, func(string) (int, any) {
+			return http.StatusInternalServerError, nil
+		})
+		defer ts.Close()
+
+		Convey("When I use FailurePolicyError", func() {
+
+			action, err := NewAuthenticator(ts.URL).AuthenticateRequest(makeContext("tok"))
+
+			Convey("Then I should get a 503 error", func() {
+				So(action, ShouldEqual, bahamut.AuthActionKO)
+				So(err, ShouldNotBeNil)
+				So(err.(elemental.Error).Code, ShouldEqual, http.StatusServiceUnavailable)
+			})
+		})
+
+		Convey("When I use FailurePolicyReject", func() {
+
+			action, err := NewAuthenticator(ts.URL, OptionFailurePolicy(FailurePolicyReject)).AuthenticateRequest(makeContext("tok"))
+
+			Convey("Then I should get KO", func() {
+				So(err, ShouldBeNil)
+				So(action, ShouldEqual, bahamut.AuthActionKO)
+			})
+		})
+
+		Convey("When I use FailurePolicyContinue", func() {
+
+			a := NewAuthenticator(ts.URL, OptionFailurePolicy(FailurePolicyContinue))
+			action, err := a.AuthenticateRequest(makeContext("tok"))
+			_, _ = a.AuthenticateRequest(makeContext("tok"))
+
+			Convey("Then I should get continue and the failure should not be cached", func() {
+				So(err, ShouldBeNil)
+				So(action, ShouldEqual, bahamut.AuthActionContinue)
+				So(atomic.LoadInt64(&calls), ShouldEqual, 2)
+			})
+		})
+	})
+
+	Convey("Given I have an introspection server returning invalid data", t, func() {
+
+		var calls int64
+		ts := makeIntrospectionServer(&calls, func(string) (int, any) {
+			return http.StatusOK, "not an object"
+		})
+		defer ts.Close()
+
+		action, err := NewAuthenticator(ts.URL, OptionFailurePolicy(FailurePolicyReject)).AuthenticateRequest(makeContext("tok"))
+
+		Convey("Then the failure policy should apply", func() {
+			So(err, ShouldBeNil)
+			So(action, ShouldEqual, bahamut.AuthActionKO)
+		})
+	})
+
+	Convey("Given I have an introspection server that is down", t, func() {
+
+		ts := httptest.NewServer(http.NotFoundHandler())
+		ts.Close()
+
+		action, err := NewAuthenticator(ts.URL, OptionFailurePolicy(FailurePolicyContinue)).AuthenticateRequest(makeContext("tok"))
+
+		Convey("Then the failure policy should apply", func() {
+			So(err, ShouldBeNil)
+			So(action, ShouldEqual, bahamut.AuthActionContinue)
+		})
+	})
+}
+
+func TestAuthenticator_makeEntry(t *testing.T) {
+
+	Convey("Given I have an authenticator", t, func() {
+
+		a := NewAuthenticator("https://idp/introspect", OptionMaxCacheDuration(time.Hour), OptionInactiveCacheDuration(time.Minute))
+		now := time.Now()
+
+		Convey("When the token expires before the max cache duration", func() {
+			entry, ttl := a.makeEntry(&Response{Active: true, Exp: now.Add(10 * time.Minute).Unix()}, now)
+			So(entry.active, ShouldBeTrue)
+			So(ttl, ShouldBeLessThanOrEqualTo, 10*time.Minute)
+			So(ttl, ShouldBeGreaterThan, 9*time.Minute)
+		})
+
+		Convey("When the token expires after the max cache duration", func() {
+			_, ttl := a.makeEntry(&Response{Active: true, Exp: now.Add(10 * time.Hour).Unix()}, now)
+			So(ttl, ShouldEqual, time.Hour)
+		})
+
+		Convey("When the token has no expiration", func() {
+			_, ttl := a.makeEntry(&Response{Active: true}, now)
+			So(ttl, ShouldEqual, time.Hour)
+		})
+
+		Convey("When the token is not yet valid", func() {
+			entry, ttl := a.makeEntry(&Response{Active: true, Nbf: now.Add(time.Hour).Unix()}, now)
+			So(entry.active, ShouldBeFalse)
+			So(ttl, ShouldEqual, 0)
+		})
+
+		Convey("When the token is inactive", func() {
+			entry, ttl := a.makeEntry(&Response{}, now)
+			So(entry.active, ShouldBeFalse)
+			So(ttl, ShouldEqual, time.Minute)
+		})
+	})
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package introspection
+
+import (
+	"net/http"
+	"time"
+)
+
+// FailurePolicy represents the behavior of the Authenticator
+// when the introspection endpoint cannot be reached or returns
+// an unexpected response.
+type FailurePolicy int
+
+// Various values for FailurePolicy.
+const (
+	// FailurePolicyError makes the Authenticator return a
+	// 503 Service Unavailable error to the client.
+	FailurePolicyError FailurePolicy = iota
+
+	// FailurePolicyReject makes the Authenticator return
+	// bahamut.AuthActionKO, resulting in a 401 Unauthorized.
+	FailurePolicyReject
+
+	// FailurePolicyContinue makes the Authenticator return
+	// bahamut.AuthActionContinue, letting the next
+	// authenticator in the chain decide.
+	FailurePolicyContinue
+)
+
+// ClaimsMapperFunc is the type of function used to convert
+// an introspection Response into bahamut claims.
+type ClaimsMapperFunc func(*Response) []string
+
+// An Option represents a configuration option
+// for the Authenticator.
+type Option func(*config)
+
+type config struct {
+	httpClient            *http.Client
+	clientID              string
+	clientSecret          string
+	tokenTypeHint         string
+	claimsMapper          ClaimsMapperFunc
+	failurePolicy         FailurePolicy
+	cacheSize             int64
+	maxCacheDuration      time.Duration
+	inactiveCacheDuration time.Duration
+}
+
+func newConfig() config {
+	return config{
+		httpClient:            &http.Client{Timeout: 10 * time.Second},
+		tokenTypeHint:         "access_token",
+		claimsMapper:          DefaultClaimsMapper,
+		failurePolicy:         FailurePolicyError,
+		cacheSize:             65536,
+		maxCacheDuration:      time.Hour,
+		inactiveCacheDuration: time.Minute,
+	}
+}
+
+// OptionHTTPClient sets the *http.Client to use to
+// contact the introspection endpoint.
+// The default is a client with a 10s timeout.
+func OptionHTTPClient(client *http.Client) Option {
+	if client == nil {
+		panic("client must not be nil")
+	}
+	return func(c *config) {
+		c.httpClient = client
+	}
+}
+
+// OptionClientCredentials sets the client id and secret
+// used to authenticate against the introspection endpoint
+// using HTTP basic authentication.
+func OptionClientCredentials(clientID string, clientSecret string) Option {
+	return func(c *config) {
+		c.clientID = clientID
+		c.clientSecret = clientSecret
+	}
+}
+
+// OptionTokenTypeHint sets the token_type_hint sent to the
+// introspection endpoint. The default is access_token.
+// Passing an empty string disables the hint.
+func OptionTokenTypeHint(hint string) Option {
+	return func(c *config) {
+		c.tokenTypeHint = hint
+	}
+}
+
+// OptionClaimsMapper sets the function used to convert
+// the introspection Response into bahamut claims.
+// The default is DefaultClaimsMapper.
+func OptionClaimsMapper(mapper ClaimsMapperFunc) Option {
+	if mapper == nil {
+		panic("mapper must not be nil")
+	}
+	return func(c *config) {
+		c.claimsMapper = mapper
+	}
+}
+
+// OptionFailurePolicy sets the FailurePolicy to apply when the
+// introspection endpoint is unavailable.
+// The default is FailurePolicyError.
+func OptionFailurePolicy(policy FailurePolicy) Option {
+	return func(c *config) {
+		c.failurePolicy = policy
+	}
+}
+
+// OptionCacheSize sets the maximum number of introspection
+// results kept in the cache. The default is 65536.
+func OptionCacheSize(size int64) Option {
+	if size <= 0 {
+		panic("size must be greater than 0")
+	}
+	return func(c *config) {
+		c.cacheSize = size
+	}
+}
+
+// OptionMaxCacheDuration sets the maximum duration an active
+// introspection result is cached, regardless of the token expiration.
+// Results are never cached past the token expiration.
+// The default is 1h.
+func OptionMaxCacheDuration(d time.Duration) Option {
+	return func(c *config) {
+		c.maxCacheDuration = d
+	}
+}
+
+// OptionInactiveCacheDuration sets how long an inactive
+// introspection result is cached. Passing 0 disables
+// caching of inactive results. The default is 1m.
+func OptionInactiveCacheDuration(d time.Duration) Option {
+	return func(c *config) {
+		c.inactiveCacheDuration = d
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package introspection
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOptions(t *testing.T) {
+
+	c := newConfig()
+
+	Convey("Calling OptionHTTPClient should work", t, func() {
+		cl := &http.Client{}
+		OptionHTTPClient(cl)(&c)
+		So(c.httpClient, ShouldEqual, cl)
+		So(func() { OptionHTTPClient(nil) }, ShouldPanicWith, "client must not be nil")
+	})
+
+	Convey("Calling OptionClientCredentials should work", t, func() {
+		OptionClientCredentials("id", "secret")(&c)
+		So(c.clientID, ShouldEqual, "id")
+		So(c.clientSecret, ShouldEqual, "secret")
+	})
+
+	Convey("Calling OptionTokenTypeHint should work", t, func() {
+		OptionTokenTypeHint("refresh_token")(&c)
+		So(c.tokenTypeHint, ShouldEqual, "refresh_token")
+	})
+
+	Convey("Calling OptionClaimsMapper should work", t, func() {
+		OptionClaimsMapper(func(*Response) []string { return []string{"a=a"} })(&c)
+		So(c.claimsMapper(&Response{}), ShouldResemble, []string{"a=a"})
+		So(func() { OptionClaimsMapper(nil) }, ShouldPanicWith, "mapper must not be nil")
+	})
+
+	Convey("Calling OptionFailurePolicy should work", t, func() {
+		OptionFailurePolicy(FailurePolicyContinue)(&c)
+		So(c.failurePolicy, ShouldEqual, FailurePolicyContinue)
+	})
+
+	Convey("Calling OptionCacheSize should work", t, func() {
+		OptionCacheSize(42)(&c)
+		So(c.cacheSize, ShouldEqual, 42)
+		So(func() { OptionCacheSize(0) }, ShouldPanicWith, "size must be greater than 0")
+	})
+
+	Convey("Calling OptionMaxCacheDuration should work", t, func() {
+		OptionMaxCacheDuration(time.Minute)(&c)
+		So(c.maxCacheDuration, ShouldEqual, time.Minute)
+	})
+
+	Convey("Calling OptionInactiveCacheDuration should work", t, func() {
+		OptionInactiveCacheDuration(time.Second)(&c)
+		So(c.inactiveCacheDuration, ShouldEqual, time.Second)
+	})
+}
@@ -129,6 +129,9 @@ func NewServer(cfg config) Server {
 
 	if cfg.restServer.enabled {
 		srv.restServer = newRestServer(cfg, mux, srv.ProcessorForIdentity, srv.CustomHandlers, srv.Push)
+		if cfg.opentelemetry.tracerProvider != nil || cfg.pushServer.changesEnabled {
+			srv.restServer.contextPusher = srv.pushWithContext
+		}
 	}
 
 	if cfg.pushServer.enabled {
@@ -137,6 +140,9 @@ func NewServer(cfg config) Server {
 
 	if cfg.healthServer.enabled {
 		srv.healthServer = newHealthServer(cfg)
+		if srv.pushServer != nil && cfg.pushServer.adminAuthorizer != nil {
+			srv.healthServer.pushAdmin = newPushSessionsAdmin(srv.pushServer, cfg.pushServer.adminAuthorizer)
+		}
 	}
 
 	if cfg.profilingServer.enabled {
@@ -218,6 +224,15 @@ func (b *server) Push(events ...*elemental.Event) {
 	b.pushServer.pushEvents(events...)
 }
 
+func (b *server) pushWithContext(ctx context.Context, events ...*elemental.Event) {
+
+	if b.pushServer == nil {
+		return
+	}
+
+	b.pushServer.pushEventsWithContext(ctx, events...)
+}
+
 func (b *server) RoutesInfo() map[int][]RouteInfo {
 
 	return buildVersionedRoutes(b.cfg.model.modelManagers, b.ProcessorForIdentity)
@@ -241,6 +256,24 @@ func (b *server) PushEndpoint() string {
 	return b.cfg.pushServer.endpoint
 }
 
+func (b *server) PushOutboxStatus() PushOutboxStatus {
+
+	if b.pushServer == nil || b.cfg.pushServer.outbox == nil {
+		return PushOutboxStatus{}
+	}
+
+	return b.cfg.pushServer.outbox.status()
+}
+
+func (b *server) FlushPushOutbox(ctx context.Context) error {
+
+	if b.pushServer == nil || b.cfg.pushServer.outbox == nil || b.cfg.pushServer.service == nil {
+		return nil
+	}
+
+	return b.cfg.pushServer.outbox.flush(ctx, b.cfg.pushServer.service)
+}
+
 func (b *server) Run(ctx context.Context) {
 
 	if b.profilingServer != nil {
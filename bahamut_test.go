@@ -12,6 +12,7 @@
 package bahamut
 
 import (
+	"context"
 	"net/http"
 	"testing"
 
@@ -244,6 +245,52 @@ func TestBahamut_PushEndpoint(t *testing.T) {
 	})
 }
 
+func TestBahamut_PushOutbox(t *testing.T) {
+
+	Convey("Given I have a bahamut server with no push outbox", t, func() {
+
+		cfg := config{}
+		cfg.pushServer.enabled = true
+
+		b := NewServer(cfg)
+
+		Convey("Then the outbox status should not be enabled and flush should do nothing", func() {
+			So(b.(PushOutboxer).PushOutboxStatus(), ShouldResemble, PushOutboxStatus{})
+			So(b.(PushOutboxer).FlushPushOutbox(context.Background()), ShouldBeNil)
+		})
+	})
+
+	Convey("Given I have a bahamut server with a push outbox containing an event", t, func() {
+
+		service := &mockPubSubServer{}
+
+		cfg := config{}
+		cfg.pushServer.enabled = true
+		cfg.pushServer.service = service
+		cfg.pushServer.outbox = newPushOutbox(t.TempDir())
+		So(cfg.pushServer.outbox.store(NewPublication("topic")), ShouldBeNil)
+
+		b := NewServer(cfg)
+
+		Convey("Then the outbox status should be correct", func() {
+			s := b.(PushOutboxer).PushOutboxStatus()
+			So(s.Enabled, ShouldBeTrue)
+			So(s.Events, ShouldEqual, 1)
+		})
+
+		Convey("When I flush the outbox", func() {
+
+			err := b.(PushOutboxer).FlushPushOutbox(context.Background())
+
+			Convey("Then the event should be published", func() {
+				So(err, ShouldBeNil)
+				So(len(service.publications), ShouldEqual, 1)
+				So(b.(PushOutboxer).PushOutboxStatus().Events, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
 func TestBahamut_ProcessorRegistration(t *testing.T) {
 
 	Convey("Given I create a Bahamut, aProcessor and an Identity", t, func() {
@@ -0,0 +1,244 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.aporeto.io/elemental"
+)
+
+// RequestPriority represents the priority of a request
+// when the server needs to shed load.
+type RequestPriority int
+
+// Various values for RequestPriority.
+const (
+	// RequestPriorityLow requests are shed first.
+	RequestPriorityLow RequestPriority = iota
+
+	// RequestPriorityNormal is the priority of most requests.
+	RequestPriorityNormal
+
+	// RequestPriorityCritical requests are shed last.
+	RequestPriorityCritical
+)
+
+func (p RequestPriority) String() string {
+
+	switch p {
+	case RequestPriorityLow:
+		return "low"
+	case RequestPriorityNormal:
+		return "normal"
+	case RequestPriorityCritical:
+		return "critical"
+	default:
+		return "unknown"
+	}
+}
+
+// A RequestPriorityClassifier returns the RequestPriority of
+// the given request.
+type RequestPriorityClassifier func(*elemental.Request) RequestPriority
+
+// DefaultRequestPriorityClassifier gives a critical priority to
+// requests on private identities, as they are usually issued by
+// other internal services, and a normal priority to the others.
+func DefaultRequestPriorityClassifier(req *elemental.Request) RequestPriority {
+
+	if req.Identity.Private {
+		return RequestPriorityCritical
+	}
+
+	return RequestPriorityNormal
+}
+
+// A ConcurrencyLimiter decides if a request can be processed
+// based on the number of requests currently in flight.
+type ConcurrencyLimiter interface {
+
+	// Acquire tries to reserve a slot for a request with the given
+	// priority. If ok is false, the request must be shed. Otherwise
+	// release must be called once the request is processed with the
+	// observed latency and whether the request failed because of
+	// the server.
+	Acquire(priority RequestPriority) (release func(latency time.Duration, failed bool), ok bool)
+
+	// Limit returns the current concurrency limit.
+	Limit() int
+
+	// InFlight returns the number of requests currently in flight.
+	InFlight() int
+}
+
+// AIMDConcurrencyLimiterOption represents an option that can be passed to
+// NewAIMDConcurrencyLimiter.
+type AIMDConcurrencyLimiterOption func(*aimdConcurrencyLimiter)
+
+// AIMDConcurrencyLimiterOptLimits sets the initial, minimum and maximum
+// concurrency limits. The defaults are 20, 1 and 1000.
+func AIMDConcurrencyLimiterOptLimits(initial int, min int, max int) AIMDConcurrencyLimiterOption {
+	return func(l *aimdConcurrencyLimiter) {
+		if min < 1 || max < min || initial < min || initial > max {
+			panic("limits must satisfy 1 <= min <= initial <= max")
+		}
+		l.limit = float64(initial)
+		l.minLimit = float64(min)
+		l.maxLimit = float64(max)
+	}
+}
+
+// AIMDConcurrencyLimiterOptTargetLatency sets the latency above which
+// the limit will be decreased. The default is 1s.
+func AIMDConcurrencyLimiterOptTargetLatency(latency time.Duration) AIMDConcurrencyLimiterOption {
+	return func(l *aimdConcurrencyLimiter) {
+		l.targetLatency = latency
+	}
+}
+
+// AIMDConcurrencyLimiterOptBackoffRatio sets the ratio applied to the limit
+// when a request is too slow or fails. It must be in ]0, 1[. The default
+// is 0.9.
+func AIMDConcurrencyLimiterOptBackoffRatio(ratio float64) AIMDConcurrencyLimiterOption {
+	return func(l *aimdConcurrencyLimiter) {
+		if ratio <= 0 || ratio >= 1 {
+			panic("backoff ratio must be in ]0, 1[")
+		}
+		l.backoffRatio = ratio
+	}
+}
+
+// AIMDConcurrencyLimiterOptPriorityShares sets the share of the limit that
+// low and normal priority requests can use. Critical requests can always
+// use the full limit. The defaults are 0.7 and 0.9.
+func AIMDConcurrencyLimiterOptPriorityShares(low float64, normal float64) AIMDConcurrencyLimiterOption {
+	return func(l *aimdConcurrencyLimiter) {
+		if low <= 0 || low > normal || normal > 1 {
+			panic("priority shares must satisfy 0 < low <= normal <= 1")
+		}
+		l.shares[RequestPriorityLow] = low
+		l.shares[RequestPriorityNormal] = normal
+	}
+}
+
+type aimdConcurrencyLimiter struct {
+	limit         float64
+	minLimit      float64
+	maxLimit      float64
+	targetLatency time.Duration
+	backoffRatio  float64
+	shares        map[RequestPriority]float64
+	inFlight      int
+	generation    uint64
+
+	lock sync.Mutex
+}
+
+// NewAIMDConcurrencyLimiter returns a ConcurrencyLimiter that adapts its
+// limit using additive increase, multiplicative decrease. The limit grows by
+// one for every fast request while the limiter is at least half used, and
+// is multiplied by the backoff ratio when a request is slower than the
+// target latency or fails. The limit is decreased at most once for all
+// the requests in flight, so a single latency spike only backs off once.
+func NewAIMDConcurrencyLimiter(options ...AIMDConcurrencyLimiterOption) ConcurrencyLimiter {
+
+	l := &aimdConcurrencyLimiter{
+		limit:         20,
+		minLimit:      1,
+		maxLimit:      1000,
+		targetLatency: time.Second,
+		backoffRatio:  0.9,
+		shares: map[RequestPriority]float64{
+			RequestPriorityLow:      0.7,
+			RequestPriorityNormal:   0.9,
+			RequestPriorityCritical: 1.0,
+		},
+	}
+
+	for _, opt := range options {
+		opt(l)
+	}
+
+	return l
+}
+
+func (l *aimdConcurrencyLimiter) Acquire(priority RequestPriority) (func(time.Duration, bool), bool) {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	share, ok := l.shares[priority]
+	if !ok {
+		share = l.shares[RequestPriorityNormal]
+	}
+
+	if float64(l.inFlight) >= math.Max(1, math.Floor(l.limit*share)) {
+		return nil, false
+	}
+
+	l.inFlight++
+	inFlight := l.inFlight
+	generation := l.generation
+
+	var once sync.Once
+
+	return func(latency time.Duration, failed bool) {
+		once.Do(func() { l.release(inFlight, generation, latency, failed) })
+	}, true
+}
+
+func (l *aimdConcurrencyLimiter) release(inFlight int, generation uint64, latency time.Duration, failed bool) {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.inFlight--
+
+	switch {
+	case failed || latency > l.targetLatency:
+		// Only the requests started after the last decrease
+		// can decrease the limit again.
+		if generation == l.generation {
+			l.limit = math.Max(l.minLimit, l.limit*l.backoffRatio)
+			l.generation++
+		}
+	case float64(inFlight)*2 >= l.limit:
+		l.limit = math.Min(l.maxLimit, l.limit+1)
+	}
+}
+
+func (l *aimdConcurrencyLimiter) Limit() int {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return int(l.limit)
+}
+
+func (l *aimdConcurrencyLimiter) InFlight() int {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.inFlight
+}
+
+// isOverloadFailure returns true if the given response code means the
+// request failed because of the server. A 503 returned by a processor is
+// considered as a deliberate answer and not as a sign of overload.
+func isOverloadFailure(code int) bool {
+	return code == 0 || (code >= http.StatusInternalServerError && code != http.StatusServiceUnavailable)
+}
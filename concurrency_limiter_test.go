@@ -0,0 +1,197 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/elemental"
+)
+
+func TestRequestPriority(t *testing.T) {
+
+	Convey("Given I have some priorities", t, func() {
+		So(RequestPriorityLow.String(), ShouldEqual, "low")
+		So(RequestPriorityNormal.String(), ShouldEqual, "normal")
+		So(RequestPriorityCritical.String(), ShouldEqual, "critical")
+		So(RequestPriority(42).String(), ShouldEqual, "unknown")
+	})
+
+	Convey("Given I use the DefaultRequestPriorityClassifier", t, func() {
+
+		req := elemental.NewRequest()
+
+		Convey("Then a public identity should have a normal priority", func() {
+			req.Identity = elemental.Identity{Name: "thing", Category: "things"}
+			So(DefaultRequestPriorityClassifier(req), ShouldEqual, RequestPriorityNormal)
+		})
+
+		Convey("Then a private identity should have a critical priority", func() {
+			req.Identity = elemental.Identity{Name: "thing", Category: "things", Private: true}
+			So(DefaultRequestPriorityClassifier(req), ShouldEqual, RequestPriorityCritical)
+		})
+	})
+}
+
+func TestAIMDConcurrencyLimiter(t *testing.T) {
+
+	Convey("Given I have an AIMD concurrency limiter", t, func() {
+
+		l := NewAIMDConcurrencyLimiter(
+			AIMDConcurrencyLimiterOptLimits(10, 2, 12),
+			AIMDConcurrencyLimiterOptTargetLatency(100*time.Millisecond),
+			AIMDConcurrencyLimiterOptBackoffRatio(0.5),
+			AIMDConcurrencyLimiterOptPriorityShares(0.5, 0.8),
+		)
+
+		So(l.Limit(), ShouldEqual, 10)
+		So(l.InFlight(), ShouldEqual, 0)
+
+		Convey("When I acquire slots with various priorities", func() {
+
+			var releases []func(time.Duration, bool)
+			acquire := func(p RequestPriority) bool {
+				r, ok := l.Acquire(p)
+				if ok {
+					releases = append(releases, r)
+				}
+				return ok
+			}
+
+			for i := 0; i < 5; i++ {
+				So(acquire(RequestPriorityLow), ShouldBeTrue)
+			}
+
+			Convey("Then low priority requests should be shed first", func() {
+				So(acquire(RequestPriorityLow), ShouldBeFalse)
+				So(acquire(RequestPriorityNormal), ShouldBeTrue)
+				So(acquire(RequestPriorityNormal), ShouldBeTrue)
+				So(acquire(RequestPriorityNormal), ShouldBeTrue)
+				So(acquire(RequestPriorityNormal), ShouldBeFalse)
+				So(acquire(RequestPriorityCritical), ShouldBeTrue)
+				So(acquire(RequestPriorityCritical), ShouldBeTrue)
+				So(acquire(RequestPriorityCritical), ShouldBeFalse)
+				So(l.InFlight(), ShouldEqual, 10)
+			})
+
+			Convey("When the requests are fast", func() {
+
+				for _, r := range releases {
+					r(time.Millisecond, false)
+				}
+
+				Convey("Then the limit should increase only for the requests that used it enough", func() {
+					So(l.InFlight(), ShouldEqual, 0)
+					So(l.Limit(), ShouldEqual, 11)
+				})
+			})
+
+			Convey("When a request is slow", func() {
+
+				releases[0](time.Second, false)
+				releases[0](time.Second, false)
+
+				Convey("Then the limit should decrease once", func() {
+					So(l.InFlight(), ShouldEqual, 4)
+					So(l.Limit(), ShouldEqual, 5)
+				})
+			})
+
+			Convey("When requests in flight together fail", func() {
+
+				for _, r := range releases {
+					r(time.Millisecond, true)
+				}
+
+				Convey("Then the limit should decrease only once", func() {
+					So(l.InFlight(), ShouldEqual, 0)
+					So(l.Limit(), ShouldEqual, 5)
+				})
+
+				Convey("When a request started after the decrease fails", func() {
+
+					r, ok := l.Acquire(RequestPriorityCritical)
+					So(ok, ShouldBeTrue)
+					r(time.Millisecond, true)
+
+					Convey("Then the limit should decrease down to the min", func() {
+						So(l.InFlight(), ShouldEqual, 0)
+						So(l.Limit(), ShouldEqual, 2)
+					})
+				})
+			})
+		})
+	})
+
+	Convey("Given I have an AIMD concurrency limiter with default values", t, func() {
+
+		l := NewAIMDConcurrencyLimiter().(*aimdConcurrencyLimiter)
+
+		So(l.Limit(), ShouldEqual, 20)
+		So(l.minLimit, ShouldEqual, 1)
+		So(l.maxLimit, ShouldEqual, 1000)
+		So(l.targetLatency, ShouldEqual, time.Second)
+		So(l.backoffRatio, ShouldEqual, 0.9)
+
+		Convey("When the limiter is barely used", func() {
+
+			r, ok := l.Acquire(RequestPriorityNormal)
+			So(ok, ShouldBeTrue)
+			r(time.Millisecond, false)
+
+			Convey("Then the limit should not increase", func() {
+				So(l.Limit(), ShouldEqual, 20)
+			})
+		})
+	})
+
+	Convey("Given I have an AIMD concurrency limiter close to its max limit", t, func() {
+
+		l := NewAIMDConcurrencyLimiter(AIMDConcurrencyLimiterOptLimits(2, 1, 3))
+
+		Convey("When I process many fast requests", func() {
+
+			for i := 0; i < 10; i++ {
+				r1, _ := l.Acquire(RequestPriorityCritical)
+				r2, _ := l.Acquire(RequestPriorityCritical)
+				r1(time.Millisecond, false)
+				r2(time.Millisecond, false)
+			}
+
+			Convey("Then the limit should not go above the max", func() {
+				So(l.Limit(), ShouldEqual, 3)
+			})
+		})
+	})
+
+	Convey("Given I pass invalid options", t, func() {
+		So(func() { AIMDConcurrencyLimiterOptLimits(1, 2, 3) }, ShouldNotPanic)
+		So(func() { NewAIMDConcurrencyLimiter(AIMDConcurrencyLimiterOptLimits(1, 2, 3)) }, ShouldPanicWith, "limits must satisfy 1 <= min <= initial <= max")
+		So(func() { NewAIMDConcurrencyLimiter(AIMDConcurrencyLimiterOptBackoffRatio(1)) }, ShouldPanicWith, "backoff ratio must be in ]0, 1[")
+		So(func() { NewAIMDConcurrencyLimiter(AIMDConcurrencyLimiterOptPriorityShares(0.9, 0.5)) }, ShouldPanicWith, "priority shares must satisfy 0 < low <= normal <= 1")
+	})
+}
+
+func TestConcurrencyLimiter_isOverloadFailure(t *testing.T) {
+
+	Convey("Given I have various response codes", t, func() {
+		So(isOverloadFailure(0), ShouldBeTrue)
+		So(isOverloadFailure(http.StatusOK), ShouldBeFalse)
+		So(isOverloadFailure(http.StatusNotFound), ShouldBeFalse)
+		So(isOverloadFailure(http.StatusInternalServerError), ShouldBeTrue)
+		So(isOverloadFailure(http.StatusServiceUnavailable), ShouldBeFalse)
+		So(isOverloadFailure(http.StatusGatewayTimeout), ShouldBeTrue)
+	})
+}
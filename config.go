@@ -21,6 +21,7 @@ import (
 
 	opentracing "github.com/opentracing/opentracing-go"
 	"go.aporeto.io/elemental"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 )
 
@@ -75,8 +76,13 @@ type config struct {
 		endpoint                  string
 		dispatchHandler           PushDispatchHandler
 		publishHandler            PushPublishHandler
+		adminAuthorizer           PushSessionsAdminAuthorizer
+		compression               PublicationCompression
+		compressionThreshold      int
+		outbox                    *pushOutbox
 		enabled                   bool
 		subjectHierarchiesEnabled bool
+		changesEnabled            bool
 		publishEnabled            bool
 		dispatchEnabled           bool
 	}
@@ -90,11 +96,14 @@ type config struct {
 		enabled        bool
 		customStats    map[string]HealthStatFunc
 		metricsManager MetricsManager
+		checks         []*healthCheck
+		checkInterval  time.Duration
 	}
 
 	profilingServer struct {
 		listenAddress string
 		enabled       bool
+		snapshotter   *profilingSnapshotter
 	}
 
 	tls struct {
@@ -118,6 +127,16 @@ type config struct {
 	rateLimiting struct {
 		rateLimiter     *rate.Limiter
 		apiRateLimiters map[elemental.Identity]apiRateLimit
+		rateLimiters    []RateLimiter
+
+		clusterPubSub       PubSubClient
+		clusterTopic        string
+		clusterPingInterval time.Duration
+		clusterPeerTimeout  time.Duration
+
+		concurrencyLimiter    ConcurrencyLimiter
+		priorityClassifier    RequestPriorityClassifier
+		concurrencyRetryAfter time.Duration
 	}
 
 	model struct {
@@ -142,6 +161,14 @@ type config struct {
 		traceCleaner       TraceCleaner
 	}
 
+	opentelemetry struct {
+		tracerProvider trace.TracerProvider
+	}
+
+	accessLog struct {
+		log *accessLog
+	}
+
 	hooks struct {
 		postStart        func(Server) error
 		preStop          func(Server) error
@@ -15,6 +15,7 @@ import (
 	"context"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"go.aporeto.io/elemental"
@@ -35,11 +36,17 @@ type bcontext struct {
 	next                  string
 	outputCookies         []*http.Cookie
 	outputData            any
+	previousData          any
+	changes               []AttributeChange
+	changesComputed       bool
+	pushChanges           bool
+	outputDataEvent       *elemental.Event
 	redirect              string
 	request               *elemental.Request
 	responseWriter        ResponseWriter
 	statusCode            int
 	disableOutputDataPush bool
+	startTime             time.Time
 }
 
 // NewContext creates a new *Context.
@@ -61,6 +68,7 @@ func newContext(ctx context.Context, request *elemental.Request) *bcontext {
 		id:           uuid.Must(uuid.NewV4()).String(),
 		messagesLock: &sync.Mutex{},
 		request:      request,
+		startTime:    time.Now(),
 	}
 }
 
@@ -100,6 +108,14 @@ func (c *bcontext) SetDisableOutputDataPush(disabled bool) {
 	c.disableOutputDataPush = disabled
 }
 
+func (c *bcontext) PreviousData() any {
+	return c.previousData
+}
+
+func (c *bcontext) SetPreviousData(data any) {
+	c.previousData = data
+}
+
 func (c *bcontext) SetOutputData(data any) {
 
 	if c.responseWriter != nil {
@@ -208,6 +224,9 @@ func (c *bcontext) Duplicate() Context {
 	c2.count = c.count
 	c2.statusCode = c.statusCode
 	c2.outputData = c.outputData
+	c2.previousData = c.previousData
+	c2.changes = c.changes
+	c2.changesComputed = c.changesComputed
 	c2.claims = append(c2.claims, c.claims...)
 	c2.redirect = c.redirect
 	c2.messages = append(c2.messages, c.messages...)
@@ -215,6 +234,7 @@ func (c *bcontext) Duplicate() Context {
 	c2.outputCookies = append(c2.outputCookies, c.outputCookies...)
 	c2.responseWriter = c.responseWriter
 	c2.disableOutputDataPush = c.disableOutputDataPush
+	c2.startTime = c.startTime
 
 	for k, v := range c.claimsMap {
 		c2.claimsMap[k] = v
@@ -229,3 +249,19 @@ func (c *bcontext) Duplicate() Context {
 
 	return c2
 }
+
+func (c *bcontext) startedAt() time.Time {
+	return c.startTime
+}
+
+// snapshotChanges computes the changes that will be reported
+// in the AuditRecord. It must be called before the secret
+// attributes of the output data are reset.
+func (c *bcontext) snapshotChanges() {
+	c.changes = auditChanges(c)
+	c.changesComputed = true
+}
+
+func (c *bcontext) computedChanges() ([]AttributeChange, bool) {
+	return c.changes, c.changesComputed
+}
@@ -34,6 +34,7 @@ type MockContext struct {
 	MockNext                  string
 	MockOutputCookies         []*http.Cookie
 	MockOutputData            any
+	MockPreviousData          any
 	MockRedirect              string
 	MockRequest               *elemental.Request
 	MockResponseWriter        ResponseWriter
@@ -100,6 +101,16 @@ func (c *MockContext) SetOutputData(data any) {
 	c.MockOutputData = data
 }
 
+// PreviousData returns the context's previous data.
+func (c *MockContext) PreviousData() any {
+	return c.MockPreviousData
+}
+
+// SetPreviousData sets the context's previous data.
+func (c *MockContext) SetPreviousData(data any) {
+	c.MockPreviousData = data
+}
+
 // SetResponseWriter sets the context's custom response writer.
 func (c *MockContext) SetResponseWriter(writer ResponseWriter) {
 	c.MockResponseWriter = writer
@@ -208,6 +219,7 @@ func (c *MockContext) Duplicate() Context {
 	c2.MockCount = c.MockCount
 	c2.MockStatusCode = c.MockStatusCode
 	c2.MockOutputData = c.MockOutputData
+	c2.MockPreviousData = c.MockPreviousData
 	c2.MockClaims = append(c2.MockClaims, c.MockClaims...)
 	c2.MockRedirect = c.MockRedirect
 	c2.MockMessages = append(c2.MockMessages, c.MockMessages...)
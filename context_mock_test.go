@@ -84,6 +84,7 @@ func TestMockContext_Duplicate(t *testing.T) {
 		ctx.SetCount(10)
 		ctx.SetInputData("input")
 		ctx.SetOutputData("output")
+		ctx.SetPreviousData("previous")
 		ctx.SetStatusCode(42)
 		ctx.AddMessage("a")
 		ctx.SetRedirect("laba")
@@ -105,6 +106,7 @@ func TestMockContext_Duplicate(t *testing.T) {
 				So(ctx.Metadata("hello").(string), ShouldEqual, "world")
 				So(ctx.MockInputData, ShouldEqual, ctx2.InputData())
 				So(ctx.MockOutputData, ShouldEqual, ctx2.OutputData())
+				So(ctx.MockPreviousData, ShouldEqual, ctx2.(PreviousDataHolder).PreviousData())
 				So(ctx.MockRequest.Namespace, ShouldEqual, ctx2.Request().Namespace)
 				So(ctx.MockRequest.ParentID, ShouldEqual, ctx2.Request().ParentID)
 				So(ctx.MockStatusCode, ShouldEqual, ctx2.StatusCode())
@@ -132,6 +132,7 @@ func TestContext_Duplicate(t *testing.T) {
 		ctx.SetCount(10)
 		ctx.SetInputData("input")
 		ctx.SetInputData("output")
+		ctx.SetPreviousData("previous")
 		ctx.SetStatusCode(42)
 		ctx.AddMessage("a")
 		ctx.SetRedirect("laba")
@@ -152,6 +153,7 @@ func TestContext_Duplicate(t *testing.T) {
 				So(ctx.Metadata("hello").(string), ShouldEqual, "world")
 				So(ctx.inputData, ShouldEqual, ctx2.InputData())
 				So(ctx.outputData, ShouldEqual, ctx2.OutputData())
+				So(ctx.previousData, ShouldEqual, ctx2.(PreviousDataHolder).PreviousData())
 				So(ctx.request.Namespace, ShouldEqual, ctx2.Request().Namespace)
 				So(ctx.request.ParentID, ShouldEqual, ctx2.Request().ParentID)
 				So(ctx.statusCode, ShouldEqual, ctx2.StatusCode())
@@ -164,6 +166,7 @@ func TestContext_Duplicate(t *testing.T) {
 				So(ctx.outputCookies, ShouldResemble, cookies)
 				So(ctx.responseWriter, ShouldEqual, rwriter)
 				So(ctx.disableOutputDataPush, ShouldEqual, ctx.disableOutputDataPush)
+				So(ctx.startTime, ShouldEqual, ctx2.(*bcontext).startTime)
 			})
 		})
 	})
@@ -1,7 +1,9 @@
 package bahamut
 
 import (
+	"fmt"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -11,6 +13,10 @@ import (
 // feature that is not secure.
 const CORSOriginMirror = "_mirror_"
 
+// CORSOriginRegexPrefix is the prefix of an additional origin
+// that must be interpreted as a regular expression.
+const CORSOriginRegexPrefix = "re:"
+
 // CORSPolicy allows to configure
 // CORS Access Control header of a response.
 type CORSPolicy struct {
@@ -22,6 +28,7 @@ type CORSPolicy struct {
 	AllowCredentials bool
 
 	additionalOrigins map[string]struct{}
+	originPatterns    []*regexp.Regexp
 }
 
 type corsPolicyController struct {
@@ -30,65 +37,146 @@ type corsPolicyController struct {
 
 // NewDefaultCORSController returns a CORSPolicyController that always returns a CORSAccessControlPolicy
 // with sensible defaults.
+//
+// The additional origins can be exact origins, wildcard patterns like
+// https://*.example.com or regular expressions prefixed by CORSOriginRegexPrefix.
+// It will panic if a pattern is invalid.
 func NewDefaultCORSController(origin string, additionalOrigins []string) CORSPolicyController {
 
-	additionalOriginsMap := make(map[string]struct{}, len(additionalOrigins))
-	if len(additionalOrigins) > 0 {
-		for _, o := range additionalOrigins {
-			additionalOriginsMap[o] = struct{}{}
-		}
+	policy, err := NewDefaultCORSPolicy(origin, additionalOrigins)
+	if err != nil {
+		panic(err)
 	}
 
 	return &corsPolicyController{
-		policy: &CORSPolicy{
-			AllowOrigin:       origin,
-			additionalOrigins: additionalOriginsMap,
-			AllowCredentials:  true,
-			MaxAge:            1500,
-			AllowHeaders: []string{
-				"Authorization",
-				"Accept",
-				"Content-Type",
-				"Cache-Control",
-				"Cookie",
-				"If-Modified-Since",
-				"X-Requested-With",
-				"X-Count-Total",
-				"X-Namespace",
-				"X-External-Tracking-Type",
-				"X-External-Tracking-ID",
-				"X-TLS-Client-Certificate",
-				"Accept-Encoding",
-				"X-Fields",
-				"X-Read-Consistency",
-				"X-Write-Consistency",
-				"Idempotency-Key",
-			},
-			AllowMethods: []string{
-				"GET",
-				"POST",
-				"PUT",
-				"DELETE",
-				"PATCH",
-				"HEAD",
-				"OPTIONS",
-			},
-			ExposeHeaders: []string{
-				"X-Requested-With",
-				"X-Count-Total",
-				"X-Namespace",
-				"X-Messages",
-				"X-Fields",
-				"X-Next",
-			},
+		policy: policy,
+	}
+}
+
+// NewDefaultCORSPolicy returns a new CORSPolicy with the same sensible
+// defaults as NewDefaultCORSController. It returns an error if one of the
+// additional origins is an invalid pattern.
+func NewDefaultCORSPolicy(origin string, additionalOrigins []string) (*CORSPolicy, error) {
+
+	policy := &CORSPolicy{
+		AllowOrigin:      origin,
+		AllowCredentials: true,
+		MaxAge:           1500,
+		AllowHeaders: []string{
+			"Authorization",
+			"Accept",
+			"Content-Type",
+			"Cache-Control",
+			"Cookie",
+			"If-Modified-Since",
+			"X-Requested-With",
+			"X-Count-Total",
+			"X-Namespace",
+			"X-External-Tracking-Type",
+			"X-External-Tracking-ID",
+			"X-TLS-Client-Certificate",
+			"Accept-Encoding",
+			"X-Fields",
+			"X-Read-Consistency",
+			"X-Write-Consistency",
+			"Idempotency-Key",
+		},
+		AllowMethods: []string{
+			"GET",
+			"POST",
+			"PUT",
+			"DELETE",
+			"PATCH",
+			"HEAD",
+			"OPTIONS",
+		},
+		ExposeHeaders: []string{
+			"X-Requested-With",
+			"X-Count-Total",
+			"X-Namespace",
+			"X-Messages",
+			"X-Fields",
+			"X-Next",
 		},
 	}
+
+	if err := policy.SetAdditionalOrigins(additionalOrigins); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
 }
 
 func (c *corsPolicyController) PolicyForRequest(*http.Request) *CORSPolicy {
 	return c.policy
 }
 
+// SetAdditionalOrigins sets the additional origins that are allowed
+// in addition to AllowOrigin. An origin can be:
+//
+//   - an exact origin, like https://example.com
+//   - a wildcard pattern, like https://*.example.com, where * matches one
+//     or more subdomains
+//   - a regular expression prefixed by CORSOriginRegexPrefix, like
+//     re:https://[a-z]+\.example\.com. It must match the whole origin.
+//
+// It returns an error if a pattern is invalid, in which case the policy
+// is not modified.
+func (a *CORSPolicy) SetAdditionalOrigins(origins []string) error {
+
+	exact := make(map[string]struct{}, len(origins))
+	var patterns []*regexp.Regexp
+
+	for _, o := range origins {
+
+		switch {
+
+		case strings.HasPrefix(o, CORSOriginRegexPrefix):
+			// The pattern is anchored so it cannot match
+			// an origin that only contains an allowed one.
+			re, err := regexp.Compile("^(?:" + strings.TrimPrefix(o, CORSOriginRegexPrefix) + ")$")
+			if err != nil {
+				return fmt.Errorf("invalid origin pattern '%s': %w", o, err)
+			}
+			patterns = append(patterns, re)
+
+		case strings.Contains(o, "*"):
+			parts := strings.Split(o, "*")
+			for i, p := range parts {
+				parts[i] = regexp.QuoteMeta(p)
+			}
+			patterns = append(patterns, regexp.MustCompile("^"+strings.Join(parts, `[a-zA-Z0-9-]+(?:\.[a-zA-Z0-9-]+)*`)+"$"))
+
+		default:
+			exact[o] = struct{}{}
+		}
+	}
+
+	a.additionalOrigins = exact
+	a.originPatterns = patterns
+
+	return nil
+}
+
+func (a *CORSPolicy) isAdditionalOrigin(origin string) bool {
+
+	if origin == "" {
+		return false
+	}
+
+	if _, ok := a.additionalOrigins[origin]; ok {
+		return true
+	}
+
+	for _, re := range a.originPatterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Inject injects the CORS header on the given http.Header. It will use
 // the given request origin to determine the allow origin policy and the method
 // to determine if it should inject pre-flight OPTIONS header.
@@ -111,7 +199,7 @@ func (a *CORSPolicy) Inject(h http.Header, origin string, preflight bool) {
 	case a.AllowOrigin == CORSOriginMirror && origin == "":
 		corsOrigin = ""
 
-	case func() bool { _, ok := a.additionalOrigins[origin]; return ok }():
+	case a.isAdditionalOrigin(origin):
 		corsOrigin = origin
 	}
 
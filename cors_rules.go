@@ -0,0 +1,196 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A CORSRule associates a CORSPolicy to the requests matching
+// a path prefix and/or a list of identities.
+type CORSRule struct {
+	// PathPrefix is the prefix the path of the request must have for
+	// the rule to match. If empty, any path matches.
+	PathPrefix string
+
+	// Identities is the list of identity categories (as they appear in
+	// the request path, like "users") the request must target for the
+	// rule to match. If empty, any identity matches.
+	Identities []string
+
+	// Policy is the policy to apply.
+	Policy *CORSPolicy
+}
+
+func (r CORSRule) matches(path string, identity string) bool {
+
+	if r.PathPrefix != "" && !strings.HasPrefix(path, r.PathPrefix) {
+		return false
+	}
+
+	if len(r.Identities) == 0 {
+		return true
+	}
+
+	for _, i := range r.Identities {
+		if i == identity {
+			return true
+		}
+	}
+
+	return false
+}
+
+type corsRulesController struct {
+	defaultPolicy *CORSPolicy
+	rules         []CORSRule
+}
+
+// NewCORSRulesController returns a CORSPolicyController that returns
+// the policy of the first rule matching the request, or the default policy
+// if none matches.
+//
+// The identity of a request is derived from its path the same way bahamut
+// routes are, after removing the optional version prefix. If you use
+// OptAPIPrefix, use PathPrefix in the rules instead.
+func NewCORSRulesController(defaultPolicy *CORSPolicy, rules ...CORSRule) CORSPolicyController {
+
+	for i, r := range rules {
+		if r.Policy == nil {
+			panic(fmt.Sprintf("cors rule %d has no policy", i))
+		}
+	}
+
+	return &corsRulesController{
+		defaultPolicy: defaultPolicy,
+		rules:         rules,
+	}
+}
+
+func (c *corsRulesController) PolicyForRequest(req *http.Request) *CORSPolicy {
+
+	if req == nil || req.URL == nil {
+		return c.defaultPolicy
+	}
+
+	identity := corsIdentityFromPath(req.URL.Path)
+
+	for _, r := range c.rules {
+		if r.matches(req.URL.Path, identity) {
+			return r.Policy
+		}
+	}
+
+	return c.defaultPolicy
+}
+
+// corsIdentityFromPath returns the category of the identity targeted
+// by the given path. /things, /things/id return things, and
+// /parents/id/things returns things.
+func corsIdentityFromPath(path string) string {
+
+	path = vregexp.ReplaceAllString(path, "")
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) >= 3 {
+		return parts[2]
+	}
+
+	return parts[0]
+}
+
+// A CORSPolicyConfig is the configuration of a CORSPolicy. It can be
+// decoded from JSON. Unset values use the defaults of NewDefaultCORSPolicy.
+type CORSPolicyConfig struct {
+	AllowOrigin       string   `json:"allowOrigin"`
+	AdditionalOrigins []string `json:"additionalOrigins,omitempty"`
+	AllowHeaders      []string `json:"allowHeaders,omitempty"`
+	AllowMethods      []string `json:"allowMethods,omitempty"`
+	ExposeHeaders     []string `json:"exposeHeaders,omitempty"`
+	MaxAge            *int     `json:"maxAge,omitempty"`
+	AllowCredentials  *bool    `json:"allowCredentials,omitempty"`
+}
+
+// Policy returns the CORSPolicy described by the configuration.
+func (c CORSPolicyConfig) Policy() (*CORSPolicy, error) {
+
+	policy, err := NewDefaultCORSPolicy(c.AllowOrigin, c.AdditionalOrigins)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.AllowHeaders != nil {
+		policy.AllowHeaders = c.AllowHeaders
+	}
+
+	if c.AllowMethods != nil {
+		policy.AllowMethods = c.AllowMethods
+	}
+
+	if c.ExposeHeaders != nil {
+		policy.ExposeHeaders = c.ExposeHeaders
+	}
+
+	if c.MaxAge != nil {
+		policy.MaxAge = *c.MaxAge
+	}
+
+	if c.AllowCredentials != nil {
+		policy.AllowCredentials = *c.AllowCredentials
+	}
+
+	return policy, nil
+}
+
+// A CORSRuleConfig is the configuration of a CORSRule.
+type CORSRuleConfig struct {
+	PathPrefix string           `json:"pathPrefix,omitempty"`
+	Identities []string         `json:"identities,omitempty"`
+	Policy     CORSPolicyConfig `json:"policy"`
+}
+
+// A CORSConfig is the configuration of a set of CORS policies.
+// It can be decoded from JSON and passed to NewCORSControllerFromConfig.
+type CORSConfig struct {
+	Default CORSPolicyConfig `json:"default"`
+	Rules   []CORSRuleConfig `json:"rules,omitempty"`
+}
+
+// NewCORSControllerFromConfig returns a CORSPolicyController built from
+// the given configuration. See NewCORSRulesController for how the rules
+// are applied.
+func NewCORSControllerFromConfig(cfg CORSConfig) (CORSPolicyController, error) {
+
+	defaultPolicy, err := cfg.Default.Policy()
+	if err != nil {
+		return nil, fmt.Errorf("invalid default cors policy: %w", err)
+	}
+
+	rules := make([]CORSRule, len(cfg.Rules))
+	for i, rc := range cfg.Rules {
+
+		policy, err := rc.Policy.Policy()
+		if err != nil {
+			return nil, fmt.Errorf("invalid cors policy for rule %d: %w", i, err)
+		}
+
+		rules[i] = CORSRule{
+			PathPrefix: rc.PathPrefix,
+			Identities: rc.Identities,
+			Policy:     policy,
+		}
+	}
+
+	return NewCORSRulesController(defaultPolicy, rules...), nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCORSIdentityFromPath(t *testing.T) {
+
+	Convey("Given I have some paths", t, func() {
+		So(corsIdentityFromPath("/things"), ShouldEqual, "things")
+		So(corsIdentityFromPath("/things/xyz"), ShouldEqual, "things")
+		So(corsIdentityFromPath("/parents/xyz/things"), ShouldEqual, "things")
+		So(corsIdentityFromPath("/v/1/things/xyz"), ShouldEqual, "things")
+		So(corsIdentityFromPath("/"), ShouldEqual, "")
+	})
+}
+
+func TestCORSRulesController(t *testing.T) {
+
+	Convey("Given I have a rules controller", t, func() {
+
+		def, _ := NewDefaultCORSPolicy("default.com", nil)
+		admin, _ := NewDefaultCORSPolicy("admin.com", nil)
+		public, _ := NewDefaultCORSPolicy("*", nil)
+		public.AllowCredentials = false
+
+		c := NewCORSRulesController(
+			def,
+			CORSRule{Identities: []string{"admins", "secrets"}, Policy: admin},
+			CORSRule{PathPrefix: "/public", Policy: public},
+		)
+
+		Convey("Then the policies should be correctly selected", func() {
+			So(c.PolicyForRequest(nil), ShouldEqual, def)
+			So(c.PolicyForRequest(httptest.NewRequest(http.MethodGet, "/things", nil)), ShouldEqual, def)
+			So(c.PolicyForRequest(httptest.NewRequest(http.MethodGet, "/admins/xyz", nil)), ShouldEqual, admin)
+			So(c.PolicyForRequest(httptest.NewRequest(http.MethodGet, "/v/1/parents/xyz/secrets", nil)), ShouldEqual, admin)
+			So(c.PolicyForRequest(httptest.NewRequest(http.MethodGet, "/publicthings", nil)), ShouldEqual, public)
+		})
+	})
+
+	Convey("Given I create a rules controller with a rule without policy", t, func() {
+		So(func() { NewCORSRulesController(nil, CORSRule{PathPrefix: "/a"}) }, ShouldPanicWith, "cors rule 0 has no policy")
+	})
+}
+
+func TestNewCORSControllerFromConfig(t *testing.T) {
+
+	Convey("Given I have a valid json configuration", t, func() {
+
+		data := `{
+			"default": {"allowOrigin": "https://app.com", "additionalOrigins": ["https://*.app.com"]},
+			"rules": [
+				{"identities": ["admins"], "policy": {"allowOrigin": "https://admin.app.com", "maxAge": 10}},
+				{"pathPrefix": "/public", "policy": {"allowOrigin": "*", "allowCredentials": false, "allowMethods": ["GET"]}}
+			]
+		}`
+
+		cfg := CORSConfig{}
+		So(json.Unmarshal([]byte(data), &cfg), ShouldBeNil)
+
+		c, err := NewCORSControllerFromConfig(cfg)
+		So(err, ShouldBeNil)
+
+		Convey("Then the default policy should be correct", func() {
+			p := c.PolicyForRequest(httptest.NewRequest(http.MethodGet, "/things", nil))
+			So(p.AllowOrigin, ShouldEqual, "https://app.com")
+			So(p.isAdditionalOrigin("https://a.app.com"), ShouldBeTrue)
+			So(p.AllowCredentials, ShouldBeTrue)
+			So(p.MaxAge, ShouldEqual, 1500)
+		})
+
+		Convey("Then the admin policy should be correct", func() {
+			p := c.PolicyForRequest(httptest.NewRequest(http.MethodGet, "/admins", nil))
+			So(p.AllowOrigin, ShouldEqual, "https://admin.app.com")
+			So(p.MaxAge, ShouldEqual, 10)
+			So(p.isAdditionalOrigin("https://a.app.com"), ShouldBeFalse)
+		})
+
+		Convey("Then the public policy should be correct", func() {
+			p := c.PolicyForRequest(httptest.NewRequest(http.MethodGet, "/public/things", nil))
+			So(p.AllowOrigin, ShouldEqual, "*")
+			So(p.AllowCredentials, ShouldBeFalse)
+			So(p.AllowMethods, ShouldResemble, []string{"GET"})
+		})
+	})
+
+	Convey("Given I have a configuration with an invalid default policy", t, func() {
+
+		_, err := NewCORSControllerFromConfig(CORSConfig{Default: CORSPolicyConfig{AdditionalOrigins: []string{"re:("}}})
+
+		Convey("Then it should fail", func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "invalid default cors policy:")
+		})
+	})
+
+	Convey("Given I have a configuration with an invalid rule policy", t, func() {
+
+		_, err := NewCORSControllerFromConfig(CORSConfig{Rules: []CORSRuleConfig{{Policy: CORSPolicyConfig{AdditionalOrigins: []string{"re:("}}}}})
+
+		Convey("Then it should fail", func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "invalid cors policy for rule 0:")
+		})
+	})
+}
@@ -168,3 +168,87 @@ func TestCORSInject(t *testing.T) {
 		So(h.Get("Access-Control-Allow-Credentials"), ShouldEqual, "")
 	})
 }
+
+func TestCORSPolicy_SetAdditionalOrigins(t *testing.T) {
+
+	Convey("Given I have a policy with an unanchored regular expression", t, func() {
+
+		ac, err := NewDefaultCORSPolicy("origin.com", []string{`re:https://a\.example\.com`})
+		So(err, ShouldBeNil)
+
+		Convey("Then the exact origin should be allowed", func() {
+			h := http.Header{}
+			ac.Inject(h, "https://a.example.com", false)
+			So(h.Get("Access-Control-Allow-Origin"), ShouldEqual, "https://a.example.com")
+		})
+
+		Convey("Then origins containing it should not be allowed", func() {
+			for _, o := range []string{
+				"https://a.example.com.evil.com",
+				"https://evil.com/https://a.example.com",
+			} {
+				h := http.Header{}
+				ac.Inject(h, o, false)
+				So(h.Get("Access-Control-Allow-Origin"), ShouldEqual, "origin.com")
+			}
+		})
+	})
+
+	Convey("Given I have a policy with patterns", t, func() {
+
+		ac, err := NewDefaultCORSPolicy("origin.com", []string{
+			"https://exact.com",
+			"https://*.example.com",
+			`re:^https://app-[0-9]+\.other\.com$`,
+		})
+		So(err, ShouldBeNil)
+
+		Convey("Then the patterns should be compiled", func() {
+			So(ac.additionalOrigins, ShouldResemble, map[string]struct{}{"https://exact.com": {}})
+			So(len(ac.originPatterns), ShouldEqual, 2)
+		})
+
+		Convey("Then matching origins should be allowed", func() {
+			for _, o := range []string{
+				"https://exact.com",
+				"https://a.example.com",
+				"https://a.b.example.com",
+				"https://app-42.other.com",
+			} {
+				h := http.Header{}
+				ac.Inject(h, o, false)
+				So(h.Get("Access-Control-Allow-Origin"), ShouldEqual, o)
+			}
+		})
+
+		Convey("Then non matching origins should not be allowed", func() {
+			for _, o := range []string{
+				"https://example.com",
+				"http://a.example.com",
+				"https://a.example.com.evil.com",
+				"https://evil.com/.example.com",
+				"https://app-x.other.com",
+				"",
+			} {
+				h := http.Header{}
+				ac.Inject(h, o, false)
+				So(h.Get("Access-Control-Allow-Origin"), ShouldEqual, "origin.com")
+			}
+		})
+	})
+
+	Convey("Given I have a policy with an invalid regex", t, func() {
+
+		ac, err := NewDefaultCORSPolicy("origin.com", []string{"re:("})
+
+		Convey("Then it should fail", func() {
+			So(ac, ShouldBeNil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "invalid origin pattern 're:(':")
+		})
+
+		Convey("Then NewDefaultCORSController should panic", func() {
+			So(func() { NewDefaultCORSController("origin.com", []string{"re:("}) }, ShouldPanic)
+		})
+	})
+}
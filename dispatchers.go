@@ -273,9 +273,14 @@ func dispatchUpdateOperation(
 		pusher(ctx.events...)
 	}
 
+	if auditer != nil || ctx.pushChanges {
+		ctx.snapshotChanges()
+	}
+
 	if o, ok := ctx.outputData.(elemental.Identifiable); ok && !ctx.disableOutputDataPush {
 		elemental.ResetSecretAttributesValues(o)
-		pusher(elemental.NewEvent(elemental.EventUpdate, o))
+		ctx.outputDataEvent = elemental.NewEvent(elemental.EventUpdate, o)
+		pusher(ctx.outputDataEvent)
 	}
 
 	audit(auditer, ctx, nil)
@@ -327,9 +332,14 @@ func dispatchDeleteOperation(
 		pusher(ctx.events...)
 	}
 
+	if auditer != nil || ctx.pushChanges {
+		ctx.snapshotChanges()
+	}
+
 	if o, ok := ctx.outputData.(elemental.Identifiable); ok && !ctx.disableOutputDataPush {
 		elemental.ResetSecretAttributesValues(o)
-		pusher(elemental.NewEvent(elemental.EventDelete, o))
+		ctx.outputDataEvent = elemental.NewEvent(elemental.EventDelete, o)
+		pusher(ctx.outputDataEvent)
 	}
 
 	audit(auditer, ctx, nil)
@@ -416,6 +426,13 @@ func dispatchPatchOperation(
 			audit(auditer, ctx, err)
 			return err
 		}
+
+		// Patch modifies the identifiable in place, so we keep
+		// a snapshot of the original version for the audit.
+		if auditer != nil {
+			ctx.previousData = toDataMap(identifiable)
+		}
+
 		patchable.Patch(sparse.(elemental.SparseIdentifiable))
 
 		if v, ok := patchable.(elemental.Validatable); ok {
@@ -444,9 +461,14 @@ func dispatchPatchOperation(
 		pusher(ctx.events...)
 	}
 
+	if auditer != nil || ctx.pushChanges {
+		ctx.snapshotChanges()
+	}
+
 	if o, ok := ctx.outputData.(elemental.Identifiable); ok && !ctx.disableOutputDataPush {
 		elemental.ResetSecretAttributesValues(o)
-		pusher(elemental.NewEvent(elemental.EventUpdate, o))
+		ctx.outputDataEvent = elemental.NewEvent(elemental.EventUpdate, o)
+		pusher(ctx.outputDataEvent)
 	}
 
 	audit(auditer, ctx, nil)
@@ -1678,6 +1678,7 @@ func TestDispatchers_dispatchPatchOperation(t *testing.T) {
 			So(retrieverCalled, ShouldEqual, 1)
 			So(auditer.GetCallCount(), ShouldEqual, expectedNbCalls)
 			So(ctx.outputData, ShouldResemble, &testmodel.SparseList{ID: &expectedID, Name: &expectedName})
+			So(ctx.previousData.(map[string]any)["name"], ShouldEqual, "will be patched")
 			So(len(pusher.events), ShouldEqual, 2)
 			So(pusher.events[0].Type, ShouldEqual, elemental.EventDelete)
 			So(pusher.events[1].Type, ShouldEqual, elemental.EventUpdate)
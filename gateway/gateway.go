@@ -460,7 +460,7 @@ HANDLE_INTERCEPTION:
 			case errors.Is(err, ErrUpstreamerTooManyRequests):
 
 				if mm := s.gatewayConfig.metricsManager; mm != nil {
-					mm.MeasureRequest(r.Method, path)(http.StatusTooManyRequests, nil)
+					mm.MeasureRequest(r.Method, path)(http.StatusTooManyRequests, nil, nil)
 				}
 				s.corsOriginInjectorFunc(w, r)
 				writeError(w, r, errRateLimit)
@@ -539,7 +539,7 @@ HANDLE_INTERCEPTION:
 		s.forwarder.ServeHTTP(w, r)
 
 		if finish != nil {
-			rt := finish(0, nil)
+			rt := finish(0, nil, nil)
 			if s.upstreamerLatency != nil {
 				s.upstreamerLatency.CollectLatency(upstream, rt)
 			}
@@ -556,7 +556,7 @@ HANDLE_INTERCEPTION:
 		s.proxyHTTPHandler.ServeHTTP(w, r)
 
 		if finish != nil {
-			rt := finish(0, nil)
+			rt := finish(0, nil, nil)
 			if s.upstreamerLatency != nil {
 				s.upstreamerLatency.CollectLatency(upstream, rt)
 			}
@@ -55,7 +55,7 @@ type fakeMetricManager struct {
 }
 
 func (m *fakeMetricManager) MeasureRequest(method string, url string) bahamut.FinishMeasurementFunc {
-	return func(code int, span opentracing.Span) time.Duration { return 0 }
+	return func(code int, info *bahamut.RequestMetricsInfo, span opentracing.Span) time.Duration { return 0 }
 }
 
 func (m *fakeMetricManager) RegisterWSConnection() {
@@ -70,7 +70,13 @@ func (m *fakeMetricManager) RegisterTCPConnection() {
 func (m *fakeMetricManager) UnregisterTCPConnection() {
 	atomic.AddInt64(&m.unregisterTCPConnectionCalled, 1)
 }
-func (m *fakeMetricManager) Write(w http.ResponseWriter, r *http.Request) {}
+func (m *fakeMetricManager) RegisterPushPublication(identity string, eventType string, failed bool) {}
+func (m *fakeMetricManager) RegisterPushDispatch(outcome string, count int)                         {}
+func (m *fakeMetricManager) ObservePushDispatchDuration(duration time.Duration)                     {}
+func (m *fakeMetricManager) ObservePushSessionQueueDepth(depth int)                                 {}
+func (m *fakeMetricManager) RegisterPushEventDropped()                                              {}
+func (m *fakeMetricManager) ObservePushSessionLifetime(duration time.Duration)                      {}
+func (m *fakeMetricManager) Write(w http.ResponseWriter, r *http.Request)                           {}
 
 func makeServerCert() tls.Certificate {
 	certPem, keyPem, err := tglib.Issue(pkix.Name{}, tglib.OptIssueTypeServerAuth())
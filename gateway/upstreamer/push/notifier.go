@@ -112,6 +112,9 @@ func (w *Notifier) MakeStartHook(ctx context.Context) func(server bahamut.Server
 
 					sp.Load = pct / cores
 
+					// A new publication is made for every ping, as the
+					// pubsub may deduplicate the publications by ID.
+					pub := bahamut.NewPublication(w.serviceStatusTopic)
 					if err := pub.Encode(sp); err != nil {
 						zap.L().Error("Unable to encode service ping", zap.Error(err))
 						continue
@@ -148,7 +151,7 @@ func (w *Notifier) MakeStopHook() func(server bahamut.Server) error {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		if err := w.pubsub.Publish(pub, bahamut.NATSOptPublishRequireAck(ctx)); err != nil {
+		if err := w.pubsub.Publish(pub, bahamut.PubSubOptPublishRequireAck(ctx)); err != nil {
 			return err
 		}
 
@@ -33,7 +33,8 @@ func TestNonNotifier(t *testing.T) {
 
 		errCh := make(chan error, 10)
 		pubCh := make(chan *bahamut.Publication, 10)
-		defer pubsub.Subscribe(pubCh, errCh, "topic")()
+		// The pings must not be dropped by deduplicating subscribers.
+		defer pubsub.Subscribe(pubCh, errCh, "topic", bahamut.PubSubOptSubscribeDeduplicate(time.Minute))()
 
 		Convey("When I call NewNotifier", func() {
 
@@ -124,6 +125,8 @@ func TestNonNotifier(t *testing.T) {
 						case <-time.After(1500 * time.Millisecond):
 						}
 
+						So(p, ShouldNotBeNil)
+
 						sping := &servicePing{}
 						if err := p.Decode(sping); err != nil {
 							panic(err)
@@ -388,6 +388,11 @@ func (c *Upstreamer) listenServices(ctx context.Context, ready chan struct{}) {
 
 		case pub := <-pubs:
 
+			// Services send their pings periodically, so a lost
+			// one is superseded by the next and never needs to be
+			// redelivered.
+			_ = pub.Ack()
+
 			var sp servicePing
 
 			if err = pub.Decode(&sp); err != nil {
@@ -520,6 +525,10 @@ func (c *Upstreamer) listenPeers(ctx context.Context) {
 
 		case pub := <-pubs:
 
+			// A redelivered peer ping would be handled after the
+			// fresher ones and could resurrect a peer that said goodbye.
+			_ = pub.Ack()
+
 			var ping peerPing
 
 			if err := pub.Decode(&ping); err != nil {
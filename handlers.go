@@ -20,6 +20,7 @@ import (
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/log"
 	"go.aporeto.io/elemental"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 )
 
@@ -38,6 +39,9 @@ func makeResponse(ctx *bcontext, response *elemental.Response, marshallers map[e
 			span.LogFields(fields...)
 			span.SetTag("status.code", response.StatusCode)
 		}
+		if span := otelSpanFromContext(ctx.ctx); span != nil {
+			span.SetAttributes(attribute.Int("status.code", response.StatusCode))
+		}
 	}()
 
 	response.StatusCode = ctx.statusCode
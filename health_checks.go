@@ -0,0 +1,350 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// PingStatusPending represents the status of a component
+	// that has not been checked yet.
+	PingStatusPending = "pending"
+)
+
+// Various values of the overall status returned
+// by the liveness, readiness and startup endpoints.
+const (
+	HealthStatusOK       = "ok"
+	HealthStatusDegraded = "degraded"
+	HealthStatusFailed   = "failed"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+)
+
+// A HealthComponentStatus contains the status of
+// a component registered with OptHealthCheck.
+type HealthComponentStatus struct {
+	Status    string     `json:"status"`
+	Critical  bool       `json:"critical"`
+	Latency   string     `json:"latency,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+	LastCheck *time.Time `json:"lastCheck,omitempty"`
+}
+
+// A HealthReport is the body returned by the
+// liveness, readiness and startup endpoints.
+type HealthReport struct {
+	Status     string                           `json:"status"`
+	Components map[string]HealthComponentStatus `json:"components,omitempty"`
+}
+
+// A HealthCheckOption represents an option that can be passed to OptHealthCheck.
+type HealthCheckOption func(*healthCheck)
+
+// HealthCheckOptTimeout sets the maximum time the component has to
+// answer the ping. If it does not answer in time, its status will be
+// PingStatusTimeout. The default is 5s.
+func HealthCheckOptTimeout(timeout time.Duration) HealthCheckOption {
+
+	if timeout <= 0 {
+		panic("timeout must be greater than 0")
+	}
+
+	return func(c *healthCheck) {
+		c.timeout = timeout
+	}
+}
+
+// HealthCheckOptNonCritical marks the component as non critical.
+// A failing non critical component degrades the readiness of the
+// server instead of failing it.
+func HealthCheckOptNonCritical() HealthCheckOption {
+	return func(c *healthCheck) {
+		c.critical = false
+	}
+}
+
+// healthCheck holds the configuration and the last
+// result of a component registered with OptHealthCheck.
+type healthCheck struct {
+	name     string
+	pinger   Pinger
+	timeout  time.Duration
+	critical bool
+
+	status    string
+	latency   time.Duration
+	lastError error
+	lastCheck time.Time
+	succeeded bool
+	running   bool
+}
+
+func newHealthCheck(name string, pinger Pinger, options ...HealthCheckOption) *healthCheck {
+
+	c := &healthCheck{
+		name:     name,
+		pinger:   pinger,
+		timeout:  defaultHealthCheckTimeout,
+		critical: true,
+		status:   PingStatusPending,
+	}
+
+	for _, opt := range options {
+		opt(c)
+	}
+
+	return c
+}
+
+// healthRegistry periodically checks the registered
+// components and caches their results.
+type healthRegistry struct {
+	checks   []*healthCheck
+	interval time.Duration
+	started  bool
+	lock     sync.RWMutex
+}
+
+func newHealthRegistry(checks []*healthCheck, interval time.Duration) *healthRegistry {
+
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	return &healthRegistry{
+		checks:   checks,
+		interval: interval,
+	}
+}
+
+// run checks all the components every interval until
+// the given context is canceled.
+func (r *healthRegistry) run(ctx context.Context) {
+
+	if len(r.checks) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.checkAll()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkAll checks all the components concurrently and
+// waits for them to answer or to time out.
+func (r *healthRegistry) checkAll() {
+
+	var wg sync.WaitGroup
+
+	for _, c := range r.checks {
+
+		r.lock.Lock()
+		if c.running {
+			r.lock.Unlock()
+			continue
+		}
+		c.running = true
+		r.lock.Unlock()
+
+		wg.Add(1)
+		go func(c *healthCheck) {
+			defer wg.Done()
+			r.check(c)
+		}(c)
+	}
+
+	wg.Wait()
+}
+
+// check pings the given component. If the pinger does not
+// honor the timeout, the result is recorded as a timeout and
+// the component will not be checked again until it returns.
+func (r *healthRegistry) check(c *healthCheck) {
+
+	done := make(chan error, 1)
+	start := time.Now()
+
+	go func() {
+		err := c.pinger.Ping(c.timeout)
+
+		r.lock.Lock()
+		c.running = false
+		r.lock.Unlock()
+
+		done <- err
+	}()
+
+	var err error
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case err = <-done:
+	case <-timer.C:
+		err = fmt.Errorf(PingStatusTimeout)
+	}
+
+	latency := time.Since(start)
+	status := stringifyStatus(err)
+
+	if err != nil {
+		zap.L().Warn("Health check failed",
+			zap.String("component", c.name),
+			zap.String("status", status),
+			zap.Duration("latency", latency),
+			zap.Bool("critical", c.critical),
+			zap.Error(err),
+		)
+	}
+
+	r.lock.Lock()
+	c.status = status
+	c.latency = latency
+	c.lastError = err
+	c.lastCheck = time.Now()
+	if err == nil {
+		c.succeeded = true
+	}
+	r.lock.Unlock()
+}
+
+// live returns the liveness report. Liveness only
+// reflects that the server is able to answer.
+func (r *healthRegistry) live() (HealthReport, bool) {
+	return HealthReport{Status: HealthStatusOK}, true
+}
+
+// ready returns the readiness report. The server is not ready
+// if any critical component is not ok, and is degraded if any
+// non critical component is not ok.
+func (r *healthRegistry) ready() (HealthReport, bool) {
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	report := r.report()
+	report.Status = HealthStatusOK
+
+	for _, c := range r.checks {
+
+		if c.status == PingStatusOK {
+			continue
+		}
+
+		if c.critical {
+			report.Status = HealthStatusFailed
+			return report, false
+		}
+
+		report.Status = HealthStatusDegraded
+	}
+
+	return report, true
+}
+
+// startup returns the startup report. The server has started
+// once every critical component has been ok at least once.
+func (r *healthRegistry) startup() (HealthReport, bool) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	report := r.report()
+
+	if !r.started {
+		for _, c := range r.checks {
+			if c.critical && !c.succeeded {
+				report.Status = HealthStatusFailed
+				return report, false
+			}
+		}
+		r.started = true
+	}
+
+	report.Status = HealthStatusOK
+
+	return report, true
+}
+
+// report returns a report with the current status of each
+// component. The caller must hold the lock.
+func (r *healthRegistry) report() HealthReport {
+
+	report := HealthReport{}
+
+	if len(r.checks) == 0 {
+		return report
+	}
+
+	report.Components = make(map[string]HealthComponentStatus, len(r.checks))
+
+	for _, c := range r.checks {
+
+		s := HealthComponentStatus{
+			Status:   c.status,
+			Critical: c.critical,
+		}
+
+		if !c.lastCheck.IsZero() {
+			lastCheck := c.lastCheck
+			s.LastCheck = &lastCheck
+			s.Latency = c.latency.String()
+		}
+
+		if c.lastError != nil {
+			s.LastError = c.lastError.Error()
+		}
+
+		report.Components[c.name] = s
+	}
+
+	return report
+}
+
+// writeHealthReport writes the given report as JSON in the
+// given http.ResponseWriter, with a status code matching ok.
+func writeHealthReport(w http.ResponseWriter, report HealthReport, ok bool) {
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		zap.L().Error("Unable to encode health report", zap.Error(err))
+	}
+}
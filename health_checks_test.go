@@ -0,0 +1,240 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type blockingPinger struct {
+	release chan struct{}
+}
+
+func (p *blockingPinger) Ping(timeout time.Duration) error {
+	<-p.release
+	return nil
+}
+
+func TestHealthRegistry_ready(t *testing.T) {
+
+	Convey("Given I have a registry with no components", t, func() {
+
+		r := newHealthRegistry(nil, 0)
+
+		Convey("Then it should be live, ready and started", func() {
+			So(r.interval, ShouldEqual, defaultHealthCheckInterval)
+
+			report, ok := r.live()
+			So(ok, ShouldBeTrue)
+			So(report.Status, ShouldEqual, HealthStatusOK)
+
+			report, ok = r.ready()
+			So(ok, ShouldBeTrue)
+			So(report.Status, ShouldEqual, HealthStatusOK)
+			So(report.Components, ShouldBeNil)
+
+			_, ok = r.startup()
+			So(ok, ShouldBeTrue)
+		})
+	})
+
+	Convey("Given I have a registry with a critical and a non critical component", t, func() {
+
+		critical := &MockPinger{}
+		nonCritical := &MockPinger{}
+
+		r := newHealthRegistry(
+			[]*healthCheck{
+				newHealthCheck("db", critical),
+				newHealthCheck("cache", nonCritical, HealthCheckOptNonCritical()),
+			},
+			time.Second,
+		)
+
+		Convey("When nothing has been checked yet", func() {
+
+			report, ok := r.ready()
+
+			Convey("Then it should not be ready nor started", func() {
+				So(ok, ShouldBeFalse)
+				So(report.Status, ShouldEqual, HealthStatusFailed)
+				So(report.Components["db"].Status, ShouldEqual, PingStatusPending)
+				So(report.Components["db"].Critical, ShouldBeTrue)
+				So(report.Components["db"].LastCheck, ShouldBeNil)
+				So(report.Components["cache"].Critical, ShouldBeFalse)
+
+				_, ok = r.startup()
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When everything is ok", func() {
+
+			r.checkAll()
+			report, ok := r.ready()
+
+			Convey("Then it should be ready and started", func() {
+				So(ok, ShouldBeTrue)
+				So(report.Status, ShouldEqual, HealthStatusOK)
+				So(report.Components["db"].Status, ShouldEqual, PingStatusOK)
+				So(report.Components["db"].LastCheck, ShouldNotBeNil)
+				So(report.Components["db"].Latency, ShouldNotBeEmpty)
+
+				_, ok = r.startup()
+				So(ok, ShouldBeTrue)
+			})
+		})
+
+		Convey("When the non critical component fails", func() {
+
+			nonCritical.PingStatus = fmt.Errorf("boom")
+			r.checkAll()
+			report, ok := r.ready()
+
+			Convey("Then it should be ready but degraded", func() {
+				So(ok, ShouldBeTrue)
+				So(report.Status, ShouldEqual, HealthStatusDegraded)
+				So(report.Components["cache"].Status, ShouldEqual, PingStatusError)
+				So(report.Components["cache"].LastError, ShouldEqual, "boom")
+
+				_, ok = r.startup()
+				So(ok, ShouldBeTrue)
+			})
+		})
+
+		Convey("When the critical component fails after the startup", func() {
+
+			r.checkAll()
+			_, ok := r.startup()
+			So(ok, ShouldBeTrue)
+
+			critical.PingStatus = fmt.Errorf("boom")
+			r.checkAll()
+			report, ok := r.ready()
+
+			Convey("Then it should not be ready but still started", func() {
+				So(ok, ShouldBeFalse)
+				So(report.Status, ShouldEqual, HealthStatusFailed)
+				So(report.Components["db"].LastError, ShouldEqual, "boom")
+
+				_, ok = r.startup()
+				So(ok, ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestHealthRegistry_timeout(t *testing.T) {
+
+	Convey("Given I have a registry with a component that does not answer in time", t, func() {
+
+		p := &blockingPinger{release: make(chan struct{})}
+		r := newHealthRegistry(
+			[]*healthCheck{
+				newHealthCheck("slow", p, HealthCheckOptTimeout(10*time.Millisecond)),
+			},
+			time.Second,
+		)
+
+		Convey("When I check it", func() {
+
+			r.checkAll()
+			report, ok := r.ready()
+
+			Convey("Then it should have timed out", func() {
+				So(ok, ShouldBeFalse)
+				So(report.Components["slow"].Status, ShouldEqual, PingStatusTimeout)
+			})
+
+			Convey("Then it should not be checked again until it answers", func() {
+				start := time.Now()
+				r.checkAll()
+				So(time.Since(start), ShouldBeLessThan, 10*time.Millisecond)
+
+				close(p.release)
+			})
+		})
+	})
+
+	Convey("Calling HealthCheckOptTimeout with 0 should panic", t, func() {
+		So(func() { HealthCheckOptTimeout(0) }, ShouldPanicWith, "timeout must be greater than 0")
+	})
+}
+
+func TestHealthRegistry_run(t *testing.T) {
+
+	Convey("Given I have a running registry", t, func() {
+
+		p := &MockPinger{}
+		r := newHealthRegistry([]*healthCheck{newHealthCheck("db", p)}, 10*time.Millisecond)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go r.run(ctx)
+
+		Convey("Then it should eventually be started", func() {
+			var ok bool
+			for i := 0; i < 100 && !ok; i++ {
+				time.Sleep(10 * time.Millisecond)
+				_, ok = r.startup()
+			}
+			So(ok, ShouldBeTrue)
+		})
+	})
+}
+
+func Test_writeHealthReport(t *testing.T) {
+
+	Convey("Given I have a report", t, func() {
+
+		report := HealthReport{
+			Status: HealthStatusDegraded,
+			Components: map[string]HealthComponentStatus{
+				"cache": {Status: PingStatusError, LastError: "boom"},
+			},
+		}
+
+		Convey("When I write it as ok", func() {
+
+			w := httptest.NewRecorder()
+			writeHealthReport(w, report, true)
+
+			Convey("Then the response should be correct", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Header().Get("Content-Type"), ShouldEqual, "application/json; charset=UTF-8")
+
+				out := HealthReport{}
+				So(json.Unmarshal(w.Body.Bytes(), &out), ShouldBeNil)
+				So(out, ShouldResemble, report)
+			})
+		})
+
+		Convey("When I write it as not ok", func() {
+
+			w := httptest.NewRecorder()
+			writeHealthReport(w, report, false)
+
+			Convey("Then the response should be correct", func() {
+				So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+			})
+		})
+	})
+}
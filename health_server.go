@@ -22,16 +22,19 @@ import (
 
 // an healthServer is the structure serving the health check endpoint.
 type healthServer struct {
-	cfg    config
-	server *http.Server
+	cfg       config
+	server    *http.Server
+	registry  *healthRegistry
+	pushAdmin http.Handler
 }
 
 // newHealthServer returns a new healthServer.
 func newHealthServer(cfg config) *healthServer {
 
 	s := &healthServer{
-		cfg:    cfg,
-		server: &http.Server{Addr: cfg.healthServer.listenAddress},
+		cfg:      cfg,
+		server:   &http.Server{Addr: cfg.healthServer.listenAddress},
+		registry: newHealthRegistry(cfg.healthServer.checks, cfg.healthServer.checkInterval),
 	}
 
 	s.server.Handler = s
@@ -41,6 +44,11 @@ func newHealthServer(cfg config) *healthServer {
 
 func (s *healthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
+	if s.pushAdmin != nil && (r.URL.Path == pushSessionsAdminPath || strings.HasPrefix(r.URL.Path, pushSessionsAdminPath+"/")) {
+		s.pushAdmin.ServeHTTP(w, r)
+		return
+	}
+
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
@@ -62,6 +70,18 @@ func (s *healthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		w.WriteHeader(http.StatusNoContent)
 
+	case "/live":
+		report, ok := s.registry.live()
+		writeHealthReport(w, report, ok)
+
+	case "/ready":
+		report, ok := s.registry.ready()
+		writeHealthReport(w, report, ok)
+
+	case "/startup":
+		report, ok := s.registry.startup()
+		writeHealthReport(w, report, ok)
+
 	case "/metrics":
 		if s.cfg.healthServer.metricsManager == nil {
 			w.WriteHeader(http.StatusNotImplemented)
@@ -91,6 +111,8 @@ func (s *healthServer) start(ctx context.Context) {
 
 	zap.L().Debug("Health server enabled", zap.String("listen", s.cfg.healthServer.listenAddress))
 
+	go s.registry.run(ctx)
+
 	go func() {
 		if err := s.server.ListenAndServe(); err != nil {
 			if err == http.ErrServerClosed {
@@ -13,9 +13,11 @@ package bahamut
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -44,6 +46,13 @@ func (m *testMetricsManager) RegisterWSConnection()    {}
 func (m *testMetricsManager) UnregisterWSConnection()  {}
 func (m *testMetricsManager) RegisterTCPConnection()   {}
 func (m *testMetricsManager) UnregisterTCPConnection() {}
+func (m *testMetricsManager) RegisterPushPublication(identity string, eventType string, failed bool) {
+}
+func (m *testMetricsManager) RegisterPushDispatch(outcome string, count int)     {}
+func (m *testMetricsManager) ObservePushDispatchDuration(duration time.Duration) {}
+func (m *testMetricsManager) ObservePushSessionQueueDepth(depth int)             {}
+func (m *testMetricsManager) RegisterPushEventDropped()                          {}
+func (m *testMetricsManager) ObservePushSessionLifetime(duration time.Duration)  {}
 func (m *testMetricsManager) Write(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusTeapot)
 }
@@ -241,3 +250,107 @@ func TestHealthServerWithCustomHandler(t *testing.T) {
 		})
 	})
 }
+
+func TestHealthServerWithHealthChecks(t *testing.T) {
+
+	Convey("Given I have a health server with health checks", t, func() {
+
+		port := freePort()
+		cfg := config{}
+		cfg.healthServer.listenAddress = fmt.Sprintf("127.0.0.1:%d", port)
+		cfg.healthServer.checkInterval = 100 * time.Millisecond
+		cfg.healthServer.checks = []*healthCheck{
+			newHealthCheck("db", MockPinger{}),
+			newHealthCheck("cache", MockPinger{PingStatus: fmt.Errorf("boom")}, HealthCheckOptNonCritical()),
+		}
+
+		hs := newHealthServer(cfg)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		go hs.start(ctx)
+		defer hs.stop()
+
+		time.Sleep(1 * time.Second)
+
+		Convey("When I get /live", func() {
+
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/live", port))
+
+			Convey("Then err should be nil", func() {
+				So(err, ShouldBeNil)
+			})
+
+			Convey("Then code should be 200", func() {
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			})
+		})
+
+		Convey("When I get /ready", func() {
+
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/ready", port))
+
+			Convey("Then err should be nil", func() {
+				So(err, ShouldBeNil)
+			})
+
+			Convey("Then code should be 200", func() {
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			})
+
+			Convey("Then the report should be degraded", func() {
+				report := HealthReport{}
+				So(json.NewDecoder(resp.Body).Decode(&report), ShouldBeNil)
+				So(report.Status, ShouldEqual, HealthStatusDegraded)
+				So(report.Components["db"].Status, ShouldEqual, PingStatusOK)
+				So(report.Components["cache"].Status, ShouldEqual, PingStatusError)
+				So(report.Components["cache"].LastError, ShouldEqual, "boom")
+			})
+		})
+
+		Convey("When I get /startup", func() {
+
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/startup", port))
+
+			Convey("Then err should be nil", func() {
+				So(err, ShouldBeNil)
+			})
+
+			Convey("Then code should be 200", func() {
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			})
+		})
+	})
+}
+
+func TestHealthServerWithPushSessionsAdmin(t *testing.T) {
+
+	Convey("Given I have a health server with a push sessions admin", t, func() {
+
+		hs := newHealthServer(config{})
+		hs.pushAdmin = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})
+
+		Convey("When I send a DELETE to /_push/sessions/xxx", func() {
+
+			w := httptest.NewRecorder()
+			hs.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/_push/sessions/xxx", nil))
+
+			Convey("Then the admin should have handled it", func() {
+				So(w.Code, ShouldEqual, http.StatusTeapot)
+			})
+		})
+
+		Convey("When I send a DELETE to /_push/sessionsxxx", func() {
+
+			w := httptest.NewRecorder()
+			hs.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/_push/sessionsxxx", nil))
+
+			Convey("Then it should not be allowed", func() {
+				So(w.Code, ShouldEqual, http.StatusMethodNotAllowed)
+			})
+		})
+	})
+}
@@ -22,6 +22,7 @@ import (
 type processorFinderFunc func(identity elemental.Identity) (Processor, error)
 
 type eventPusherFunc func(...*elemental.Event)
+type contextEventPusherFunc func(context.Context, ...*elemental.Event)
 
 type retrieveHandlersFunc func() map[string]http.HandlerFunc
 
@@ -92,6 +93,22 @@ type Server interface {
 	Run(context.Context)
 }
 
+// A PushOutboxer gives access to the push outbox of a Server.
+// The Server returned by New and NewServer implements it:
+//
+//	status := server.(bahamut.PushOutboxer).PushOutboxStatus()
+type PushOutboxer interface {
+
+	// PushOutboxStatus returns the status of the push outbox.
+	// The status is not enabled if OptPushOutbox is not set.
+	PushOutboxStatus() PushOutboxStatus
+
+	// FlushPushOutbox publishes the events stored in the push outbox
+	// until it is empty or the given context is done, in which case
+	// an error is returned. It does nothing if OptPushOutbox is not set.
+	FlushPushOutbox(context.Context) error
+}
+
 // A ResponseWriter is a function you can use in
 // the Context to handle the writing of the response by
 // yourself. You are responsible for the full handling of the response,
@@ -197,6 +214,25 @@ type Context interface {
 	AddOutputCookies(cookies ...*http.Cookie)
 }
 
+// A PreviousDataHolder is a Context that can hold the version of the
+// object as it was before the operation. Bahamut uses it to compute the
+// changes reported in the AuditRecord of update, patch and delete
+// operations. The Contexts given to the processors implement it:
+//
+//	ctx.(bahamut.PreviousDataHolder).SetPreviousData(previous)
+type PreviousDataHolder interface {
+	Context
+
+	// SetPreviousData sets the version of the object as it was before
+	// the operation.
+	//
+	// The given object must not be modified after calling this method.
+	SetPreviousData(any)
+
+	// PreviousData returns the data set by SetPreviousData.
+	PreviousData() any
+}
+
 // Processor is the interface for a Processor Unit
 type Processor any
 
@@ -13,13 +13,71 @@ package bahamut
 
 import (
 	"net/http"
+	"strconv"
 	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
+	"go.aporeto.io/elemental"
+)
+
+// RequestMetricsInfo contains the information about a request
+// that are only known once it has been decoded by the dispatcher.
+type RequestMetricsInfo struct {
+	Identity  string
+	Operation elemental.Operation
+	Version   int
+}
+
+// newRequestMetricsInfo returns the RequestMetricsInfo for the given request.
+func newRequestMetricsInfo(request *elemental.Request) *RequestMetricsInfo {
+
+	return &RequestMetricsInfo{
+		Identity:  request.Identity.Name,
+		Operation: request.Operation,
+		Version:   request.Version,
+	}
+}
+
+// statusClass returns the class of the given status code, like 2xx.
+func statusClass(code int) string {
+
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// Various outcomes of the dispatch of a push event
+// reported to MetricsManager.RegisterPushDispatch.
+const (
+	// PushDispatchOutcomeDispatched is used when the event is sent to a session.
+	PushDispatchOutcomeDispatched = "dispatched"
+
+	// PushDispatchOutcomeDropped is used when the event is dropped because
+	// the queue of a session is full. The events pushed directly to a session,
+	// which are not dispatched, are reported with RegisterPushEventDropped.
+	PushDispatchOutcomeDropped = "dropped"
+
+	// PushDispatchOutcomeFiltered is used when the event is filtered out by the push config
+	// of a session, or when the session started after the event.
+	PushDispatchOutcomeFiltered = "filtered"
+
+	// PushDispatchOutcomeRejected is used when the PushDispatchHandler refused to dispatch
+	// the event to a session.
+	PushDispatchOutcomeRejected = "rejected"
+
+	// PushDispatchOutcomeError is used when an error occurred while preparing the event,
+	// or when the PushDispatchHandler returned an error.
+	PushDispatchOutcomeError = "error"
+
+	// PushDispatchOutcomeDecodeError is used when the publication could not be decoded.
+	PushDispatchOutcomeDecodeError = "decode_error"
 )
 
 // FinishMeasurementFunc is the kind of functinon returned by MetricsManager.MeasureRequest().
-type FinishMeasurementFunc func(code int, span opentracing.Span) time.Duration
+// The info is nil when the request could not be decoded, or when it is not an elemental request.
+type FinishMeasurementFunc func(code int, info *RequestMetricsInfo, span opentracing.Span) time.Duration
 
 // A MetricsManager handles Prometheus Metrics Management
 type MetricsManager interface {
@@ -28,5 +86,55 @@ type MetricsManager interface {
 	UnregisterWSConnection()
 	RegisterTCPConnection()
 	UnregisterTCPConnection()
+	RegisterPushPublication(identity string, eventType string, failed bool)
+	RegisterPushDispatch(outcome string, count int)
+	ObservePushDispatchDuration(duration time.Duration)
+	ObservePushSessionQueueDepth(depth int)
+	RegisterPushEventDropped()
+	ObservePushSessionLifetime(duration time.Duration)
 	Write(w http.ResponseWriter, r *http.Request)
 }
+
+// A RateLimitMetricsManager is a MetricsManager that can also
+// report the requests rejected by the rate limiters. The tier
+// is the name of the tier of the rate limiter that has been
+// applied, or "global" and "api" for the ones set by
+// OptRateLimiting and OptAPIRateLimiting.
+type RateLimitMetricsManager interface {
+	RegisterRateLimitedRequest(tier string)
+}
+
+// registerRateLimitedRequest reports a rate limited request
+// if the given MetricsManager supports it.
+func registerRateLimitedRequest(m MetricsManager, tier string) {
+
+	if rm, ok := m.(RateLimitMetricsManager); ok {
+		rm.RegisterRateLimitedRequest(tier)
+	}
+}
+
+// A ConcurrencyLimitMetricsManager is a MetricsManager that can also
+// report the requests shed by the ConcurrencyLimiter and its current
+// concurrency limit.
+type ConcurrencyLimitMetricsManager interface {
+	RegisterShedRequest(priority string)
+	SetConcurrencyLimit(limit int)
+}
+
+// registerShedRequest reports a shed request
+// if the given MetricsManager supports it.
+func registerShedRequest(m MetricsManager, priority string) {
+
+	if cm, ok := m.(ConcurrencyLimitMetricsManager); ok {
+		cm.RegisterShedRequest(priority)
+	}
+}
+
+// setConcurrencyLimit reports the concurrency limit
+// if the given MetricsManager supports it.
+func setConcurrencyLimit(m MetricsManager, limit int) {
+
+	if cm, ok := m.(ConcurrencyLimitMetricsManager); ok {
+		cm.SetConcurrencyLimit(limit)
+	}
+}
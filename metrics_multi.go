@@ -0,0 +1,147 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"net/http"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+type multiMetricsManager struct {
+	managers []MetricsManager
+}
+
+// NewMultiMetricsManager returns a MetricsManager that forwards
+// all the measurements to the given managers. This allows for
+// instance to export metrics to both Prometheus and OpenTelemetry.
+//
+// The Write method is delegated to the first given manager.
+func NewMultiMetricsManager(managers ...MetricsManager) MetricsManager {
+
+	if len(managers) == 0 {
+		panic("at least one metrics manager must be given")
+	}
+
+	for _, m := range managers {
+		if m == nil {
+			panic("metrics manager must not be nil")
+		}
+	}
+
+	return &multiMetricsManager{
+		managers: managers,
+	}
+}
+
+func (c *multiMetricsManager) MeasureRequest(method string, url string) FinishMeasurementFunc {
+
+	finishers := make([]FinishMeasurementFunc, len(c.managers))
+	for i, m := range c.managers {
+		finishers[i] = m.MeasureRequest(method, url)
+	}
+
+	return func(code int, info *RequestMetricsInfo, span opentracing.Span) time.Duration {
+
+		var d time.Duration
+		for i, f := range finishers {
+			if md := f(code, info, span); i == 0 {
+				d = md
+			}
+		}
+
+		return d
+	}
+}
+
+func (c *multiMetricsManager) RegisterWSConnection() {
+	for _, m := range c.managers {
+		m.RegisterWSConnection()
+	}
+}
+
+func (c *multiMetricsManager) UnregisterWSConnection() {
+	for _, m := range c.managers {
+		m.UnregisterWSConnection()
+	}
+}
+
+func (c *multiMetricsManager) RegisterTCPConnection() {
+	for _, m := range c.managers {
+		m.RegisterTCPConnection()
+	}
+}
+
+func (c *multiMetricsManager) UnregisterTCPConnection() {
+	for _, m := range c.managers {
+		m.UnregisterTCPConnection()
+	}
+}
+
+func (c *multiMetricsManager) RegisterRateLimitedRequest(tier string) {
+	for _, m := range c.managers {
+		registerRateLimitedRequest(m, tier)
+	}
+}
+
+func (c *multiMetricsManager) RegisterShedRequest(priority string) {
+	for _, m := range c.managers {
+		registerShedRequest(m, priority)
+	}
+}
+
+func (c *multiMetricsManager) SetConcurrencyLimit(limit int) {
+	for _, m := range c.managers {
+		setConcurrencyLimit(m, limit)
+	}
+}
+
+func (c *multiMetricsManager) RegisterPushPublication(identity string, eventType string, failed bool) {
+	for _, m := range c.managers {
+		m.RegisterPushPublication(identity, eventType, failed)
+	}
+}
+
+func (c *multiMetricsManager) RegisterPushDispatch(outcome string, count int) {
+	for _, m := range c.managers {
+		m.RegisterPushDispatch(outcome, count)
+	}
+}
+
+func (c *multiMetricsManager) ObservePushDispatchDuration(duration time.Duration) {
+	for _, m := range c.managers {
+		m.ObservePushDispatchDuration(duration)
+	}
+}
+
+func (c *multiMetricsManager) ObservePushSessionQueueDepth(depth int) {
+	for _, m := range c.managers {
+		m.ObservePushSessionQueueDepth(depth)
+	}
+}
+
+func (c *multiMetricsManager) RegisterPushEventDropped() {
+	for _, m := range c.managers {
+		m.RegisterPushEventDropped()
+	}
+}
+
+func (c *multiMetricsManager) ObservePushSessionLifetime(duration time.Duration) {
+	for _, m := range c.managers {
+		m.ObservePushSessionLifetime(duration)
+	}
+}
+
+func (c *multiMetricsManager) Write(w http.ResponseWriter, r *http.Request) {
+	c.managers[0].Write(w, r)
+}
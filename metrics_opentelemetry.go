@@ -0,0 +1,318 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/unit"
+)
+
+type otelMetricsManager struct {
+	reqDuration      instrument.Float64Histogram
+	activeRequests   instrument.Int64UpDownCounter
+	tcpConnTotal     instrument.Int64Counter
+	tcpConnCurrent   instrument.Int64UpDownCounter
+	wsConnTotal      instrument.Int64Counter
+	wsConnCurrent    instrument.Int64UpDownCounter
+	rateLimited      instrument.Int64Counter
+	shed             instrument.Int64Counter
+	pushPublications instrument.Int64Counter
+	pushDispatch     instrument.Int64Counter
+	pushDispatchTime instrument.Float64Histogram
+	pushQueueDepth   instrument.Int64Histogram
+	pushDropped      instrument.Int64Counter
+	pushLifetime     instrument.Float64Histogram
+	concurrencyLimit int64
+	concurrencySet   int32
+	routeLimiter     *labelValueLimiter
+	identityLimiter  *labelValueLimiter
+}
+
+// An OpenTelemetryMetricsManagerOption represents an option
+// that can be passed to NewOpenTelemetryMetricsManager.
+type OpenTelemetryMetricsManagerOption func(*otelMetricsManagerConfig)
+
+type otelMetricsManagerConfig struct {
+	maxLabelValues int
+}
+
+// OpenTelemetryMetricsManagerOptMaxLabelValues sets the maximum number of
+// distinct values the route and identity attributes can take. Once reached,
+// new values are reported as PrometheusMetricsOverflowLabelValue.
+// The default is 256.
+func OpenTelemetryMetricsManagerOptMaxLabelValues(max int) OpenTelemetryMetricsManagerOption {
+	return func(c *otelMetricsManagerConfig) {
+		if max <= 0 {
+			panic("max label values must be greater than 0")
+		}
+		c.maxLabelValues = max
+	}
+}
+
+// NewOpenTelemetryMetricsManager returns a new MetricsManager recording
+// the metrics with the given OpenTelemetry MeterProvider. The request
+// instruments use the names of the HTTP semantic conventions.
+//
+// The exporter is configured on the provider. For instance, to export
+// to stdout:
+//
+//	exporter, _ := stdoutmetric.New()
+//	provider := sdkmetric.NewMeterProvider(
+//	    sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+//	)
+//	bahamut.OptMetricsManager(bahamut.NewOpenTelemetryMetricsManager(provider))
+//
+// The OTLP exporters from go.opentelemetry.io/otel/exporters/otlp can be used
+// the same way. As the metrics are pushed by the exporter, the Write method
+// of the returned MetricsManager does not serve any metrics. To run it side
+// by side with Prometheus, use NewMultiMetricsManager.
+//
+// The cardinality of the route and identity attributes is bounded. See
+// OpenTelemetryMetricsManagerOptMaxLabelValues.
+func NewOpenTelemetryMetricsManager(provider metric.MeterProvider, options ...OpenTelemetryMetricsManagerOption) MetricsManager {
+
+	cfg := otelMetricsManagerConfig{
+		maxLabelValues: 256,
+	}
+
+	for _, opt := range options {
+		opt(&cfg)
+	}
+
+	meter := provider.Meter(otelInstrumentationName)
+
+	mc := &otelMetricsManager{
+		routeLimiter:    newLabelValueLimiter(cfg.maxLabelValues),
+		identityLimiter: newLabelValueLimiter(cfg.maxLabelValues),
+	}
+
+	mc.reqDuration = mustOTelInstrument(meter.Float64Histogram(
+		"http.server.duration",
+		instrument.WithUnit(string(unit.Milliseconds)),
+		instrument.WithDescription("The duration of the inbound HTTP requests."),
+	))
+
+	mc.activeRequests = mustOTelInstrument(meter.Int64UpDownCounter(
+		"http.server.active_requests",
+		instrument.WithUnit("{request}"),
+		instrument.WithDescription("The number of concurrent HTTP requests that are currently in-flight."),
+	))
+
+	mc.tcpConnTotal = mustOTelInstrument(meter.Int64Counter(
+		"bahamut.tcp.connections",
+		instrument.WithUnit("{connection}"),
+		instrument.WithDescription("The total number of TCP connections."),
+	))
+
+	mc.tcpConnCurrent = mustOTelInstrument(meter.Int64UpDownCounter(
+		"bahamut.tcp.active_connections",
+		instrument.WithUnit("{connection}"),
+		instrument.WithDescription("The current number of TCP connections."),
+	))
+
+	mc.wsConnTotal = mustOTelInstrument(meter.Int64Counter(
+		"bahamut.ws.connections",
+		instrument.WithUnit("{connection}"),
+		instrument.WithDescription("The total number of websocket connections."),
+	))
+
+	mc.wsConnCurrent = mustOTelInstrument(meter.Int64UpDownCounter(
+		"bahamut.ws.active_connections",
+		instrument.WithUnit("{connection}"),
+		instrument.WithDescription("The current number of websocket connections."),
+	))
+
+	mc.rateLimited = mustOTelInstrument(meter.Int64Counter(
+		"bahamut.http.server.rate_limited",
+		instrument.WithUnit("{request}"),
+		instrument.WithDescription("The total number of rate limited requests."),
+	))
+
+	mc.shed = mustOTelInstrument(meter.Int64Counter(
+		"bahamut.http.server.shed",
+		instrument.WithUnit("{request}"),
+		instrument.WithDescription("The total number of requests shed by the concurrency limiter."),
+	))
+
+	mc.pushPublications = mustOTelInstrument(meter.Int64Counter(
+		"bahamut.push.published",
+		instrument.WithUnit("{event}"),
+		instrument.WithDescription("The total number of push events published."),
+	))
+
+	mc.pushDispatch = mustOTelInstrument(meter.Int64Counter(
+		"bahamut.push.dispatch.decisions",
+		instrument.WithUnit("{decision}"),
+		instrument.WithDescription("The total number of push events dispatch decisions, per outcome."),
+	))
+
+	mc.pushDispatchTime = mustOTelInstrument(meter.Float64Histogram(
+		"bahamut.push.dispatch.duration",
+		instrument.WithUnit(string(unit.Milliseconds)),
+		instrument.WithDescription("The duration of the fan-out of a push event to all sessions."),
+	))
+
+	mc.pushQueueDepth = mustOTelInstrument(meter.Int64Histogram(
+		"bahamut.push.session.queue_depth",
+		instrument.WithUnit("{event}"),
+		instrument.WithDescription("The depth of the queue of a push session when an event is enqueued."),
+	))
+
+	mc.pushDropped = mustOTelInstrument(meter.Int64Counter(
+		"bahamut.push.dropped",
+		instrument.WithUnit("{event}"),
+		instrument.WithDescription("The total number of push events sent directly to a session and dropped because of slow consumers."),
+	))
+
+	mc.pushLifetime = mustOTelInstrument(meter.Float64Histogram(
+		"bahamut.push.session.duration",
+		instrument.WithUnit("s"),
+		instrument.WithDescription("The lifetime of the push sessions."),
+	))
+
+	concurrencyGauge := mustOTelInstrument(meter.Int64ObservableGauge(
+		"bahamut.http.server.concurrency_limit",
+		instrument.WithUnit("{request}"),
+		instrument.WithDescription("The current concurrency limit."),
+	))
+
+	_ = mustOTelInstrument(meter.RegisterCallback(
+		func(ctx context.Context, o metric.Observer) error {
+			// Only report the limit when a concurrency limiter is in use.
+			if atomic.LoadInt32(&mc.concurrencySet) == 1 {
+				o.ObserveInt64(concurrencyGauge, atomic.LoadInt64(&mc.concurrencyLimit))
+			}
+			return nil
+		},
+		concurrencyGauge,
+	))
+
+	return mc
+}
+
+func mustOTelInstrument[T any](i T, err error) T {
+
+	if err != nil {
+		panic(err)
+	}
+
+	return i
+}
+
+func (c *otelMetricsManager) MeasureRequest(method string, url string) FinishMeasurementFunc {
+
+	ctx := context.Background()
+	start := time.Now()
+
+	route := c.routeLimiter.limit(sanitizeURL(url))
+	methodAttr := attribute.String("http.method", method)
+
+	c.activeRequests.Add(ctx, 1, methodAttr)
+
+	return func(code int, info *RequestMetricsInfo, span opentracing.Span) time.Duration {
+
+		d := time.Since(start)
+
+		attrs := []attribute.KeyValue{
+			methodAttr,
+			attribute.String("http.route", route),
+			attribute.Int("http.status_code", code),
+			attribute.String("bahamut.http.status_class", statusClass(code)),
+		}
+
+		if info != nil {
+			attrs = append(attrs,
+				attribute.String("bahamut.request.identity", c.identityLimiter.limit(info.Identity)),
+				attribute.String("bahamut.request.operation", string(info.Operation)),
+				attribute.Int("bahamut.request.api_version", info.Version),
+			)
+		}
+
+		c.activeRequests.Add(ctx, -1, methodAttr)
+		c.reqDuration.Record(ctx, float64(d)/float64(time.Millisecond), attrs...)
+
+		return d
+	}
+}
+
+func (c *otelMetricsManager) RegisterWSConnection() {
+	c.wsConnTotal.Add(context.Background(), 1)
+	c.wsConnCurrent.Add(context.Background(), 1)
+}
+
+func (c *otelMetricsManager) UnregisterWSConnection() {
+	c.wsConnCurrent.Add(context.Background(), -1)
+}
+
+func (c *otelMetricsManager) RegisterTCPConnection() {
+	c.tcpConnTotal.Add(context.Background(), 1)
+	c.tcpConnCurrent.Add(context.Background(), 1)
+}
+
+func (c *otelMetricsManager) UnregisterTCPConnection() {
+	c.tcpConnCurrent.Add(context.Background(), -1)
+}
+
+func (c *otelMetricsManager) RegisterRateLimitedRequest(tier string) {
+	c.rateLimited.Add(context.Background(), 1, attribute.String("bahamut.rate_limit.tier", tier))
+}
+
+func (c *otelMetricsManager) RegisterShedRequest(priority string) {
+	c.shed.Add(context.Background(), 1, attribute.String("bahamut.request.priority", priority))
+}
+
+func (c *otelMetricsManager) SetConcurrencyLimit(limit int) {
+	atomic.StoreInt64(&c.concurrencyLimit, int64(limit))
+	atomic.StoreInt32(&c.concurrencySet, 1)
+}
+
+func (c *otelMetricsManager) RegisterPushPublication(identity string, eventType string, failed bool) {
+	c.pushPublications.Add(
+		context.Background(),
+		1,
+		attribute.String("bahamut.event.identity", c.identityLimiter.limit(identity)),
+		attribute.String("bahamut.event.type", eventType),
+		attribute.Bool("bahamut.event.failed", failed),
+	)
+}
+
+func (c *otelMetricsManager) RegisterPushDispatch(outcome string, count int) {
+	c.pushDispatch.Add(context.Background(), int64(count), attribute.String("bahamut.push.outcome", outcome))
+}
+
+func (c *otelMetricsManager) ObservePushDispatchDuration(duration time.Duration) {
+	c.pushDispatchTime.Record(context.Background(), float64(duration)/float64(time.Millisecond))
+}
+
+func (c *otelMetricsManager) ObservePushSessionQueueDepth(depth int) {
+	c.pushQueueDepth.Record(context.Background(), int64(depth))
+}
+
+func (c *otelMetricsManager) RegisterPushEventDropped() {
+	c.pushDropped.Add(context.Background(), 1)
+}
+
+func (c *otelMetricsManager) ObservePushSessionLifetime(duration time.Duration) {
+	c.pushLifetime.Record(context.Background(), duration.Seconds())
+}
+
+func (c *otelMetricsManager) Write(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "metrics are exported through OpenTelemetry", http.StatusNotImplemented)
+}
@@ -0,0 +1,318 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/elemental"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func collectOTelMetrics(reader sdkmetric.Reader) map[string]metricdata.Aggregation {
+
+	rm := metricdata.ResourceMetrics{}
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		panic(err)
+	}
+
+	out := map[string]metricdata.Aggregation{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			out[m.Name] = m.Data
+		}
+	}
+
+	return out
+}
+
+func TestOpenTelemetryMetrics_MeasureRequest(t *testing.T) {
+
+	Convey("Given I have an otel metrics manager", t, func() {
+
+		reader := sdkmetric.NewManualReader()
+		pmm := NewOpenTelemetryMetricsManager(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+		Convey("When I call measure a request that succeeds", func() {
+
+			f := pmm.MeasureRequest("GET", "/v/1/toto/xxxxxxx")
+
+			data := collectOTelMetrics(reader)
+			active := data["http.server.active_requests"].(metricdata.Sum[int64])
+
+			Convey("Then the request should be active", func() {
+				So(len(active.DataPoints), ShouldEqual, 1)
+				So(active.DataPoints[0].Value, ShouldEqual, 1)
+			})
+
+			Convey("When I finish the measurement", func() {
+
+				f(201, &RequestMetricsInfo{Identity: "toto", Operation: elemental.OperationRetrieve, Version: 1}, nil)
+
+				data := collectOTelMetrics(reader)
+				active := data["http.server.active_requests"].(metricdata.Sum[int64])
+				duration := data["http.server.duration"].(metricdata.Histogram)
+
+				Convey("Then the request should not be active anymore", func() {
+					So(active.DataPoints[0].Value, ShouldEqual, 0)
+				})
+
+				Convey("Then the duration should be recorded", func() {
+					So(len(duration.DataPoints), ShouldEqual, 1)
+					So(duration.DataPoints[0].Count, ShouldEqual, 1)
+
+					attrs := duration.DataPoints[0].Attributes
+					v, _ := attrs.Value(attribute.Key("http.method"))
+					So(v.AsString(), ShouldEqual, "GET")
+					v, _ = attrs.Value(attribute.Key("http.route"))
+					So(v.AsString(), ShouldEqual, "/toto/:id")
+					v, _ = attrs.Value(attribute.Key("http.status_code"))
+					So(v.AsInt64(), ShouldEqual, 201)
+					v, _ = attrs.Value(attribute.Key("bahamut.http.status_class"))
+					So(v.AsString(), ShouldEqual, "2xx")
+					v, _ = attrs.Value(attribute.Key("bahamut.request.identity"))
+					So(v.AsString(), ShouldEqual, "toto")
+					v, _ = attrs.Value(attribute.Key("bahamut.request.operation"))
+					So(v.AsString(), ShouldEqual, "retrieve")
+					v, _ = attrs.Value(attribute.Key("bahamut.request.api_version"))
+					So(v.AsInt64(), ShouldEqual, 1)
+				})
+			})
+		})
+	})
+}
+
+func TestOpenTelemetryMetrics_MaxLabelValues(t *testing.T) {
+
+	Convey("Given I have an otel metrics manager with a max label values", t, func() {
+
+		reader := sdkmetric.NewManualReader()
+		pmm := NewOpenTelemetryMetricsManager(
+			sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			OpenTelemetryMetricsManagerOptMaxLabelValues(1),
+		)
+
+		Convey("When I measure requests on more routes and identities than allowed", func() {
+
+			pmm.MeasureRequest("GET", "/toto")(200, &RequestMetricsInfo{Identity: "toto"}, nil)
+			pmm.MeasureRequest("GET", "/titi")(200, &RequestMetricsInfo{Identity: "titi"}, nil)
+
+			duration := collectOTelMetrics(reader)["http.server.duration"].(metricdata.Histogram)
+
+			Convey("Then the extra values should go in the overflow bucket", func() {
+
+				routes := map[string]string{}
+				for _, dp := range duration.DataPoints {
+					route, _ := dp.Attributes.Value(attribute.Key("http.route"))
+					identity, _ := dp.Attributes.Value(attribute.Key("bahamut.request.identity"))
+					routes[route.AsString()] = identity.AsString()
+				}
+
+				So(routes, ShouldResemble, map[string]string{
+					"/toto":                             "toto",
+					PrometheusMetricsOverflowLabelValue: PrometheusMetricsOverflowLabelValue,
+				})
+			})
+		})
+	})
+
+	Convey("Given I pass an invalid max label values", t, func() {
+		So(func() { OpenTelemetryMetricsManagerOptMaxLabelValues(0)(&otelMetricsManagerConfig{}) }, ShouldPanicWith, "max label values must be greater than 0")
+	})
+}
+
+func TestOpenTelemetryMetrics_Connections(t *testing.T) {
+
+	Convey("Given I have an otel metrics manager", t, func() {
+
+		reader := sdkmetric.NewManualReader()
+		pmm := NewOpenTelemetryMetricsManager(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+		Convey("When I register and unregister connections", func() {
+
+			pmm.RegisterTCPConnection()
+			pmm.RegisterTCPConnection()
+			pmm.UnregisterTCPConnection()
+			pmm.RegisterWSConnection()
+			pmm.UnregisterWSConnection()
+
+			data := collectOTelMetrics(reader)
+
+			Convey("Then the metrics should be correct", func() {
+				So(data["bahamut.tcp.connections"].(metricdata.Sum[int64]).DataPoints[0].Value, ShouldEqual, 2)
+				So(data["bahamut.tcp.active_connections"].(metricdata.Sum[int64]).DataPoints[0].Value, ShouldEqual, 1)
+				So(data["bahamut.ws.connections"].(metricdata.Sum[int64]).DataPoints[0].Value, ShouldEqual, 1)
+				So(data["bahamut.ws.active_connections"].(metricdata.Sum[int64]).DataPoints[0].Value, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestOpenTelemetryMetrics_Limiters(t *testing.T) {
+
+	Convey("Given I have an otel metrics manager", t, func() {
+
+		reader := sdkmetric.NewManualReader()
+		pmm := NewOpenTelemetryMetricsManager(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+		Convey("When I did not set any concurrency limit", func() {
+
+			data := collectOTelMetrics(reader)
+
+			Convey("Then the limit should not be reported", func() {
+				_, ok := data["bahamut.http.server.concurrency_limit"]
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When I register limited requests and set the concurrency limit", func() {
+
+			pmm.(RateLimitMetricsManager).RegisterRateLimitedRequest("global")
+			pmm.(ConcurrencyLimitMetricsManager).RegisterShedRequest("low")
+			pmm.(ConcurrencyLimitMetricsManager).RegisterShedRequest("low")
+			pmm.(ConcurrencyLimitMetricsManager).SetConcurrencyLimit(42)
+
+			data := collectOTelMetrics(reader)
+
+			Convey("Then the metrics should be correct", func() {
+
+				rl := data["bahamut.http.server.rate_limited"].(metricdata.Sum[int64]).DataPoints[0]
+				So(rl.Value, ShouldEqual, 1)
+				v, _ := rl.Attributes.Value(attribute.Key("bahamut.rate_limit.tier"))
+				So(v.AsString(), ShouldEqual, "global")
+
+				shed := data["bahamut.http.server.shed"].(metricdata.Sum[int64]).DataPoints[0]
+				So(shed.Value, ShouldEqual, 2)
+				v, _ = shed.Attributes.Value(attribute.Key("bahamut.request.priority"))
+				So(v.AsString(), ShouldEqual, "low")
+
+				So(data["bahamut.http.server.concurrency_limit"].(metricdata.Gauge[int64]).DataPoints[0].Value, ShouldEqual, 42)
+			})
+		})
+	})
+}
+
+func TestOpenTelemetryMetrics_Push(t *testing.T) {
+
+	Convey("Given I have an otel metrics manager", t, func() {
+
+		reader := sdkmetric.NewManualReader()
+		pmm := NewOpenTelemetryMetricsManager(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+		Convey("When I register some push metrics", func() {
+
+			pmm.RegisterPushPublication("list", "create", false)
+			pmm.RegisterPushDispatch(PushDispatchOutcomeDispatched, 4)
+			pmm.ObservePushDispatchDuration(time.Millisecond)
+			pmm.ObservePushSessionQueueDepth(3)
+			pmm.RegisterPushEventDropped()
+			pmm.ObservePushSessionLifetime(time.Minute)
+
+			data := collectOTelMetrics(reader)
+
+			Convey("Then the metrics should be correct", func() {
+
+				pub := data["bahamut.push.published"].(metricdata.Sum[int64]).DataPoints[0]
+				So(pub.Value, ShouldEqual, 1)
+				v, _ := pub.Attributes.Value(attribute.Key("bahamut.event.identity"))
+				So(v.AsString(), ShouldEqual, "list")
+
+				dispatch := data["bahamut.push.dispatch.decisions"].(metricdata.Sum[int64]).DataPoints[0]
+				So(dispatch.Value, ShouldEqual, 4)
+				v, _ = dispatch.Attributes.Value(attribute.Key("bahamut.push.outcome"))
+				So(v.AsString(), ShouldEqual, "dispatched")
+
+				So(data["bahamut.push.dispatch.duration"].(metricdata.Histogram).DataPoints[0].Count, ShouldEqual, 1)
+				So(data["bahamut.push.session.queue_depth"].(metricdata.Histogram).DataPoints[0].Sum, ShouldEqual, 3)
+				So(data["bahamut.push.dropped"].(metricdata.Sum[int64]).DataPoints[0].Value, ShouldEqual, 1)
+				So(data["bahamut.push.session.duration"].(metricdata.Histogram).DataPoints[0].Sum, ShouldEqual, 60)
+			})
+		})
+	})
+}
+
+func TestOpenTelemetryMetrics_Write(t *testing.T) {
+
+	Convey("Given I have an otel metrics manager", t, func() {
+
+		pmm := NewOpenTelemetryMetricsManager(sdkmetric.NewMeterProvider())
+
+		Convey("When I call Write", func() {
+
+			w := httptest.NewRecorder()
+			pmm.Write(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+			Convey("Then the response should be not implemented", func() {
+				So(w.Code, ShouldEqual, http.StatusNotImplemented)
+			})
+		})
+	})
+}
+
+func TestMultiMetricsManager(t *testing.T) {
+
+	Convey("Given I have a multi metrics manager", t, func() {
+
+		r1 := sdkmetric.NewManualReader()
+		r2 := sdkmetric.NewManualReader()
+		m1 := NewOpenTelemetryMetricsManager(sdkmetric.NewMeterProvider(sdkmetric.WithReader(r1)))
+		m2 := NewOpenTelemetryMetricsManager(sdkmetric.NewMeterProvider(sdkmetric.WithReader(r2)))
+
+		mm := NewMultiMetricsManager(m1, m2)
+
+		Convey("When I record some metrics", func() {
+
+			mm.MeasureRequest("GET", "/toto")(200, nil, nil)
+			mm.RegisterTCPConnection()
+			mm.UnregisterTCPConnection()
+			mm.RegisterWSConnection()
+			mm.UnregisterWSConnection()
+			mm.(RateLimitMetricsManager).RegisterRateLimitedRequest("api")
+			mm.(ConcurrencyLimitMetricsManager).RegisterShedRequest("normal")
+			mm.(ConcurrencyLimitMetricsManager).SetConcurrencyLimit(10)
+
+			Convey("Then all managers should have received them", func() {
+				for _, r := range []sdkmetric.Reader{r1, r2} {
+					data := collectOTelMetrics(r)
+					So(data["http.server.duration"].(metricdata.Histogram).DataPoints[0].Count, ShouldEqual, 1)
+					So(data["bahamut.tcp.connections"].(metricdata.Sum[int64]).DataPoints[0].Value, ShouldEqual, 1)
+					So(data["bahamut.ws.connections"].(metricdata.Sum[int64]).DataPoints[0].Value, ShouldEqual, 1)
+					So(data["bahamut.http.server.rate_limited"].(metricdata.Sum[int64]).DataPoints[0].Value, ShouldEqual, 1)
+					So(data["bahamut.http.server.shed"].(metricdata.Sum[int64]).DataPoints[0].Value, ShouldEqual, 1)
+					So(data["bahamut.http.server.concurrency_limit"].(metricdata.Gauge[int64]).DataPoints[0].Value, ShouldEqual, 10)
+				}
+			})
+		})
+
+		Convey("When I call Write", func() {
+
+			w := httptest.NewRecorder()
+			mm.Write(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+			Convey("Then it should be delegated to the first manager", func() {
+				So(w.Code, ShouldEqual, http.StatusNotImplemented)
+			})
+		})
+	})
+
+	Convey("Given I create a multi metrics manager without managers", t, func() {
+		So(func() { NewMultiMetricsManager() }, ShouldPanicWith, "at least one metrics manager must be given")
+		So(func() { NewMultiMetricsManager(nil) }, ShouldPanicWith, "metrics manager must not be nil")
+	})
+}
@@ -16,6 +16,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
@@ -39,27 +40,147 @@ func sanitizeURL(url string) string {
 	return strings.Join(parts, "/")
 }
 
+const (
+	// PrometheusMetricsOverflowLabelValue is the label value used in place
+	// of the actual value once a label reached its maximum cardinality.
+	PrometheusMetricsOverflowLabelValue = "_overflow"
+
+	prometheusMetricsUnknownLabelValue = "unknown"
+)
+
+// A PrometheusMetricsManagerOption represents an option
+// that can be passed to NewPrometheusMetricsManager.
+type PrometheusMetricsManagerOption func(*prometheusMetricsManagerConfig)
+
+type prometheusMetricsManagerConfig struct {
+	durationBuckets []float64
+	maxLabelValues  int
+}
+
+// PrometheusMetricsManagerOptDurationBuckets sets the buckets of the
+// request duration histogram, in seconds.
+// The default is prometheus.DefBuckets.
+func PrometheusMetricsManagerOptDurationBuckets(buckets []float64) PrometheusMetricsManagerOption {
+	return func(c *prometheusMetricsManagerConfig) {
+		if len(buckets) == 0 {
+			panic("buckets must not be empty")
+		}
+		c.durationBuckets = buckets
+	}
+}
+
+// PrometheusMetricsManagerOptMaxLabelValues sets the maximum number of
+// distinct values a request label can take. Once reached, new values
+// are reported as PrometheusMetricsOverflowLabelValue.
+// The default is 256.
+func PrometheusMetricsManagerOptMaxLabelValues(max int) PrometheusMetricsManagerOption {
+	return func(c *prometheusMetricsManagerConfig) {
+		if max <= 0 {
+			panic("max label values must be greater than 0")
+		}
+		c.maxLabelValues = max
+	}
+}
+
+// A labelValueLimiter bounds the number of distinct values of a label.
+type labelValueLimiter struct {
+	max    int
+	values map[string]struct{}
+	sync.RWMutex
+}
+
+func newLabelValueLimiter(max int) *labelValueLimiter {
+	return &labelValueLimiter{
+		max:    max,
+		values: map[string]struct{}{},
+	}
+}
+
+// limit returns the value if it has already been seen or if the
+// maximum cardinality has not been reached yet. Otherwise it
+// returns PrometheusMetricsOverflowLabelValue.
+func (l *labelValueLimiter) limit(value string) string {
+
+	l.RLock()
+	_, ok := l.values[value]
+	l.RUnlock()
+
+	if ok {
+		return value
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if _, ok := l.values[value]; ok {
+		return value
+	}
+
+	if len(l.values) >= l.max {
+		return PrometheusMetricsOverflowLabelValue
+	}
+
+	l.values[value] = struct{}{}
+
+	return value
+}
+
 type prometheusMetricsManager struct {
-	reqDurationMetric    *prometheus.SummaryVec
+	reqDurationMetric    *prometheus.HistogramVec
 	reqTotalMetric       *prometheus.CounterVec
 	errorMetric          *prometheus.CounterVec
 	tcpConnTotalMetric   prometheus.Counter
 	tcpConnCurrentMetric prometheus.Gauge
 	wsConnTotalMetric    prometheus.Counter
 	wsConnCurrentMetric  prometheus.Gauge
+	rateLimitedMetric    *prometheus.CounterVec
+	shedMetric           *prometheus.CounterVec
+	concurrencyMetric    prometheus.Gauge
+
+	pushPublicationsMetric     *prometheus.CounterVec
+	pushDispatchMetric         *prometheus.CounterVec
+	pushDispatchDurationMetric prometheus.Histogram
+	pushQueueDepthMetric       prometheus.Histogram
+	pushDroppedMetric          prometheus.Counter
+	pushSessionLifetimeMetric  prometheus.Histogram
+
+	urlLimiter      *labelValueLimiter
+	identityLimiter *labelValueLimiter
+
+	registerer          prometheus.Registerer
+	concurrencyRegister sync.Once
 
 	handler http.Handler
 }
 
 // NewPrometheusMetricsManager returns a new MetricManager using the prometheus format.
-func NewPrometheusMetricsManager() MetricsManager {
+//
+// The request durations are reported by identity, operation, API version and
+// status class in the http_requests_duration_seconds histogram. The request
+// counts are reported by method, url and code in http_requests_total.
+// The cardinality of the url and identity labels is bounded. See
+// PrometheusMetricsManagerOptMaxLabelValues.
+func NewPrometheusMetricsManager(options ...PrometheusMetricsManagerOption) MetricsManager {
 
-	return newPrometheusMetricsManager(prometheus.DefaultRegisterer)
+	return newPrometheusMetricsManager(prometheus.DefaultRegisterer, options...)
 }
 
-func newPrometheusMetricsManager(registerer prometheus.Registerer) MetricsManager {
+func newPrometheusMetricsManager(registerer prometheus.Registerer, options ...PrometheusMetricsManagerOption) MetricsManager {
+
+	cfg := prometheusMetricsManagerConfig{
+		durationBuckets: prometheus.DefBuckets,
+		maxLabelValues:  256,
+	}
+
+	for _, opt := range options {
+		opt(&cfg)
+	}
+
 	mc := &prometheusMetricsManager{
-		handler: promhttp.Handler(),
+		handler:         promhttp.Handler(),
+		registerer:      registerer,
+		urlLimiter:      newLabelValueLimiter(cfg.maxLabelValues),
+		identityLimiter: newLabelValueLimiter(cfg.maxLabelValues),
 		reqTotalMetric: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "http_requests_total",
@@ -67,13 +188,13 @@ func newPrometheusMetricsManager(registerer prometheus.Registerer) MetricsManage
 			},
 			[]string{"method", "url", "code"},
 		),
-		reqDurationMetric: prometheus.NewSummaryVec(
-			prometheus.SummaryOpts{
-				Name:       "http_requests_duration_seconds",
-				Help:       "The average duration of the requests",
-				Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		reqDurationMetric: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_requests_duration_seconds",
+				Help:    "The duration of the requests.",
+				Buckets: cfg.durationBuckets,
 			},
-			[]string{"method", "url"},
+			[]string{"method", "identity", "operation", "version", "status_class"},
 		),
 		tcpConnTotalMetric: prometheus.NewCounter(
 			prometheus.CounterOpts{
@@ -106,6 +227,67 @@ func newPrometheusMetricsManager(registerer prometheus.Registerer) MetricsManage
 			},
 			[]string{"trace", "method", "url", "code"},
 		),
+		rateLimitedMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_requests_rate_limited_total",
+				Help: "The total number of rate limited requests.",
+			},
+			[]string{"tier"},
+		),
+		shedMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_requests_shed_total",
+				Help: "The total number of requests shed by the concurrency limiter.",
+			},
+			[]string{"priority"},
+		),
+		concurrencyMetric: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "http_requests_concurrency_limit",
+				Help: "The current concurrency limit.",
+			},
+		),
+		pushPublicationsMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ws_push_events_published_total",
+				Help: "The total number of push events published.",
+			},
+			[]string{"identity", "type", "status"},
+		),
+		pushDispatchMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ws_push_dispatch_total",
+				Help: "The total number of push events dispatch decisions, per outcome.",
+			},
+			[]string{"outcome"},
+		),
+		pushDispatchDurationMetric: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "ws_push_dispatch_duration_seconds",
+				Help:    "The duration of the fan-out of a push event to all sessions.",
+				Buckets: cfg.durationBuckets,
+			},
+		),
+		pushQueueDepthMetric: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "ws_push_session_queue_depth",
+				Help:    "The depth of the queue of a push session when an event is enqueued.",
+				Buckets: []float64{0, 1, 2, 4, 8, 16, 32, 48, 64},
+			},
+		),
+		pushDroppedMetric: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "ws_push_events_dropped_total",
+				Help: "The total number of push events sent directly to a session and dropped because of slow consumers.",
+			},
+		),
+		pushSessionLifetimeMetric: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "ws_push_session_lifetime_seconds",
+				Help:    "The lifetime of the push sessions.",
+				Buckets: []float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600},
+			},
+		),
 	}
 
 	registerer.MustRegister(mc.tcpConnCurrentMetric)
@@ -115,28 +297,42 @@ func newPrometheusMetricsManager(registerer prometheus.Registerer) MetricsManage
 	registerer.MustRegister(mc.wsConnTotalMetric)
 	registerer.MustRegister(mc.wsConnCurrentMetric)
 	registerer.MustRegister(mc.errorMetric)
+	registerer.MustRegister(mc.rateLimitedMetric)
+	registerer.MustRegister(mc.shedMetric)
+	registerer.MustRegister(mc.pushPublicationsMetric)
+	registerer.MustRegister(mc.pushDispatchMetric)
+	registerer.MustRegister(mc.pushDispatchDurationMetric)
+	registerer.MustRegister(mc.pushQueueDepthMetric)
+	registerer.MustRegister(mc.pushDroppedMetric)
+	registerer.MustRegister(mc.pushSessionLifetimeMetric)
 
 	return mc
 }
 
 func (c *prometheusMetricsManager) MeasureRequest(method string, url string) FinishMeasurementFunc {
 
-	surl := sanitizeURL(url)
+	surl := c.urlLimiter.limit(sanitizeURL(url))
 
-	timer := prometheus.NewTimer(
-		prometheus.ObserverFunc(
-			func(v float64) {
-				c.reqDurationMetric.With(
-					prometheus.Labels{
-						"method": method,
-						"url":    surl,
-					},
-				).Observe(v)
-			},
-		),
-	)
+	start := time.Now()
+
+	return func(code int, info *RequestMetricsInfo, span opentracing.Span) time.Duration {
 
-	return func(code int, span opentracing.Span) time.Duration {
+		d := time.Since(start)
+
+		identity, operation, version := prometheusMetricsUnknownLabelValue, prometheusMetricsUnknownLabelValue, prometheusMetricsUnknownLabelValue
+		if info != nil {
+			identity = c.identityLimiter.limit(info.Identity)
+			operation = string(info.Operation)
+			version = strconv.Itoa(info.Version)
+		}
+
+		c.reqDurationMetric.With(prometheus.Labels{
+			"method":       method,
+			"identity":     identity,
+			"operation":    operation,
+			"version":      version,
+			"status_class": statusClass(code),
+		}).Observe(d.Seconds())
 
 		c.reqTotalMetric.With(prometheus.Labels{
 			"method": method,
@@ -154,7 +350,7 @@ func (c *prometheusMetricsManager) MeasureRequest(method string, url string) Fin
 			}).Inc()
 		}
 
-		return timer.ObserveDuration()
+		return d
 	}
 }
 
@@ -176,6 +372,55 @@ func (c *prometheusMetricsManager) UnregisterTCPConnection() {
 	c.tcpConnCurrentMetric.Dec()
 }
 
+func (c *prometheusMetricsManager) RegisterRateLimitedRequest(tier string) {
+	c.rateLimitedMetric.WithLabelValues(tier).Inc()
+}
+
+func (c *prometheusMetricsManager) RegisterShedRequest(priority string) {
+	c.shedMetric.WithLabelValues(priority).Inc()
+}
+
+func (c *prometheusMetricsManager) SetConcurrencyLimit(limit int) {
+	// The gauge is only registered when a concurrency limiter
+	// is in use, so it does not report a limit of 0 otherwise.
+	c.concurrencyRegister.Do(func() { c.registerer.MustRegister(c.concurrencyMetric) })
+	c.concurrencyMetric.Set(float64(limit))
+}
+
+func (c *prometheusMetricsManager) RegisterPushPublication(identity string, eventType string, failed bool) {
+
+	status := "success"
+	if failed {
+		status = "failure"
+	}
+
+	c.pushPublicationsMetric.With(prometheus.Labels{
+		"identity": c.identityLimiter.limit(identity),
+		"type":     eventType,
+		"status":   status,
+	}).Inc()
+}
+
+func (c *prometheusMetricsManager) RegisterPushDispatch(outcome string, count int) {
+	c.pushDispatchMetric.WithLabelValues(outcome).Add(float64(count))
+}
+
+func (c *prometheusMetricsManager) ObservePushDispatchDuration(duration time.Duration) {
+	c.pushDispatchDurationMetric.Observe(duration.Seconds())
+}
+
+func (c *prometheusMetricsManager) ObservePushSessionQueueDepth(depth int) {
+	c.pushQueueDepthMetric.Observe(float64(depth))
+}
+
+func (c *prometheusMetricsManager) RegisterPushEventDropped() {
+	c.pushDroppedMetric.Inc()
+}
+
+func (c *prometheusMetricsManager) ObservePushSessionLifetime(duration time.Duration) {
+	c.pushSessionLifetimeMetric.Observe(duration.Seconds())
+}
+
 func (c *prometheusMetricsManager) Write(w http.ResponseWriter, r *http.Request) {
 	c.handler.ServeHTTP(w, r)
 }
@@ -13,9 +13,11 @@ package bahamut
 
 import (
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/elemental"
 )
 
 func Test_sanitizeURL(t *testing.T) {
@@ -89,7 +91,7 @@ func TestMeasureRequest(t *testing.T) {
 		Convey("When I call measure a valid request", func() {
 
 			f := pmm.MeasureRequest("GET", "/toto/id")
-			f(200, nil)
+			f(200, nil, nil)
 
 			data, _ := r.Gather()
 
@@ -105,7 +107,7 @@ func TestMeasureRequest(t *testing.T) {
 		Convey("When I call measure a 502 request", func() {
 
 			f := pmm.MeasureRequest("GET", "http://toto.com/id/toto")
-			f(502, nil)
+			f(502, nil, nil)
 
 			data, _ := r.Gather()
 
@@ -120,6 +122,108 @@ func TestMeasureRequest(t *testing.T) {
 	})
 }
 
+func TestMeasureRequestWithInfo(t *testing.T) {
+
+	Convey("Given I have a PrometheusMetricsManager with custom buckets", t, func() {
+
+		r := prometheus.NewRegistry()
+		pmm := newPrometheusMetricsManager(
+			r,
+			PrometheusMetricsManagerOptDurationBuckets([]float64{0.1, 1}),
+		).(*prometheusMetricsManager)
+
+		Convey("When I call measure a request with info", func() {
+
+			f := pmm.MeasureRequest("GET", "/v/1/lists/xxx")
+			f(204, &RequestMetricsInfo{Identity: "list", Operation: elemental.OperationRetrieve, Version: 1}, nil)
+
+			data, _ := r.Gather()
+
+			Convey("Then the duration should be collected in the histogram", func() {
+				So(data[0].GetName(), ShouldEqual, "http_requests_duration_seconds")
+				So(data[0].GetMetric()[0].Histogram.GetSampleCount(), ShouldEqual, 1)
+				So(len(data[0].GetMetric()[0].Histogram.GetBucket()), ShouldEqual, 2)
+				So(data[0].GetMetric()[0].Histogram.GetBucket()[1].GetUpperBound(), ShouldEqual, 1)
+				So(data[0].GetMetric()[0].Label[0].String(), ShouldEqual, `name:"identity" value:"list" `)
+				So(data[0].GetMetric()[0].Label[1].String(), ShouldEqual, `name:"method" value:"GET" `)
+				So(data[0].GetMetric()[0].Label[2].String(), ShouldEqual, `name:"operation" value:"retrieve" `)
+				So(data[0].GetMetric()[0].Label[3].String(), ShouldEqual, `name:"status_class" value:"2xx" `)
+				So(data[0].GetMetric()[0].Label[4].String(), ShouldEqual, `name:"version" value:"1" `)
+			})
+		})
+
+		Convey("When I call measure a request without info", func() {
+
+			f := pmm.MeasureRequest("GET", "/lists")
+			f(400, nil, nil)
+
+			data, _ := r.Gather()
+
+			Convey("Then the labels should be unknown", func() {
+				So(data[0].GetName(), ShouldEqual, "http_requests_duration_seconds")
+				So(data[0].GetMetric()[0].Label[0].String(), ShouldEqual, `name:"identity" value:"unknown" `)
+				So(data[0].GetMetric()[0].Label[2].String(), ShouldEqual, `name:"operation" value:"unknown" `)
+				So(data[0].GetMetric()[0].Label[3].String(), ShouldEqual, `name:"status_class" value:"4xx" `)
+				So(data[0].GetMetric()[0].Label[4].String(), ShouldEqual, `name:"version" value:"unknown" `)
+			})
+		})
+	})
+
+	Convey("Given I have a PrometheusMetricsManager with a max label values", t, func() {
+
+		r := prometheus.NewRegistry()
+		pmm := newPrometheusMetricsManager(
+			r,
+			PrometheusMetricsManagerOptMaxLabelValues(2),
+		).(*prometheusMetricsManager)
+
+		Convey("When I measure more distinct urls and identities than allowed", func() {
+
+			for _, i := range []string{"a", "b", "c", "d", "a"} {
+				pmm.MeasureRequest("GET", "/"+i)(200, &RequestMetricsInfo{Identity: i}, nil)
+			}
+
+			data, _ := r.Gather()
+
+			Convey("Then the extra values should go in the overflow bucket", func() {
+
+				So(data[0].GetName(), ShouldEqual, "http_requests_duration_seconds")
+				So(len(data[0].GetMetric()), ShouldEqual, 3)
+				So(data[0].GetMetric()[0].Label[0].String(), ShouldEqual, `name:"identity" value:"_overflow" `)
+				So(data[0].GetMetric()[0].Histogram.GetSampleCount(), ShouldEqual, 2)
+				So(data[0].GetMetric()[1].Label[0].String(), ShouldEqual, `name:"identity" value:"a" `)
+				So(data[0].GetMetric()[1].Histogram.GetSampleCount(), ShouldEqual, 2)
+				So(data[0].GetMetric()[2].Label[0].String(), ShouldEqual, `name:"identity" value:"b" `)
+
+				So(data[1].GetName(), ShouldEqual, "http_requests_total")
+				So(len(data[1].GetMetric()), ShouldEqual, 3)
+				So(data[1].GetMetric()[0].Label[2].String(), ShouldEqual, `name:"url" value:"/a" `)
+				So(data[1].GetMetric()[0].Counter.String(), ShouldEqual, "value:2 ")
+				So(data[1].GetMetric()[1].Label[2].String(), ShouldEqual, `name:"url" value:"/b" `)
+				So(data[1].GetMetric()[2].Label[2].String(), ShouldEqual, `name:"url" value:"_overflow" `)
+				So(data[1].GetMetric()[2].Counter.String(), ShouldEqual, "value:2 ")
+			})
+		})
+	})
+
+	Convey("Given I pass invalid options", t, func() {
+		So(func() { PrometheusMetricsManagerOptDurationBuckets(nil)(&prometheusMetricsManagerConfig{}) }, ShouldPanicWith, "buckets must not be empty")
+		So(func() { PrometheusMetricsManagerOptMaxLabelValues(0)(&prometheusMetricsManagerConfig{}) }, ShouldPanicWith, "max label values must be greater than 0")
+	})
+}
+
+func Test_statusClass(t *testing.T) {
+
+	Convey("Given I have some status codes", t, func() {
+		So(statusClass(200), ShouldEqual, "2xx")
+		So(statusClass(302), ShouldEqual, "3xx")
+		So(statusClass(429), ShouldEqual, "4xx")
+		So(statusClass(503), ShouldEqual, "5xx")
+		So(statusClass(0), ShouldEqual, "unknown")
+		So(statusClass(600), ShouldEqual, "unknown")
+	})
+}
+
 func TestRegisterWSConnection(t *testing.T) {
 
 	Convey("Given I have a PrometheusMetricsManager", t, func() {
@@ -195,3 +299,91 @@ func TestRegisterTCPConnection(t *testing.T) {
 		})
 	})
 }
+
+func TestRegisterRateLimitedRequest(t *testing.T) {
+
+	Convey("Given I have a PrometheusMetricsManager", t, func() {
+
+		r := prometheus.NewRegistry()
+		pmm := newPrometheusMetricsManager(r).(*prometheusMetricsManager)
+
+		Convey("When I call RegisterRateLimitedRequest twice", func() {
+
+			pmm.RegisterRateLimitedRequest("premium")
+			pmm.RegisterRateLimitedRequest("premium")
+
+			data, _ := r.Gather()
+
+			Convey("Then the total should increase", func() {
+				So(data[0].GetName(), ShouldEqual, "http_requests_rate_limited_total")
+				So(data[0].GetMetric()[0].Counter.String(), ShouldEqual, "value:2 ")
+				So(data[0].GetMetric()[0].Label[0].String(), ShouldEqual, `name:"tier" value:"premium" `)
+			})
+		})
+	})
+}
+
+func TestRegisterShedRequest(t *testing.T) {
+
+	Convey("Given I have a PrometheusMetricsManager", t, func() {
+
+		r := prometheus.NewRegistry()
+		pmm := newPrometheusMetricsManager(r).(*prometheusMetricsManager)
+
+		Convey("When I call RegisterShedRequest and SetConcurrencyLimit", func() {
+
+			pmm.RegisterShedRequest("low")
+			pmm.SetConcurrencyLimit(42)
+
+			data, _ := r.Gather()
+
+			Convey("Then the data should be collected", func() {
+				So(data[0].GetName(), ShouldEqual, "http_requests_concurrency_limit")
+				So(data[0].GetMetric()[0].String(), ShouldEqual, "gauge:<value:42 > ")
+				So(data[1].GetName(), ShouldEqual, "http_requests_shed_total")
+				So(data[1].GetMetric()[0].Counter.String(), ShouldEqual, "value:1 ")
+				So(data[1].GetMetric()[0].Label[0].String(), ShouldEqual, `name:"priority" value:"low" `)
+			})
+		})
+	})
+}
+
+func TestRegisterPushMetrics(t *testing.T) {
+
+	Convey("Given I have a PrometheusMetricsManager", t, func() {
+
+		r := prometheus.NewRegistry()
+		pmm := newPrometheusMetricsManager(r).(*prometheusMetricsManager)
+
+		Convey("When I register some push metrics", func() {
+
+			pmm.RegisterPushPublication("list", "create", false)
+			pmm.RegisterPushPublication("list", "create", true)
+			pmm.RegisterPushDispatch(PushDispatchOutcomeRejected, 3)
+			pmm.ObservePushDispatchDuration(time.Millisecond)
+			pmm.ObservePushSessionQueueDepth(12)
+			pmm.RegisterPushEventDropped()
+			pmm.ObservePushSessionLifetime(time.Minute)
+
+			data, _ := r.Gather()
+
+			Convey("Then the data should be collected", func() {
+				So(data[4].GetName(), ShouldEqual, "ws_push_dispatch_duration_seconds")
+				So(data[4].GetMetric()[0].Histogram.GetSampleCount(), ShouldEqual, 1)
+				So(data[5].GetName(), ShouldEqual, "ws_push_dispatch_total")
+				So(data[5].GetMetric()[0].Counter.String(), ShouldEqual, "value:3 ")
+				So(data[5].GetMetric()[0].Label[0].String(), ShouldEqual, `name:"outcome" value:"rejected" `)
+				So(data[6].GetName(), ShouldEqual, "ws_push_events_dropped_total")
+				So(data[6].GetMetric()[0].String(), ShouldEqual, "counter:<value:1 > ")
+				So(data[7].GetName(), ShouldEqual, "ws_push_events_published_total")
+				So(len(data[7].GetMetric()), ShouldEqual, 2)
+				So(data[7].GetMetric()[0].Label[1].String(), ShouldEqual, `name:"status" value:"failure" `)
+				So(data[7].GetMetric()[1].Label[1].String(), ShouldEqual, `name:"status" value:"success" `)
+				So(data[8].GetName(), ShouldEqual, "ws_push_session_lifetime_seconds")
+				So(data[8].GetMetric()[0].Histogram.GetSampleSum(), ShouldEqual, 60)
+				So(data[9].GetName(), ShouldEqual, "ws_push_session_queue_depth")
+				So(data[9].GetMetric()[0].Histogram.GetSampleSum(), ShouldEqual, 12)
+			})
+		})
+	})
+}
@@ -0,0 +1,171 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go.aporeto.io/elemental"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const otelInstrumentationName = "go.aporeto.io/bahamut"
+
+// otelPropagator is the propagator used to carry the trace context
+// over HTTP headers and publications. It uses the W3C traceparent
+// and tracestate headers.
+var otelPropagator = propagation.TraceContext{}
+
+type otelSpanContextKey struct{}
+
+// otelSpanFromContext returns the OpenTelemetry span started by bahamut
+// for the given context, or nil. It does not return the spans that
+// may have been started by another middleware.
+func otelSpanFromContext(ctx context.Context) trace.Span {
+
+	span, _ := ctx.Value(otelSpanContextKey{}).(trace.Span)
+
+	return span
+}
+
+// traceRequestOTel starts an OpenTelemetry span for the given request
+// with the same attributes as the ones set by traceRequest.
+func traceRequestOTel(ctx context.Context, r *elemental.Request, provider trace.TracerProvider, exludedIdentities map[string]struct{}, cleaner TraceCleaner) context.Context {
+
+	if provider == nil {
+		return ctx
+	}
+
+	if _, ok := exludedIdentities[r.Identity.Name]; ok {
+		return ctx
+	}
+
+	ctx = otelPropagator.Extract(ctx, propagation.HeaderCarrier(r.Headers))
+
+	ctx, span := provider.Tracer(otelInstrumentationName).Start(
+		ctx,
+		tracingName(r),
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+
+	attrs := []attribute.KeyValue{
+		attribute.Int("req.api_version", r.Version),
+		attribute.String("req.id", r.RequestID),
+		attribute.String("req.identity", r.Identity.Name),
+		attribute.Bool("req.recursive", r.Recursive),
+		attribute.String("req.operation", string(r.Operation)),
+		attribute.Bool("req.override_protection", r.OverrideProtection),
+		attribute.Int("req.page.number", r.Page),
+		attribute.Int("req.page.size", r.PageSize),
+		attribute.String("req.client_ip", r.ClientIP),
+	}
+
+	if r.ExternalTrackingID != "" {
+		attrs = append(attrs, attribute.String("req.external_tracking_id", r.ExternalTrackingID))
+	}
+
+	if r.ExternalTrackingType != "" {
+		attrs = append(attrs, attribute.String("req.external_tracking_type", r.ExternalTrackingType))
+	}
+
+	if r.Namespace != "" {
+		attrs = append(attrs, attribute.String("req.namespace", r.Namespace))
+	}
+
+	if r.ObjectID != "" {
+		attrs = append(attrs, attribute.String("req.object.id", r.ObjectID))
+	}
+
+	if r.ParentID != "" {
+		attrs = append(attrs, attribute.String("req.parent.id", r.ParentID))
+	}
+
+	if !r.ParentIdentity.IsEmpty() {
+		attrs = append(attrs, attribute.String("req.parent.identity", r.ParentIdentity.Name))
+	}
+
+	if len(r.Order) > 0 {
+		attrs = append(attrs, attribute.StringSlice("req.order_by", r.Order))
+	}
+
+	span.SetAttributes(attrs...)
+
+	// Remove sensitive information from parameters.
+	safeParameters := url.Values{}
+	for k, p := range r.Parameters {
+		lk := strings.ToLower(k)
+		if lk == "token" || lk == "password" {
+			safeParameters[k] = snipSlice
+			continue
+		}
+		safeParameters[k] = []string{fmt.Sprintf("%v", p.Values())}
+	}
+
+	// Remove sensitive information from headers.
+	safeHeaders := make([]attribute.KeyValue, 0, len(r.Headers))
+	for k, v := range r.Headers {
+		lk := strings.ToLower(k)
+		if lk == "authorization" || lk == "cookie" {
+			v = snipSlice
+		}
+		safeHeaders = append(safeHeaders, attribute.StringSlice("req.header."+lk, v))
+	}
+
+	data := append([]byte{}, r.Data...)
+	if cleaner != nil {
+		data = cleaner(r.Identity, data)
+	}
+
+	span.AddEvent(
+		"request",
+		trace.WithAttributes(safeHeaders...),
+		trace.WithAttributes(
+			attribute.String("req.claims", extractClaims(r)),
+			attribute.String("req.parameters", safeParameters.Encode()),
+			attribute.String("req.payload", string(data)),
+		),
+	)
+
+	return context.WithValue(ctx, otelSpanContextKey{}, span)
+}
+
+// finishTracingOTel ends the OpenTelemetry span started
+// by traceRequestOTel, if any.
+func finishTracingOTel(ctx context.Context) {
+
+	span := otelSpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+
+	span.End()
+}
+
+// recordErrorOTel records the given error on the OpenTelemetry
+// span started by bahamut, if any.
+func recordErrorOTel(ctx context.Context, err elemental.Errors) {
+
+	span := otelSpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+
+	span.SetAttributes(attribute.Int("status.code", err.Code()))
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,232 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-zoo/bone"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/bahamut/oteltest"
+	"go.aporeto.io/elemental"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func otelAttributesMap(attrs []attribute.KeyValue) map[string]any {
+
+	out := make(map[string]any, len(attrs))
+	for _, kv := range attrs {
+		out[string(kv.Key)] = kv.Value.AsInterface()
+	}
+
+	return out
+}
+
+func TestTraceRequestOTel(t *testing.T) {
+
+	Convey("Given I have a request and a tracer provider", t, func() {
+
+		tp := oteltest.NewTracerProvider()
+
+		req := elemental.NewRequest()
+		req.RequestID = "rid"
+		req.Identity = elemental.MakeIdentity("thing", "things")
+		req.Operation = elemental.OperationRetrieve
+		req.ObjectID = "xyz"
+		req.Namespace = "/ns"
+		req.ClientIP = "10.0.0.1"
+		req.Headers = http.Header{
+			"Authorization": []string{"Bearer secret"},
+			"Traceparent":   []string{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		}
+
+		Convey("When I call traceRequestOTel", func() {
+
+			ctx := traceRequestOTel(context.Background(), req, tp, nil, nil)
+			span := otelSpanFromContext(ctx)
+
+			Convey("Then a span should be in the context", func() {
+				So(span, ShouldNotBeNil)
+				So(span.SpanContext().TraceID().String(), ShouldEqual, "0af7651916cd43dd8448eb211c80319c")
+			})
+
+			Convey("When I finish the tracing", func() {
+
+				finishTracingOTel(ctx)
+				spans := tp.Spans()
+
+				Convey("Then the span should be correct", func() {
+					So(len(spans), ShouldEqual, 1)
+					So(spans[0].Name, ShouldEqual, "bahamut.handle.retrieve.things")
+					So(spans[0].SpanKind, ShouldEqual, trace.SpanKindServer)
+					So(spans[0].Parent.SpanID().String(), ShouldEqual, "b7ad6b7169203331")
+					So(spans[0].Parent.IsRemote(), ShouldBeTrue)
+
+					attrs := otelAttributesMap(spans[0].Attributes)
+					So(attrs["req.id"], ShouldEqual, "rid")
+					So(attrs["req.identity"], ShouldEqual, "thing")
+					So(attrs["req.operation"], ShouldEqual, "retrieve")
+					So(attrs["req.object.id"], ShouldEqual, "xyz")
+					So(attrs["req.namespace"], ShouldEqual, "/ns")
+					So(attrs["req.client_ip"], ShouldEqual, "10.0.0.1")
+
+					So(len(spans[0].Events), ShouldEqual, 1)
+					eattrs := otelAttributesMap(spans[0].Events[0].Attributes)
+					So(eattrs["req.header.authorization"], ShouldResemble, []string{"[snip]"})
+				})
+			})
+
+			Convey("When I record an error", func() {
+
+				processError(ctx, elemental.NewError("nope", "nope", "test", http.StatusForbidden))
+				finishTracingOTel(ctx)
+				spans := tp.Spans()
+
+				Convey("Then the span should have the error", func() {
+					So(len(spans), ShouldEqual, 1)
+					So(spans[0].Status.Code, ShouldEqual, codes.Error)
+					So(otelAttributesMap(spans[0].Attributes)["status.code"], ShouldEqual, int64(http.StatusForbidden))
+				})
+			})
+		})
+
+		Convey("When I call traceRequestOTel on an excluded identity", func() {
+
+			ctx := traceRequestOTel(context.Background(), req, tp, map[string]struct{}{"thing": {}}, nil)
+
+			Convey("Then no span should be created", func() {
+				So(otelSpanFromContext(ctx), ShouldBeNil)
+				So(func() { finishTracingOTel(ctx) }, ShouldNotPanic)
+			})
+		})
+
+		Convey("When I call traceRequestOTel with no provider", func() {
+
+			ctx := traceRequestOTel(context.Background(), req, nil, nil, nil)
+
+			Convey("Then no span should be created", func() {
+				So(otelSpanFromContext(ctx), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestPublicationTraceContext(t *testing.T) {
+
+	Convey("Given I have a publication and a span", t, func() {
+
+		tp := oteltest.NewTracerProvider()
+		ctx, span := tp.Tracer("test").Start(context.Background(), "parent")
+		defer span.End()
+
+		pub := NewPublication("topic")
+		pub.TrackingData = nil
+
+		Convey("When I inject the trace context", func() {
+
+			pub.InjectTraceContext(ctx)
+
+			Convey("Then the traceparent should be set", func() {
+				So(pub.TrackingData["traceparent"], ShouldEqual, fmt.Sprintf("00-%s-%s-01", span.SpanContext().TraceID(), span.SpanContext().SpanID()))
+			})
+
+			Convey("Then I can extract it", func() {
+				sc := trace.SpanContextFromContext(pub.ExtractTraceContext(context.Background()))
+				So(sc.TraceID(), ShouldEqual, span.SpanContext().TraceID())
+				So(sc.SpanID(), ShouldEqual, span.SpanContext().SpanID())
+				So(sc.IsRemote(), ShouldBeTrue)
+			})
+		})
+
+		Convey("When I extract from a publication without trace context", func() {
+
+			sc := trace.SpanContextFromContext(pub.ExtractTraceContext(context.Background()))
+
+			Convey("Then the span context should be invalid", func() {
+				So(sc.IsValid(), ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestPushServerOTel(t *testing.T) {
+
+	Convey("Given I have a push server with a tracer provider", t, func() {
+
+		tp := oteltest.NewTracerProvider()
+
+		ps := NewLocalPubSubClient()
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer ps.Disconnect() // nolint: errcheck
+
+		cfg := config{}
+		cfg.pushServer.enabled = true
+		cfg.pushServer.service = ps
+		cfg.pushServer.topic = "events"
+		cfg.opentelemetry.tracerProvider = tp
+
+		srv := newPushServer(cfg, bone.New(), nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go srv.start(ctx)
+		time.Sleep(100 * time.Millisecond) // let the push server subscribe
+
+		Convey("When I push an event from a traced request", func() {
+
+			rctx, rspan := tp.Tracer("test").Start(context.Background(), "request")
+			srv.pushEventsWithContext(rctx, &elemental.Event{
+				Type:      elemental.EventCreate,
+				Identity:  "thing",
+				Encoding:  elemental.EncodingTypeMSGPACK,
+				Timestamp: time.Now(),
+			})
+			rspan.End()
+
+			var spans map[string]int
+			for i := 0; i < 100; i++ {
+				spans = map[string]int{}
+				for idx, s := range tp.Spans() {
+					spans[s.Name] = idx
+				}
+				if len(spans) == 3 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			Convey("Then the publish span should be a child of the request span", func() {
+				So(spans, ShouldContainKey, "bahamut.push.publish")
+				pspan := tp.Spans()[spans["bahamut.push.publish"]]
+				So(pspan.Parent.SpanID(), ShouldEqual, rspan.SpanContext().SpanID())
+				So(pspan.SpanKind, ShouldEqual, trace.SpanKindProducer)
+			})
+
+			Convey("Then the dispatch span should be linked to the publish span", func() {
+				So(spans, ShouldContainKey, "bahamut.push.dispatch")
+				pspan := tp.Spans()[spans["bahamut.push.publish"]]
+				dspan := tp.Spans()[spans["bahamut.push.dispatch"]]
+				So(dspan.Parent.IsValid(), ShouldBeFalse)
+				So(dspan.SpanKind, ShouldEqual, trace.SpanKindConsumer)
+				So(len(dspan.Links), ShouldEqual, 1)
+				So(dspan.Links[0].SpanContext.SpanID(), ShouldEqual, pspan.SpanContext.SpanID())
+				So(otelAttributesMap(dspan.Attributes)["push.dispatched"], ShouldEqual, int64(0))
+			})
+		})
+	})
+}
@@ -25,6 +25,7 @@ import (
 
 	opentracing "github.com/opentracing/opentracing-go"
 	"go.aporeto.io/elemental"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 )
 
@@ -108,6 +109,20 @@ func OptHTTPLogger(l *log.Logger) Option {
 	}
 }
 
+// OptAccessLog configures the access log. One record is written in the given
+// AccessLogger for each request handled by the REST server, and for each
+// start and stop of a push session.
+//
+// You can use NewZapAccessLogger or NewWriterAccessLogger to get an AccessLogger.
+func OptAccessLog(logger AccessLogger, options ...AccessLogOption) Option {
+	return func(c *config) {
+		if logger == nil {
+			panic("logger must not be nil")
+		}
+		c.accessLog.log = newAccessLog(logger, options...)
+	}
+}
+
 // OptEnableCustomRoutePathPrefix enables custom routes in the server that
 // start with the given prefix. A user must also provide an API
 // prefix in this case and the two must not overlap. Otherwise,
@@ -178,6 +193,56 @@ func OptPushServerEnableSubjectHierarchies() Option {
 	}
 }
 
+// OptPushServerEnableChanges makes the push server attach the changes made
+// by update, patch and delete operations to the publications of the events
+// pushed for their output data, in the PushChangesHeader header. The changes
+// are the same as the ones reported in the AuditRecords, and the values of
+// the secret and encrypted attributes are redacted. They are only computed
+// when the previous version of the object is known. See PreviousDataHolder.
+// This option has no effect if OptPushServer is not set.
+func OptPushServerEnableChanges() Option {
+	return func(c *config) {
+		c.pushServer.changesEnabled = true
+	}
+}
+
+// OptPushServerCompression makes the push server compress the publications
+// of the events using the given compression when their data is at least
+// threshold bytes long. This avoids hitting the maximum payload size of
+// the broker with large entities.
+//
+// Push servers running a version of bahamut that does not support
+// compression will not be able to decode these publications, so make
+// sure all of them are up to date before enabling this option.
+// This option has no effect if OptPushServer is not set.
+func OptPushServerCompression(compression PublicationCompression, threshold int) Option {
+	return func(c *config) {
+		c.pushServer.compression = compression
+		c.pushServer.compressionThreshold = threshold
+	}
+}
+
+// OptPushOutbox stores in the given directory the events that could not
+// be published by the push server, instead of dropping them. They are
+// published again, in order, once the PubSubClient is available. If the
+// PubSubClient is a Pinger, it is used to check its availability.
+//
+// While the outbox is not empty, the new events are stored after the
+// others to keep the order. Once the outbox is full, the new events are
+// dropped. You can use the PushOutboxer implemented by the Server
+// to observe and flush the outbox. This option has no effect if
+// OptPushServer is not set.
+func OptPushOutbox(dir string, options ...PushOutboxOption) Option {
+
+	if dir == "" {
+		panic("dir must not be empty")
+	}
+
+	return func(c *config) {
+		c.pushServer.outbox = newPushOutbox(dir, options...)
+	}
+}
+
 // OptPushEndpoint sets the endpoint to use for websocket channel.
 //
 // If unset, it fallsback to the default which is /events. This option
@@ -210,6 +275,26 @@ func OptPushPublishHandler(publishHandler PushPublishHandler) Option {
 	}
 }
 
+// OptPushSessionsAdmin enables the push sessions admin endpoint on the
+// health server. It lists the live push sessions on /_push/sessions and
+// allows to close a session using DELETE /_push/sessions/<id>, or all
+// the sessions having some claims using DELETE /_push/sessions?claim=k=v.
+//
+// Every request must be accepted by the given authorizer. You can use
+// NewPushSessionsAdminTokenAuthorizer to protect the endpoint with a token.
+// Both the push server and the health server must be enabled or this
+// option will have no effect.
+func OptPushSessionsAdmin(authorizer PushSessionsAdminAuthorizer) Option {
+
+	if authorizer == nil {
+		panic("authorizer must not be nil")
+	}
+
+	return func(c *config) {
+		c.pushServer.adminAuthorizer = authorizer
+	}
+}
+
 // OptHealthServer enables and configures the health server.
 //
 // ListenAddress is the general listening address for the health server.
@@ -264,6 +349,53 @@ func OptHealthCustomStats(handlers map[string]HealthStatFunc) Option {
 	}
 }
 
+// OptHealthCheck registers a component to check in the background
+// for the /ready and /startup endpoints of the health server.
+//
+// The name must be unique and is used to report the status of the
+// component. By default, the component is critical and must answer
+// in less than 5s. You can change that using HealthCheckOptTimeout
+// and HealthCheckOptNonCritical.
+//
+// The health server must be enabled using OptHealthServer or this option
+// will have no effect.
+func OptHealthCheck(name string, pinger Pinger, options ...HealthCheckOption) Option {
+
+	if name == "" {
+		panic("name must not be empty")
+	}
+
+	if pinger == nil {
+		panic("pinger must not be nil")
+	}
+
+	check := newHealthCheck(name, pinger, options...)
+
+	return func(c *config) {
+
+		for _, existing := range c.healthServer.checks {
+			if existing.name == name {
+				panic(fmt.Sprintf("health check '%s' already registered", name))
+			}
+		}
+
+		c.healthServer.checks = append(c.healthServer.checks, check)
+	}
+}
+
+// OptHealthCheckInterval sets how often the components registered
+// with OptHealthCheck are checked. The default is 10s.
+func OptHealthCheckInterval(interval time.Duration) Option {
+
+	if interval <= 0 {
+		panic("interval must be greater than 0")
+	}
+
+	return func(c *config) {
+		c.healthServer.checkInterval = interval
+	}
+}
+
 // OptHealthServerTimeouts configures the health server timeouts.
 func OptHealthServerTimeouts(read, write, idle time.Duration) Option {
 	return func(c *config) {
@@ -281,6 +413,25 @@ func OptProfilingLocal(listen string) Option {
 	}
 }
 
+// OptProfilingSnapshots automatically captures CPU, heap, goroutine and
+// mutex profiles into the given directory when one of the thresholds
+// set by the given options is crossed.
+//
+// The captured snapshots can be listed on /debug/snapshots and downloaded
+// from /debug/snapshots/<name>/<file> on the profiling server. The
+// profiling server must be enabled using OptProfilingLocal or this option
+// will have no effect.
+func OptProfilingSnapshots(dir string, options ...ProfilingSnapshotOption) Option {
+
+	if dir == "" {
+		panic("dir must not be empty")
+	}
+
+	return func(c *config) {
+		c.profilingServer.snapshotter = newProfilingSnapshotter(dir, options...)
+	}
+}
+
 // OptTLS configures server TLS.
 //
 // ServerCertificates are the TLS certficates to use for the secure api server.
@@ -367,6 +518,8 @@ func OptAuthorizers(authorizers []Authorizer) Option {
 //
 // The Audit() method will be run in a go routine so there is no
 // need to deal with it in your implementation.
+// You can use NewAuditTrail to get a structured asynchronous
+// Auditer writing into an AuditSink.
 func OptAuditer(auditer Auditer) Option {
 	return func(c *config) {
 		c.security.auditer = auditer
@@ -408,6 +561,59 @@ func OptAPIRateLimiting(identity elemental.Identity, limit float64, burst int, c
 	}
 }
 
+// OptRateLimitingCluster makes the limits configured with OptRateLimiting,
+// OptAPIRateLimiting and the limiters returned by NewKeyedRateLimiter
+// passed to OptRateLimiters cluster aware. The server will announce itself
+// to its peers on the given topic using the given PubSubClient, and will
+// divide the configured limits and bursts by the number of live replicas.
+//
+// A peer is considered gone if it did not send a ping for peerTimeout.
+// If pingInterval is 0, it defaults to 10s. If peerTimeout is 0, it defaults
+// to 3 times the pingInterval.
+func OptRateLimitingCluster(pubsub PubSubClient, topic string, pingInterval time.Duration, peerTimeout time.Duration) Option {
+
+	if pubsub == nil {
+		panic("pubsub must not be nil")
+	}
+
+	return func(c *config) {
+		c.rateLimiting.clusterPubSub = pubsub
+		c.rateLimiting.clusterTopic = topic
+		c.rateLimiting.clusterPingInterval = pingInterval
+		c.rateLimiting.clusterPeerTimeout = peerTimeout
+	}
+}
+
+// OptConcurrencyLimiting configures a ConcurrencyLimiter that will shed
+// the requests that cannot be processed with a 503 error and a Retry-After
+// header set to retryAfter, or 1s if it is 0. The classifier decides the
+// priority of each request. If it is nil, DefaultRequestPriorityClassifier
+// is used. You can use NewAIMDConcurrencyLimiter to get an adaptive limiter.
+func OptConcurrencyLimiting(limiter ConcurrencyLimiter, classifier RequestPriorityClassifier, retryAfter time.Duration) Option {
+	return func(c *config) {
+		if classifier == nil {
+			classifier = DefaultRequestPriorityClassifier
+		}
+		if retryAfter <= 0 {
+			retryAfter = time.Second
+		}
+		c.rateLimiting.concurrencyLimiter = limiter
+		c.rateLimiting.priorityClassifier = classifier
+		c.rateLimiting.concurrencyRetryAfter = retryAfter
+	}
+}
+
+// OptRateLimiters configures additional rate limiters that are applied,
+// in order, after the global and per-api rate limiters.
+// If a limiter is a StatusRateLimiter, the RateLimit-* and Retry-After
+// headers will be added to the response. You can use NewKeyedRateLimiter
+// to get per-client buckets.
+func OptRateLimiters(limiters []RateLimiter) Option {
+	return func(c *config) {
+		c.rateLimiting.rateLimiters = limiters
+	}
+}
+
 // OptModel configures the elemental Model for the server.
 //
 // modelManagers is a map of version to elemental.ModelManager.
@@ -483,6 +689,22 @@ func OptOpentracingTracer(tracer opentracing.Tracer) Option {
 	}
 }
 
+// OptOpenTelemetryTracerProvider sets the OpenTelemetry TracerProvider to use.
+// Bahamut will create a span for each request with the same attributes as
+// the ones set with OptOpentracingTracer, and will use the W3C traceparent
+// header to continue the trace of the caller. Both tracers can be used at
+// the same time. The identities excluded with OptOpentracingExcludedIdentities
+// and the cleaner set with OptTraceCleaner also apply.
+//
+// If a push server is configured, the trace context of the request is
+// propagated into the publications of the pushed events, and the span
+// dispatching an event to the push sessions is linked to it.
+func OptOpenTelemetryTracerProvider(provider trace.TracerProvider) Option {
+	return func(c *config) {
+		c.opentelemetry.tracerProvider = provider
+	}
+}
+
 // OptOpentracingExcludedIdentities excludes the given identity from being traced.
 func OptOpentracingExcludedIdentities(identities []elemental.Identity) Option {
 	return func(c *config) {
@@ -22,8 +22,10 @@ import (
 	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/bahamut/oteltest"
 	"go.aporeto.io/elemental"
 	testmodel "go.aporeto.io/elemental/test/model"
+	"go.uber.org/zap"
 	"golang.org/x/time/rate"
 )
 
@@ -110,6 +112,25 @@ func TestBahamut_Options(t *testing.T) {
 		So(c.pushServer.subjectHierarchiesEnabled, ShouldEqual, true)
 	})
 
+	Convey("Calling OptPushServerEnableChanges should work", t, func() {
+		OptPushServerEnableChanges()(&c)
+		So(c.pushServer.changesEnabled, ShouldEqual, true)
+	})
+
+	Convey("Calling OptPushOutbox should work", t, func() {
+		OptPushOutbox("/tmp/outbox", PushOutboxOptMaxEvents(42))(&c)
+		So(c.pushServer.outbox, ShouldNotBeNil)
+		So(c.pushServer.outbox.dir, ShouldEqual, "/tmp/outbox")
+		So(c.pushServer.outbox.config.maxEvents, ShouldEqual, 42)
+		So(func() { OptPushOutbox("") }, ShouldPanicWith, "dir must not be empty")
+	})
+
+	Convey("Calling OptPushServerCompression should work", t, func() {
+		OptPushServerCompression(PublicationCompressionZstd, 1024)(&c)
+		So(c.pushServer.compression, ShouldEqual, PublicationCompressionZstd)
+		So(c.pushServer.compressionThreshold, ShouldEqual, 1024)
+	})
+
 	Convey("Calling OptHealthServer should work", t, func() {
 		h := func() error { return nil }
 		OptHealthServer("1.2.3.4:123", h)(&c)
@@ -132,6 +153,38 @@ func TestBahamut_Options(t *testing.T) {
 		So(c.healthServer.idleTimeout, ShouldEqual, 3*time.Second)
 	})
 
+	Convey("Calling OptProfilingSnapshots should work", t, func() {
+		OptProfilingSnapshots("/tmp/snapshots", ProfilingSnapshotOptGoroutineThreshold(1000))(&c)
+		So(c.profilingServer.snapshotter.dir, ShouldEqual, "/tmp/snapshots")
+		So(c.profilingServer.snapshotter.cfg.goroutineThreshold, ShouldEqual, 1000)
+		So(func() { OptProfilingSnapshots("") }, ShouldPanicWith, "dir must not be empty")
+	})
+
+	Convey("Calling OptPushSessionsAdmin should work", t, func() {
+		OptPushSessionsAdmin(NewPushSessionsAdminTokenAuthorizer("secret"))(&c)
+		So(c.pushServer.adminAuthorizer, ShouldNotBeNil)
+		So(func() { OptPushSessionsAdmin(nil) }, ShouldPanicWith, "authorizer must not be nil")
+	})
+
+	Convey("Calling OptHealthCheck should work", t, func() {
+		p := MockPinger{}
+		OptHealthCheck("db", p, HealthCheckOptTimeout(time.Second), HealthCheckOptNonCritical())(&c)
+		So(len(c.healthServer.checks), ShouldEqual, 1)
+		So(c.healthServer.checks[0].name, ShouldEqual, "db")
+		So(c.healthServer.checks[0].pinger, ShouldEqual, p)
+		So(c.healthServer.checks[0].timeout, ShouldEqual, time.Second)
+		So(c.healthServer.checks[0].critical, ShouldBeFalse)
+		So(func() { OptHealthCheck("db", p)(&c) }, ShouldPanicWith, "health check 'db' already registered")
+		So(func() { OptHealthCheck("", p) }, ShouldPanicWith, "name must not be empty")
+		So(func() { OptHealthCheck("x", nil) }, ShouldPanicWith, "pinger must not be nil")
+	})
+
+	Convey("Calling OptHealthCheckInterval should work", t, func() {
+		OptHealthCheckInterval(time.Minute)(&c)
+		So(c.healthServer.checkInterval, ShouldEqual, time.Minute)
+		So(func() { OptHealthCheckInterval(0) }, ShouldPanicWith, "interval must be greater than 0")
+	})
+
 	Convey("Calling OptHealthCustomStat should work", t, func() {
 		h := func(w http.ResponseWriter, r *http.Request) {}
 		OptHealthCustomStats(map[string]HealthStatFunc{
@@ -217,6 +270,15 @@ func TestBahamut_Options(t *testing.T) {
 		So(c.security.auditer, ShouldEqual, a)
 	})
 
+	Convey("Calling OptAccessLog should work", t, func() {
+		l := NewZapAccessLogger(zap.NewNop())
+		OptAccessLog(l, AccessLogOptSampleSuccess(10), AccessLogOptClaims("a"))(&c)
+		So(c.accessLog.log.logger, ShouldEqual, l)
+		So(c.accessLog.log.sampleEvery, ShouldEqual, 10)
+		So(c.accessLog.log.claims, ShouldResemble, []string{"a"})
+		So(func() { OptAccessLog(nil)(&c) }, ShouldPanicWith, "logger must not be nil")
+	})
+
 	Convey("Calling OptAuditer should work", t, func() {
 		a := NewDefaultCORSController("", nil)
 		OptCORSAccessControl(a)(&c)
@@ -239,6 +301,42 @@ func TestBahamut_Options(t *testing.T) {
 		So(c.rateLimiting.apiRateLimiters[ident].condition, ShouldEqual, cond)
 	})
 
+	Convey("Calling OptRateLimitingCluster should work", t, func() {
+		ps := NewLocalPubSubClient()
+		OptRateLimitingCluster(ps, "peers", time.Second, 3*time.Second)(&c)
+		So(c.rateLimiting.clusterPubSub, ShouldEqual, ps)
+		So(c.rateLimiting.clusterTopic, ShouldEqual, "peers")
+		So(c.rateLimiting.clusterPingInterval, ShouldEqual, time.Second)
+		So(c.rateLimiting.clusterPeerTimeout, ShouldEqual, 3*time.Second)
+	})
+
+	Convey("Calling OptRateLimitingCluster with a nil pubsub should panic", t, func() {
+		So(func() { OptRateLimitingCluster(nil, "peers", 0, 0) }, ShouldPanicWith, "pubsub must not be nil")
+	})
+
+	Convey("Calling OptConcurrencyLimiting should work", t, func() {
+		l := NewAIMDConcurrencyLimiter()
+		cl := func(*elemental.Request) RequestPriority { return RequestPriorityLow }
+		OptConcurrencyLimiting(l, cl, 3*time.Second)(&c)
+		So(c.rateLimiting.concurrencyLimiter, ShouldEqual, l)
+		So(c.rateLimiting.priorityClassifier, ShouldEqual, cl)
+		So(c.rateLimiting.concurrencyRetryAfter, ShouldEqual, 3*time.Second)
+	})
+
+	Convey("Calling OptConcurrencyLimiting with default values should work", t, func() {
+		l := NewAIMDConcurrencyLimiter()
+		OptConcurrencyLimiting(l, nil, 0)(&c)
+		So(c.rateLimiting.concurrencyLimiter, ShouldEqual, l)
+		So(c.rateLimiting.priorityClassifier, ShouldEqual, DefaultRequestPriorityClassifier)
+		So(c.rateLimiting.concurrencyRetryAfter, ShouldEqual, time.Second)
+	})
+
+	Convey("Calling OptRateLimiters should work", t, func() {
+		rls := []RateLimiter{NewKeyedRateLimiter(RateLimitKeyFromNamespace(), RateLimitTier{Limit: 10, Burst: 20})}
+		OptRateLimiters(rls)(&c)
+		So(c.rateLimiting.rateLimiters, ShouldResemble, rls)
+	})
+
 	Convey("Calling OptModel should work", t, func() {
 		m := map[int]elemental.ModelManager{0: testmodel.Manager()}
 		OptModel(m)(&c)
@@ -288,6 +386,12 @@ func TestBahamut_Options(t *testing.T) {
 		So(c.opentracing.excludedIdentities, ShouldResemble, map[string]struct{}{"user": {}, "list": {}})
 	})
 
+	Convey("Calling OptOpenTelemetryTracerProvider should work", t, func() {
+		tp := oteltest.NewTracerProvider()
+		OptOpenTelemetryTracerProvider(tp)(&c)
+		So(c.opentelemetry.tracerProvider, ShouldEqual, tp)
+	})
+
 	Convey("Calling OptPostStartHook should work", t, func() {
 		f := func(Server) error { return nil }
 		OptPostStartHook(f)(&c)
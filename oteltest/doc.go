@@ -0,0 +1,16 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package oteltest provides an OpenTelemetry TracerProvider keeping the
+// spans in memory, to help writing unit tests of the code using
+// bahamut.OptOpenTelemetryTracerProvider. It is kept out of bahamut so
+// the OpenTelemetry SDK is only a dependency of the tests.
+package oteltest // import "go.aporeto.io/bahamut/oteltest"
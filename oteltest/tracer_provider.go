@@ -0,0 +1,48 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oteltest
+
+import (
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// A TracerProvider is an OpenTelemetry TracerProvider that keeps
+// the ended spans in memory. It can be passed to
+// bahamut.OptOpenTelemetryTracerProvider to help writing unit tests.
+type TracerProvider struct {
+	*sdktrace.TracerProvider
+	exporter *tracetest.InMemoryExporter
+}
+
+// NewTracerProvider returns a new TracerProvider.
+func NewTracerProvider() *TracerProvider {
+
+	exporter := tracetest.NewInMemoryExporter()
+
+	return &TracerProvider{
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)),
+		exporter:       exporter,
+	}
+}
+
+// Spans returns the spans that have been ended so far.
+func (p *TracerProvider) Spans() tracetest.SpanStubs {
+
+	return p.exporter.GetSpans()
+}
+
+// Reset removes all the recorded spans.
+func (p *TracerProvider) Reset() {
+
+	p.exporter.Reset()
+}
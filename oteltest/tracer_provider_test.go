@@ -0,0 +1,43 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oteltest
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTracerProvider(t *testing.T) {
+
+	Convey("Given I have a tracer provider", t, func() {
+
+		tp := NewTracerProvider()
+
+		Convey("When I end a span", func() {
+
+			_, span := tp.Tracer("test").Start(context.Background(), "op")
+			span.End()
+
+			Convey("Then it should be recorded", func() {
+				So(len(tp.Spans()), ShouldEqual, 1)
+				So(tp.Spans()[0].Name, ShouldEqual, "op")
+			})
+
+			Convey("Then resetting should remove it", func() {
+				tp.Reset()
+				So(len(tp.Spans()), ShouldEqual, 0)
+			})
+		})
+	})
+}
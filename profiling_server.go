@@ -43,6 +43,12 @@ func (s *profilingServer) start(ctx context.Context) {
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
+	if snapshotter := s.cfg.profilingServer.snapshotter; snapshotter != nil {
+		mux.Handle("/debug/snapshots", snapshotter)
+		mux.Handle("/debug/snapshots/", snapshotter)
+		go snapshotter.run(ctx)
+	}
+
 	s.server = &http.Server{
 		Addr:    s.cfg.profilingServer.listenAddress,
 		Handler: mux,
@@ -0,0 +1,583 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+	"go.uber.org/zap"
+)
+
+// Various reasons for which a profiling snapshot is captured.
+const (
+	ProfilingSnapshotReasonCPU        = "cpu"
+	ProfilingSnapshotReasonRSS        = "rss"
+	ProfilingSnapshotReasonGoroutines = "goroutines"
+	ProfilingSnapshotReasonLatency    = "latency"
+)
+
+const (
+	profilingSnapshotTimeFormat       = "20060102T150405.000Z"
+	profilingSnapshotLatencySamples   = 4096
+	profilingSnapshotMutexFraction    = 100
+	defaultProfilingSnapshotInterval  = 10 * time.Second
+	defaultProfilingSnapshotCooldown  = 5 * time.Minute
+	defaultProfilingSnapshotRetention = 10
+	defaultProfilingSnapshotCPUTime   = 10 * time.Second
+)
+
+// A ProfilingSnapshot describes a set of profiles
+// captured when a threshold has been crossed.
+type ProfilingSnapshot struct {
+	Name   string    `json:"name"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+	Files  []string  `json:"files"`
+}
+
+// A ProfilingSnapshotOption represents an option that can be passed to OptProfilingSnapshots.
+type ProfilingSnapshotOption func(*profilingSnapshotConfig)
+
+type profilingSnapshotConfig struct {
+	cpuThreshold       float64
+	rssThreshold       uint64
+	goroutineThreshold int
+	latencyThreshold   time.Duration
+	interval           time.Duration
+	cooldown           time.Duration
+	retention          int
+	cpuProfileDuration time.Duration
+}
+
+// ProfilingSnapshotOptCPUThreshold captures a snapshot when the CPU usage
+// of the process, in percent of the CPUs usable by the Go runtime, is
+// above the given value between two checks.
+func ProfilingSnapshotOptCPUThreshold(percent float64) ProfilingSnapshotOption {
+
+	if percent <= 0 {
+		panic("percent must be greater than 0")
+	}
+
+	return func(c *profilingSnapshotConfig) {
+		c.cpuThreshold = percent
+	}
+}
+
+// ProfilingSnapshotOptRSSThreshold captures a snapshot when the resident
+// set size of the process is above the given number of bytes.
+func ProfilingSnapshotOptRSSThreshold(bytes uint64) ProfilingSnapshotOption {
+
+	if bytes == 0 {
+		panic("bytes must be greater than 0")
+	}
+
+	return func(c *profilingSnapshotConfig) {
+		c.rssThreshold = bytes
+	}
+}
+
+// ProfilingSnapshotOptGoroutineThreshold captures a snapshot when
+// the number of goroutines is above the given value.
+func ProfilingSnapshotOptGoroutineThreshold(count int) ProfilingSnapshotOption {
+
+	if count <= 0 {
+		panic("count must be greater than 0")
+	}
+
+	return func(c *profilingSnapshotConfig) {
+		c.goroutineThreshold = count
+	}
+}
+
+// ProfilingSnapshotOptLatencyThreshold captures a snapshot when the 99th
+// percentile of the latency of the requests handled by the rest server
+// between two checks is above the given value.
+func ProfilingSnapshotOptLatencyThreshold(p99 time.Duration) ProfilingSnapshotOption {
+
+	if p99 <= 0 {
+		panic("p99 must be greater than 0")
+	}
+
+	return func(c *profilingSnapshotConfig) {
+		c.latencyThreshold = p99
+	}
+}
+
+// ProfilingSnapshotOptInterval sets how often the thresholds are checked.
+// The default is 10s.
+func ProfilingSnapshotOptInterval(interval time.Duration) ProfilingSnapshotOption {
+
+	if interval <= 0 {
+		panic("interval must be greater than 0")
+	}
+
+	return func(c *profilingSnapshotConfig) {
+		c.interval = interval
+	}
+}
+
+// ProfilingSnapshotOptCooldown sets the minimum time between two
+// snapshots. The default is 5m.
+func ProfilingSnapshotOptCooldown(cooldown time.Duration) ProfilingSnapshotOption {
+
+	if cooldown < 0 {
+		panic("cooldown must not be negative")
+	}
+
+	return func(c *profilingSnapshotConfig) {
+		c.cooldown = cooldown
+	}
+}
+
+// ProfilingSnapshotOptRetention sets the maximum number of snapshots
+// to keep in the directory. The oldest ones are deleted first.
+// The default is 10.
+func ProfilingSnapshotOptRetention(max int) ProfilingSnapshotOption {
+
+	if max <= 0 {
+		panic("max must be greater than 0")
+	}
+
+	return func(c *profilingSnapshotConfig) {
+		c.retention = max
+	}
+}
+
+// ProfilingSnapshotOptCPUProfileDuration sets for how long the CPU
+// profile is recorded when a snapshot is captured. The default is 10s.
+func ProfilingSnapshotOptCPUProfileDuration(duration time.Duration) ProfilingSnapshotOption {
+
+	if duration <= 0 {
+		panic("duration must be greater than 0")
+	}
+
+	return func(c *profilingSnapshotConfig) {
+		c.cpuProfileDuration = duration
+	}
+}
+
+// processStats contains the resource usage of the process.
+type processStats struct {
+	cpu time.Duration
+	rss uint64
+}
+
+// readProcessStats returns the CPU time consumed by the
+// process and its resident set size.
+func readProcessStats() (processStats, error) {
+
+	p, err := process.NewProcess(int32(os.Getpid()))
+	if err != nil {
+		return processStats{}, fmt.Errorf("unable to get process: %w", err)
+	}
+
+	times, err := p.Times()
+	if err != nil {
+		return processStats{}, fmt.Errorf("unable to get cpu times: %w", err)
+	}
+
+	mem, err := p.MemoryInfo()
+	if err != nil {
+		return processStats{}, fmt.Errorf("unable to get memory info: %w", err)
+	}
+
+	return processStats{
+		cpu: time.Duration((times.User + times.System) * float64(time.Second)),
+		rss: mem.RSS,
+	}, nil
+}
+
+// profilingSnapshotter periodically checks the configured
+// thresholds and captures profiles when they are crossed.
+type profilingSnapshotter struct {
+	dir   string
+	cfg   profilingSnapshotConfig
+	stats func() (processStats, error)
+
+	latencies     []time.Duration
+	latencyCount  int64
+	latenciesLock sync.Mutex
+
+	lastStats    processStats
+	lastStatsAt  time.Time
+	lastCapture  time.Time
+	statsWarned  bool
+	captureMutex sync.Mutex
+}
+
+func newProfilingSnapshotter(dir string, options ...ProfilingSnapshotOption) *profilingSnapshotter {
+
+	cfg := profilingSnapshotConfig{
+		interval:           defaultProfilingSnapshotInterval,
+		cooldown:           defaultProfilingSnapshotCooldown,
+		retention:          defaultProfilingSnapshotRetention,
+		cpuProfileDuration: defaultProfilingSnapshotCPUTime,
+	}
+
+	for _, opt := range options {
+		opt(&cfg)
+	}
+
+	return &profilingSnapshotter{
+		dir:   dir,
+		cfg:   cfg,
+		stats: readProcessStats,
+	}
+}
+
+// observeLatency records the latency of a request. Once the maximum
+// number of samples is reached, the latencies are kept using reservoir
+// sampling so the samples stay representative of the whole interval.
+func (s *profilingSnapshotter) observeLatency(latency time.Duration) {
+
+	if s.cfg.latencyThreshold == 0 {
+		return
+	}
+
+	s.latenciesLock.Lock()
+	defer s.latenciesLock.Unlock()
+
+	s.latencyCount++
+
+	if len(s.latencies) < profilingSnapshotLatencySamples {
+		s.latencies = append(s.latencies, latency)
+		return
+	}
+
+	if i := rand.Int63n(s.latencyCount); i < profilingSnapshotLatencySamples {
+		s.latencies[i] = latency
+	}
+}
+
+// latencyP99 returns the 99th percentile of the latencies
+// recorded since the last call and resets them.
+func (s *profilingSnapshotter) latencyP99() time.Duration {
+
+	s.latenciesLock.Lock()
+	latencies := s.latencies
+	s.latencies = nil
+	s.latencyCount = 0
+	s.latenciesLock.Unlock()
+
+	if len(latencies) == 0 {
+		return 0
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	return latencies[(len(latencies)*99-1)/100]
+}
+
+// run checks the thresholds every interval until the
+// given context is canceled.
+func (s *profilingSnapshotter) run(ctx context.Context) {
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		zap.L().Error("Unable to create profiling snapshots directory. Snapshots disabled",
+			zap.String("dir", s.dir),
+			zap.Error(err),
+		)
+		return
+	}
+
+	if runtime.SetMutexProfileFraction(-1) == 0 {
+		runtime.SetMutexProfileFraction(profilingSnapshotMutexFraction)
+		defer runtime.SetMutexProfileFraction(0)
+	}
+
+	ticker := time.NewTicker(s.cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if reason := s.check(time.Now()); reason != "" {
+				if _, err := s.capture(ctx, reason); err != nil {
+					zap.L().Error("Unable to capture profiling snapshot", zap.String("reason", reason), zap.Error(err))
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check returns the reason for which a snapshot must be
+// captured, or an empty string if no threshold is crossed
+// or if the cooldown period is not over.
+func (s *profilingSnapshotter) check(now time.Time) string {
+
+	reason := s.crossedThreshold(now)
+	if reason == "" {
+		return ""
+	}
+
+	if !s.lastCapture.IsZero() && now.Sub(s.lastCapture) < s.cfg.cooldown {
+		return ""
+	}
+
+	return reason
+}
+
+func (s *profilingSnapshotter) crossedThreshold(now time.Time) string {
+
+	// The latencies must be consumed at every check
+	// to only account for the last interval.
+	var p99 time.Duration
+	if s.cfg.latencyThreshold > 0 {
+		p99 = s.latencyP99()
+	}
+
+	if s.cfg.cpuThreshold > 0 || s.cfg.rssThreshold > 0 {
+
+		stats, err := s.stats()
+		switch {
+
+		case err != nil:
+			if !s.statsWarned {
+				zap.L().Warn("Unable to read process stats. CPU and RSS thresholds ignored", zap.Error(err))
+				s.statsWarned = true
+			}
+
+		default:
+			previous, previousAt := s.lastStats, s.lastStatsAt
+			s.lastStats, s.lastStatsAt = stats, now
+
+			if s.cfg.cpuThreshold > 0 && !previousAt.IsZero() {
+				wall := now.Sub(previousAt) * time.Duration(runtime.GOMAXPROCS(0))
+				if wall > 0 && float64(stats.cpu-previous.cpu)/float64(wall)*100 >= s.cfg.cpuThreshold {
+					return ProfilingSnapshotReasonCPU
+				}
+			}
+
+			if s.cfg.rssThreshold > 0 && stats.rss >= s.cfg.rssThreshold {
+				return ProfilingSnapshotReasonRSS
+			}
+		}
+	}
+
+	if s.cfg.goroutineThreshold > 0 && runtime.NumGoroutine() >= s.cfg.goroutineThreshold {
+		return ProfilingSnapshotReasonGoroutines
+	}
+
+	if s.cfg.latencyThreshold > 0 && p99 >= s.cfg.latencyThreshold {
+		return ProfilingSnapshotReasonLatency
+	}
+
+	return ""
+}
+
+// capture writes the CPU, heap, goroutine and mutex profiles
+// in a new snapshot directory, then applies the retention.
+func (s *profilingSnapshotter) capture(ctx context.Context, reason string) (string, error) {
+
+	s.captureMutex.Lock()
+	defer s.captureMutex.Unlock()
+
+	now := time.Now().UTC()
+	s.lastCapture = now
+
+	name := fmt.Sprintf("%s-%s", now.Format(profilingSnapshotTimeFormat), reason)
+	dir := filepath.Join(s.dir, name)
+
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", fmt.Errorf("unable to create snapshot directory: %w", err)
+	}
+
+	zap.L().Info("Capturing profiling snapshot", zap.String("name", name), zap.String("reason", reason))
+
+	if err := s.captureCPU(ctx, filepath.Join(dir, "cpu.pprof")); err != nil {
+		// The CPU profile may already be recorded by someone using
+		// the live pprof endpoint. We still capture the other ones.
+		zap.L().Warn("Unable to capture CPU profile", zap.String("name", name), zap.Error(err))
+	}
+
+	for _, p := range []string{"heap", "goroutine", "mutex"} {
+		if err := writeProfile(p, filepath.Join(dir, p+".pprof")); err != nil {
+			return name, err
+		}
+	}
+
+	s.applyRetention()
+
+	return name, nil
+}
+
+func (s *profilingSnapshotter) captureCPU(ctx context.Context, path string) error {
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()       // nolint: errcheck
+		os.Remove(path) // nolint: errcheck
+		return err
+	}
+
+	timer := time.NewTimer(s.cfg.cpuProfileDuration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	pprof.StopCPUProfile()
+
+	return f.Close()
+}
+
+func writeProfile(name string, path string) error {
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("unable to create %s profile: %w", name, err)
+	}
+
+	if err := pprof.Lookup(name).WriteTo(f, 0); err != nil {
+		f.Close() // nolint: errcheck
+		return fmt.Errorf("unable to write %s profile: %w", name, err)
+	}
+
+	return f.Close()
+}
+
+// applyRetention deletes the oldest snapshots
+// above the configured retention.
+func (s *profilingSnapshotter) applyRetention() {
+
+	snapshots, err := s.list()
+	if err != nil {
+		zap.L().Error("Unable to list profiling snapshots", zap.Error(err))
+		return
+	}
+
+	for i := 0; i < len(snapshots)-s.cfg.retention; i++ {
+		if err := os.RemoveAll(filepath.Join(s.dir, snapshots[i].Name)); err != nil {
+			zap.L().Error("Unable to delete profiling snapshot", zap.String("name", snapshots[i].Name), zap.Error(err))
+		}
+	}
+}
+
+// list returns the snapshots present in the directory,
+// from the oldest to the most recent.
+func (s *profilingSnapshotter) list() ([]ProfilingSnapshot, error) {
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []ProfilingSnapshot{}
+
+	for _, entry := range entries {
+
+		if !entry.IsDir() {
+			continue
+		}
+
+		parts := strings.SplitN(entry.Name(), "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		t, err := time.Parse(profilingSnapshotTimeFormat, parts[0])
+		if err != nil {
+			continue
+		}
+
+		files, err := os.ReadDir(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		snapshot := ProfilingSnapshot{
+			Name:   entry.Name(),
+			Reason: parts[1],
+			Time:   t,
+			Files:  make([]string, 0, len(files)),
+		}
+
+		for _, f := range files {
+			snapshot.Files = append(snapshot.Files, f.Name())
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+
+	return snapshots, nil
+}
+
+// ServeHTTP lists the snapshots on /debug/snapshots and
+// serves the files on /debug/snapshots/<name>/<file>.
+func (s *profilingSnapshotter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/debug/snapshots"), "/")
+
+	if path == "" {
+
+		snapshots, err := s.list()
+		if err != nil {
+			http.Error(w, "Unable to list snapshots", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		if err := json.NewEncoder(w).Encode(snapshots); err != nil {
+			zap.L().Error("Unable to encode profiling snapshots", zap.Error(err))
+		}
+
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || !isSafePathElement(parts[0]) || !isSafePathElement(parts[1]) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	file := filepath.Join(s.dir, parts[0], parts[1])
+	if info, err := os.Stat(file); err != nil || info.IsDir() {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s"`, parts[0], parts[1]))
+	http.ServeFile(w, r, file)
+}
+
+func isSafePathElement(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\`)
+}
@@ -0,0 +1,275 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProfilingSnapshotter_latencyP99(t *testing.T) {
+
+	Convey("Given I have a snapshotter with a latency threshold", t, func() {
+
+		s := newProfilingSnapshotter(t.TempDir(), ProfilingSnapshotOptLatencyThreshold(time.Second))
+
+		Convey("When I observe 100 latencies", func() {
+
+			for i := 1; i <= 100; i++ {
+				s.observeLatency(time.Duration(i) * time.Millisecond)
+			}
+
+			Convey("Then the p99 should be correct and the latencies reset", func() {
+				So(s.latencyP99(), ShouldEqual, 99*time.Millisecond)
+				So(s.latencyP99(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I observe more latencies than the number of samples", func() {
+
+			for i := 0; i < profilingSnapshotLatencySamples; i++ {
+				s.observeLatency(time.Millisecond)
+			}
+			for i := 0; i < 9*profilingSnapshotLatencySamples; i++ {
+				s.observeLatency(time.Second)
+			}
+
+			Convey("Then the samples should account for the latest latencies", func() {
+				So(len(s.latencies), ShouldEqual, profilingSnapshotLatencySamples)
+				So(s.latencyP99(), ShouldEqual, time.Second)
+			})
+		})
+	})
+
+	Convey("Given I have a snapshotter without latency threshold", t, func() {
+
+		s := newProfilingSnapshotter(t.TempDir())
+
+		Convey("When I observe a latency", func() {
+
+			s.observeLatency(time.Second)
+
+			Convey("Then it should not be recorded", func() {
+				So(s.latencies, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestProfilingSnapshotter_readProcessStats(t *testing.T) {
+
+	Convey("When I read the process stats", t, func() {
+
+		stats, err := readProcessStats()
+
+		Convey("Then they should be correct", func() {
+			So(err, ShouldBeNil)
+			So(stats.rss, ShouldBeGreaterThan, 0)
+		})
+	})
+}
+
+func TestProfilingSnapshotter_check(t *testing.T) {
+
+	Convey("Given I have a snapshotter with CPU and RSS thresholds", t, func() {
+
+		stats := processStats{}
+		s := newProfilingSnapshotter(
+			t.TempDir(),
+			ProfilingSnapshotOptCPUThreshold(50),
+			ProfilingSnapshotOptRSSThreshold(1024),
+			ProfilingSnapshotOptCooldown(time.Minute),
+		)
+		s.stats = func() (processStats, error) { return stats, nil }
+
+		now := time.Now()
+
+		Convey("When nothing is crossed", func() {
+
+			stats.rss = 512
+			So(s.check(now), ShouldBeEmpty)
+
+			stats.cpu = time.Duration(float64(10*time.Second) * 0.1 * float64(runtime.GOMAXPROCS(0)))
+			So(s.check(now.Add(10*time.Second)), ShouldBeEmpty)
+		})
+
+		Convey("When the CPU usage is crossed", func() {
+
+			So(s.check(now), ShouldBeEmpty)
+
+			stats.cpu = time.Duration(float64(10*time.Second) * 0.8 * float64(runtime.GOMAXPROCS(0)))
+			So(s.check(now.Add(10*time.Second)), ShouldEqual, ProfilingSnapshotReasonCPU)
+		})
+
+		Convey("When the RSS is crossed", func() {
+
+			stats.rss = 2048
+			So(s.check(now), ShouldEqual, ProfilingSnapshotReasonRSS)
+
+			Convey("Then it should not trigger again during the cooldown", func() {
+				s.lastCapture = now
+				So(s.check(now.Add(30*time.Second)), ShouldBeEmpty)
+				So(s.check(now.Add(2*time.Minute)), ShouldEqual, ProfilingSnapshotReasonRSS)
+			})
+		})
+
+		Convey("When the stats cannot be read", func() {
+
+			s.stats = func() (processStats, error) { return processStats{}, fmt.Errorf("boom") }
+
+			So(s.check(now), ShouldBeEmpty)
+			So(s.statsWarned, ShouldBeTrue)
+		})
+	})
+
+	Convey("Given I have a snapshotter with a goroutine threshold", t, func() {
+
+		s := newProfilingSnapshotter(t.TempDir(), ProfilingSnapshotOptGoroutineThreshold(1))
+
+		Convey("Then check should return the goroutines reason", func() {
+			So(s.check(time.Now()), ShouldEqual, ProfilingSnapshotReasonGoroutines)
+		})
+	})
+
+	Convey("Given I have a snapshotter with a latency threshold", t, func() {
+
+		s := newProfilingSnapshotter(t.TempDir(), ProfilingSnapshotOptLatencyThreshold(100*time.Millisecond))
+
+		Convey("Then check should return the latency reason only when crossed", func() {
+			s.observeLatency(10 * time.Millisecond)
+			So(s.check(time.Now()), ShouldBeEmpty)
+
+			s.observeLatency(time.Second)
+			So(s.check(time.Now()), ShouldEqual, ProfilingSnapshotReasonLatency)
+		})
+	})
+}
+
+func TestProfilingSnapshotter_capture(t *testing.T) {
+
+	Convey("Given I have a snapshotter with a retention of 2", t, func() {
+
+		dir := t.TempDir()
+		s := newProfilingSnapshotter(
+			dir,
+			ProfilingSnapshotOptRetention(2),
+			ProfilingSnapshotOptCPUProfileDuration(10*time.Millisecond),
+		)
+
+		Convey("When I capture 3 snapshots", func() {
+
+			var names []string
+			for _, reason := range []string{ProfilingSnapshotReasonCPU, ProfilingSnapshotReasonRSS, ProfilingSnapshotReasonLatency} {
+				name, err := s.capture(context.Background(), reason)
+				So(err, ShouldBeNil)
+				names = append(names, name)
+				time.Sleep(2 * time.Millisecond)
+			}
+
+			Convey("Then only the 2 most recent should be kept", func() {
+				snapshots, err := s.list()
+				So(err, ShouldBeNil)
+				So(len(snapshots), ShouldEqual, 2)
+				So(snapshots[0].Name, ShouldEqual, names[1])
+				So(snapshots[0].Reason, ShouldEqual, ProfilingSnapshotReasonRSS)
+				So(snapshots[1].Name, ShouldEqual, names[2])
+				So(snapshots[1].Files, ShouldResemble, []string{"cpu.pprof", "goroutine.pprof", "heap.pprof", "mutex.pprof"})
+				So(s.lastCapture.IsZero(), ShouldBeFalse)
+
+				_, err = os.Stat(filepath.Join(dir, names[0]))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestProfilingSnapshotter_ServeHTTP(t *testing.T) {
+
+	Convey("Given I have a snapshotter with a snapshot", t, func() {
+
+		dir := t.TempDir()
+		s := newProfilingSnapshotter(dir)
+
+		name := fmt.Sprintf("%s-%s", time.Now().UTC().Format(profilingSnapshotTimeFormat), ProfilingSnapshotReasonGoroutines)
+		So(os.Mkdir(filepath.Join(dir, name), 0700), ShouldBeNil)
+		So(os.WriteFile(filepath.Join(dir, name, "heap.pprof"), []byte("heap"), 0600), ShouldBeNil)
+		So(os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0600), ShouldBeNil)
+
+		Convey("When I list the snapshots", func() {
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/snapshots", nil))
+
+			Convey("Then the response should be correct", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+
+				var snapshots []ProfilingSnapshot
+				So(json.Unmarshal(w.Body.Bytes(), &snapshots), ShouldBeNil)
+				So(len(snapshots), ShouldEqual, 1)
+				So(snapshots[0].Name, ShouldEqual, name)
+				So(snapshots[0].Reason, ShouldEqual, ProfilingSnapshotReasonGoroutines)
+				So(snapshots[0].Files, ShouldResemble, []string{"heap.pprof"})
+			})
+		})
+
+		Convey("When I download a file", func() {
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/snapshots/"+name+"/heap.pprof", nil))
+
+			Convey("Then the response should be correct", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Body.String(), ShouldEqual, "heap")
+			})
+		})
+
+		Convey("When I try to download a file outside of a snapshot", func() {
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/snapshots/secret", nil))
+
+			Convey("Then the response should be 404", func() {
+				So(w.Code, ShouldEqual, http.StatusNotFound)
+			})
+		})
+
+		Convey("When I try to download a missing file", func() {
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/snapshots/"+name+"/nope", nil))
+
+			Convey("Then the response should be 404", func() {
+				So(w.Code, ShouldEqual, http.StatusNotFound)
+			})
+		})
+
+		Convey("When I send a POST", func() {
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/debug/snapshots", nil))
+
+			Convey("Then the response should be 405", func() {
+				So(w.Code, ShouldEqual, http.StatusMethodNotAllowed)
+			})
+		})
+	})
+}
@@ -12,13 +12,18 @@
 package bahamut
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"time"
 
+	"github.com/gofrs/uuid"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
 	"github.com/opentracing/opentracing-go/log"
 	"go.aporeto.io/elemental"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 // ResponseMode represents the response that is expected to be produced by the subscriber
@@ -53,30 +58,73 @@ const (
 
 // Publication is a structure that can be published to a PublishServer.
 type Publication struct {
-	Data         []byte                     `msgpack:"data,omitempty" json:"data,omitempty"`
-	Topic        string                     `msgpack:"topic,omitempty" json:"topic,omitempty"`
-	Partition    int32                      `msgpack:"partition,omitempty" json:"partition,omitempty"`
-	TrackingName string                     `msgpack:"trackingName,omitempty" json:"trackingName,omitempty"`
-	TrackingData opentracing.TextMapCarrier `msgpack:"trackingData,omitempty" json:"trackingData,omitempty"`
-	Encoding     elemental.EncodingType     `msgpack:"encoding,omitempty" json:"encoding,omitempty"`
-	ResponseMode ResponseMode               `msgpack:"responseMode,omitempty" json:"responseMode,omitempty"`
+	Data            []byte                     `msgpack:"data,omitempty" json:"data,omitempty"`
+	Topic           string                     `msgpack:"topic,omitempty" json:"topic,omitempty"`
+	Partition       int32                      `msgpack:"partition,omitempty" json:"partition,omitempty"`
+	TrackingName    string                     `msgpack:"trackingName,omitempty" json:"trackingName,omitempty"`
+	TrackingData    opentracing.TextMapCarrier `msgpack:"trackingData,omitempty" json:"trackingData,omitempty"`
+	Encoding        elemental.EncodingType     `msgpack:"encoding,omitempty" json:"encoding,omitempty"`
+	ResponseMode    ResponseMode               `msgpack:"responseMode,omitempty" json:"responseMode,omitempty"`
+	Headers         map[string]string          `msgpack:"headers,omitempty" json:"headers,omitempty"`
+	ID              string                     `msgpack:"id,omitempty" json:"id,omitempty"`
+	Timestamp       time.Time                  `msgpack:"timestamp,omitempty" json:"timestamp,omitempty"`
+	TTL             time.Duration              `msgpack:"ttl,omitempty" json:"ttl,omitempty"`
+	Compression     PublicationCompression     `msgpack:"compression,omitempty" json:"compression,omitempty"`
+	Signature       []byte                     `msgpack:"signature,omitempty" json:"signature,omitempty"`
+	SignatureKeyID  string                     `msgpack:"signatureKeyID,omitempty" json:"signatureKeyID,omitempty"`
+	EncryptionKeyID string                     `msgpack:"encryptionKeyID,omitempty" json:"encryptionKeyID,omitempty"`
 
 	replyCh  chan *Publication
 	replied  bool
 	timedOut bool
 	mux      sync.Mutex
 	span     opentracing.Span
+	ackFunc  func() error
+	nakFunc  func() error
 }
 
-// NewPublication returns a new Publication.
+// NewPublication returns a new Publication with
+// a unique ID and the current time as timestamp.
 func NewPublication(topic string) *Publication {
 
 	return &Publication{
 		Topic:        topic,
 		TrackingData: opentracing.TextMapCarrier{},
+		ID:           uuid.Must(uuid.NewV4()).String(),
+		Timestamp:    time.Now(),
 	}
 }
 
+// SetHeader sets the header with the given key to the given value.
+func (p *Publication) SetHeader(key string, value string) {
+
+	if p.Headers == nil {
+		p.Headers = map[string]string{}
+	}
+
+	p.Headers[key] = value
+}
+
+// Header returns the value of the header with the given key,
+// or an empty string if it is not set.
+func (p *Publication) Header(key string) string {
+
+	return p.Headers[key]
+}
+
+// IsExpired returns true if the publication has a TTL and has been
+// created for longer than the TTL. As the timestamp is set by the
+// publisher, the TTL should be large compared to the clock skew
+// between the publishers and the subscribers.
+func (p *Publication) IsExpired() bool {
+
+	if p.TTL <= 0 || p.Timestamp.IsZero() {
+		return false
+	}
+
+	return time.Since(p.Timestamp) > p.TTL
+}
+
 // Encode the given object into the publication.
 func (p *Publication) Encode(o any) error {
 	return p.EncodeWithEncoding(o, elemental.EncodingTypeMSGPACK)
@@ -92,6 +140,7 @@ func (p *Publication) EncodeWithEncoding(o any, encoding elemental.EncodingType)
 
 	p.Data = data
 	p.Encoding = encoding
+	p.Compression = PublicationCompressionNone
 
 	if p.span != nil {
 		p.span.LogFields(log.Object("payload", string(p.Data)))
@@ -100,14 +149,43 @@ func (p *Publication) EncodeWithEncoding(o any, encoding elemental.EncodingType)
 	return nil
 }
 
-// Decode decodes the data into the given dest.
+// Compress compresses the data of the publication using the given
+// compression. It does nothing if the data is already compressed.
+//
+// Subscribers running a version of bahamut that does not support
+// compression will not be able to decode compressed publications,
+// so make sure all of them are up to date before compressing.
+func (p *Publication) Compress(compression PublicationCompression) error {
+
+	if compression == PublicationCompressionNone || p.Compression != PublicationCompressionNone {
+		return nil
+	}
+
+	data, err := compressPublicationData(compression, p.Data)
+	if err != nil {
+		return err
+	}
+
+	p.Data = data
+	p.Compression = compression
+
+	return nil
+}
+
+// Decode decodes the data into the given dest,
+// decompressing it first if needed.
 func (p *Publication) Decode(dest any) error {
 
+	data, err := decompressPublicationData(p.Compression, p.Data)
+	if err != nil {
+		return fmt.Errorf("unable to decompress publication data: %w", err)
+	}
+
 	if p.span != nil {
-		p.span.LogFields(log.Object("payload", string(p.Data)))
+		p.span.LogFields(log.Object("payload", string(data)))
 	}
 
-	return elemental.Decode(p.Encoding, p.Data, dest)
+	return elemental.Decode(p.Encoding, data, dest)
 }
 
 // StartTracingFromSpan starts a new child opentracing.Span using the given span as parent.
@@ -140,6 +218,24 @@ func (p *Publication) StartTracing(tracer opentracing.Tracer, name string) {
 
 }
 
+// InjectTraceContext injects the W3C trace context of the OpenTelemetry
+// span contained in the given context into the TrackingData.
+func (p *Publication) InjectTraceContext(ctx context.Context) {
+
+	if p.TrackingData == nil {
+		p.TrackingData = opentracing.TextMapCarrier{}
+	}
+
+	otelPropagator.Inject(ctx, propagation.MapCarrier(p.TrackingData))
+}
+
+// ExtractTraceContext returns a copy of the given context containing the
+// OpenTelemetry span context carried in the TrackingData, if any.
+func (p *Publication) ExtractTraceContext(ctx context.Context) context.Context {
+
+	return otelPropagator.Extract(ctx, propagation.MapCarrier(p.TrackingData))
+}
+
 // Span returns the current tracking span.
 func (p *Publication) Span() opentracing.Span {
 
@@ -156,7 +252,23 @@ func (p *Publication) Duplicate() *Publication {
 	pub.TrackingData = p.TrackingData
 	pub.Encoding = p.Encoding
 	pub.ResponseMode = p.ResponseMode
+	pub.ID = p.ID
+	pub.Timestamp = p.Timestamp
+	pub.TTL = p.TTL
+	pub.Compression = p.Compression
+	pub.Signature = p.Signature
+	pub.SignatureKeyID = p.SignatureKeyID
+	pub.EncryptionKeyID = p.EncryptionKeyID
 	pub.span = p.span
+	pub.ackFunc = p.ackFunc
+	pub.nakFunc = p.nakFunc
+
+	if p.Headers != nil {
+		pub.Headers = make(map[string]string, len(p.Headers))
+		for k, v := range p.Headers {
+			pub.Headers[k] = v
+		}
+	}
 
 	return pub
 }
@@ -193,3 +305,29 @@ func (p *Publication) setExpired() {
 	p.timedOut = true
 	p.replyCh = nil
 }
+
+// Ack acknowledges the publication, when it has been received by
+// a PubSubClient that requires explicit acknowledgements, like the one
+// backed by NATS JetStream. The publication will not be redelivered.
+// It does nothing for the other publications.
+func (p *Publication) Ack() error {
+
+	if p.ackFunc == nil {
+		return nil
+	}
+
+	return p.ackFunc()
+}
+
+// Nak negatively acknowledges the publication, when it has been received
+// by a PubSubClient that requires explicit acknowledgements, like the one
+// backed by NATS JetStream. The publication will be redelivered.
+// It does nothing for the other publications.
+func (p *Publication) Nak() error {
+
+	if p.nakFunc == nil {
+		return nil
+	}
+
+	return p.nakFunc()
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxDecompressedPublicationSize is the maximum size of the
+// decompressed data of a publication.
+const maxDecompressedPublicationSize = 64 << 20
+
+// PublicationCompression represents the compression
+// algorithm used for the data of a Publication.
+type PublicationCompression string
+
+// Various values of PublicationCompression.
+const (
+	PublicationCompressionNone PublicationCompression = ""
+	PublicationCompressionGzip PublicationCompression = "gzip"
+	PublicationCompressionZstd PublicationCompression = "zstd"
+)
+
+var (
+	zstdEncoder     *zstd.Encoder
+	zstdDecoder     *zstd.Decoder
+	zstdEncoderOnce sync.Once
+	zstdDecoderOnce sync.Once
+)
+
+func compressPublicationData(compression PublicationCompression, data []byte) ([]byte, error) {
+
+	switch compression {
+
+	case PublicationCompressionNone:
+		return data, nil
+
+	case PublicationCompressionGzip:
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	case PublicationCompressionZstd:
+		zstdEncoderOnce.Do(func() { zstdEncoder, _ = zstd.NewWriter(nil) })
+		return zstdEncoder.EncodeAll(data, nil), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported publication compression '%s'", compression)
+	}
+}
+
+func decompressPublicationData(compression PublicationCompression, data []byte) ([]byte, error) {
+
+	switch compression {
+
+	case PublicationCompressionNone:
+		return data, nil
+
+	case PublicationCompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close() // nolint: errcheck
+
+		out, err := io.ReadAll(io.LimitReader(r, maxDecompressedPublicationSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > maxDecompressedPublicationSize {
+			return nil, fmt.Errorf("decompressed publication data exceeds %d bytes", maxDecompressedPublicationSize)
+		}
+		return out, nil
+
+	case PublicationCompressionZstd:
+		zstdDecoderOnce.Do(func() {
+			zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedPublicationSize))
+		})
+		return zstdDecoder.DecodeAll(data, nil)
+
+	default:
+		return nil, fmt.Errorf("unsupported publication compression '%s'", compression)
+	}
+}
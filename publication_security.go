@@ -0,0 +1,493 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Various reasons of rejection reported to PubSubMetrics.RegisterRejectedPublication.
+const (
+	PubSubRejectionReasonUnsigned         = "unsigned"
+	PubSubRejectionReasonInvalidSignature = "invalid_signature"
+	PubSubRejectionReasonUndecryptable    = "undecryptable"
+)
+
+// A PublicationSigner signs the publications sent by a PubSubClient.
+type PublicationSigner interface {
+
+	// Sign returns the signature of the given data,
+	// and the ID of the key used to compute it.
+	Sign(data []byte) (keyID string, signature []byte, err error)
+}
+
+// A PublicationVerifier verifies the signature of the
+// publications received by a PubSubClient.
+type PublicationVerifier interface {
+
+	// Verify returns an error if the given signature of the given
+	// data has not been computed with the key with the given ID.
+	Verify(keyID string, data []byte, signature []byte) error
+}
+
+// A PublicationEncrypter encrypts the data of the publications sent by
+// a PubSubClient, and decrypts the data of the ones it receives.
+type PublicationEncrypter interface {
+
+	// Encrypt returns the encrypted data, and the
+	// ID of the key used to encrypt it.
+	Encrypt(data []byte) (keyID string, ciphertext []byte, err error)
+
+	// Decrypt returns the data decrypted using the key with the given ID.
+	Decrypt(keyID string, ciphertext []byte) ([]byte, error)
+}
+
+// An HMACPublicationKeyring is both a PublicationSigner and a
+// PublicationVerifier using HMAC-SHA256 with shared secrets.
+type HMACPublicationKeyring struct {
+	signingKeyID string
+	keys         map[string][]byte
+	lock         sync.RWMutex
+}
+
+// NewHMACPublicationKeyring returns a new HMACPublicationKeyring
+// signing with the key with the given signingKeyID, and accepting
+// the signatures made with any of the given keys.
+func NewHMACPublicationKeyring(signingKeyID string, keys map[string][]byte) (*HMACPublicationKeyring, error) {
+
+	k := &HMACPublicationKeyring{}
+
+	if err := k.Rotate(signingKeyID, keys); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Rotate replaces the keys of the keyring. To rotate keys without
+// rejecting valid publications, first add the new key to the keys of
+// all the verifiers, then start signing with it, and finally remove
+// the old key once all the publications signed with it are consumed.
+func (k *HMACPublicationKeyring) Rotate(signingKeyID string, keys map[string][]byte) error {
+
+	if err := checkPublicationKeys(signingKeyID, len(keys), keys[signingKeyID] != nil); err != nil {
+		return err
+	}
+
+	copied := make(map[string][]byte, len(keys))
+	for id, key := range keys {
+		if len(key) == 0 {
+			return fmt.Errorf("key '%s' must not be empty", id)
+		}
+		copied[id] = append([]byte(nil), key...)
+	}
+
+	k.lock.Lock()
+	k.signingKeyID = signingKeyID
+	k.keys = copied
+	k.lock.Unlock()
+
+	return nil
+}
+
+// Sign implements PublicationSigner.
+func (k *HMACPublicationKeyring) Sign(data []byte) (string, []byte, error) {
+
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	return k.signingKeyID, computeHMAC(k.keys[k.signingKeyID], data), nil
+}
+
+// Verify implements PublicationVerifier.
+func (k *HMACPublicationKeyring) Verify(keyID string, data []byte, signature []byte) error {
+
+	k.lock.RLock()
+	key, ok := k.keys[keyID]
+	k.lock.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("unknown key '%s'", keyID)
+	}
+
+	if !hmac.Equal(computeHMAC(key, data), signature) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+func computeHMAC(key []byte, data []byte) []byte {
+
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(data)
+
+	return mac.Sum(nil)
+}
+
+// An Ed25519PublicationSigner is a PublicationSigner using an Ed25519 private key.
+type Ed25519PublicationSigner struct {
+	keyID string
+	key   ed25519.PrivateKey
+	lock  sync.RWMutex
+}
+
+// NewEd25519PublicationSigner returns a new Ed25519PublicationSigner
+// signing with the given key, identified by the given keyID.
+func NewEd25519PublicationSigner(keyID string, key ed25519.PrivateKey) (*Ed25519PublicationSigner, error) {
+
+	s := &Ed25519PublicationSigner{}
+
+	if err := s.Rotate(keyID, key); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Rotate replaces the key used to sign. The public key must
+// have been added to the verifiers beforehand.
+func (s *Ed25519PublicationSigner) Rotate(keyID string, key ed25519.PrivateKey) error {
+
+	if keyID == "" {
+		return errors.New("key ID must not be empty")
+	}
+
+	if len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("invalid ed25519 private key size %d", len(key))
+	}
+
+	s.lock.Lock()
+	s.keyID = keyID
+	s.key = key
+	s.lock.Unlock()
+
+	return nil
+}
+
+// Sign implements PublicationSigner.
+func (s *Ed25519PublicationSigner) Sign(data []byte) (string, []byte, error) {
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.keyID, ed25519.Sign(s.key, data), nil
+}
+
+// An Ed25519PublicationVerifier is a PublicationVerifier
+// using a set of Ed25519 public keys.
+type Ed25519PublicationVerifier struct {
+	keys map[string]ed25519.PublicKey
+	lock sync.RWMutex
+}
+
+// NewEd25519PublicationVerifier returns a new Ed25519PublicationVerifier
+// accepting the signatures made with any of the given keys.
+func NewEd25519PublicationVerifier(keys map[string]ed25519.PublicKey) (*Ed25519PublicationVerifier, error) {
+
+	v := &Ed25519PublicationVerifier{}
+
+	if err := v.Rotate(keys); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Rotate replaces the accepted keys.
+func (v *Ed25519PublicationVerifier) Rotate(keys map[string]ed25519.PublicKey) error {
+
+	if len(keys) == 0 {
+		return errors.New("at least one key must be given")
+	}
+
+	copied := make(map[string]ed25519.PublicKey, len(keys))
+	for id, key := range keys {
+		if len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid ed25519 public key size %d for key '%s'", len(key), id)
+		}
+		copied[id] = key
+	}
+
+	v.lock.Lock()
+	v.keys = copied
+	v.lock.Unlock()
+
+	return nil
+}
+
+// Verify implements PublicationVerifier.
+func (v *Ed25519PublicationVerifier) Verify(keyID string, data []byte, signature []byte) error {
+
+	v.lock.RLock()
+	key, ok := v.keys[keyID]
+	v.lock.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("unknown key '%s'", keyID)
+	}
+
+	if !ed25519.Verify(key, data, signature) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+// An AESGCMPublicationKeyring is a PublicationEncrypter using AES-GCM.
+type AESGCMPublicationKeyring struct {
+	encryptionKeyID string
+	aeads           map[string]cipher.AEAD
+	lock            sync.RWMutex
+}
+
+// NewAESGCMPublicationKeyring returns a new AESGCMPublicationKeyring
+// encrypting with the key with the given encryptionKeyID, and able to
+// decrypt the data encrypted with any of the given keys. The keys must
+// be 16, 24 or 32 bytes long to use AES-128, AES-192 or AES-256.
+func NewAESGCMPublicationKeyring(encryptionKeyID string, keys map[string][]byte) (*AESGCMPublicationKeyring, error) {
+
+	k := &AESGCMPublicationKeyring{}
+
+	if err := k.Rotate(encryptionKeyID, keys); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Rotate replaces the keys of the keyring. Like for the signing keys,
+// the new key must be known by all the subscribers before being used
+// for encryption.
+func (k *AESGCMPublicationKeyring) Rotate(encryptionKeyID string, keys map[string][]byte) error {
+
+	if err := checkPublicationKeys(encryptionKeyID, len(keys), keys[encryptionKeyID] != nil); err != nil {
+		return err
+	}
+
+	aeads := make(map[string]cipher.AEAD, len(keys))
+	for id, key := range keys {
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("invalid key '%s': %w", id, err)
+		}
+
+		if aeads[id], err = cipher.NewGCM(block); err != nil {
+			return fmt.Errorf("invalid key '%s': %w", id, err)
+		}
+	}
+
+	k.lock.Lock()
+	k.encryptionKeyID = encryptionKeyID
+	k.aeads = aeads
+	k.lock.Unlock()
+
+	return nil
+}
+
+// Encrypt implements PublicationEncrypter.
+// The random nonce is prepended to the ciphertext.
+func (k *AESGCMPublicationKeyring) Encrypt(data []byte) (string, []byte, error) {
+
+	k.lock.RLock()
+	keyID, aead := k.encryptionKeyID, k.aeads[k.encryptionKeyID]
+	k.lock.RUnlock()
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, err
+	}
+
+	return keyID, aead.Seal(nonce, nonce, data, []byte(keyID)), nil
+}
+
+// Decrypt implements PublicationEncrypter.
+func (k *AESGCMPublicationKeyring) Decrypt(keyID string, ciphertext []byte) ([]byte, error) {
+
+	k.lock.RLock()
+	aead, ok := k.aeads[keyID]
+	k.lock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key '%s'", keyID)
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, []byte(keyID))
+}
+
+func checkPublicationKeys(currentKeyID string, count int, hasCurrent bool) error {
+
+	switch {
+	case currentKeyID == "":
+		return errors.New("key ID must not be empty")
+	case count == 0:
+		return errors.New("at least one key must be given")
+	case !hasCurrent:
+		return fmt.Errorf("unknown key '%s'", currentKeyID)
+	}
+
+	return nil
+}
+
+// publicationSecurity holds what is used by a PubSubClient
+// to sign, verify, encrypt and decrypt the publications.
+type publicationSecurity struct {
+	signer    PublicationSigner
+	verifier  PublicationVerifier
+	encrypter PublicationEncrypter
+}
+
+// seal returns a copy of the given publication, with its data
+// encrypted and then signed if needed. It returns the publication
+// itself if there is nothing to do.
+func (s publicationSecurity) seal(publication *Publication) (*Publication, error) {
+
+	if s.signer == nil && s.encrypter == nil {
+		return publication, nil
+	}
+
+	sealed := publication.Duplicate()
+	sealed.Signature = nil
+	sealed.SignatureKeyID = ""
+
+	if s.encrypter != nil && sealed.EncryptionKeyID == "" {
+
+		keyID, ciphertext, err := s.encrypter.Encrypt(sealed.Data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encrypt publication. message dropped: %w", err)
+		}
+
+		sealed.Data = ciphertext
+		sealed.EncryptionKeyID = keyID
+	}
+
+	if s.signer != nil {
+
+		keyID, signature, err := s.signer.Sign(publicationSignedData(sealed))
+		if err != nil {
+			return nil, fmt.Errorf("unable to sign publication. message dropped: %w", err)
+		}
+
+		sealed.Signature = signature
+		sealed.SignatureKeyID = keyID
+	}
+
+	return sealed, nil
+}
+
+// open verifies the signature of the given received publication
+// and decrypts its data if needed. If the publication must be
+// rejected, it returns the reason and the error.
+func (s publicationSecurity) open(publication *Publication) (string, error) {
+
+	if s.verifier != nil {
+
+		if len(publication.Signature) == 0 {
+			return PubSubRejectionReasonUnsigned, errors.New("publication is not signed")
+		}
+
+		if err := s.verifier.Verify(publication.SignatureKeyID, publicationSignedData(publication), publication.Signature); err != nil {
+			return PubSubRejectionReasonInvalidSignature, err
+		}
+	}
+
+	if publication.EncryptionKeyID == "" {
+		return "", nil
+	}
+
+	if s.encrypter == nil {
+		return PubSubRejectionReasonUndecryptable, errors.New("publication is encrypted but no encrypter is configured")
+	}
+
+	data, err := s.encrypter.Decrypt(publication.EncryptionKeyID, publication.Data)
+	if err != nil {
+		return PubSubRejectionReasonUndecryptable, err
+	}
+
+	publication.Data = data
+	publication.EncryptionKeyID = ""
+
+	return "", nil
+}
+
+// publicationSignedData returns the data covered by the signature of the
+// given publication. The topic and the response mode are covered, so a
+// signed publication cannot be injected on another topic, while the
+// headers and the tracking data can be changed when it is forwarded.
+func publicationSignedData(p *Publication) []byte {
+
+	var timestamp int64
+	if !p.Timestamp.IsZero() {
+		timestamp = p.Timestamp.UnixNano()
+	}
+
+	fields := [][]byte{
+		[]byte(p.Topic),
+		[]byte(strconv.Itoa(int(p.ResponseMode))),
+		[]byte(p.ID),
+		[]byte(strconv.FormatInt(timestamp, 10)),
+		[]byte(strconv.FormatInt(int64(p.TTL), 10)),
+		[]byte(p.Encoding),
+		[]byte(p.Compression),
+		[]byte(p.EncryptionKeyID),
+		p.Data,
+	}
+
+	size := 0
+	for _, f := range fields {
+		size += 4 + len(f)
+	}
+
+	out := make([]byte, size)
+	offset := 0
+	for _, f := range fields {
+		binary.BigEndian.PutUint32(out[offset:], uint32(len(f)))
+		offset += 4 + copy(out[offset+4:], f)
+	}
+
+	return out
+}
+
+// rejectPublication logs and reports the rejection of
+// a received publication.
+func rejectPublication(metrics PubSubMetrics, topic string, reason string, err error) {
+
+	zap.L().Warn("Publication rejected. Message dropped.",
+		zap.String("topic", topic),
+		zap.String("reason", reason),
+		zap.Error(err),
+	)
+
+	if metrics != nil {
+		metrics.RegisterRejectedPublication(topic, reason)
+	}
+}
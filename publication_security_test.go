@@ -0,0 +1,242 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHMACPublicationKeyring(t *testing.T) {
+
+	Convey("Given I have an HMAC keyring", t, func() {
+
+		k, err := NewHMACPublicationKeyring("k1", map[string][]byte{"k1": []byte("secret1")})
+		So(err, ShouldBeNil)
+
+		keyID, sig, err := k.Sign([]byte("data"))
+		So(err, ShouldBeNil)
+		So(keyID, ShouldEqual, "k1")
+
+		Convey("Then the signature should be verified", func() {
+			So(k.Verify("k1", []byte("data"), sig), ShouldBeNil)
+		})
+
+		Convey("Then a signature of other data should be rejected", func() {
+			So(k.Verify("k1", []byte("other"), sig), ShouldNotBeNil)
+		})
+
+		Convey("Then a signature with an unknown key should be rejected", func() {
+			So(k.Verify("k2", []byte("data"), sig), ShouldNotBeNil)
+		})
+
+		Convey("When I rotate the keys keeping the old one", func() {
+
+			So(k.Rotate("k2", map[string][]byte{"k1": []byte("secret1"), "k2": []byte("secret2")}), ShouldBeNil)
+
+			Convey("Then I should sign with the new key and accept both", func() {
+				keyID, sig2, err := k.Sign([]byte("data"))
+				So(err, ShouldBeNil)
+				So(keyID, ShouldEqual, "k2")
+				So(k.Verify("k2", []byte("data"), sig2), ShouldBeNil)
+				So(k.Verify("k1", []byte("data"), sig), ShouldBeNil)
+			})
+		})
+
+		Convey("When I rotate with invalid keys", func() {
+
+			Convey("Then it should fail", func() {
+				So(k.Rotate("", map[string][]byte{"k1": []byte("s")}), ShouldNotBeNil)
+				So(k.Rotate("k1", nil), ShouldNotBeNil)
+				So(k.Rotate("k2", map[string][]byte{"k1": []byte("s")}), ShouldNotBeNil)
+				So(k.Rotate("k1", map[string][]byte{"k1": {}}), ShouldNotBeNil)
+				So(k.Verify("k1", []byte("data"), sig), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestEd25519Publication(t *testing.T) {
+
+	Convey("Given I have an ed25519 signer and verifier", t, func() {
+
+		pub1, priv1, _ := ed25519.GenerateKey(rand.Reader)
+		pub2, priv2, _ := ed25519.GenerateKey(rand.Reader)
+
+		s, err := NewEd25519PublicationSigner("k1", priv1)
+		So(err, ShouldBeNil)
+
+		v, err := NewEd25519PublicationVerifier(map[string]ed25519.PublicKey{"k1": pub1})
+		So(err, ShouldBeNil)
+
+		keyID, sig, err := s.Sign([]byte("data"))
+		So(err, ShouldBeNil)
+		So(keyID, ShouldEqual, "k1")
+
+		Convey("Then the signature should be verified", func() {
+			So(v.Verify("k1", []byte("data"), sig), ShouldBeNil)
+			So(v.Verify("k1", []byte("other"), sig), ShouldNotBeNil)
+			So(v.Verify("k2", []byte("data"), sig), ShouldNotBeNil)
+		})
+
+		Convey("When I rotate the keys", func() {
+
+			So(v.Rotate(map[string]ed25519.PublicKey{"k1": pub1, "k2": pub2}), ShouldBeNil)
+			So(s.Rotate("k2", priv2), ShouldBeNil)
+
+			Convey("Then both signatures should be verified", func() {
+				keyID, sig2, err := s.Sign([]byte("data"))
+				So(err, ShouldBeNil)
+				So(keyID, ShouldEqual, "k2")
+				So(v.Verify("k2", []byte("data"), sig2), ShouldBeNil)
+				So(v.Verify("k1", []byte("data"), sig), ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Creating an ed25519 signer or verifier with invalid keys should fail", t, func() {
+		_, err := NewEd25519PublicationSigner("k1", ed25519.PrivateKey("short"))
+		So(err, ShouldNotBeNil)
+		_, err = NewEd25519PublicationSigner("", nil)
+		So(err, ShouldNotBeNil)
+		_, err = NewEd25519PublicationVerifier(nil)
+		So(err, ShouldNotBeNil)
+		_, err = NewEd25519PublicationVerifier(map[string]ed25519.PublicKey{"k1": ed25519.PublicKey("short")})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestAESGCMPublicationKeyring(t *testing.T) {
+
+	Convey("Given I have an AES-GCM keyring", t, func() {
+
+		k, err := NewAESGCMPublicationKeyring("k1", map[string][]byte{"k1": make([]byte, 32)})
+		So(err, ShouldBeNil)
+
+		keyID, ciphertext, err := k.Encrypt([]byte("data"))
+		So(err, ShouldBeNil)
+		So(keyID, ShouldEqual, "k1")
+		So(string(ciphertext), ShouldNotContainSubstring, "data")
+
+		Convey("Then I should be able to decrypt it", func() {
+			data, err := k.Decrypt("k1", ciphertext)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "data")
+		})
+
+		Convey("Then decrypting tampered data should fail", func() {
+			ciphertext[len(ciphertext)-1] ^= 0xff
+			_, err := k.Decrypt("k1", ciphertext)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Then decrypting with an unknown key or truncated data should fail", func() {
+			_, err := k.Decrypt("k2", ciphertext)
+			So(err, ShouldNotBeNil)
+			_, err = k.Decrypt("k1", ciphertext[:4])
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Creating an AES-GCM keyring with an invalid key should fail", t, func() {
+		_, err := NewAESGCMPublicationKeyring("k1", map[string][]byte{"k1": []byte("short")})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestPublicationSecurity(t *testing.T) {
+
+	Convey("Given I have a publication security with signature and encryption", t, func() {
+
+		hk, _ := NewHMACPublicationKeyring("k1", map[string][]byte{"k1": []byte("secret")})
+		ek, _ := NewAESGCMPublicationKeyring("e1", map[string][]byte{"e1": make([]byte, 16)})
+		s := publicationSecurity{signer: hk, verifier: hk, encrypter: ek}
+
+		pub := NewPublication("topic")
+		pub.Data = []byte("data")
+
+		sealed, err := s.seal(pub)
+		So(err, ShouldBeNil)
+
+		Convey("Then the original publication should not be modified", func() {
+			So(sealed, ShouldNotEqual, pub)
+			So(string(pub.Data), ShouldEqual, "data")
+			So(pub.Signature, ShouldBeNil)
+		})
+
+		Convey("Then the sealed publication should be signed and encrypted", func() {
+			So(sealed.SignatureKeyID, ShouldEqual, "k1")
+			So(sealed.EncryptionKeyID, ShouldEqual, "e1")
+			So(string(sealed.Data), ShouldNotEqual, "data")
+		})
+
+		Convey("Then I should be able to open it, even if the headers changed", func() {
+			sealed.SetHeader("k", "v")
+			reason, err := s.open(sealed)
+			So(err, ShouldBeNil)
+			So(reason, ShouldEqual, "")
+			So(string(sealed.Data), ShouldEqual, "data")
+		})
+
+		Convey("Then opening it on another topic should fail", func() {
+			sealed.Topic = "other"
+			reason, err := s.open(sealed)
+			So(err, ShouldNotBeNil)
+			So(reason, ShouldEqual, PubSubRejectionReasonInvalidSignature)
+		})
+
+		Convey("Then opening it with another response mode should fail", func() {
+			sealed.ResponseMode = ResponseModeACK
+			reason, err := s.open(sealed)
+			So(err, ShouldNotBeNil)
+			So(reason, ShouldEqual, PubSubRejectionReasonInvalidSignature)
+		})
+
+		Convey("Then opening it with tampered data should fail", func() {
+			sealed.TTL = 42
+			reason, err := s.open(sealed)
+			So(err, ShouldNotBeNil)
+			So(reason, ShouldEqual, PubSubRejectionReasonInvalidSignature)
+		})
+
+		Convey("Then opening it without encrypter should fail", func() {
+			reason, err := publicationSecurity{verifier: hk}.open(sealed)
+			So(err, ShouldNotBeNil)
+			So(reason, ShouldEqual, PubSubRejectionReasonUndecryptable)
+		})
+
+		Convey("Then opening an unsigned publication should fail", func() {
+			reason, err := s.open(pub)
+			So(err, ShouldNotBeNil)
+			So(reason, ShouldEqual, PubSubRejectionReasonUnsigned)
+		})
+	})
+
+	Convey("Given I have an empty publication security", t, func() {
+
+		s := publicationSecurity{}
+		pub := NewPublication("topic")
+
+		Convey("Then seal and open should do nothing", func() {
+			sealed, err := s.seal(pub)
+			So(err, ShouldBeNil)
+			So(sealed, ShouldEqual, pub)
+
+			reason, err := s.open(pub)
+			So(err, ShouldBeNil)
+			So(reason, ShouldEqual, "")
+		})
+	})
+}
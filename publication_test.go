@@ -12,6 +12,8 @@
 package bahamut
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -28,6 +30,72 @@ func TestPublication_NewPublication(t *testing.T) {
 
 		Convey("Then the publication should be correctly initialized", func() {
 			So(publication.Topic, ShouldEqual, "topic")
+			So(publication.ID, ShouldNotBeEmpty)
+			So(publication.Timestamp, ShouldHappenWithin, time.Second, time.Now())
+			So(publication.TTL, ShouldEqual, 0)
+		})
+
+		Convey("Then another publication should have a different ID", func() {
+			So(NewPublication("topic").ID, ShouldNotEqual, publication.ID)
+		})
+	})
+}
+
+func TestPublication_Headers(t *testing.T) {
+
+	Convey("Given I have a publication", t, func() {
+
+		pub := NewPublication("topic")
+
+		Convey("When I set a header", func() {
+
+			pub.SetHeader("k", "v")
+
+			Convey("Then I should retrieve it", func() {
+				So(pub.Header("k"), ShouldEqual, "v")
+				So(pub.Header("other"), ShouldEqual, "")
+			})
+
+			Convey("Then it should survive an encoding round trip", func() {
+				data, err := elemental.Encode(elemental.EncodingTypeMSGPACK, pub)
+				So(err, ShouldBeNil)
+
+				decoded := &Publication{}
+				So(elemental.Decode(elemental.EncodingTypeMSGPACK, data, decoded), ShouldBeNil)
+				So(decoded.Header("k"), ShouldEqual, "v")
+				So(decoded.ID, ShouldEqual, pub.ID)
+				So(decoded.Timestamp.Equal(pub.Timestamp), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestPublication_IsExpired(t *testing.T) {
+
+	Convey("Given I have a publication", t, func() {
+
+		pub := NewPublication("topic")
+
+		Convey("Then it should not expire without TTL", func() {
+			pub.Timestamp = time.Now().Add(-time.Hour)
+			So(pub.IsExpired(), ShouldBeFalse)
+		})
+
+		Convey("Then it should not expire without timestamp", func() {
+			pub.Timestamp = time.Time{}
+			pub.TTL = time.Second
+			So(pub.IsExpired(), ShouldBeFalse)
+		})
+
+		Convey("Then it should not be expired before its TTL", func() {
+			pub.TTL = time.Minute
+			So(pub.IsExpired(), ShouldBeFalse)
+		})
+
+		Convey("Then it should be expired after its TTL", func() {
+			pub.Timestamp = time.Now().Add(-2 * time.Minute)
+			pub.TTL = time.Minute
+			So(pub.IsExpired(), ShouldBeTrue)
 		})
 	})
 }
@@ -133,6 +201,102 @@ func TestPublication_EncodeDecode(t *testing.T) {
 	})
 }
 
+func TestPublication_Compression(t *testing.T) {
+
+	for _, compression := range []PublicationCompression{PublicationCompressionGzip, PublicationCompressionZstd} {
+
+		Convey(fmt.Sprintf("Given I have a publication compressed with %s", compression), t, func() {
+
+			in := map[string]string{"a": strings.Repeat("hello ", 1000)}
+
+			pub := NewPublication("topic")
+			So(pub.Encode(in), ShouldBeNil)
+			size := len(pub.Data)
+
+			So(pub.Compress(compression), ShouldBeNil)
+
+			Convey("Then the data should be compressed", func() {
+				So(pub.Compression, ShouldEqual, compression)
+				So(len(pub.Data), ShouldBeLessThan, size)
+			})
+
+			Convey("Then compressing it again should do nothing", func() {
+				data := pub.Data
+				So(pub.Compress(PublicationCompressionGzip), ShouldBeNil)
+				So(pub.Data, ShouldResemble, data)
+			})
+
+			Convey("Then I should be able to decode it after an encoding round trip", func() {
+				data, err := elemental.Encode(elemental.EncodingTypeMSGPACK, pub)
+				So(err, ShouldBeNil)
+
+				received := NewPublication("")
+				So(elemental.Decode(elemental.EncodingTypeMSGPACK, data, received), ShouldBeNil)
+				So(received.Compression, ShouldEqual, compression)
+
+				out := map[string]string{}
+				So(received.Decode(&out), ShouldBeNil)
+				So(out, ShouldResemble, in)
+			})
+
+			Convey("Then encoding it again should reset the compression", func() {
+				So(pub.Encode(in), ShouldBeNil)
+				So(pub.Compression, ShouldEqual, PublicationCompressionNone)
+			})
+		})
+	}
+
+	Convey("Given I have a publication from a peer that does not compress", t, func() {
+
+		payload, err := elemental.Encode(elemental.EncodingTypeMSGPACK, map[string]string{"a": "b"})
+		So(err, ShouldBeNil)
+
+		data, err := elemental.Encode(elemental.EncodingTypeMSGPACK, map[string]any{
+			"topic":    "topic",
+			"encoding": elemental.EncodingTypeMSGPACK,
+			"data":     payload,
+		})
+		So(err, ShouldBeNil)
+
+		pub := NewPublication("")
+		So(elemental.Decode(elemental.EncodingTypeMSGPACK, data, pub), ShouldBeNil)
+
+		Convey("Then I should be able to decode it", func() {
+			out := map[string]string{}
+			So(pub.Compression, ShouldEqual, PublicationCompressionNone)
+			So(pub.Decode(&out), ShouldBeNil)
+			So(out, ShouldResemble, map[string]string{"a": "b"})
+		})
+	})
+
+	Convey("Given I have a publication with an unsupported compression", t, func() {
+
+		pub := NewPublication("topic")
+		pub.Data = []byte("data")
+
+		Convey("Then compressing should fail", func() {
+			So(pub.Compress("snappy"), ShouldNotBeNil)
+			So(pub.Compression, ShouldEqual, PublicationCompressionNone)
+		})
+
+		Convey("Then decoding should fail", func() {
+			pub.Compression = "snappy"
+			So(pub.Decode(&map[string]string{}), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given I have a publication with corrupted compressed data", t, func() {
+
+		pub := NewPublication("topic")
+		pub.Data = []byte("not gzip")
+		pub.Compression = PublicationCompressionGzip
+
+		Convey("Then decoding should fail", func() {
+			So(pub.Decode(&map[string]string{}), ShouldNotBeNil)
+		})
+	})
+}
+
 func TestPublicationTracing(t *testing.T) {
 
 	Convey("Given I have no tracer", t, func() {
@@ -201,6 +365,12 @@ func TestPublication_Duplicate(t *testing.T) {
 		pub.Data = []byte("data")
 		pub.Partition = 12
 		pub.TrackingName = "TrackingName"
+		pub.TTL = time.Minute
+		pub.SetHeader("k", "v")
+
+		var acked, naked bool
+		pub.ackFunc = func() error { acked = true; return nil }
+		pub.nakFunc = func() error { naked = true; return nil }
 
 		Convey("When I call duplicate", func() {
 
@@ -213,6 +383,22 @@ func TestPublication_Duplicate(t *testing.T) {
 				So(dup.TrackingName, ShouldEqual, pub.TrackingName)
 				So(dup.Topic, ShouldEqual, pub.Topic)
 				So(dup.Encoding, ShouldEqual, pub.Encoding)
+				So(dup.ID, ShouldEqual, pub.ID)
+				So(dup.Timestamp.Equal(pub.Timestamp), ShouldBeTrue)
+				So(dup.TTL, ShouldEqual, pub.TTL)
+				So(dup.Headers, ShouldResemble, pub.Headers)
+			})
+
+			Convey("Then changing the headers of the copy should not change the original", func() {
+				dup.SetHeader("k", "v2")
+				So(pub.Header("k"), ShouldEqual, "v")
+			})
+
+			Convey("Then acknowledging the copy should acknowledge the original", func() {
+				So(dup.Ack(), ShouldBeNil)
+				So(dup.Nak(), ShouldBeNil)
+				So(acked, ShouldBeTrue)
+				So(naked, ShouldBeTrue)
 			})
 		})
 	})
@@ -311,3 +497,31 @@ func TestReply(t *testing.T) {
 		})
 	}
 }
+
+func TestPublication_AckNak(t *testing.T) {
+
+	Convey("Given I have a publication that does not require acknowledgements", t, func() {
+
+		pub := NewPublication("topic")
+
+		Convey("Then Ack and Nak should do nothing", func() {
+			So(pub.Ack(), ShouldBeNil)
+			So(pub.Nak(), ShouldBeNil)
+		})
+	})
+
+	Convey("Given I have a publication that requires acknowledgements", t, func() {
+
+		var acked, naked bool
+		pub := NewPublication("topic")
+		pub.ackFunc = func() error { acked = true; return nil }
+		pub.nakFunc = func() error { naked = true; return fmt.Errorf("boom") }
+
+		Convey("Then Ack and Nak should call the underlying functions", func() {
+			So(pub.Ack(), ShouldBeNil)
+			So(acked, ShouldBeTrue)
+			So(pub.Nak(), ShouldNotBeNil)
+			So(naked, ShouldBeTrue)
+		})
+	})
+}
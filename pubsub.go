@@ -13,6 +13,9 @@ package bahamut
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"time"
 )
 
 // PubSubOptPublish is the type of option that can use in PubSubClient.Publish.
@@ -28,3 +31,199 @@ type PubSubClient interface {
 	Connect(ctx context.Context) error
 	Disconnect() error
 }
+
+type pubSubSubscribeConfig struct {
+	queueGroup   string
+	replyTimeout time.Duration
+	dedupWindow  time.Duration
+}
+
+func defaultSubscribeConfig() pubSubSubscribeConfig {
+	return pubSubSubscribeConfig{
+		replyTimeout: 60 * time.Second,
+	}
+}
+
+type pubSubPublishConfig struct {
+	ctx                  context.Context
+	desiredResponse      ResponseMode
+	responseCh           chan *Publication
+	compression          PublicationCompression
+	compressionThreshold int
+}
+
+// compress compresses the given publication
+// if the configuration requires it.
+func (c pubSubPublishConfig) compress(publication *Publication) error {
+
+	if c.compression == PublicationCompressionNone || len(publication.Data) < c.compressionThreshold {
+		return nil
+	}
+
+	if err := publication.Compress(c.compression); err != nil {
+		return fmt.Errorf("unable to compress publication. message dropped: %w", err)
+	}
+
+	return nil
+}
+
+// PubSubOptSubscribeQueue sets the queue group of the subscriber.
+// In short, this allows to ensure only one subscriber in the
+// queue group with the same name will receive the publication.
+func PubSubOptSubscribeQueue(queueGroup string) PubSubOptSubscribe {
+	return func(c any) {
+		switch config := c.(type) {
+		case *pubSubSubscribeConfig:
+			config.queueGroup = queueGroup
+		case *jetStreamSubscribeConfig:
+			config.queueGroup = queueGroup
+		}
+	}
+}
+
+// PubSubOptSubscribeDeduplicate makes the subscriber drop the
+// publications with an ID that has already been received during
+// the given window. Duplicated publications requiring an ACK are
+// still acknowledged, as the publisher may be retrying because
+// it did not receive the first ACK.
+func PubSubOptSubscribeDeduplicate(window time.Duration) PubSubOptSubscribe {
+	return func(c any) {
+		switch config := c.(type) {
+		case *pubSubSubscribeConfig:
+			config.dedupWindow = window
+		case *jetStreamSubscribeConfig:
+			config.dedupWindow = window
+		}
+	}
+}
+
+// PubSubOptSubscribeReplyTimeout sets the duration of time to wait before giving up
+// waiting for a response to publish back to the client that is expecting a response
+func PubSubOptSubscribeReplyTimeout(t time.Duration) PubSubOptSubscribe {
+	return func(c any) {
+		if config, ok := c.(*pubSubSubscribeConfig); ok {
+			config.replyTimeout = t
+		}
+	}
+}
+
+// PubSubOptRespondToChannel will send the *Publication received to the provided channel.
+//
+// This is an advanced option which is useful in situations where you want to block until
+// you receive a response. The context parameter allows you to provide a deadline on how long
+// you should wait before considering the request as a failure:
+//
+//	myCtx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+//	respCh := make(chan *Publication)
+//	publishOption := PubSubOptRespondToChannel(myCtx, respCh)
+//
+// This option CANNOT be combined with PubSubOptPublishRequireAck
+func PubSubOptRespondToChannel(ctx context.Context, resp chan *Publication) PubSubOptPublish {
+	return func(c any) {
+		config := c.(*pubSubPublishConfig)
+
+		switch {
+		case config.desiredResponse != ResponseModeNone:
+			panic(fmt.Sprintf("illegal option: request mode has already been set to %s", config.desiredResponse))
+		case resp == nil:
+			panic("illegal argument: response channel cannot be nil")
+		case ctx == nil:
+			panic("illegal argument: context cannot be nil")
+		}
+
+		config.ctx = ctx
+		config.responseCh = resp
+		config.desiredResponse = ResponseModePublication
+	}
+}
+
+// PubSubOptPublishCompression compresses the data of the publication
+// using the given compression if it is at least threshold bytes long.
+// Subscribers transparently decompress it in Publication.Decode.
+//
+// Subscribers running a version of bahamut that does not support
+// compression will not be able to decode compressed publications,
+// so make sure all of them are up to date before using this option.
+func PubSubOptPublishCompression(compression PublicationCompression, threshold int) PubSubOptPublish {
+	return func(c any) {
+		config := c.(*pubSubPublishConfig)
+		config.compression = compression
+		config.compressionThreshold = threshold
+	}
+}
+
+// PubSubOptPublishRequireAck is a helper to require a ack in the limit
+// of the given context.Context. If the other side is bahamut.PubSubClient
+// using the Subscribe method, then it will automatically send back the expected
+// ack.
+//
+// This option CANNOT be combined with PubSubOptRespondToChannel
+func PubSubOptPublishRequireAck(ctx context.Context) PubSubOptPublish {
+	return func(c any) {
+		config := c.(*pubSubPublishConfig)
+
+		switch {
+		case config.desiredResponse != ResponseModeNone:
+			panic(fmt.Sprintf("illegal option: request mode has already been set to %s", config.desiredResponse))
+		case ctx == nil:
+			panic("illegal argument: context cannot be nil")
+		}
+
+		config.ctx = ctx
+		config.desiredResponse = ResponseModeACK
+	}
+}
+
+// deduplicator keeps track of the publication IDs
+// received during a window of time.
+type deduplicator struct {
+	window    time.Duration
+	seen      map[string]time.Time
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+// newDeduplicator returns a new deduplicator using the given
+// window, or nil if the window is not positive.
+func newDeduplicator(window time.Duration) *deduplicator {
+
+	if window <= 0 {
+		return nil
+	}
+
+	return &deduplicator{
+		window:    window,
+		seen:      map[string]time.Time{},
+		lastSweep: time.Now(),
+	}
+}
+
+// isDuplicate returns true if the given ID has already been seen
+// during the window. Otherwise, it records it and returns false.
+// Publications without ID are never considered as duplicates.
+func (d *deduplicator) isDuplicate(id string, now time.Time) bool {
+
+	if d == nil || id == "" {
+		return false
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if now.Sub(d.lastSweep) > d.window {
+		for k, t := range d.seen {
+			if now.Sub(t) > d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	if t, ok := d.seen[id]; ok && now.Sub(t) <= d.window {
+		return true
+	}
+
+	d.seen[id] = now
+
+	return false
+}
@@ -0,0 +1,289 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// PubSubBridgePathHeader is the header set by a PubSubBridge on the
+// publications it mirrors. It contains the comma separated names of
+// the sides the publication has been mirrored from, and is used to
+// prevent a publication from being mirrored back where it has been.
+const PubSubBridgePathHeader = "Bahamut-Bridge-Path"
+
+// Various reasons for which a PubSubBridge drops a publication.
+const (
+	PubSubBridgeDropReasonFiltered = "filtered"
+	PubSubBridgeDropReasonExpired  = "expired"
+	PubSubBridgeDropReasonLoop     = "loop"
+	PubSubBridgeDropReasonMaxHops  = "max_hops"
+	PubSubBridgeDropReasonError    = "error"
+)
+
+// A PubSubBridge mirrors the publications of some topics
+// from a source PubSubClient to a target PubSubClient.
+type PubSubBridge interface {
+
+	// Run mirrors the publications until the given context is done.
+	// It blocks, and does not connect nor disconnect the clients.
+	Run(ctx context.Context)
+}
+
+// pubSubBridgeRule describes the topics to mirror
+// and how to rewrite them on the target side.
+type pubSubBridgeRule struct {
+	pattern string
+	rewrite string
+}
+
+// topic returns the target topic of a publication received
+// on the given topic, using the rewrite template if any.
+// The wildcards of the template are replaced, in order, by
+// the tokens matched by the ones of the pattern.
+func (r pubSubBridgeRule) topic(topic string) string {
+
+	if r.rewrite == "" || !matchSubject(r.pattern, topic) {
+		return topic
+	}
+
+	tTokens := strings.Split(topic, ".")
+
+	var captures []string
+	for i, pt := range strings.Split(r.pattern, ".") {
+		switch pt {
+		case "*":
+			captures = append(captures, tTokens[i])
+		case ">":
+			captures = append(captures, strings.Join(tTokens[i:], "."))
+		}
+	}
+
+	rTokens := strings.Split(r.rewrite, ".")
+	for i, rt := range rTokens {
+		if (rt == "*" || rt == ">") && len(captures) > 0 {
+			rTokens[i] = captures[0]
+			captures = captures[1:]
+		}
+	}
+
+	return strings.Join(rTokens, ".")
+}
+
+// subjectWildcards returns the wildcard tokens of the given subject.
+func subjectWildcards(subject string) string {
+
+	var out string
+	for _, t := range strings.Split(subject, ".") {
+		if t == "*" || t == ">" {
+			out += t
+		}
+	}
+
+	return out
+}
+
+type pubSubBridge struct {
+	sourceName       string
+	source           PubSubClient
+	targetName       string
+	target           PubSubClient
+	rules            []pubSubBridgeRule
+	excludes         []string
+	maxHops          int
+	subscribeOptions []PubSubOptSubscribe
+	publishOptions   []PubSubOptPublish
+	metrics          PubSubBridgeMetrics
+}
+
+// NewPubSubBridge returns a new PubSubBridge mirroring the publications
+// of the topics set by PubSubBridgeOptTopic from the source client to
+// the target client. The clients must be connected by the caller.
+//
+// The names identify the two sides, typically the regions or clusters
+// the clients are connected to. They are recorded in the publications
+// so a bridge never mirrors a publication back to a side it has already
+// been mirrored from. Two bridges in opposite directions can therefore
+// be used to mirror topics both ways. When more than two sides are
+// mirrored with each other, PubSubBridgeOptMaxHops should be used to
+// avoid receiving the same publication through different paths.
+//
+// The publications received from a client requiring acknowledgements,
+// like the one backed by NATS JetStream, are acknowledged once mirrored,
+// and negatively acknowledged if publishing them to the target failed.
+//
+// It panics if a client or a name is missing, if both names are the
+// same or if no topic is set.
+func NewPubSubBridge(sourceName string, source PubSubClient, targetName string, target PubSubClient, options ...PubSubBridgeOption) PubSubBridge {
+
+	if source == nil || target == nil {
+		panic("source and target clients must not be nil")
+	}
+
+	if sourceName == "" || targetName == "" {
+		panic("source and target names must not be empty")
+	}
+
+	if sourceName == targetName {
+		panic("source and target names must be different")
+	}
+
+	b := &pubSubBridge{
+		sourceName: sourceName,
+		source:     source,
+		targetName: targetName,
+		target:     target,
+	}
+
+	for _, opt := range options {
+		opt(b)
+	}
+
+	if len(b.rules) == 0 {
+		panic("at least one topic must be set")
+	}
+
+	return b
+}
+
+func (b *pubSubBridge) Run(ctx context.Context) {
+
+	var wg sync.WaitGroup
+
+	for _, rule := range b.rules {
+		wg.Add(1)
+		go func(rule pubSubBridgeRule) {
+			defer wg.Done()
+			b.listen(ctx, rule)
+		}(rule)
+	}
+
+	wg.Wait()
+}
+
+// listen mirrors the publications received for
+// the given rule until the context is done.
+func (b *pubSubBridge) listen(ctx context.Context, rule pubSubBridgeRule) {
+
+	pubs := make(chan *Publication, 1024)
+	errs := make(chan error, 1024)
+
+	unsub := b.source.Subscribe(pubs, errs, rule.pattern, b.subscribeOptions...)
+	defer unsub()
+
+	for {
+		select {
+
+		case pub := <-pubs:
+			b.mirror(rule, pub)
+
+		case err := <-errs:
+			zap.L().Error("Received error from pubsub bridge source",
+				zap.String("source", b.sourceName),
+				zap.String("topic", rule.pattern),
+				zap.Error(err),
+			)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// mirror publishes the given publication to the target, unless it
+// must be dropped.
+func (b *pubSubBridge) mirror(rule pubSubBridgeRule, pub *Publication) {
+
+	var path []string
+	if h := pub.Header(PubSubBridgePathHeader); h != "" {
+		path = strings.Split(h, ",")
+	}
+
+	if reason := b.dropReason(pub, path); reason != "" {
+		b.drop(pub, reason)
+		_ = pub.Ack()
+		return
+	}
+
+	out := pub.Duplicate()
+	out.Topic = rule.topic(pub.Topic)
+	out.SetHeader(PubSubBridgePathHeader, strings.Join(append(path, b.sourceName), ","))
+
+	if err := b.target.Publish(out, b.publishOptions...); err != nil {
+		zap.L().Warn("Unable to mirror publication",
+			zap.String("source", b.sourceName),
+			zap.String("target", b.targetName),
+			zap.String("topic", pub.Topic),
+			zap.Error(err),
+		)
+		b.drop(pub, PubSubBridgeDropReasonError)
+		_ = pub.Nak()
+		return
+	}
+
+	_ = pub.Ack()
+
+	if b.metrics != nil {
+		lag := time.Duration(-1)
+		if !pub.Timestamp.IsZero() {
+			lag = time.Since(pub.Timestamp)
+		}
+		b.metrics.ObserveMirrored(b.sourceName, b.targetName, pub.Topic, lag)
+	}
+}
+
+// dropReason returns the reason for which the given publication,
+// that went through the given path, must not be mirrored, or an
+// empty string if it must be.
+func (b *pubSubBridge) dropReason(pub *Publication, path []string) string {
+
+	for _, pattern := range b.excludes {
+		if matchSubject(pattern, pub.Topic) {
+			return PubSubBridgeDropReasonFiltered
+		}
+	}
+
+	if pub.IsExpired() {
+		return PubSubBridgeDropReasonExpired
+	}
+
+	for _, name := range path {
+		if name == b.targetName || name == b.sourceName {
+			return PubSubBridgeDropReasonLoop
+		}
+	}
+
+	if b.maxHops > 0 && len(path) >= b.maxHops {
+		return PubSubBridgeDropReasonMaxHops
+	}
+
+	return ""
+}
+
+func (b *pubSubBridge) drop(pub *Publication, reason string) {
+
+	zap.L().Debug("Publication not mirrored",
+		zap.String("source", b.sourceName),
+		zap.String("target", b.targetName),
+		zap.String("topic", pub.Topic),
+		zap.String("reason", reason),
+	)
+
+	if b.metrics != nil {
+		b.metrics.RegisterDropped(b.sourceName, b.targetName, pub.Topic, reason)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A PubSubBridgeMetrics receives the measurements made by a PubSubBridge.
+type PubSubBridgeMetrics interface {
+
+	// ObserveMirrored is called once a publication received on the given
+	// topic has been mirrored, with the time elapsed since it has been
+	// published. The lag is negative if the publication has no timestamp.
+	ObserveMirrored(source string, target string, topic string, lag time.Duration)
+
+	// RegisterDropped is called when a publication received on the given
+	// topic is not mirrored. The reason is one of the PubSubBridgeDropReason
+	// constants.
+	RegisterDropped(source string, target string, topic string, reason string)
+}
+
+type prometheusPubSubBridgeMetrics struct {
+	mirroredMetric *prometheus.CounterVec
+	lagMetric      *prometheus.HistogramVec
+	droppedMetric  *prometheus.CounterVec
+
+	topicLimiter *labelValueLimiter
+}
+
+// NewPrometheusPubSubBridgeMetrics returns a PubSubBridgeMetrics using the prometheus
+// format. The metrics are exposed by the MetricsManager returned by NewPrometheusMetricsManager.
+// The same PubSubBridgeMetrics can be used by several bridges.
+//
+// The cardinality of the topic label is bounded to the given maximum number of values.
+// Passing 0 uses the default of 256.
+func NewPrometheusPubSubBridgeMetrics(maxTopics int) PubSubBridgeMetrics {
+
+	return newPrometheusPubSubBridgeMetrics(prometheus.DefaultRegisterer, maxTopics)
+}
+
+func newPrometheusPubSubBridgeMetrics(registerer prometheus.Registerer, maxTopics int) PubSubBridgeMetrics {
+
+	if maxTopics <= 0 {
+		maxTopics = 256
+	}
+
+	mc := &prometheusPubSubBridgeMetrics{
+		topicLimiter: newLabelValueLimiter(maxTopics),
+		mirroredMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pubsub_bridge_mirrored_publications_total",
+				Help: "The total number of publications mirrored by the bridges.",
+			},
+			[]string{"source", "target", "topic"},
+		),
+		lagMetric: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "pubsub_bridge_lag_seconds",
+				Help:    "The time elapsed between the publication and its mirroring.",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"source", "target", "topic"},
+		),
+		droppedMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pubsub_bridge_dropped_publications_total",
+				Help: "The total number of publications not mirrored by the bridges.",
+			},
+			[]string{"source", "target", "topic", "reason"},
+		),
+	}
+
+	registerer.MustRegister(mc.mirroredMetric)
+	registerer.MustRegister(mc.lagMetric)
+	registerer.MustRegister(mc.droppedMetric)
+
+	return mc
+}
+
+func (c *prometheusPubSubBridgeMetrics) ObserveMirrored(source string, target string, topic string, lag time.Duration) {
+
+	topic = c.topicLimiter.limit(topic)
+
+	c.mirroredMetric.WithLabelValues(source, target, topic).Inc()
+
+	if lag >= 0 {
+		c.lagMetric.WithLabelValues(source, target, topic).Observe(lag.Seconds())
+	}
+}
+
+func (c *prometheusPubSubBridgeMetrics) RegisterDropped(source string, target string, topic string, reason string) {
+	c.droppedMetric.WithLabelValues(source, target, c.topicLimiter.limit(topic), reason).Inc()
+}
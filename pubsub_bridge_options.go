@@ -0,0 +1,98 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"fmt"
+)
+
+// A PubSubBridgeOption represents an option that can be
+// passed to NewPubSubBridge.
+type PubSubBridgeOption func(*pubSubBridge)
+
+// PubSubBridgeOptTopic adds the topics matching the given pattern to
+// the ones mirrored by the bridge. The pattern uses the NATS semantics,
+// where `*` matches a token and `>` matches all the remaining ones.
+//
+// If rewrite is not empty, it is used as the template of the topic of
+// the mirrored publications: its wildcards are replaced, in order, by
+// the tokens matched by the ones of the pattern. For instance, with the
+// pattern "events.*.>" and the rewrite "us.events.*.>", a publication
+// on "events.user.created" is mirrored on "us.events.user.created".
+// The rewrite must contain the same wildcards as the pattern, in the
+// same order. If rewrite is empty, the topic is not changed.
+//
+// The patterns of the different topics should not overlap, as each
+// of them is subscribed to separately.
+func PubSubBridgeOptTopic(pattern string, rewrite string) PubSubBridgeOption {
+
+	if pattern == "" {
+		panic("pattern must not be empty")
+	}
+
+	if rewrite != "" && subjectWildcards(pattern) != subjectWildcards(rewrite) {
+		panic(fmt.Sprintf("rewrite '%s' must contain the same wildcards as the pattern '%s'", rewrite, pattern))
+	}
+
+	return func(b *pubSubBridge) {
+		b.rules = append(b.rules, pubSubBridgeRule{pattern: pattern, rewrite: rewrite})
+	}
+}
+
+// PubSubBridgeOptExclude sets the patterns of the topics that must not
+// be mirrored, even though they match a pattern set by PubSubBridgeOptTopic.
+func PubSubBridgeOptExclude(patterns ...string) PubSubBridgeOption {
+	return func(b *pubSubBridge) {
+		b.excludes = append(b.excludes, patterns...)
+	}
+}
+
+// PubSubBridgeOptMaxHops sets the maximum number of times a publication
+// can be mirrored. Mirroring more than two sides with each other should
+// use 1, so a publication is only mirrored from the side it has been
+// published on. The default is 0, which means no limit.
+func PubSubBridgeOptMaxHops(hops int) PubSubBridgeOption {
+
+	if hops < 0 {
+		panic("hops must be positive")
+	}
+
+	return func(b *pubSubBridge) {
+		b.maxHops = hops
+	}
+}
+
+// PubSubBridgeOptSubscribeOptions sets the options passed to the source
+// client when subscribing. When several instances of the same bridge are
+// running, PubSubOptSubscribeQueue should be used so each publication is
+// only mirrored once.
+func PubSubBridgeOptSubscribeOptions(options ...PubSubOptSubscribe) PubSubBridgeOption {
+	return func(b *pubSubBridge) {
+		b.subscribeOptions = append(b.subscribeOptions, options...)
+	}
+}
+
+// PubSubBridgeOptPublishOptions sets the options passed to
+// the target client when publishing the mirrored publications.
+func PubSubBridgeOptPublishOptions(options ...PubSubOptPublish) PubSubBridgeOption {
+	return func(b *pubSubBridge) {
+		b.publishOptions = append(b.publishOptions, options...)
+	}
+}
+
+// PubSubBridgeOptMetrics sets the PubSubBridgeMetrics used to report
+// the lag of the mirrored publications and the dropped ones.
+func PubSubBridgeOptMetrics(metrics PubSubBridgeMetrics) PubSubBridgeOption {
+	return func(b *pubSubBridge) {
+		b.metrics = metrics
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testPubSubBridgeMetrics struct {
+	mirrored []string
+	dropped  map[string][]string
+	sync.Mutex
+}
+
+func newTestPubSubBridgeMetrics() *testPubSubBridgeMetrics {
+	return &testPubSubBridgeMetrics{
+		dropped: map[string][]string{},
+	}
+}
+
+func (m *testPubSubBridgeMetrics) ObserveMirrored(source string, target string, topic string, lag time.Duration) {
+	m.Lock()
+	m.mirrored = append(m.mirrored, source+">"+target+":"+topic)
+	m.Unlock()
+}
+
+func (m *testPubSubBridgeMetrics) RegisterDropped(source string, target string, topic string, reason string) {
+	m.Lock()
+	m.dropped[source+">"+target+":"+topic] = append(m.dropped[source+">"+target+":"+topic], reason)
+	m.Unlock()
+}
+
+func (m *testPubSubBridgeMetrics) droppedFor(key string) []string {
+	m.Lock()
+	defer m.Unlock()
+	return m.dropped[key]
+}
+
+type failingPubSubClient struct {
+	PubSubClient
+}
+
+func (c failingPubSubClient) Publish(*Publication, ...PubSubOptPublish) error {
+	return errors.New("boom")
+}
+
+func TestPubSubBridge_NewPubSubBridge(t *testing.T) {
+
+	Convey("Given I have two clients", t, func() {
+
+		a := NewLocalPubSubClient()
+		b := NewLocalPubSubClient()
+		metrics := newTestPubSubBridgeMetrics()
+
+		Convey("When I create a bridge with options", func() {
+
+			br := NewPubSubBridge(
+				"a", a, "b", b,
+				PubSubBridgeOptTopic("events.>", "a.events.>"),
+				PubSubBridgeOptTopic("pings", ""),
+				PubSubBridgeOptExclude("events.internal.>"),
+				PubSubBridgeOptMaxHops(1),
+				PubSubBridgeOptSubscribeOptions(PubSubOptSubscribeQueue("bridge")),
+				PubSubBridgeOptPublishOptions(PubSubOptPublishCompression(PublicationCompressionGzip, 0)),
+				PubSubBridgeOptMetrics(metrics),
+			).(*pubSubBridge)
+
+			Convey("Then it should be correctly configured", func() {
+				So(br.sourceName, ShouldEqual, "a")
+				So(br.targetName, ShouldEqual, "b")
+				So(br.rules, ShouldResemble, []pubSubBridgeRule{
+					{pattern: "events.>", rewrite: "a.events.>"},
+					{pattern: "pings"},
+				})
+				So(br.excludes, ShouldResemble, []string{"events.internal.>"})
+				So(br.maxHops, ShouldEqual, 1)
+				So(len(br.subscribeOptions), ShouldEqual, 1)
+				So(len(br.publishOptions), ShouldEqual, 1)
+				So(br.metrics, ShouldEqual, metrics)
+			})
+		})
+
+		Convey("Then invalid configurations should panic", func() {
+			So(func() { NewPubSubBridge("a", nil, "b", b, PubSubBridgeOptTopic("t", "")) }, ShouldPanicWith, "source and target clients must not be nil")
+			So(func() { NewPubSubBridge("", a, "b", b, PubSubBridgeOptTopic("t", "")) }, ShouldPanicWith, "source and target names must not be empty")
+			So(func() { NewPubSubBridge("a", a, "a", b, PubSubBridgeOptTopic("t", "")) }, ShouldPanicWith, "source and target names must be different")
+			So(func() { NewPubSubBridge("a", a, "b", b) }, ShouldPanicWith, "at least one topic must be set")
+			So(func() { PubSubBridgeOptTopic("", "") }, ShouldPanicWith, "pattern must not be empty")
+			So(func() { PubSubBridgeOptTopic("a.*.>", "b.>.*") }, ShouldPanicWith, "rewrite 'b.>.*' must contain the same wildcards as the pattern 'a.*.>'")
+			So(func() { PubSubBridgeOptMaxHops(-1) }, ShouldPanicWith, "hops must be positive")
+		})
+	})
+}
+
+func TestPubSubBridge_rewrite(t *testing.T) {
+
+	Convey("Given I have some rules", t, func() {
+
+		Convey("Then the topics should be rewritten", func() {
+			So(pubSubBridgeRule{pattern: "events.>"}.topic("events.a.b"), ShouldEqual, "events.a.b")
+			So(pubSubBridgeRule{pattern: "events.>", rewrite: "us.events.>"}.topic("events.a.b"), ShouldEqual, "us.events.a.b")
+			So(pubSubBridgeRule{pattern: "events.*.>", rewrite: "*.mirror.>"}.topic("events.a.b.c"), ShouldEqual, "a.mirror.b.c")
+			So(pubSubBridgeRule{pattern: "pings", rewrite: "global.pings"}.topic("pings"), ShouldEqual, "global.pings")
+			So(pubSubBridgeRule{pattern: "events.*", rewrite: "x.*"}.topic("other.a"), ShouldEqual, "other.a")
+		})
+	})
+}
+
+func TestPubSubBridge_Run(t *testing.T) {
+
+	Convey("Given I have two connected clients bridged both ways", t, func() {
+
+		a := NewLocalPubSubClient()
+		b := NewLocalPubSubClient()
+		So(a.Connect(context.Background()), ShouldBeNil)
+		So(b.Connect(context.Background()), ShouldBeNil)
+		defer func() { _ = a.Disconnect() }()
+		defer func() { _ = b.Disconnect() }()
+
+		metrics := newTestPubSubBridgeMetrics()
+
+		ab := NewPubSubBridge(
+			"a", a, "b", b,
+			PubSubBridgeOptTopic("events.>", ""),
+			PubSubBridgeOptTopic("pings.*", "global.pings.*"),
+			PubSubBridgeOptExclude("events.internal.>"),
+			PubSubBridgeOptMetrics(metrics),
+		)
+
+		ba := NewPubSubBridge(
+			"b", b, "a", a,
+			PubSubBridgeOptTopic("events.>", ""),
+			PubSubBridgeOptMetrics(metrics),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go ab.Run(ctx)
+		go ba.Run(ctx)
+
+		apubs := make(chan *Publication, 10)
+		bpubs := make(chan *Publication, 10)
+		defer a.Subscribe(apubs, nil, "events.>")()
+		defer b.Subscribe(bpubs, nil, "events.>")()
+		defer b.Subscribe(bpubs, nil, "global.pings.*")()
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("When I publish on a", func() {
+
+			pub := NewPublication("events.created")
+			pub.Data = []byte("hello")
+			So(a.Publish(pub), ShouldBeNil)
+
+			Convey("Then it should be received on b once, with its path", func() {
+				So(receivePublication(apubs, time.Second), ShouldNotBeNil)
+				p := receivePublication(bpubs, time.Second)
+				So(p, ShouldNotBeNil)
+				So(p.Topic, ShouldEqual, "events.created")
+				So(p.ID, ShouldEqual, pub.ID)
+				So(string(p.Data), ShouldEqual, "hello")
+				So(p.Header(PubSubBridgePathHeader), ShouldEqual, "a")
+			})
+
+			Convey("Then it should not be mirrored back to a", func() {
+				So(receivePublication(apubs, time.Second), ShouldNotBeNil)
+				So(receivePublication(apubs, 200*time.Millisecond), ShouldBeNil)
+				So(metrics.droppedFor("b>a:events.created"), ShouldResemble, []string{PubSubBridgeDropReasonLoop})
+			})
+		})
+
+		Convey("When I publish on a topic that is rewritten", func() {
+
+			So(a.Publish(NewPublication("pings.service")), ShouldBeNil)
+
+			Convey("Then it should be received on b on the rewritten topic", func() {
+				p := receivePublication(bpubs, time.Second)
+				So(p, ShouldNotBeNil)
+				So(p.Topic, ShouldEqual, "global.pings.service")
+			})
+		})
+
+		Convey("When I publish on an excluded topic or an expired publication", func() {
+
+			So(a.Publish(NewPublication("events.internal.x")), ShouldBeNil)
+
+			expired := NewPublication("events.old")
+			expired.Timestamp = time.Now().Add(-time.Minute)
+			expired.TTL = time.Second
+			So(a.Publish(expired), ShouldBeNil)
+
+			Convey("Then they should be dropped", func() {
+				So(receivePublication(bpubs, 200*time.Millisecond), ShouldBeNil)
+				So(metrics.droppedFor("a>b:events.internal.x"), ShouldResemble, []string{PubSubBridgeDropReasonFiltered})
+			})
+		})
+	})
+
+	Convey("Given I have a bridge limited to one hop and a bridge to a failing client", t, func() {
+
+		a := NewLocalPubSubClient()
+		So(a.Connect(context.Background()), ShouldBeNil)
+		defer func() { _ = a.Disconnect() }()
+
+		metrics := newTestPubSubBridgeMetrics()
+
+		hops := NewPubSubBridge("a", a, "c", NewLocalPubSubClient(),
+			PubSubBridgeOptTopic("hops", ""),
+			PubSubBridgeOptMaxHops(1),
+			PubSubBridgeOptMetrics(metrics),
+		)
+		failing := NewPubSubBridge("a", a, "d", failingPubSubClient{},
+			PubSubBridgeOptTopic("failing", ""),
+			PubSubBridgeOptMetrics(metrics),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go hops.Run(ctx)
+		go failing.Run(ctx)
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("When I publish publications that cannot be mirrored", func() {
+
+			pub := NewPublication("hops")
+			pub.SetHeader(PubSubBridgePathHeader, "b")
+			So(a.Publish(pub), ShouldBeNil)
+			So(a.Publish(NewPublication("failing")), ShouldBeNil)
+
+			time.Sleep(100 * time.Millisecond)
+
+			Convey("Then they should be dropped", func() {
+				So(metrics.droppedFor("a>c:hops"), ShouldResemble, []string{PubSubBridgeDropReasonMaxHops})
+				So(metrics.droppedFor("a>d:failing"), ShouldResemble, []string{PubSubBridgeDropReasonError})
+			})
+		})
+	})
+}
+
+func TestPrometheusPubSubBridgeMetrics(t *testing.T) {
+
+	Convey("Given I have a prometheus PubSubBridgeMetrics", t, func() {
+
+		r := prometheus.NewRegistry()
+		m := newPrometheusPubSubBridgeMetrics(r, 0)
+
+		Convey("When I report some measurements", func() {
+
+			m.ObserveMirrored("a", "b", "topic", time.Second)
+			m.ObserveMirrored("a", "b", "topic", -1)
+			m.RegisterDropped("a", "b", "topic", PubSubBridgeDropReasonLoop)
+
+			data, _ := r.Gather()
+
+			Convey("Then the data should be collected", func() {
+
+				So(data[0].GetName(), ShouldEqual, "pubsub_bridge_dropped_publications_total")
+				So(data[0].GetMetric()[0].Label[0].String(), ShouldEqual, `name:"reason" value:"loop" `)
+				So(data[0].GetMetric()[0].Counter.String(), ShouldEqual, "value:1 ")
+
+				So(data[1].GetName(), ShouldEqual, "pubsub_bridge_lag_seconds")
+				So(data[1].GetMetric()[0].Histogram.GetSampleCount(), ShouldEqual, 1)
+
+				So(data[2].GetName(), ShouldEqual, "pubsub_bridge_mirrored_publications_total")
+				So(data[2].GetMetric()[0].Counter.String(), ShouldEqual, "value:2 ")
+			})
+		})
+	})
+}
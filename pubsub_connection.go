@@ -0,0 +1,195 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	nats "github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+// A PubSubConnectionHandler is called when the state of the connection
+// of a PubSubClient to its broker changes. The event is one of the
+// PubSubConnectionEvent constants and err is the error that caused
+// the change, if any.
+//
+// The handler is called synchronously by the client and must not block.
+type PubSubConnectionHandler func(event string, err error)
+
+// pubSubConnectionState tracks the state of the connection of a
+// PubSubClient and reports its changes to the metrics and the handler.
+type pubSubConnectionState struct {
+	handler   PubSubConnectionHandler
+	event     string
+	lastError error
+	lock      sync.RWMutex
+}
+
+// notify records the given event and reports it.
+func (s *pubSubConnectionState) notify(metrics PubSubMetrics, event string, err error) {
+
+	s.lock.Lock()
+	s.event = event
+	if err != nil {
+		s.lastError = err
+	}
+	s.lock.Unlock()
+
+	if metrics != nil {
+		metrics.RegisterConnectionEvent(event)
+	}
+
+	if s.handler != nil {
+		s.handler(event, err)
+	}
+}
+
+// current returns the last event, or an
+// empty string if nothing happened yet.
+func (s *pubSubConnectionState) current() string {
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.event
+}
+
+// error returns an error describing the given state,
+// along with the last error of the connection.
+func (s *pubSubConnectionState) error(state string) error {
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.lastError == nil {
+		return errors.New(state)
+	}
+
+	return fmt.Errorf("%s: %w", state, s.lastError)
+}
+
+// natsSubscription is a subscription made by a PubSubClient backed
+// by NATS, that is kept to be established again when it gets lost.
+type natsSubscription struct {
+	topic     string
+	errors    chan error
+	subscribe func() (*nats.Subscription, error)
+	sub       *nats.Subscription
+}
+
+// natsSubscriptions holds the subscriptions of a PubSubClient backed by NATS.
+type natsSubscriptions struct {
+	subscriptions map[*natsSubscription]struct{}
+	lock          sync.Mutex
+}
+
+func newNATSSubscriptions() *natsSubscriptions {
+	return &natsSubscriptions{
+		subscriptions: map[*natsSubscription]struct{}{},
+	}
+}
+
+// add registers the given subscription and establishes it. If this
+// fails, the subscription stays registered and is retried by restore.
+func (s *natsSubscriptions) add(subscription *natsSubscription) (err error) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.subscriptions[subscription] = struct{}{}
+	subscription.sub, err = subscription.subscribe()
+
+	return err
+}
+
+// remove unregisters the given subscription and unsubscribes.
+func (s *natsSubscriptions) remove(subscription *natsSubscription) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.subscriptions, subscription)
+
+	if subscription.sub != nil {
+		_ = subscription.sub.Unsubscribe()
+		subscription.sub = nil
+	}
+}
+
+// pending returns the number of messages pending
+// to be delivered by the given subscription.
+func (s *natsSubscriptions) pending(subscription *natsSubscription) (int, error) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if subscription.sub == nil {
+		return 0, nats.ErrBadSubscription
+	}
+
+	msgs, _, err := subscription.sub.Pending()
+
+	return msgs, err
+}
+
+// restore establishes again the subscriptions that are not valid
+// anymore, or that are not accepted by check if it is not nil.
+// The errors are sent to the error channels of the subscriptions
+// that are ready to receive them, and logged otherwise.
+func (s *natsSubscriptions) restore(check func(*nats.Subscription) bool) {
+
+	type failure struct {
+		subscription *natsSubscription
+		err          error
+	}
+
+	var failures []failure
+
+	s.lock.Lock()
+
+	for subscription := range s.subscriptions {
+
+		if subscription.sub != nil && subscription.sub.IsValid() {
+
+			if check == nil || check(subscription.sub) {
+				continue
+			}
+
+			_ = subscription.sub.Unsubscribe()
+		}
+
+		sub, err := subscription.subscribe()
+		if err != nil {
+			subscription.sub = nil
+			failures = append(failures, failure{subscription: subscription, err: err})
+			continue
+		}
+
+		subscription.sub = sub
+	}
+
+	s.lock.Unlock()
+
+	for _, f := range failures {
+		select {
+		case f.subscription.errors <- f.err:
+		default:
+			zap.L().Warn("Unable to restore subscription",
+				zap.String("topic", f.subscription.topic),
+				zap.Error(f.err),
+			)
+		}
+	}
+}
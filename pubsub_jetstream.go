@@ -0,0 +1,630 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"go.aporeto.io/elemental"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+type jetStreamPubSub struct {
+	natsURL         string
+	stream          nats.StreamConfig
+	conn            *nats.Conn
+	js              nats.JetStreamContext
+	retryInterval   time.Duration
+	maxReconnects   int
+	password        string
+	username        string
+	tlsConfig       *tls.Config
+	metrics         PubSubMetrics
+	pendingInterval time.Duration
+	tracerProvider  trace.TracerProvider
+	security        publicationSecurity
+	connection      pubSubConnectionState
+	subscriptions   *natsSubscriptions
+	stop            chan struct{}
+	stopOnce        sync.Once
+	lock            sync.RWMutex
+}
+
+// NewJetStreamPubSubClient returns a new PubSubClient backed by NATS
+// JetStream. The publications are stored in the given stream, which is
+// created on Connect if it does not exist. The subjects of the stream
+// must cover all the topics used to publish.
+//
+// Unlike the client returned by NewNATSPubSubClient, the publications
+// are kept by the server until they are acknowledged by the subscribers,
+// so nothing is lost while a subscriber is reconnecting. The received
+// publications must be acknowledged using Publication.Ack, unless the
+// subscription uses JetStreamOptSubscribeAutoAck. Request/reply is not
+// supported: PubSubOptPublishRequireAck and PubSubOptRespondToChannel
+// make Publish return an error.
+//
+// Like the client returned by NewNATSPubSubClient, the client reconnects
+// when the connection is lost and establishes the subscriptions again,
+// including the ones whose consumer has been deleted by the server in
+// the meantime.
+func NewJetStreamPubSubClient(natsURL string, stream nats.StreamConfig, options ...JetStreamOption) PubSubClient {
+
+	if stream.Name == "" {
+		panic("stream name must not be empty")
+	}
+
+	n := &jetStreamPubSub{
+		natsURL:         natsURL,
+		stream:          stream,
+		retryInterval:   5 * time.Second,
+		maxReconnects:   nats.DefaultMaxReconnect,
+		pendingInterval: 10 * time.Second,
+		subscriptions:   newNATSSubscriptions(),
+		stop:            make(chan struct{}),
+	}
+
+	for _, opt := range options {
+		opt(n)
+	}
+
+	return n
+}
+
+func (p *jetStreamPubSub) Publish(publication *Publication, opts ...PubSubOptPublish) error {
+
+	if p.jetStream() == nil {
+		return errors.New("not connected to nats. messages dropped")
+	}
+
+	if publication == nil {
+		return errors.New("publication cannot be nil")
+	}
+
+	config := pubSubPublishConfig{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	var span trace.Span
+	if p.tracerProvider != nil {
+		span = startPubSubPublishSpan(config.ctx, p.tracerProvider, "nats-jetstream", publication)
+	}
+
+	start := time.Now()
+	err := p.publish(publication, config)
+
+	if p.metrics != nil {
+		p.metrics.ObservePublish(publication.Topic, time.Since(start), err)
+	}
+
+	if span != nil {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+
+	return err
+}
+
+func (p *jetStreamPubSub) publish(publication *Publication, config pubSubPublishConfig) error {
+
+	if config.desiredResponse != ResponseModeNone {
+		return fmt.Errorf("unable to publish: %s is not supported by jetstream", config.desiredResponse)
+	}
+
+	if err := config.compress(publication); err != nil {
+		return err
+	}
+
+	publication.ResponseMode = ResponseModeNone
+
+	sealed, err := p.security.seal(publication)
+	if err != nil {
+		return err
+	}
+
+	data, err := elemental.Encode(elemental.EncodingTypeMSGPACK, sealed)
+	if err != nil {
+		return fmt.Errorf("unable to encode publication. message dropped: %s", err)
+	}
+
+	var pubOpts []nats.PubOpt
+	if config.ctx != nil {
+		pubOpts = append(pubOpts, nats.Context(config.ctx))
+	}
+
+	msg := nats.NewMsg(publication.Topic)
+	msg.Data = data
+
+	for k, v := range publication.Headers {
+		msg.Header.Set(k, v)
+	}
+
+	// This allows the stream to discard the publications
+	// with an ID already received during its duplicates window.
+	if publication.ID != "" {
+		msg.Header.Set(nats.MsgIdHdr, publication.ID)
+	}
+
+	if _, err := p.jetStream().PublishMsg(msg, pubOpts...); err != nil {
+		return fmt.Errorf("unable to publish in stream %s: %w", p.stream.Name, err)
+	}
+
+	return nil
+}
+
+func (p *jetStreamPubSub) Subscribe(pubs chan *Publication, errors chan error, topic string, opts ...PubSubOptSubscribe) func() {
+
+	config := defaultJetStreamSubscribeConfig()
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	dedup := newDeduplicator(config.dedupWindow)
+
+	handler := func(m *nats.Msg) {
+		publication := NewPublication(topic)
+
+		if e := elemental.Decode(elemental.EncodingTypeMSGPACK, m.Data, publication); e != nil {
+			zap.L().Error("Unable to decode publication envelope. Message dropped.", zap.Error(e))
+			// There is no point in redelivering it.
+			_ = m.Term()
+			return
+		}
+
+		// The topic is the subject the message has been received on,
+		// so a signed envelope cannot be replayed on another subject.
+		publication.Topic = m.Subject
+
+		if reason, err := p.security.open(publication); err != nil {
+			rejectPublication(p.metrics, m.Subject, reason, err)
+			_ = m.Term()
+			return
+		}
+
+		if publication.IsExpired() {
+			zap.L().Debug("Publication expired. Message dropped.",
+				zap.String("topic", m.Subject),
+				zap.String("id", publication.ID),
+			)
+			_ = m.Term()
+			return
+		}
+
+		if dedup.isDuplicate(publication.ID, time.Now()) {
+			zap.L().Debug("Duplicated publication. Message dropped.",
+				zap.String("topic", m.Subject),
+				zap.String("id", publication.ID),
+			)
+			_ = m.Ack()
+			return
+		}
+
+		// Headers set by other publishers than bahamut are
+		// added, without overriding the ones of the envelope.
+		for k := range m.Header {
+			if strings.HasPrefix(k, "Nats-") || publication.Header(k) != "" {
+				continue
+			}
+			publication.SetHeader(k, m.Header.Get(k))
+		}
+
+		publication.ackFunc = func() error { return m.Ack() }
+		publication.nakFunc = func() error { return m.Nak() }
+
+		if p.tracerProvider != nil {
+			_, span := p.tracerProvider.Tracer(otelInstrumentationName).Start(
+				publication.ExtractTraceContext(context.Background()),
+				"bahamut.pubsub.receive",
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithAttributes(
+					attribute.String("messaging.system", "nats-jetstream"),
+					attribute.String("messaging.destination", m.Subject),
+				),
+			)
+			defer span.End()
+		}
+
+		pubs <- publication
+
+		if config.autoAck {
+			if err := m.Ack(); err != nil {
+				errors <- err
+			}
+		}
+	}
+
+	subscription := &natsSubscription{
+		topic:  topic,
+		errors: errors,
+		subscribe: func() (*nats.Subscription, error) {
+			js := p.jetStream()
+			if js == nil {
+				return nil, fmt.Errorf("not connected to nats")
+			}
+			if config.durable != "" {
+				return p.subscribeDurable(js, topic, config, handler)
+			}
+			return p.subscribeEphemeral(js, topic, config, handler)
+		},
+	}
+
+	// If this fails, the subscription will be
+	// established again once the client is connected.
+	if err := p.subscriptions.add(subscription); err != nil {
+		errors <- err
+	}
+
+	if p.metrics == nil {
+		return func() { p.subscriptions.remove(subscription) }
+	}
+
+	stop := make(chan struct{})
+	go p.reportPending(subscription, stop)
+
+	return func() {
+		close(stop)
+		p.subscriptions.remove(subscription)
+	}
+}
+
+// subscribeEphemeral subscribes using a consumer created by the
+// nats client, that is deleted when unsubscribing.
+func (p *jetStreamPubSub) subscribeEphemeral(js nats.JetStreamContext, topic string, config jetStreamSubscribeConfig, handler nats.MsgHandler) (*nats.Subscription, error) {
+
+	subOpts := []nats.SubOpt{
+		nats.BindStream(p.stream.Name),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.AckWait(config.ackWait),
+	}
+
+	if config.maxDeliver > 0 {
+		subOpts = append(subOpts, nats.MaxDeliver(config.maxDeliver))
+	}
+
+	switch config.deliverPolicy {
+	case nats.DeliverAllPolicy:
+		subOpts = append(subOpts, nats.DeliverAll())
+	case nats.DeliverByStartSequencePolicy:
+		subOpts = append(subOpts, nats.StartSequence(config.startSequence))
+	case nats.DeliverByStartTimePolicy:
+		subOpts = append(subOpts, nats.StartTime(config.startTime))
+	default:
+		subOpts = append(subOpts, nats.DeliverNew())
+	}
+
+	if config.queueGroup == "" {
+		return js.Subscribe(topic, handler, subOpts...)
+	}
+
+	return js.QueueSubscribe(topic, config.queueGroup, handler, subOpts...)
+}
+
+// subscribeDurable creates the durable consumer if needed and binds
+// to it. As the consumer is not created by the nats client, it is
+// not deleted when unsubscribing.
+func (p *jetStreamPubSub) subscribeDurable(js nats.JetStreamContext, topic string, config jetStreamSubscribeConfig, handler nats.MsgHandler) (*nats.Subscription, error) {
+
+	_, err := js.ConsumerInfo(p.stream.Name, config.durable)
+
+	switch {
+
+	case errors.Is(err, nats.ErrConsumerNotFound):
+
+		cc := &nats.ConsumerConfig{
+			Durable:        config.durable,
+			DeliverSubject: nats.NewInbox(),
+			DeliverGroup:   config.queueGroup,
+			DeliverPolicy:  config.deliverPolicy,
+			AckPolicy:      nats.AckExplicitPolicy,
+			AckWait:        config.ackWait,
+			MaxDeliver:     config.maxDeliver,
+			FilterSubject:  topic,
+		}
+
+		switch config.deliverPolicy {
+		case nats.DeliverByStartSequencePolicy:
+			cc.OptStartSeq = config.startSequence
+		case nats.DeliverByStartTimePolicy:
+			cc.OptStartTime = &config.startTime
+		}
+
+		if _, err := js.AddConsumer(p.stream.Name, cc); err != nil {
+			return nil, fmt.Errorf("unable to create durable consumer %s: %w", config.durable, err)
+		}
+
+	case err != nil:
+		return nil, fmt.Errorf("unable to retrieve durable consumer %s: %w", config.durable, err)
+	}
+
+	subOpts := []nats.SubOpt{
+		nats.Bind(p.stream.Name, config.durable),
+		nats.ManualAck(),
+	}
+
+	if config.queueGroup == "" {
+		return js.Subscribe(topic, handler, subOpts...)
+	}
+
+	return js.QueueSubscribe(topic, config.queueGroup, handler, subOpts...)
+}
+
+// reportPending periodically reports the number of pending
+// messages of the given subscription until stop is closed.
+func (p *jetStreamPubSub) reportPending(subscription *natsSubscription, stop chan struct{}) {
+
+	ticker := time.NewTicker(p.pendingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if msgs, err := p.subscriptions.pending(subscription); err == nil {
+				p.metrics.SetSubscriptionPending(subscription.topic, msgs)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *jetStreamPubSub) Connect(ctx context.Context) error {
+
+	conn, js, err := p.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	p.conn, p.js = conn, js
+	p.lock.Unlock()
+
+	p.connection.notify(p.metrics, PubSubConnectionEventConnected, nil)
+	p.subscriptions.restore(nil)
+
+	go p.watch()
+
+	return nil
+}
+
+// connect creates a new connection to nats and ensures the
+// stream exists, retrying until it succeeds or ctx is done.
+func (p *jetStreamPubSub) connect(ctx context.Context) (*nats.Conn, nats.JetStreamContext, error) {
+
+	opts := []nats.Option{
+		nats.MaxReconnects(p.maxReconnects),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			p.connection.notify(p.metrics, PubSubConnectionEventDisconnected, err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			p.connection.notify(p.metrics, PubSubConnectionEventReconnected, nil)
+			go p.restore(nc)
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			p.connection.notify(p.metrics, PubSubConnectionEventClosed, nc.LastError())
+			if !p.stopped() && p.currentConn() == nc {
+				go p.reconnect()
+			}
+		}),
+	}
+
+	if p.username != "" || p.password != "" {
+		opts = append(opts, nats.UserInfo(p.username, p.password))
+	}
+
+	if p.tlsConfig != nil {
+		opts = append(opts, nats.Secure(p.tlsConfig))
+	}
+
+	for {
+
+		conn, err := nats.Connect(p.natsURL, opts...)
+		if err == nil {
+			var js nats.JetStreamContext
+			if js, err = p.ensureStream(conn); err == nil {
+				return conn, js, nil
+			}
+			conn.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("unable to connect to nats jetstream on time. last error: %s", err)
+		case <-time.After(p.retryInterval):
+		}
+	}
+}
+
+// ensureStream creates the stream if it does not exist.
+func (p *jetStreamPubSub) ensureStream(conn *nats.Conn) (nats.JetStreamContext, error) {
+
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create jetstream context: %w", err)
+	}
+
+	_, err = js.StreamInfo(p.stream.Name)
+
+	switch {
+
+	case errors.Is(err, nats.ErrStreamNotFound):
+		if _, err := js.AddStream(&p.stream); err != nil {
+			return nil, fmt.Errorf("unable to create stream %s: %w", p.stream.Name, err)
+		}
+
+	case err != nil:
+		return nil, fmt.Errorf("unable to retrieve stream %s: %w", p.stream.Name, err)
+	}
+
+	return js, nil
+}
+
+// restore establishes again the subscriptions once reconnected. As the
+// server may have lost the stream or the consumers in the meantime, the
+// stream is created again if needed, and the subscriptions whose
+// consumer does not exist anymore are replaced.
+func (p *jetStreamPubSub) restore(conn *nats.Conn) {
+
+	if _, err := p.ensureStream(conn); err != nil {
+		zap.L().Warn("Unable to restore jetstream stream", zap.Error(err))
+		time.AfterFunc(p.retryInterval, func() {
+			if !p.stopped() && p.currentConn() == conn && conn.IsConnected() {
+				p.restore(conn)
+			}
+		})
+		return
+	}
+
+	p.subscriptions.restore(func(sub *nats.Subscription) bool {
+		_, err := sub.ConsumerInfo()
+		return !errors.Is(err, nats.ErrConsumerNotFound)
+	})
+}
+
+// reconnect replaces the connection once it has been closed
+// for good, and establishes the subscriptions again.
+func (p *jetStreamPubSub) reconnect() {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	conn, js, err := p.connect(ctx)
+	if err != nil {
+		return
+	}
+
+	p.lock.Lock()
+	if p.stopped() {
+		p.lock.Unlock()
+		conn.Close()
+		return
+	}
+	p.conn, p.js = conn, js
+	p.lock.Unlock()
+
+	p.connection.notify(p.metrics, PubSubConnectionEventReconnected, nil)
+	p.subscriptions.restore(nil)
+}
+
+// watch periodically establishes again the subscriptions
+// that failed, until the client is disconnected.
+func (p *jetStreamPubSub) watch() {
+
+	ticker := time.NewTicker(p.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if conn := p.currentConn(); conn != nil && conn.IsConnected() {
+				p.subscriptions.restore(nil)
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// currentConn returns the connection currently in use.
+func (p *jetStreamPubSub) currentConn() *nats.Conn {
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.conn
+}
+
+// jetStream returns the jetstream context currently in use.
+func (p *jetStreamPubSub) jetStream() nats.JetStreamContext {
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.js
+}
+
+// stopped returns true if Disconnect has been called.
+func (p *jetStreamPubSub) stopped() bool {
+
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *jetStreamPubSub) Disconnect() error {
+
+	p.stopOnce.Do(func() { close(p.stop) })
+
+	conn := p.currentConn()
+	if conn == nil {
+		return nil
+	}
+
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	conn.Close()
+
+	return nil
+}
+
+func (p *jetStreamPubSub) Ping(timeout time.Duration) error {
+
+	conn := p.currentConn()
+	if conn == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	errChannel := make(chan error, 1)
+
+	go func() {
+		if conn.IsConnected() {
+			errChannel <- nil
+		} else if conn.IsReconnecting() {
+			errChannel <- p.connection.error("reconnecting")
+		} else {
+			errChannel <- p.connection.error("connection closed")
+		}
+	}()
+
+	select {
+	case <-time.After(timeout):
+		return fmt.Errorf("connection timeout")
+	case err := <-errChannel:
+		return err
+	}
+}
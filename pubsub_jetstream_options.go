@@ -0,0 +1,237 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A JetStreamOption represents an option to the pubsub backed by NATS JetStream.
+type JetStreamOption func(*jetStreamPubSub)
+
+// JetStreamOptConnectRetryInterval sets the connection retry interval.
+func JetStreamOptConnectRetryInterval(interval time.Duration) JetStreamOption {
+	return func(n *jetStreamPubSub) {
+		n.retryInterval = interval
+	}
+}
+
+// JetStreamOptMaxReconnects sets the number of times the client tries
+// to reconnect when the connection is lost, before the connection gets
+// closed and replaced by a new one. A negative value makes it try
+// indefinitely. The default is nats.DefaultMaxReconnect.
+func JetStreamOptMaxReconnects(max int) JetStreamOption {
+	return func(n *jetStreamPubSub) {
+		n.maxReconnects = max
+	}
+}
+
+// JetStreamOptCredentials sets the username and password to use to connect to nats.
+func JetStreamOptCredentials(username string, password string) JetStreamOption {
+	return func(n *jetStreamPubSub) {
+		n.username = username
+		n.password = password
+	}
+}
+
+// JetStreamOptTLS sets the tls config to use to connect nats.
+func JetStreamOptTLS(tlsConfig *tls.Config) JetStreamOption {
+	return func(n *jetStreamPubSub) {
+		n.tlsConfig = tlsConfig
+	}
+}
+
+// JetStreamOptMetrics sets the PubSubMetrics used to report the
+// publications, the connection events and the number of pending
+// messages of the subscriptions.
+func JetStreamOptMetrics(metrics PubSubMetrics) JetStreamOption {
+	return func(n *jetStreamPubSub) {
+		n.metrics = metrics
+	}
+}
+
+// JetStreamOptTracerProvider sets the OpenTelemetry TracerProvider used
+// to trace the publications and their reception.
+func JetStreamOptTracerProvider(provider trace.TracerProvider) JetStreamOption {
+	return func(n *jetStreamPubSub) {
+		n.tracerProvider = provider
+	}
+}
+
+// JetStreamOptPublicationSigner sets the PublicationSigner used
+// to sign the publications before publishing them.
+func JetStreamOptPublicationSigner(signer PublicationSigner) JetStreamOption {
+	return func(n *jetStreamPubSub) {
+		n.security.signer = signer
+	}
+}
+
+// JetStreamOptPublicationVerifier sets the PublicationVerifier used to
+// verify the signature of the received publications. Once set, the
+// publications that are not signed or have an invalid signature are
+// rejected, and will not be redelivered.
+func JetStreamOptPublicationVerifier(verifier PublicationVerifier) JetStreamOption {
+	return func(n *jetStreamPubSub) {
+		n.security.verifier = verifier
+	}
+}
+
+// JetStreamOptPublicationEncrypter sets the PublicationEncrypter used to
+// encrypt the data of the publications before publishing them, and to
+// decrypt the data of the received ones.
+func JetStreamOptPublicationEncrypter(encrypter PublicationEncrypter) JetStreamOption {
+	return func(n *jetStreamPubSub) {
+		n.security.encrypter = encrypter
+	}
+}
+
+// JetStreamOptConnectionHandler sets the PubSubConnectionHandler called
+// when the client is connected, disconnected, reconnected or when its
+// connection is closed.
+func JetStreamOptConnectionHandler(handler PubSubConnectionHandler) JetStreamOption {
+	return func(n *jetStreamPubSub) {
+		n.connection.handler = handler
+	}
+}
+
+// JetStreamOptPublishContext sets the context used to wait for
+// the acknowledgement of the stream when publishing. It also
+// carries the parent span of the publication, if any.
+func JetStreamOptPublishContext(ctx context.Context) PubSubOptPublish {
+
+	if ctx == nil {
+		panic("illegal argument: context cannot be nil")
+	}
+
+	return func(c any) {
+		c.(*pubSubPublishConfig).ctx = ctx
+	}
+}
+
+type jetStreamSubscribeConfig struct {
+	durable       string
+	queueGroup    string
+	deliverPolicy nats.DeliverPolicy
+	startSequence uint64
+	startTime     time.Time
+	ackWait       time.Duration
+	maxDeliver    int
+	autoAck       bool
+	dedupWindow   time.Duration
+}
+
+func defaultJetStreamSubscribeConfig() jetStreamSubscribeConfig {
+	return jetStreamSubscribeConfig{
+		deliverPolicy: nats.DeliverNewPolicy,
+		ackWait:       30 * time.Second,
+		maxDeliver:    5,
+	}
+}
+
+// JetStreamOptSubscribeDurable makes the subscription use the durable
+// consumer with the given name, creating it if needed. The consumer
+// keeps track of the acknowledged publications across reconnections and
+// restarts, and it is not deleted when unsubscribing. The deliver options
+// only apply when the consumer is created.
+//
+// By default, an ephemeral consumer is used.
+func JetStreamOptSubscribeDurable(name string) PubSubOptSubscribe {
+
+	if name == "" {
+		panic("illegal argument: durable name cannot be empty")
+	}
+
+	return func(c any) {
+		if config, ok := c.(*jetStreamSubscribeConfig); ok {
+			config.durable = name
+		}
+	}
+}
+
+// JetStreamOptSubscribeQueue sets the queue group of the subscription.
+// Only one subscriber of the queue group will receive each publication.
+//
+// It is equivalent to PubSubOptSubscribeQueue.
+func JetStreamOptSubscribeQueue(queueGroup string) PubSubOptSubscribe {
+	return PubSubOptSubscribeQueue(queueGroup)
+}
+
+// JetStreamOptSubscribeDeliverAll replays all the publications
+// available in the stream. By default, only the publications
+// published after the subscription are delivered.
+func JetStreamOptSubscribeDeliverAll() PubSubOptSubscribe {
+	return func(c any) {
+		if config, ok := c.(*jetStreamSubscribeConfig); ok {
+			config.deliverPolicy = nats.DeliverAllPolicy
+		}
+	}
+}
+
+// JetStreamOptSubscribeStartSequence replays the publications
+// of the stream starting from the given sequence.
+func JetStreamOptSubscribeStartSequence(seq uint64) PubSubOptSubscribe {
+	return func(c any) {
+		if config, ok := c.(*jetStreamSubscribeConfig); ok {
+			config.deliverPolicy = nats.DeliverByStartSequencePolicy
+			config.startSequence = seq
+		}
+	}
+}
+
+// JetStreamOptSubscribeStartTime replays the publications
+// of the stream published since the given time.
+func JetStreamOptSubscribeStartTime(t time.Time) PubSubOptSubscribe {
+	return func(c any) {
+		if config, ok := c.(*jetStreamSubscribeConfig); ok {
+			config.deliverPolicy = nats.DeliverByStartTimePolicy
+			config.startTime = t
+		}
+	}
+}
+
+// JetStreamOptSubscribeAckWait sets how long the stream waits for a
+// received publication to be acknowledged using Publication.Ack before
+// redelivering it. The default is 30s.
+func JetStreamOptSubscribeAckWait(wait time.Duration) PubSubOptSubscribe {
+	return func(c any) {
+		if config, ok := c.(*jetStreamSubscribeConfig); ok {
+			config.ackWait = wait
+		}
+	}
+}
+
+// JetStreamOptSubscribeMaxDeliver sets the maximum number of times a
+// publication is delivered if it is not acknowledged. The default is 5.
+// Passing -1 redelivers it until it is acknowledged.
+func JetStreamOptSubscribeMaxDeliver(max int) PubSubOptSubscribe {
+	return func(c any) {
+		if config, ok := c.(*jetStreamSubscribeConfig); ok {
+			config.maxDeliver = max
+		}
+	}
+}
+
+// JetStreamOptSubscribeAutoAck acknowledges the publications as soon
+// as they are sent in the publications channel, instead of waiting
+// for the subscriber to call Publication.Ack.
+func JetStreamOptSubscribeAutoAck() PubSubOptSubscribe {
+	return func(c any) {
+		if config, ok := c.(*jetStreamSubscribeConfig); ok {
+			config.autoAck = true
+		}
+	}
+}
@@ -0,0 +1,543 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	natsd "github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	nats "github.com/nats-io/nats.go"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/bahamut/oteltest"
+	"go.aporeto.io/elemental"
+)
+
+func runJetStreamServer(t *testing.T) *natsd.Server {
+
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+
+	return natsserver.RunServer(&opts)
+}
+
+func receivePublication(pubs chan *Publication, timeout time.Duration) *Publication {
+
+	select {
+	case p := <-pubs:
+		return p
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func TestJetStream_NewJetStreamPubSubClient(t *testing.T) {
+
+	Convey("Given I create a new jetstream client", t, func() {
+
+		metrics := newTestPubSubMetrics()
+		hk, _ := NewHMACPublicationKeyring("k1", map[string][]byte{"k1": []byte("secret")})
+		ek, _ := NewAESGCMPublicationKeyring("e1", map[string][]byte{"e1": make([]byte, 16)})
+		ps := NewJetStreamPubSubClient(
+			"nats://localhost:4222",
+			nats.StreamConfig{Name: "events", Subjects: []string{"events.>"}},
+			JetStreamOptConnectRetryInterval(time.Second),
+			JetStreamOptMaxReconnects(-1),
+			JetStreamOptCredentials("user", "pass"),
+			JetStreamOptMetrics(metrics),
+			JetStreamOptPublicationSigner(hk),
+			JetStreamOptPublicationVerifier(hk),
+			JetStreamOptPublicationEncrypter(ek),
+			JetStreamOptConnectionHandler(func(string, error) {}),
+		).(*jetStreamPubSub)
+
+		Convey("Then it should be correctly configured", func() {
+			So(ps.natsURL, ShouldEqual, "nats://localhost:4222")
+			So(ps.stream.Name, ShouldEqual, "events")
+			So(ps.retryInterval, ShouldEqual, time.Second)
+			So(ps.maxReconnects, ShouldEqual, -1)
+			So(ps.username, ShouldEqual, "user")
+			So(ps.password, ShouldEqual, "pass")
+			So(ps.metrics, ShouldEqual, metrics)
+			So(ps.security.signer, ShouldEqual, hk)
+			So(ps.security.verifier, ShouldEqual, hk)
+			So(ps.security.encrypter, ShouldEqual, ek)
+			So(ps.connection.handler, ShouldNotBeNil)
+		})
+
+		Convey("Then publishing before connecting should fail", func() {
+			So(ps.Publish(NewPublication("events.a")), ShouldNotBeNil)
+		})
+
+		Convey("Then pinging before connecting should fail", func() {
+			So(ps.Ping(time.Second), ShouldNotBeNil)
+		})
+
+		Convey("Then disconnecting before connecting should not fail", func() {
+			So(ps.Disconnect(), ShouldBeNil)
+		})
+	})
+
+	Convey("Creating a jetstream client without stream name should panic", t, func() {
+		So(func() { NewJetStreamPubSubClient("nats://localhost:4222", nats.StreamConfig{}) }, ShouldPanicWith, "stream name must not be empty")
+	})
+}
+
+func TestJetStream_PublishSubscribe(t *testing.T) {
+
+	Convey("Given I have a connected jetstream client", t, func() {
+
+		srv := runJetStreamServer(t)
+		defer srv.Shutdown()
+
+		ps := NewJetStreamPubSubClient(
+			srv.ClientURL(),
+			nats.StreamConfig{Name: "events", Subjects: []string{"events.>"}},
+		)
+
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer ps.Disconnect() // nolint: errcheck
+
+		Convey("When I subscribe then publish", func() {
+
+			pubs := make(chan *Publication, 10)
+			errs := make(chan error, 10)
+			unsub := ps.Subscribe(pubs, errs, "events.a", JetStreamOptSubscribeAutoAck())
+			defer unsub()
+
+			pub := NewPublication("events.a")
+			pub.Data = []byte("hello")
+			So(ps.Publish(pub, JetStreamOptPublishContext(context.Background())), ShouldBeNil)
+
+			Convey("Then I should receive the publication", func() {
+				p := receivePublication(pubs, 2*time.Second)
+				So(p, ShouldNotBeNil)
+				So(p.Data, ShouldResemble, []byte("hello"))
+				So(p.Topic, ShouldEqual, "events.a")
+			})
+		})
+
+		Convey("When I publish then subscribe from the start of the stream", func() {
+
+			for _, d := range []string{"one", "two", "three"} {
+				pub := NewPublication("events.a")
+				pub.Data = []byte(d)
+				So(ps.Publish(pub), ShouldBeNil)
+			}
+
+			pubs := make(chan *Publication, 10)
+			errs := make(chan error, 10)
+
+			Convey("Then I should receive all of them with DeliverAll", func() {
+				unsub := ps.Subscribe(pubs, errs, "events.a", JetStreamOptSubscribeDeliverAll(), JetStreamOptSubscribeAutoAck())
+				defer unsub()
+
+				for _, d := range []string{"one", "two", "three"} {
+					p := receivePublication(pubs, 2*time.Second)
+					So(p, ShouldNotBeNil)
+					So(string(p.Data), ShouldEqual, d)
+				}
+			})
+
+			Convey("Then I should receive the last ones with StartSequence", func() {
+				unsub := ps.Subscribe(pubs, errs, "events.a", JetStreamOptSubscribeStartSequence(2), JetStreamOptSubscribeAutoAck())
+				defer unsub()
+
+				for _, d := range []string{"two", "three"} {
+					p := receivePublication(pubs, 2*time.Second)
+					So(p, ShouldNotBeNil)
+					So(string(p.Data), ShouldEqual, d)
+				}
+			})
+
+			Convey("Then I should receive none with StartTime in the future", func() {
+				unsub := ps.Subscribe(pubs, errs, "events.a", JetStreamOptSubscribeStartTime(time.Now().Add(time.Hour)))
+				defer unsub()
+
+				So(receivePublication(pubs, 200*time.Millisecond), ShouldBeNil)
+			})
+
+			Convey("Then I should receive none by default", func() {
+				unsub := ps.Subscribe(pubs, errs, "events.a")
+				defer unsub()
+
+				So(receivePublication(pubs, 200*time.Millisecond), ShouldBeNil)
+			})
+		})
+
+		Convey("When I do not acknowledge a publication", func() {
+
+			pubs := make(chan *Publication, 10)
+			errs := make(chan error, 10)
+			unsub := ps.Subscribe(
+				pubs,
+				errs,
+				"events.a",
+				JetStreamOptSubscribeAckWait(100*time.Millisecond),
+				JetStreamOptSubscribeMaxDeliver(2),
+			)
+			defer unsub()
+
+			So(ps.Publish(NewPublication("events.a")), ShouldBeNil)
+
+			Convey("Then it should be redelivered up to the max deliver", func() {
+				So(receivePublication(pubs, 2*time.Second), ShouldNotBeNil)
+				So(receivePublication(pubs, 2*time.Second), ShouldNotBeNil)
+				So(receivePublication(pubs, 500*time.Millisecond), ShouldBeNil)
+			})
+		})
+
+		Convey("When I nak a publication", func() {
+
+			pubs := make(chan *Publication, 10)
+			errs := make(chan error, 10)
+			unsub := ps.Subscribe(pubs, errs, "events.a")
+			defer unsub()
+
+			So(ps.Publish(NewPublication("events.a")), ShouldBeNil)
+
+			p := receivePublication(pubs, 2*time.Second)
+			So(p, ShouldNotBeNil)
+			So(p.Nak(), ShouldBeNil)
+
+			Convey("Then it should be redelivered right away, and not after an ack", func() {
+				p = receivePublication(pubs, 2*time.Second)
+				So(p, ShouldNotBeNil)
+				So(p.Ack(), ShouldBeNil)
+				So(receivePublication(pubs, 500*time.Millisecond), ShouldBeNil)
+			})
+		})
+
+		Convey("When I acknowledge a duplicate of a publication", func() {
+
+			pubs := make(chan *Publication, 10)
+			errs := make(chan error, 10)
+			unsub := ps.Subscribe(pubs, errs, "events.a", JetStreamOptSubscribeAckWait(100*time.Millisecond))
+			defer unsub()
+
+			So(ps.Publish(NewPublication("events.a")), ShouldBeNil)
+
+			p := receivePublication(pubs, 2*time.Second)
+			So(p, ShouldNotBeNil)
+			So(p.Duplicate().Ack(), ShouldBeNil)
+
+			Convey("Then it should not be redelivered", func() {
+				So(receivePublication(pubs, 500*time.Millisecond), ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Given the default subscription configuration", t, func() {
+
+		Convey("Then the publications should not be redelivered forever", func() {
+			So(defaultJetStreamSubscribeConfig().maxDeliver, ShouldEqual, 5)
+		})
+	})
+}
+
+func TestJetStream_Durable(t *testing.T) {
+
+	Convey("Given I have a connected jetstream client with a durable subscription", t, func() {
+
+		srv := runJetStreamServer(t)
+		defer srv.Shutdown()
+
+		ps := NewJetStreamPubSubClient(
+			srv.ClientURL(),
+			nats.StreamConfig{Name: "events", Subjects: []string{"events.>"}},
+		)
+
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer ps.Disconnect() // nolint: errcheck
+
+		pubs := make(chan *Publication, 10)
+		errs := make(chan error, 10)
+		unsub := ps.Subscribe(pubs, errs, "events.a", JetStreamOptSubscribeDurable("worker"))
+
+		pub := NewPublication("events.a")
+		pub.Data = []byte("one")
+		So(ps.Publish(pub), ShouldBeNil)
+
+		p := receivePublication(pubs, 2*time.Second)
+		So(p, ShouldNotBeNil)
+		So(p.Ack(), ShouldBeNil)
+
+		Convey("When I unsubscribe, publish and subscribe again", func() {
+
+			unsub()
+
+			pub := NewPublication("events.a")
+			pub.Data = []byte("two")
+			So(ps.Publish(pub), ShouldBeNil)
+
+			unsub = ps.Subscribe(pubs, errs, "events.a", JetStreamOptSubscribeDurable("worker"))
+			defer unsub()
+
+			Convey("Then I should only receive the publication sent while I was away", func() {
+				p := receivePublication(pubs, 2*time.Second)
+				So(p, ShouldNotBeNil)
+				So(string(p.Data), ShouldEqual, "two")
+				So(p.Ack(), ShouldBeNil)
+				So(receivePublication(pubs, 200*time.Millisecond), ShouldBeNil)
+				So(len(errs), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestJetStream_HeadersExpirationDeduplication(t *testing.T) {
+
+	Convey("Given I have a connected jetstream client", t, func() {
+
+		srv := runJetStreamServer(t)
+		defer srv.Shutdown()
+
+		ps := NewJetStreamPubSubClient(
+			srv.ClientURL(),
+			nats.StreamConfig{Name: "events", Subjects: []string{"events.>"}, Duplicates: time.Minute},
+		)
+
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer ps.Disconnect() // nolint: errcheck
+
+		nc, err := nats.Connect(srv.ClientURL())
+		So(err, ShouldBeNil)
+		defer nc.Close()
+
+		Convey("When I publish a publication with headers", func() {
+
+			sub, err := nc.SubscribeSync("events.a")
+			So(err, ShouldBeNil)
+			So(nc.Flush(), ShouldBeNil)
+
+			pub := NewPublication("events.a")
+			pub.SetHeader("k", "v")
+			So(ps.Publish(pub), ShouldBeNil)
+
+			Convey("Then they should be mapped to the nats message headers", func() {
+				msg, err := sub.NextMsg(2 * time.Second)
+				So(err, ShouldBeNil)
+				So(msg.Header.Get("k"), ShouldEqual, "v")
+				So(msg.Header.Get(nats.MsgIdHdr), ShouldEqual, pub.ID)
+			})
+		})
+
+		Convey("When I receive a message published with headers by another client", func() {
+
+			pubs := make(chan *Publication, 1)
+			errs := make(chan error, 1)
+			defer ps.Subscribe(pubs, errs, "events.a", JetStreamOptSubscribeAutoAck())()
+
+			pub := NewPublication("events.a")
+			pub.SetHeader("k", "v")
+			data, err := elemental.Encode(elemental.EncodingTypeMSGPACK, pub)
+			So(err, ShouldBeNil)
+
+			msg := nats.NewMsg("events.a")
+			msg.Data = data
+			msg.Header.Set("k", "other")
+			msg.Header.Set("x", "y")
+			js, err := nc.JetStream()
+			So(err, ShouldBeNil)
+			_, err = js.PublishMsg(msg)
+			So(err, ShouldBeNil)
+
+			Convey("Then the headers should be merged without overriding the envelope", func() {
+				p := receivePublication(pubs, 2*time.Second)
+				So(p, ShouldNotBeNil)
+				So(p.Header("k"), ShouldEqual, "v")
+				So(p.Header("x"), ShouldEqual, "y")
+				So(p.Header(nats.MsgIdHdr), ShouldEqual, "")
+			})
+		})
+
+		Convey("When I publish the same publication twice", func() {
+
+			pubs := make(chan *Publication, 2)
+			errs := make(chan error, 1)
+			defer ps.Subscribe(pubs, errs, "events.a", JetStreamOptSubscribeAutoAck())()
+
+			pub := NewPublication("events.a")
+			So(ps.Publish(pub), ShouldBeNil)
+			So(ps.Publish(pub), ShouldBeNil)
+
+			Convey("Then the stream should only store it once", func() {
+				So(receivePublication(pubs, 2*time.Second), ShouldNotBeNil)
+				So(receivePublication(pubs, 200*time.Millisecond), ShouldBeNil)
+			})
+		})
+
+		Convey("When the stream does not deduplicate and I subscribe with deduplication", func() {
+
+			pubs := make(chan *Publication, 2)
+			errs := make(chan error, 1)
+			defer ps.Subscribe(pubs, errs, "events.b", PubSubOptSubscribeDeduplicate(time.Minute), JetStreamOptSubscribeAutoAck())()
+
+			pub := NewPublication("events.b")
+			data, err := elemental.Encode(elemental.EncodingTypeMSGPACK, pub)
+			So(err, ShouldBeNil)
+
+			// Publishing without message ID bypasses the stream deduplication.
+			js, err := nc.JetStream()
+			So(err, ShouldBeNil)
+			_, err = js.Publish("events.b", data)
+			So(err, ShouldBeNil)
+			_, err = js.Publish("events.b", data)
+			So(err, ShouldBeNil)
+
+			Convey("Then I should receive it once", func() {
+				p := receivePublication(pubs, 2*time.Second)
+				So(p, ShouldNotBeNil)
+				So(p.ID, ShouldEqual, pub.ID)
+				So(receivePublication(pubs, 200*time.Millisecond), ShouldBeNil)
+			})
+		})
+
+		Convey("When I publish an expired publication", func() {
+
+			pubs := make(chan *Publication, 1)
+			errs := make(chan error, 1)
+			defer ps.Subscribe(pubs, errs, "events.a")()
+
+			pub := NewPublication("events.a")
+			pub.Timestamp = time.Now().Add(-time.Minute)
+			pub.TTL = time.Second
+			So(ps.Publish(pub), ShouldBeNil)
+
+			Convey("Then it should not be delivered", func() {
+				So(receivePublication(pubs, 200*time.Millisecond), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestJetStream_Instrumentation(t *testing.T) {
+
+	Convey("Given I have a connected jetstream client with metrics and tracing", t, func() {
+
+		srv := runJetStreamServer(t)
+		defer srv.Shutdown()
+
+		metrics := newTestPubSubMetrics()
+		tp := oteltest.NewTracerProvider()
+
+		ps := NewJetStreamPubSubClient(
+			srv.ClientURL(),
+			nats.StreamConfig{Name: "events", Subjects: []string{"events.>"}},
+			JetStreamOptMetrics(metrics),
+			JetStreamOptTracerProvider(tp),
+		).(*jetStreamPubSub)
+		ps.pendingInterval = 10 * time.Millisecond
+
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer ps.Disconnect() // nolint: errcheck
+
+		Convey("When I publish a publication", func() {
+
+			pubs := make(chan *Publication, 1)
+			errs := make(chan error, 1)
+			unsub := ps.Subscribe(pubs, errs, "events.a", JetStreamOptSubscribeAutoAck())
+			defer unsub()
+
+			So(ps.Publish(NewPublication("events.a")), ShouldBeNil)
+			So(receivePublication(pubs, 2*time.Second), ShouldNotBeNil)
+			time.Sleep(50 * time.Millisecond)
+
+			Convey("Then the publication should be reported", func() {
+				metrics.Lock()
+				defer metrics.Unlock()
+				So(metrics.published["events.a"], ShouldResemble, []error{nil})
+				So(metrics.pending, ShouldContainKey, "events.a")
+			})
+
+			Convey("Then the publication and its reception should be traced", func() {
+				So(len(tp.Spans()), ShouldEqual, 2)
+			})
+		})
+	})
+}
+
+func TestJetStream_ConnectionLifecycle(t *testing.T) {
+
+	Convey("Given I have a connected jetstream client with subscriptions", t, func() {
+
+		srv := runJetStreamServer(t)
+		defer func() { srv.Shutdown() }()
+
+		events := make(chan string, 16)
+
+		ps := NewJetStreamPubSubClient(
+			srv.ClientURL(),
+			nats.StreamConfig{Name: "events", Subjects: []string{"events.>"}},
+			JetStreamOptConnectRetryInterval(100*time.Millisecond),
+			JetStreamOptConnectionHandler(func(event string, err error) { events <- event }),
+		)
+
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer ps.Disconnect() // nolint: errcheck
+
+		So(waitConnectionEvent(events, time.Second), ShouldEqual, PubSubConnectionEventConnected)
+		So(ps.(Pinger).Ping(time.Second), ShouldBeNil)
+
+		pubs := make(chan *Publication, 10)
+		qpubs := make(chan *Publication, 10)
+		dpubs := make(chan *Publication, 10)
+		errs := make(chan error, 10)
+		defer ps.Subscribe(pubs, errs, "events.a", JetStreamOptSubscribeAutoAck())()
+		defer ps.Subscribe(qpubs, errs, "events.a", PubSubOptSubscribeQueue("queue"), JetStreamOptSubscribeAutoAck())()
+		defer ps.Subscribe(dpubs, errs, "events.a", JetStreamOptSubscribeDurable("worker"), JetStreamOptSubscribeAutoAck())()
+
+		Convey("When the server restarts and loses its stream and consumers", func() {
+
+			port := srv.Addr().(*net.TCPAddr).Port
+			srv.Shutdown()
+
+			So(waitConnectionEvent(events, 5*time.Second), ShouldEqual, PubSubConnectionEventDisconnected)
+
+			err := ps.(Pinger).Ping(time.Second)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "reconnecting")
+
+			opts := natsserver.DefaultTestOptions
+			opts.Port = port
+			opts.JetStream = true
+			opts.StoreDir = t.TempDir()
+			srv = natsserver.RunServer(&opts)
+
+			So(waitConnectionEvent(events, 10*time.Second), ShouldEqual, PubSubConnectionEventReconnected)
+
+			Convey("Then the stream and the subscriptions should be established again", func() {
+
+				So(ps.(Pinger).Ping(time.Second), ShouldBeNil)
+
+				var err error
+				for i := 0; i < 20; i++ {
+					if err = ps.Publish(NewPublication("events.a")); err == nil {
+						break
+					}
+					time.Sleep(100 * time.Millisecond)
+				}
+				So(err, ShouldBeNil)
+
+				So(receivePublication(pubs, 2*time.Second), ShouldNotBeNil)
+				So(receivePublication(qpubs, 2*time.Second), ShouldNotBeNil)
+				So(receivePublication(dpubs, 2*time.Second), ShouldNotBeNil)
+				So(len(errs), ShouldEqual, 0)
+			})
+		})
+	})
+}
@@ -13,58 +13,189 @@ package bahamut
 
 import (
 	"context"
+	"fmt"
+	"math/rand"
+	"strings"
 	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 )
 
 type registration struct {
+	topic        string
+	queue        string
+	replyTimeout time.Duration
+	errors       chan error
+	ch           chan *Publication
+	dedup        *deduplicator
+
+	// count is the number of times the channel is subscribed to
+	// the topic. The options of the first subscription are kept.
+	count int
+}
+
+// localPublication is a publication sent through the local
+// pubsub, with the channel to reply to if it is a request.
+type localPublication struct {
+	publication *Publication
+	replyTo     chan localReply
+}
+
+// localReply is the reply to a localPublication.
+type localReply struct {
+	publication *Publication
+	err         error
+}
+
+// subscriberKey identifies a channel subscribed to a topic.
+type subscriberKey struct {
 	topic string
 	ch    chan *Publication
 }
 
 // localPubSub implements a PubSubClient using local channels
 type localPubSub struct {
-	subscribers  map[string][]chan *Publication
-	register     chan *registration
-	unregister   chan *registration
-	publications chan *Publication
-	stop         chan struct{}
+	subscribers   map[string][]chan *Publication
+	registrations map[subscriberKey]*registration
+	register      chan *registration
+	unregister    chan *registration
+	publications  chan *localPublication
+	stop          chan struct{}
+
+	metrics        PubSubMetrics
+	tracerProvider trace.TracerProvider
+	connection     pubSubConnectionState
 
 	lock *sync.Mutex
 }
 
 // NewLocalPubSubClient returns a PubSubClient backed by local channels.
-func NewLocalPubSubClient() PubSubClient {
+func NewLocalPubSubClient(options ...LocalPubSubOption) PubSubClient {
+
+	p := newlocalPubSub()
+
+	for _, opt := range options {
+		opt(p)
+	}
 
-	return newlocalPubSub()
+	return p
 }
 
 // newlocalPubSub returns a new localPubSub.
 func newlocalPubSub() *localPubSub {
 
 	return &localPubSub{
-		subscribers:  map[string][]chan *Publication{},
-		register:     make(chan *registration),
-		unregister:   make(chan *registration),
-		stop:         make(chan struct{}),
-		publications: make(chan *Publication, 1024),
-		lock:         &sync.Mutex{},
+		subscribers:   map[string][]chan *Publication{},
+		registrations: map[subscriberKey]*registration{},
+		register:      make(chan *registration),
+		unregister:    make(chan *registration),
+		stop:          make(chan struct{}),
+		publications:  make(chan *localPublication, 1024),
+		lock:          &sync.Mutex{},
 	}
 }
 
-// Publish publishes a publication.
+// Publish publishes a publication. Like with NATS, PubSubOptPublishRequireAck
+// and PubSubOptRespondToChannel can be used to wait for an ACK or a
+// response from one of the subscribers.
 func (p *localPubSub) Publish(publication *Publication, opts ...PubSubOptPublish) error {
 
-	p.publications <- publication
+	config := pubSubPublishConfig{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	var span trace.Span
+	if p.tracerProvider != nil {
+		span = startPubSubPublishSpan(config.ctx, p.tracerProvider, "local", publication)
+	}
+
+	start := time.Now()
+	err := p.publish(publication, config)
+
+	if p.metrics != nil {
+		p.metrics.ObservePublish(publication.Topic, time.Since(start), err)
+	}
+
+	if span != nil {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+
+	return err
+}
+
+func (p *localPubSub) publish(publication *Publication, config pubSubPublishConfig) error {
+
+	if err := config.compress(publication); err != nil {
+		return err
+	}
+
+	publication.ResponseMode = config.desiredResponse
+
+	if config.desiredResponse == ResponseModeNone {
+		p.publications <- &localPublication{publication: publication}
+		return nil
+	}
+
+	start := time.Now()
+	replyTo := make(chan localReply, 1)
+
+	p.publications <- &localPublication{publication: publication, replyTo: replyTo}
+
+	var reply localReply
+	select {
+	case reply = <-replyTo:
+	case <-config.ctx.Done():
+		reply.err = config.ctx.Err()
+	}
+
+	if config.desiredResponse == ResponseModeACK {
+		if p.metrics != nil {
+			p.metrics.ObserveAck(publication.Topic, time.Since(start), reply.err)
+		}
+		return reply.err
+	}
+
+	if reply.err != nil {
+		return reply.err
+	}
+
+	config.responseCh <- reply.publication
 
 	return nil
 }
 
-// Subscribe will subscribe the given channel to the given topic
+// Subscribe will subscribe the given channel to the given topic.
+// Like with NATS, the topic can contain the wildcards `*`, matching
+// exactly one token, and `>`, matching one or more tokens at the end
+// of the subject. If PubSubOptSubscribeQueue is given, each publication
+// is delivered to only one of the channels of the queue group.
+// Expired publications are never delivered, and duplicated ones are
+// dropped if PubSubOptSubscribeDeduplicate is given.
 func (p *localPubSub) Subscribe(c chan *Publication, errors chan error, topic string, opts ...PubSubOptSubscribe) func() {
 
+	config := defaultSubscribeConfig()
+	for _, opt := range opts {
+		opt(&config)
+	}
+
 	unsubscribe := make(chan struct{})
 
-	p.registerSubscriberChannel(c, topic)
+	p.register <- &registration{
+		ch:           c,
+		topic:        topic,
+		queue:        config.queueGroup,
+		replyTimeout: config.replyTimeout,
+		errors:       errors,
+		dedup:        newDeduplicator(config.dedupWindow),
+	}
 
 	go func() {
 		<-unsubscribe
@@ -79,6 +210,8 @@ func (p *localPubSub) Connect(ctx context.Context) error {
 
 	go p.listen()
 
+	p.connection.notify(p.metrics, PubSubConnectionEventConnected, nil)
+
 	return nil
 }
 
@@ -87,12 +220,27 @@ func (p *localPubSub) Disconnect() error {
 
 	close(p.stop)
 
+	p.connection.notify(p.metrics, PubSubConnectionEventClosed, nil)
+
 	return nil
 }
 
+// Ping returns an error if the PubSubClient is not connected.
+func (p *localPubSub) Ping(timeout time.Duration) error {
+
+	switch p.connection.current() {
+	case PubSubConnectionEventConnected:
+		return nil
+	case PubSubConnectionEventClosed:
+		return fmt.Errorf("connection closed")
+	default:
+		return fmt.Errorf("not connected")
+	}
+}
+
 func (p *localPubSub) registerSubscriberChannel(c chan *Publication, topic string) {
 
-	p.register <- &registration{ch: c, topic: topic}
+	p.register <- &registration{ch: c, topic: topic, replyTimeout: defaultSubscribeConfig().replyTimeout}
 }
 
 func (p *localPubSub) unregisterSubscriberChannel(c chan *Publication, topic string) {
@@ -111,6 +259,14 @@ func (p *localPubSub) listen() {
 			}
 
 			p.subscribers[reg.topic] = append(p.subscribers[reg.topic], reg.ch)
+
+			key := subscriberKey{topic: reg.topic, ch: reg.ch}
+			if existing, ok := p.registrations[key]; ok {
+				existing.count++
+			} else {
+				reg.count = 1
+				p.registrations[key] = reg
+			}
 			p.lock.Unlock()
 
 		case reg := <-p.unregister:
@@ -118,31 +274,187 @@ func (p *localPubSub) listen() {
 			for i, sub := range p.subscribers[reg.topic] {
 				if sub == reg.ch {
 					p.subscribers[reg.topic] = append(p.subscribers[reg.topic][:i], p.subscribers[reg.topic][i+1:]...)
+
+					// The channel is only closed once it is not
+					// subscribed to the topic anymore.
+					key := subscriberKey{topic: reg.topic, ch: sub}
+					if existing := p.registrations[key]; existing != nil {
+						existing.count--
+						if existing.count > 0 {
+							break
+						}
+					}
+
+					delete(p.registrations, key)
 					close(sub)
 					break
 				}
 			}
 			p.lock.Unlock()
 
-		case publication := <-p.publications:
+		case lp := <-p.publications:
+
+			if lp.publication.IsExpired() {
+				if lp.replyTo != nil {
+					sendLocalReply(lp.replyTo, localReply{err: fmt.Errorf("publication expired")})
+				}
+				continue
+			}
 
 			p.lock.Lock()
 			var wg sync.WaitGroup
-			for _, sub := range p.subscribers[publication.Topic] {
+			var delivered bool
+
+			deliver := func(s chan *Publication, reg *registration) {
+
+				delivered = true
+
+				if reg.dedup.isDuplicate(lp.publication.ID, time.Now()) {
+					// The publisher may be retrying because
+					// it did not receive the first ACK.
+					if lp.replyTo != nil && lp.publication.ResponseMode == ResponseModeACK {
+						sendLocalReply(lp.replyTo, localReply{})
+					}
+					return
+				}
+
+				pub := lp.publication.Duplicate()
+
+				if lp.replyTo != nil {
+					switch pub.ResponseMode {
+					case ResponseModeACK:
+						sendLocalReply(lp.replyTo, localReply{})
+					case ResponseModePublication:
+						// The channel is buffered so a late reply
+						// never blocks the subscriber.
+						pub.replyCh = make(chan *Publication, 1)
+						go p.handleReply(pub, lp.replyTo, reg)
+					}
+				}
+
 				wg.Add(1)
-				go func(s chan *Publication, p *Publication) {
+				go func() {
 					defer wg.Done()
-					s <- p.Duplicate()
-				}(sub, publication)
+					s <- pub
+					if p.metrics != nil {
+						p.metrics.SetSubscriptionPending(reg.topic, len(s))
+					}
+				}()
 			}
+
+			for topic, subs := range p.subscribers {
+
+				if !matchSubject(topic, lp.publication.Topic) {
+					continue
+				}
+
+				var groups map[string][]chan *Publication
+
+				for _, sub := range subs {
+
+					reg := p.registrations[subscriberKey{topic: topic, ch: sub}]
+					if reg.queue == "" {
+						deliver(sub, reg)
+						continue
+					}
+
+					if groups == nil {
+						groups = map[string][]chan *Publication{}
+					}
+					groups[reg.queue] = append(groups[reg.queue], sub)
+				}
+
+				// Like NATS, we deliver to a random member of each queue group.
+				for _, members := range groups {
+					sub := members[rand.Intn(len(members))]
+					deliver(sub, p.registrations[subscriberKey{topic: topic, ch: sub}])
+				}
+			}
+
+			if !delivered && lp.replyTo != nil {
+				sendLocalReply(lp.replyTo, localReply{err: fmt.Errorf("no responders available for request")})
+			}
+
 			wg.Wait()
 			p.lock.Unlock()
 
 		case <-p.stop:
 			p.lock.Lock()
 			p.subscribers = map[string][]chan *Publication{}
+			p.registrations = map[subscriberKey]*registration{}
 			p.lock.Unlock()
 			return
 		}
 	}
 }
+
+// handleReply waits for the subscriber to reply to the given
+// publication, and sends the reply to the publisher.
+func (p *localPubSub) handleReply(publication *Publication, replyTo chan localReply, reg *registration) {
+
+	select {
+
+	case r := <-publication.replyCh:
+		// no response should be expected for a response.
+		r.ResponseMode = ResponseModeNone
+		sendLocalReply(replyTo, localReply{publication: r})
+
+	case <-time.After(reg.replyTimeout):
+		publication.setExpired()
+		if p.metrics != nil {
+			p.metrics.RegisterReplyTimeout(reg.topic)
+		}
+		if reg.errors != nil {
+			err := fmt.Errorf("timed out waiting for response to send to subscriber on topic: %s", reg.topic)
+			select {
+			case reg.errors <- err:
+			default:
+				zap.L().Warn("Unable to report reply timeout",
+					zap.String("topic", reg.topic),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
+
+// sendLocalReply sends the given reply, unless another
+// subscriber already replied first.
+func sendLocalReply(replyTo chan localReply, reply localReply) {
+
+	select {
+	case replyTo <- reply:
+	default:
+	}
+}
+
+// matchSubject returns true if the given subject matches the given
+// pattern, using the NATS semantics: tokens are separated by `.`, `*`
+// matches exactly one token and `>`, when it is the last token of the
+// pattern, matches one or more tokens.
+func matchSubject(pattern string, subject string) bool {
+
+	if pattern == subject {
+		return true
+	}
+
+	pTokens := strings.Split(pattern, ".")
+	sTokens := strings.Split(subject, ".")
+
+	for i, pt := range pTokens {
+
+		if pt == ">" && i == len(pTokens)-1 {
+			return len(sTokens) > i
+		}
+
+		if i >= len(sTokens) {
+			return false
+		}
+
+		if sTokens[i] == "" || (pt != "*" && pt != sTokens[i]) {
+			return false
+		}
+	}
+
+	return len(pTokens) == len(sTokens)
+}
@@ -0,0 +1,46 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A LocalPubSubOption represents an option that can be
+// passed to NewLocalPubSubClient.
+type LocalPubSubOption func(*localPubSub)
+
+// LocalPubSubOptMetrics sets the PubSubMetrics used to report the
+// publications, the connection events and the number of pending
+// messages of the subscriptions.
+func LocalPubSubOptMetrics(metrics PubSubMetrics) LocalPubSubOption {
+	return func(p *localPubSub) {
+		p.metrics = metrics
+	}
+}
+
+// LocalPubSubOptTracerProvider sets the OpenTelemetry TracerProvider
+// used to trace the publications. The trace context is propagated in
+// the TrackingData of the publications.
+func LocalPubSubOptTracerProvider(provider trace.TracerProvider) LocalPubSubOption {
+	return func(p *localPubSub) {
+		p.tracerProvider = provider
+	}
+}
+
+// LocalPubSubOptConnectionHandler sets the PubSubConnectionHandler
+// called when the client is connected and when it is disconnected.
+func LocalPubSubOptConnectionHandler(handler PubSubConnectionHandler) LocalPubSubOption {
+	return func(p *localPubSub) {
+		p.connection.handler = handler
+	}
+}
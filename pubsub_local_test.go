@@ -13,10 +13,13 @@ package bahamut
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/bahamut/oteltest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestLocalPubSub_NewPubSubServer(t *testing.T) {
@@ -92,6 +95,55 @@ func TestLocalPubSub_RegisterUnregister(t *testing.T) {
 				})
 			})
 		})
+
+		Convey("When I subscribe with options that only apply to JetStream", func() {
+
+			c := make(chan *Publication, 10)
+
+			Convey("Then they should be ignored", func() {
+				So(func() {
+					defer ps.Subscribe(c, nil, "topic", JetStreamOptSubscribeDurable("durable"), JetStreamOptSubscribeAutoAck())()
+				}, ShouldNotPanic)
+			})
+		})
+
+		Convey("When I subscribe the same channel twice to a topic and unsubscribe once", func() {
+
+			c := make(chan *Publication, 10)
+
+			unsub1 := ps.Subscribe(c, nil, "topic")
+			unsub2 := ps.Subscribe(c, nil, "topic")
+			time.Sleep(30 * time.Millisecond)
+			unsub1()
+			time.Sleep(30 * time.Millisecond)
+
+			So(ps.Publish(NewPublication("topic")), ShouldBeNil)
+
+			Convey("Then the channel should still receive the publications", func() {
+				select {
+				case pub, ok := <-c:
+					So(ok, ShouldBeTrue)
+					So(pub.Topic, ShouldEqual, "topic")
+				case <-time.After(time.Second):
+					t.Fatal("publication not received")
+				}
+			})
+
+			Convey("When I unsubscribe it again", func() {
+
+				unsub2()
+				time.Sleep(30 * time.Millisecond)
+
+				Convey("Then the channel should be unregistered and closed", func() {
+					ps.lock.Lock()
+					So(ps.registrations, ShouldNotContainKey, subscriberKey{topic: "topic", ch: c})
+					ps.lock.Unlock()
+
+					for range c {
+					}
+				})
+			})
+		})
 	})
 }
 
@@ -166,3 +218,451 @@ func TestLocalPubSub_PublishSubscribe(t *testing.T) {
 		})
 	})
 }
+
+func TestLocalPubSub_Instrumentation(t *testing.T) {
+
+	Convey("Given I create a new PubSubServer with metrics and tracing", t, func() {
+
+		metrics := newTestPubSubMetrics()
+		tp := oteltest.NewTracerProvider()
+
+		ps := NewLocalPubSubClient(
+			LocalPubSubOptMetrics(metrics),
+			LocalPubSubOptTracerProvider(tp),
+		)
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer ps.Disconnect() // nolint: errcheck
+
+		pubs := make(chan *Publication, 2)
+		errs := make(chan error, 1)
+		defer ps.Subscribe(pubs, errs, "topic")()
+
+		Convey("When I publish a publication", func() {
+
+			So(ps.Publish(NewPublication("topic")), ShouldBeNil)
+
+			pub := <-pubs
+
+			var reported bool
+			for i := 0; i < 100 && !reported; i++ {
+				metrics.Lock()
+				_, reported = metrics.pending["topic"]
+				metrics.Unlock()
+				time.Sleep(time.Millisecond)
+			}
+
+			Convey("Then the publication should be reported", func() {
+				metrics.Lock()
+				defer metrics.Unlock()
+				So(metrics.published["topic"], ShouldResemble, []error{nil})
+				So(metrics.pending, ShouldContainKey, "topic")
+			})
+
+			Convey("Then the publication should carry the trace context of the publish span", func() {
+				spans := tp.Spans()
+				So(len(spans), ShouldEqual, 1)
+				So(spans[0].Name, ShouldEqual, "bahamut.pubsub.publish")
+				sc := trace.SpanContextFromContext(pub.ExtractTraceContext(context.Background()))
+				So(sc.SpanID(), ShouldEqual, spans[0].SpanContext.SpanID())
+			})
+		})
+	})
+}
+
+func Test_matchSubject(t *testing.T) {
+
+	tests := []struct {
+		pattern string
+		subject string
+		want    bool
+	}{
+		{"a.b.c", "a.b.c", true},
+		{"a.b.c", "a.b.d", false},
+		{"a.b", "a.b.c", false},
+		{"a.b.c", "a.b", false},
+		{"a.*.c", "a.b.c", true},
+		{"a.*.c", "a.b.d", false},
+		{"a.*", "a.b.c", false},
+		{"a.*", "a", false},
+		{"*", "a", true},
+		{"*.*", "a.b", true},
+		{"a.>", "a.b", true},
+		{"a.>", "a.b.c", true},
+		{"a.>", "a", false},
+		{">", "a.b.c", true},
+		{"*.b.>", "a.b.c.d", true},
+		{"*.b.>", "a.c.c.d", false},
+		{"a.>.c", "a.>.c", true},
+		{"a.>.c", "a.b.c", false},
+		{"a.*", "a.", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.subject, func(t *testing.T) {
+			if got := matchSubject(tt.pattern, tt.subject); got != tt.want {
+				t.Errorf("matchSubject(%q, %q) = %v, want %v", tt.pattern, tt.subject, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalPubSub_Wildcards(t *testing.T) {
+
+	Convey("Given I have a connected local pubsub with wildcard subscriptions", t, func() {
+
+		ps := newlocalPubSub()
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer func() { _ = ps.Disconnect() }()
+
+		exact := make(chan *Publication, 10)
+		star := make(chan *Publication, 10)
+		gt := make(chan *Publication, 10)
+		other := make(chan *Publication, 10)
+
+		defer ps.Subscribe(exact, nil, "topic")()
+		defer ps.Subscribe(star, nil, "topic.*")()
+		defer ps.Subscribe(gt, nil, "topic.>")()
+		defer ps.Subscribe(other, nil, "other.>")()
+
+		Convey("When I publish on topic, topic.a and topic.a.b", func() {
+
+			So(ps.Publish(NewPublication("topic")), ShouldBeNil)
+			So(ps.Publish(NewPublication("topic.a")), ShouldBeNil)
+			So(ps.Publish(NewPublication("topic.a.b")), ShouldBeNil)
+			time.Sleep(50 * time.Millisecond)
+
+			Convey("Then the publications should be delivered to the matching subscriptions", func() {
+				So(len(exact), ShouldEqual, 1)
+				So((<-exact).Topic, ShouldEqual, "topic")
+
+				So(len(star), ShouldEqual, 1)
+				So((<-star).Topic, ShouldEqual, "topic.a")
+
+				So(len(gt), ShouldEqual, 2)
+				So((<-gt).Topic, ShouldEqual, "topic.a")
+				So((<-gt).Topic, ShouldEqual, "topic.a.b")
+
+				So(len(other), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestLocalPubSub_QueueGroups(t *testing.T) {
+
+	Convey("Given I have a connected local pubsub with a queue group and a regular subscription", t, func() {
+
+		ps := newlocalPubSub()
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer func() { _ = ps.Disconnect() }()
+
+		q1 := make(chan *Publication, 100)
+		q2 := make(chan *Publication, 100)
+		regular := make(chan *Publication, 100)
+
+		defer ps.Subscribe(q1, nil, "topic.*", NATSOptSubscribeQueue("workers"))()
+		defer ps.Subscribe(q2, nil, "topic.*", NATSOptSubscribeQueue("workers"))()
+		defer ps.Subscribe(regular, nil, "topic.*")()
+
+		Convey("When I publish 50 publications", func() {
+
+			for i := 0; i < 50; i++ {
+				So(ps.Publish(NewPublication("topic.a")), ShouldBeNil)
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			Convey("Then each one should be delivered once to the queue group and to the regular subscription", func() {
+				So(len(q1)+len(q2), ShouldEqual, 50)
+				So(len(q1), ShouldBeGreaterThan, 0)
+				So(len(q2), ShouldBeGreaterThan, 0)
+				So(len(regular), ShouldEqual, 50)
+			})
+		})
+
+		Convey("When I unsubscribe a member of the queue group", func() {
+
+			c := make(chan *Publication, 10)
+			unsub := ps.Subscribe(c, nil, "topic.b", NATSOptSubscribeQueue("other"))
+			time.Sleep(30 * time.Millisecond)
+			unsub()
+			time.Sleep(30 * time.Millisecond)
+
+			Convey("Then its queue group should be forgotten", func() {
+				ps.lock.Lock()
+				defer ps.lock.Unlock()
+				So(ps.registrations, ShouldNotContainKey, subscriberKey{topic: "topic.b", ch: c})
+			})
+		})
+	})
+}
+
+func TestLocalPubSub_RequestReply(t *testing.T) {
+
+	Convey("Given I have a connected local pubsub", t, func() {
+
+		metrics := newTestPubSubMetrics()
+		ps := NewLocalPubSubClient(LocalPubSubOptMetrics(metrics)).(*localPubSub)
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer func() { _ = ps.Disconnect() }()
+
+		Convey("When I publish requiring an ACK without subscriber", func() {
+
+			err := ps.Publish(NewPublication("topic"), PubSubOptPublishRequireAck(context.Background()))
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "no responders available for request")
+			})
+		})
+
+		Convey("When I publish requiring an ACK with a subscriber", func() {
+
+			pubs := make(chan *Publication, 1)
+			defer ps.Subscribe(pubs, nil, "topic")()
+			time.Sleep(30 * time.Millisecond)
+
+			err := ps.Publish(NewPublication("topic"), PubSubOptPublishRequireAck(context.Background()))
+
+			Convey("Then it should be acked", func() {
+				So(err, ShouldBeNil)
+				p := <-pubs
+				So(p.ResponseMode, ShouldEqual, ResponseModeACK)
+
+				metrics.Lock()
+				defer metrics.Unlock()
+				So(metrics.acks["topic"], ShouldResemble, []error{nil})
+			})
+		})
+
+		Convey("When I publish requiring a response and the subscriber replies", func() {
+
+			pubs := make(chan *Publication)
+			defer ps.Subscribe(pubs, nil, "topic")()
+			time.Sleep(30 * time.Millisecond)
+
+			go func() {
+				p := <-pubs
+				resp := NewPublication("response")
+				resp.Data = []byte("pong")
+				resp.ResponseMode = ResponseModeACK
+				_ = p.Reply(resp)
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			responses := make(chan *Publication, 1)
+			err := ps.Publish(NewPublication("topic"), PubSubOptRespondToChannel(ctx, responses))
+
+			Convey("Then I should get the response", func() {
+				So(err, ShouldBeNil)
+				resp := <-responses
+				So(resp.Data, ShouldResemble, []byte("pong"))
+				So(resp.ResponseMode, ShouldEqual, ResponseModeNone)
+			})
+		})
+
+		Convey("When I publish requiring a response and the subscriber does not reply in time", func() {
+
+			pubs := make(chan *Publication, 1)
+			errs := make(chan error, 1)
+			defer ps.Subscribe(pubs, errs, "topic", PubSubOptSubscribeReplyTimeout(50*time.Millisecond))()
+			time.Sleep(30 * time.Millisecond)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			err := ps.Publish(NewPublication("topic"), PubSubOptRespondToChannel(ctx, make(chan *Publication, 1)))
+
+			Convey("Then the publisher should time out", func() {
+				So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+			})
+
+			Convey("Then the subscriber should get an error and not be able to reply anymore", func() {
+				So((<-errs).Error(), ShouldEqual, "timed out waiting for response to send to subscriber on topic: topic")
+				So((<-pubs).Reply(NewPublication("late")), ShouldNotBeNil)
+
+				metrics.Lock()
+				defer metrics.Unlock()
+				So(metrics.replyTimeouts["topic"], ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestLocalPubSub_handleReply(t *testing.T) {
+
+	Convey("Given I have a local pubsub and a registration whose errors are not consumed", t, func() {
+
+		metrics := newTestPubSubMetrics()
+		ps := NewLocalPubSubClient(LocalPubSubOptMetrics(metrics)).(*localPubSub)
+
+		reg := &registration{
+			topic:        "topic",
+			replyTimeout: 10 * time.Millisecond,
+			errors:       make(chan error),
+		}
+
+		Convey("When the subscriber does not reply in time", func() {
+
+			done := make(chan struct{})
+			go func() {
+				ps.handleReply(NewPublication("topic"), make(chan localReply, 1), reg)
+				close(done)
+			}()
+
+			Convey("Then it should not block", func() {
+				select {
+				case <-done:
+				case <-time.After(time.Second):
+					t.Fatal("handleReply is blocked")
+				}
+
+				metrics.Lock()
+				defer metrics.Unlock()
+				So(metrics.replyTimeouts["topic"], ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestLocalPubSub_ExpirationDeduplication(t *testing.T) {
+
+	Convey("Given I have a connected local pubsub", t, func() {
+
+		ps := NewLocalPubSubClient().(*localPubSub)
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer func() { _ = ps.Disconnect() }()
+
+		Convey("When I publish an expired publication", func() {
+
+			pubs := make(chan *Publication, 1)
+			defer ps.Subscribe(pubs, nil, "topic")()
+			time.Sleep(30 * time.Millisecond)
+
+			pub := NewPublication("topic")
+			pub.Timestamp = time.Now().Add(-time.Minute)
+			pub.TTL = time.Second
+			So(ps.Publish(pub), ShouldBeNil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			err := ps.Publish(pub.Duplicate(), PubSubOptPublishRequireAck(ctx))
+
+			Convey("Then it should not be delivered", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "publication expired")
+				So(receivePublication(pubs, 100*time.Millisecond), ShouldBeNil)
+			})
+		})
+
+		Convey("When I publish the same publication twice to a deduplicating subscriber", func() {
+
+			pubs := make(chan *Publication, 2)
+			defer ps.Subscribe(pubs, nil, "topic", PubSubOptSubscribeDeduplicate(time.Minute))()
+			time.Sleep(30 * time.Millisecond)
+
+			pub := NewPublication("topic")
+			pub.SetHeader("k", "v")
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			err1 := ps.Publish(pub, PubSubOptPublishRequireAck(ctx))
+			err2 := ps.Publish(pub.Duplicate(), PubSubOptPublishRequireAck(ctx))
+
+			Convey("Then it should be acked twice but delivered once", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+				p := receivePublication(pubs, time.Second)
+				So(p, ShouldNotBeNil)
+				So(p.ID, ShouldEqual, pub.ID)
+				So(p.Header("k"), ShouldEqual, "v")
+				So(receivePublication(pubs, 100*time.Millisecond), ShouldBeNil)
+			})
+		})
+
+		Convey("When I publish the same publication twice to a regular subscriber", func() {
+
+			pubs := make(chan *Publication, 2)
+			defer ps.Subscribe(pubs, nil, "topic")()
+			time.Sleep(30 * time.Millisecond)
+
+			pub := NewPublication("topic")
+			So(ps.Publish(pub), ShouldBeNil)
+			So(ps.Publish(pub.Duplicate()), ShouldBeNil)
+
+			Convey("Then it should be delivered twice", func() {
+				So(receivePublication(pubs, time.Second), ShouldNotBeNil)
+				So(receivePublication(pubs, time.Second), ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestLocalPubSub_Compression(t *testing.T) {
+
+	Convey("Given I have a connected local pubsub", t, func() {
+
+		ps := NewLocalPubSubClient().(*localPubSub)
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer func() { _ = ps.Disconnect() }()
+
+		pubs := make(chan *Publication, 1)
+		defer ps.Subscribe(pubs, nil, "topic")()
+		time.Sleep(30 * time.Millisecond)
+
+		Convey("When I publish with compression", func() {
+
+			pub := NewPublication("topic")
+			So(pub.Encode(map[string]string{"a": "b"}), ShouldBeNil)
+			So(ps.Publish(pub, PubSubOptPublishCompression(PublicationCompressionGzip, 0)), ShouldBeNil)
+
+			Convey("Then the subscriber should be able to decode it", func() {
+				p := receivePublication(pubs, time.Second)
+				So(p, ShouldNotBeNil)
+				So(p.Compression, ShouldEqual, PublicationCompressionGzip)
+
+				out := map[string]string{}
+				So(p.Decode(&out), ShouldBeNil)
+				So(out, ShouldResemble, map[string]string{"a": "b"})
+			})
+		})
+	})
+}
+
+func TestLocalPubSub_ConnectionLifecycle(t *testing.T) {
+
+	Convey("Given I create a local pubsub with a connection handler", t, func() {
+
+		var events []string
+		ps := NewLocalPubSubClient(
+			LocalPubSubOptConnectionHandler(func(event string, err error) { events = append(events, event) }),
+		)
+
+		Convey("Then it should not be connected", func() {
+			So(ps.(Pinger).Ping(time.Second), ShouldNotBeNil)
+		})
+
+		Convey("When I connect", func() {
+
+			So(ps.Connect(context.Background()), ShouldBeNil)
+
+			Convey("Then it should be connected", func() {
+				So(ps.(Pinger).Ping(time.Second), ShouldBeNil)
+				So(events, ShouldResemble, []string{PubSubConnectionEventConnected})
+			})
+
+			Convey("When I disconnect", func() {
+
+				So(ps.Disconnect(), ShouldBeNil)
+
+				Convey("Then it should be closed", func() {
+					err := ps.(Pinger).Ping(time.Second)
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldEqual, "connection closed")
+					So(events, ShouldResemble, []string{PubSubConnectionEventConnected, PubSubConnectionEventClosed})
+				})
+			})
+		})
+	})
+}
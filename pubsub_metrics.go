@@ -0,0 +1,220 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Various connection events reported to PubSubMetrics.RegisterConnectionEvent
+// and PubSubConnectionHandler.
+const (
+	PubSubConnectionEventConnected    = "connected"
+	PubSubConnectionEventDisconnected = "disconnected"
+	PubSubConnectionEventReconnected  = "reconnected"
+	PubSubConnectionEventClosed       = "closed"
+)
+
+// A PubSubMetrics receives the measurements made by a PubSubClient.
+type PubSubMetrics interface {
+
+	// ObservePublish is called once a publication has been published,
+	// with the time it took and the eventual error.
+	ObservePublish(topic string, duration time.Duration, err error)
+
+	// ObserveAck is called once a publication requiring an ACK has
+	// been acknowledged, or failed to be.
+	ObserveAck(topic string, duration time.Duration, err error)
+
+	// RegisterReplyTimeout is called when a subscriber did not
+	// send the response to a publication on time.
+	RegisterReplyTimeout(topic string)
+
+	// RegisterConnectionEvent is called when the state of the
+	// connection to the broker changes.
+	RegisterConnectionEvent(event string)
+
+	// SetSubscriptionPending is called periodically with the number of
+	// messages received but not yet delivered by a subscription.
+	SetSubscriptionPending(topic string, messages int)
+
+	// RegisterRejectedPublication is called when a received publication
+	// is rejected because its signature is missing or invalid, or it
+	// cannot be decrypted. The reason is one of the PubSubRejectionReason
+	// constants.
+	RegisterRejectedPublication(topic string, reason string)
+}
+
+type prometheusPubSubMetrics struct {
+	publishTotalMetric    *prometheus.CounterVec
+	publishDurationMetric *prometheus.HistogramVec
+	ackDurationMetric     *prometheus.HistogramVec
+	replyTimeoutMetric    *prometheus.CounterVec
+	connectionEventMetric *prometheus.CounterVec
+	pendingMetric         *prometheus.GaugeVec
+	rejectedMetric        *prometheus.CounterVec
+
+	topicLimiter *labelValueLimiter
+}
+
+// NewPrometheusPubSubMetrics returns a PubSubMetrics using the prometheus format.
+// The metrics are exposed by the MetricsManager returned by NewPrometheusMetricsManager.
+//
+// The cardinality of the topic label is bounded to the given maximum number of values.
+// Passing 0 uses the default of 256.
+func NewPrometheusPubSubMetrics(maxTopics int) PubSubMetrics {
+
+	return newPrometheusPubSubMetrics(prometheus.DefaultRegisterer, maxTopics)
+}
+
+func newPrometheusPubSubMetrics(registerer prometheus.Registerer, maxTopics int) PubSubMetrics {
+
+	if maxTopics <= 0 {
+		maxTopics = 256
+	}
+
+	mc := &prometheusPubSubMetrics{
+		topicLimiter: newLabelValueLimiter(maxTopics),
+		publishTotalMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pubsub_publications_total",
+				Help: "The total number of publications.",
+			},
+			[]string{"topic", "status"},
+		),
+		publishDurationMetric: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "pubsub_publications_duration_seconds",
+				Help:    "The duration of the publications.",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"topic"},
+		),
+		ackDurationMetric: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "pubsub_ack_duration_seconds",
+				Help:    "The time taken to receive the ACK of a publication.",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"topic", "status"},
+		),
+		replyTimeoutMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pubsub_reply_timeouts_total",
+				Help: "The total number of replies not sent on time by the subscribers.",
+			},
+			[]string{"topic"},
+		),
+		connectionEventMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pubsub_connection_events_total",
+				Help: "The total number of connection events.",
+			},
+			[]string{"event"},
+		),
+		pendingMetric: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "pubsub_subscription_pending_messages",
+				Help: "The number of messages received but not yet delivered by a subscription.",
+			},
+			[]string{"topic"},
+		),
+		rejectedMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pubsub_rejected_publications_total",
+				Help: "The total number of received publications rejected because of their signature or encryption.",
+			},
+			[]string{"topic", "reason"},
+		),
+	}
+
+	registerer.MustRegister(mc.publishTotalMetric)
+	registerer.MustRegister(mc.publishDurationMetric)
+	registerer.MustRegister(mc.ackDurationMetric)
+	registerer.MustRegister(mc.replyTimeoutMetric)
+	registerer.MustRegister(mc.connectionEventMetric)
+	registerer.MustRegister(mc.pendingMetric)
+	registerer.MustRegister(mc.rejectedMetric)
+
+	return mc
+}
+
+func (c *prometheusPubSubMetrics) ObservePublish(topic string, duration time.Duration, err error) {
+
+	topic = c.topicLimiter.limit(topic)
+
+	c.publishTotalMetric.WithLabelValues(topic, pubSubStatus(err)).Inc()
+	c.publishDurationMetric.WithLabelValues(topic).Observe(duration.Seconds())
+}
+
+func (c *prometheusPubSubMetrics) ObserveAck(topic string, duration time.Duration, err error) {
+	c.ackDurationMetric.WithLabelValues(c.topicLimiter.limit(topic), pubSubStatus(err)).Observe(duration.Seconds())
+}
+
+func (c *prometheusPubSubMetrics) RegisterReplyTimeout(topic string) {
+	c.replyTimeoutMetric.WithLabelValues(c.topicLimiter.limit(topic)).Inc()
+}
+
+func (c *prometheusPubSubMetrics) RegisterConnectionEvent(event string) {
+	c.connectionEventMetric.WithLabelValues(event).Inc()
+}
+
+func (c *prometheusPubSubMetrics) SetSubscriptionPending(topic string, messages int) {
+	c.pendingMetric.WithLabelValues(c.topicLimiter.limit(topic)).Set(float64(messages))
+}
+
+func (c *prometheusPubSubMetrics) RegisterRejectedPublication(topic string, reason string) {
+	c.rejectedMetric.WithLabelValues(c.topicLimiter.limit(topic), reason).Inc()
+}
+
+func pubSubStatus(err error) string {
+
+	if err != nil {
+		return "failure"
+	}
+
+	return "success"
+}
+
+// startPubSubPublishSpan starts the span tracing the given publication. Its
+// parent is the span contained in the given context if any, or the one
+// carried by the publication otherwise. The trace context of the new span
+// is then injected in the publication so subscribers can continue the trace.
+func startPubSubPublishSpan(ctx context.Context, provider trace.TracerProvider, system string, publication *Publication) trace.Span {
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = publication.ExtractTraceContext(ctx)
+	}
+
+	ctx, span := provider.Tracer(otelInstrumentationName).Start(
+		ctx,
+		"bahamut.pubsub.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", system),
+			attribute.String("messaging.destination", publication.Topic),
+		),
+	)
+
+	publication.InjectTraceContext(ctx)
+
+	return span
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPrometheusPubSubMetrics(t *testing.T) {
+
+	Convey("Given I have a prometheus PubSubMetrics", t, func() {
+
+		r := prometheus.NewRegistry()
+		m := newPrometheusPubSubMetrics(r, 1)
+
+		Convey("When I report some measurements", func() {
+
+			m.ObservePublish("topic", time.Second, nil)
+			m.ObservePublish("topic", time.Second, errors.New("boom"))
+			m.ObservePublish("other", time.Second, nil)
+			m.ObserveAck("topic", time.Second, nil)
+			m.RegisterReplyTimeout("topic")
+			m.RegisterConnectionEvent(PubSubConnectionEventReconnected)
+			m.SetSubscriptionPending("topic", 42)
+			m.RegisterRejectedPublication("topic", PubSubRejectionReasonUnsigned)
+
+			data, _ := r.Gather()
+
+			Convey("Then the data should be collected", func() {
+
+				So(data[0].GetName(), ShouldEqual, "pubsub_ack_duration_seconds")
+				So(data[0].GetMetric()[0].Histogram.GetSampleCount(), ShouldEqual, 1)
+				So(data[0].GetMetric()[0].Label[0].String(), ShouldEqual, `name:"status" value:"success" `)
+				So(data[0].GetMetric()[0].Label[1].String(), ShouldEqual, `name:"topic" value:"topic" `)
+
+				So(data[1].GetName(), ShouldEqual, "pubsub_connection_events_total")
+				So(data[1].GetMetric()[0].Label[0].String(), ShouldEqual, `name:"event" value:"reconnected" `)
+
+				So(data[2].GetName(), ShouldEqual, "pubsub_publications_duration_seconds")
+				So(len(data[2].GetMetric()), ShouldEqual, 2)
+				So(data[2].GetMetric()[0].Label[0].String(), ShouldEqual, `name:"topic" value:"_overflow" `)
+				So(data[2].GetMetric()[1].Histogram.GetSampleCount(), ShouldEqual, 2)
+
+				So(data[3].GetName(), ShouldEqual, "pubsub_publications_total")
+				So(len(data[3].GetMetric()), ShouldEqual, 3)
+				So(data[3].GetMetric()[0].Label[0].String(), ShouldEqual, `name:"status" value:"failure" `)
+				So(data[3].GetMetric()[0].Label[1].String(), ShouldEqual, `name:"topic" value:"topic" `)
+
+				So(data[4].GetName(), ShouldEqual, "pubsub_rejected_publications_total")
+				So(data[4].GetMetric()[0].Label[0].String(), ShouldEqual, `name:"reason" value:"unsigned" `)
+				So(data[4].GetMetric()[0].Counter.String(), ShouldEqual, "value:1 ")
+
+				So(data[5].GetName(), ShouldEqual, "pubsub_reply_timeouts_total")
+				So(data[5].GetMetric()[0].Counter.String(), ShouldEqual, "value:1 ")
+
+				So(data[6].GetName(), ShouldEqual, "pubsub_subscription_pending_messages")
+				So(data[6].GetMetric()[0].String(), ShouldEqual, `label:<name:"topic" value:"topic" > gauge:<value:42 > `)
+			})
+		})
+	})
+}
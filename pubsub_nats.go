@@ -17,11 +17,15 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/gofrs/uuid"
 	nats "github.com/nats-io/nats.go"
 	"go.aporeto.io/elemental"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -41,22 +45,42 @@ type natsPubSub struct {
 	natsURL         string
 	client          natsClient
 	retryInterval   time.Duration
+	maxReconnects   int
 	clientID        string
 	clusterID       string
 	password        string
 	username        string
 	tlsConfig       *tls.Config
 	errorHandleFunc func(*nats.Conn, *nats.Subscription, error)
+	metrics         PubSubMetrics
+	pendingInterval time.Duration
+	tracerProvider  trace.TracerProvider
+	security        publicationSecurity
+	connection      pubSubConnectionState
+	subscriptions   *natsSubscriptions
+	stop            chan struct{}
+	stopOnce        sync.Once
+	lock            sync.RWMutex
 }
 
 // NewNATSPubSubClient returns a new PubSubClient backend by Nats.
+//
+// Once connected, the client reconnects when the connection is lost, as
+// many times as set by NATSOptMaxReconnects, and creates a new one if it
+// gets closed by anything else than Disconnect. The subscriptions, including the ones that failed, are
+// established again as soon as the client is connected. The changes of
+// the connection can be followed using NATSOptConnectionHandler.
 func NewNATSPubSubClient(natsURL string, options ...NATSOption) PubSubClient {
 
 	n := &natsPubSub{
-		natsURL:       natsURL,
-		retryInterval: 5 * time.Second,
-		clientID:      uuid.Must(uuid.NewV4()).String(),
-		clusterID:     "test-cluster",
+		natsURL:         natsURL,
+		retryInterval:   5 * time.Second,
+		maxReconnects:   nats.DefaultMaxReconnect,
+		clientID:        uuid.Must(uuid.NewV4()).String(),
+		clusterID:       "test-cluster",
+		pendingInterval: 10 * time.Second,
+		subscriptions:   newNATSSubscriptions(),
+		stop:            make(chan struct{}),
 	}
 
 	for _, opt := range options {
@@ -68,7 +92,7 @@ func NewNATSPubSubClient(natsURL string, options ...NATSOption) PubSubClient {
 
 func (p *natsPubSub) Publish(publication *Publication, opts ...PubSubOptPublish) error {
 
-	if p.client == nil {
+	if p.currentClient() == nil {
 		return errors.New("not connected to nats. messages dropped")
 	}
 
@@ -76,13 +100,48 @@ func (p *natsPubSub) Publish(publication *Publication, opts ...PubSubOptPublish)
 		return errors.New("publication cannot be nil")
 	}
 
-	config := natsPublishConfig{}
+	config := pubSubPublishConfig{}
 	for _, opt := range opts {
 		opt(&config)
 	}
 
+	var span trace.Span
+	if p.tracerProvider != nil {
+		span = startPubSubPublishSpan(config.ctx, p.tracerProvider, "nats", publication)
+	}
+
+	start := time.Now()
+	err := p.publish(publication, config)
+
+	if p.metrics != nil {
+		p.metrics.ObservePublish(publication.Topic, time.Since(start), err)
+	}
+
+	if span != nil {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+
+	return err
+}
+
+func (p *natsPubSub) publish(publication *Publication, config pubSubPublishConfig) error {
+
+	if err := config.compress(publication); err != nil {
+		return err
+	}
+
 	publication.ResponseMode = config.desiredResponse
-	data, err := elemental.Encode(elemental.EncodingTypeMSGPACK, publication)
+
+	sealed, err := p.security.seal(publication)
+	if err != nil {
+		return err
+	}
+
+	data, err := elemental.Encode(elemental.EncodingTypeMSGPACK, sealed)
 	if err != nil {
 		return fmt.Errorf("unable to encode publication. message dropped: %s", err)
 	}
@@ -90,8 +149,13 @@ func (p *natsPubSub) Publish(publication *Publication, opts ...PubSubOptPublish)
 	switch config.desiredResponse {
 	case ResponseModeACK, ResponseModePublication:
 
-		msg, err := p.client.RequestWithContext(config.ctx, publication.Topic, data)
+		start := time.Now()
+
+		msg, err := p.currentClient().RequestWithContext(config.ctx, publication.Topic, data)
 		if err != nil {
+			if config.desiredResponse == ResponseModeACK && p.metrics != nil {
+				p.metrics.ObserveAck(publication.Topic, time.Since(start), err)
+			}
 			// TODO: should return a custom error type here to let the client know
 			// that the request failed so client code has sufficient context if
 			// it needs to build some kind of retry strategy based on the returned
@@ -101,7 +165,13 @@ func (p *natsPubSub) Publish(publication *Publication, opts ...PubSubOptPublish)
 
 		if config.desiredResponse == ResponseModeACK {
 			if !bytes.Equal(msg.Data, ackMessage) {
-				return fmt.Errorf("invalid ack: %s", string(msg.Data))
+				err = fmt.Errorf("invalid ack: %s", string(msg.Data))
+			}
+			if p.metrics != nil {
+				p.metrics.ObserveAck(publication.Topic, time.Since(start), err)
+			}
+			if err != nil {
+				return err
 			}
 		}
 
@@ -110,6 +180,12 @@ func (p *natsPubSub) Publish(publication *Publication, opts ...PubSubOptPublish)
 			if err := elemental.Decode(elemental.EncodingTypeMSGPACK, msg.Data, responsePub); err != nil {
 				return err
 			}
+			responsePub.Topic = msg.Subject
+
+			if reason, err := p.security.open(responsePub); err != nil {
+				rejectPublication(p.metrics, publication.Topic, reason, err)
+				return fmt.Errorf("invalid response: %w", err)
+			}
 
 			config.responseCh <- responsePub
 		}
@@ -117,7 +193,7 @@ func (p *natsPubSub) Publish(publication *Publication, opts ...PubSubOptPublish)
 		return nil
 
 	default:
-		return p.client.Publish(publication.Topic, data)
+		return p.currentClient().Publish(publication.Topic, data)
 	}
 }
 
@@ -128,8 +204,7 @@ func (p *natsPubSub) Subscribe(pubs chan *Publication, errors chan error, topic
 		opt(&config)
 	}
 
-	var sub *nats.Subscription
-	var err error
+	dedup := newDeduplicator(config.dedupWindow)
 
 	responseHandler := func(replyAddr string, pub *Publication) {
 		select {
@@ -147,6 +222,9 @@ func (p *natsPubSub) Subscribe(pubs chan *Publication, errors chan error, topic
 		// about the reply because you took too long to respond).
 		case <-time.After(config.replyTimeout):
 			pub.setExpired()
+			if p.metrics != nil {
+				p.metrics.RegisterReplyTimeout(topic)
+			}
 			errors <- fmt.Errorf("timed out waiting for response to send to subscriber on NATS subject: %s", replyAddr)
 		}
 	}
@@ -159,13 +237,45 @@ func (p *natsPubSub) Subscribe(pubs chan *Publication, errors chan error, topic
 			return
 		}
 
+		// The topic is the subject the message has been received on,
+		// so a signed envelope cannot be replayed on another subject.
+		publication.Topic = m.Subject
+
+		if reason, err := p.security.open(publication); err != nil {
+			rejectPublication(p.metrics, m.Subject, reason, err)
+			return
+		}
+
+		if publication.IsExpired() {
+			zap.L().Debug("Publication expired. Message dropped.",
+				zap.String("topic", m.Subject),
+				zap.String("id", publication.ID),
+			)
+			return
+		}
+
+		duplicate := dedup.isDuplicate(publication.ID, time.Now())
+
+		if p.tracerProvider != nil {
+			_, span := p.tracerProvider.Tracer(otelInstrumentationName).Start(
+				publication.ExtractTraceContext(context.Background()),
+				"bahamut.pubsub.receive",
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithAttributes(
+					attribute.String("messaging.system", "nats"),
+					attribute.String("messaging.destination", m.Subject),
+				),
+			)
+			defer span.End()
+		}
+
 		if m.Reply != "" {
 			switch publication.ResponseMode {
 			// `ResponseModeACK` mode responds to the client right away, BEFORE the subscriber has had the opportunity
 			// to process the publication. Most consumers do message processing asynchronously and simply need
 			// to respond to the publisher with an ACK.
 			case ResponseModeACK:
-				if err := p.client.Publish(m.Reply, ackMessage); err != nil {
+				if err := p.currentClient().Publish(m.Reply, ackMessage); err != nil {
 					errors <- err
 					return
 				}
@@ -175,31 +285,117 @@ func (p *natsPubSub) Subscribe(pubs chan *Publication, errors chan error, topic
 			// to whenever it is ready. The subscriber SHOULD attempt to respond ASAP as there is a client waiting
 			// for a response.
 			case ResponseModePublication:
+				if duplicate {
+					break
+				}
 				publication.replyCh = make(chan *Publication)
 				go responseHandler(m.Reply, publication)
 			}
 		}
 
+		if duplicate {
+			zap.L().Debug("Duplicated publication. Message dropped.",
+				zap.String("topic", m.Subject),
+				zap.String("id", publication.ID),
+			)
+			return
+		}
+
 		pubs <- publication
 	}
 
-	if config.queueGroup == "" {
-		sub, err = p.client.Subscribe(topic, handler)
-	} else {
-		sub, err = p.client.QueueSubscribe(topic, config.queueGroup, handler)
+	subscription := &natsSubscription{
+		topic:  topic,
+		errors: errors,
+		subscribe: func() (*nats.Subscription, error) {
+			client := p.currentClient()
+			if client == nil {
+				return nil, nats.ErrInvalidConnection
+			}
+			if config.queueGroup == "" {
+				return client.Subscribe(topic, handler)
+			}
+			return client.QueueSubscribe(topic, config.queueGroup, handler)
+		},
 	}
 
-	if err != nil {
+	// If this fails, the subscription will be
+	// established again once the client is connected.
+	if err := p.subscriptions.add(subscription); err != nil {
 		errors <- err
-		return func() {}
 	}
 
-	return func() { _ = sub.Unsubscribe() }
+	if p.metrics == nil {
+		return func() { p.subscriptions.remove(subscription) }
+	}
+
+	stop := make(chan struct{})
+	go p.reportPending(subscription, stop)
+
+	return func() {
+		close(stop)
+		p.subscriptions.remove(subscription)
+	}
+}
+
+// reportPending periodically reports the number of pending
+// messages of the given subscription until stop is closed.
+func (p *natsPubSub) reportPending(subscription *natsSubscription, stop chan struct{}) {
+
+	ticker := time.NewTicker(p.pendingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if msgs, err := p.subscriptions.pending(subscription); err == nil {
+				p.metrics.SetSubscriptionPending(subscription.topic, msgs)
+			}
+		case <-stop:
+			return
+		}
+	}
 }
 
 func (p *natsPubSub) Connect(ctx context.Context) error {
 
-	opts := []nats.Option{}
+	client, err := p.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	p.client = client
+	p.lock.Unlock()
+
+	p.connection.notify(p.metrics, PubSubConnectionEventConnected, nil)
+	p.subscriptions.restore(nil)
+
+	go p.watch()
+
+	return nil
+}
+
+// connect creates a new connection to nats,
+// retrying until it succeeds or ctx is done.
+func (p *natsPubSub) connect(ctx context.Context) (*nats.Conn, error) {
+
+	opts := []nats.Option{
+		nats.MaxReconnects(p.maxReconnects),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			p.connection.notify(p.metrics, PubSubConnectionEventDisconnected, err)
+		}),
+		nats.ReconnectHandler(func(*nats.Conn) {
+			p.connection.notify(p.metrics, PubSubConnectionEventReconnected, nil)
+			go p.subscriptions.restore(nil)
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			p.connection.notify(p.metrics, PubSubConnectionEventClosed, nc.LastError())
+			if !p.stopped() && p.currentClient() == natsClient(nc) {
+				go p.reconnect()
+			}
+		}),
+	}
 
 	if p.username != "" || p.password != "" {
 		opts = append(opts, nats.UserInfo(p.username, p.password))
@@ -209,47 +405,128 @@ func (p *natsPubSub) Connect(ctx context.Context) error {
 		opts = append(opts, nats.Secure(p.tlsConfig))
 	}
 
+	if p.errorHandleFunc != nil {
+		opts = append(opts, nats.ErrorHandler(p.errorHandleFunc))
+	}
+
 	for {
 
-		var err error
-		if p.client, err = nats.Connect(p.natsURL, opts...); err == nil {
-			if p.errorHandleFunc != nil {
-				nats.ErrorHandler(p.errorHandleFunc)
-			}
-			return nil
+		client, err := nats.Connect(p.natsURL, opts...)
+		if err == nil {
+			return client, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("unable to connect to nats on time. last error: %s", err)
+		case <-time.After(p.retryInterval):
 		}
+	}
+}
+
+// reconnect replaces the connection once it has been closed
+// for good, and establishes the subscriptions again.
+func (p *natsPubSub) reconnect() {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
+	go func() {
 		select {
+		case <-p.stop:
+			cancel()
 		case <-ctx.Done():
-			return fmt.Errorf("unable to connect to nats on time. last error: %s", err)
-		default:
-			time.Sleep(p.retryInterval)
+		}
+	}()
+
+	client, err := p.connect(ctx)
+	if err != nil {
+		return
+	}
+
+	p.lock.Lock()
+	if p.stopped() {
+		p.lock.Unlock()
+		client.Close()
+		return
+	}
+	p.client = client
+	p.lock.Unlock()
+
+	p.connection.notify(p.metrics, PubSubConnectionEventReconnected, nil)
+	p.subscriptions.restore(nil)
+}
+
+// watch periodically establishes again the subscriptions
+// that failed, until the client is disconnected.
+func (p *natsPubSub) watch() {
+
+	ticker := time.NewTicker(p.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if client := p.currentClient(); client != nil && client.IsConnected() {
+				p.subscriptions.restore(nil)
+			}
+		case <-p.stop:
+			return
 		}
 	}
 }
 
+// currentClient returns the client currently in use.
+func (p *natsPubSub) currentClient() natsClient {
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.client
+}
+
+// stopped returns true if Disconnect has been called.
+func (p *natsPubSub) stopped() bool {
+
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
 func (p *natsPubSub) Disconnect() error {
 
-	if err := p.client.Flush(); err != nil {
+	p.stopOnce.Do(func() { close(p.stop) })
+
+	client := p.currentClient()
+
+	if err := client.Flush(); err != nil {
 		return err
 	}
 
-	p.client.Close()
+	client.Close()
 
 	return nil
 }
 
 func (p *natsPubSub) Ping(timeout time.Duration) error {
 
-	errChannel := make(chan error)
+	client := p.currentClient()
+	if client == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	errChannel := make(chan error, 1)
 
 	go func() {
-		if p.client.IsConnected() {
+		if client.IsConnected() {
 			errChannel <- nil
-		} else if p.client.IsReconnecting() {
-			errChannel <- fmt.Errorf("reconnecting")
+		} else if client.IsReconnecting() {
+			errChannel <- p.connection.error("reconnecting")
 		} else {
-			errChannel <- fmt.Errorf("connection closed")
+			errChannel <- p.connection.error("connection closed")
 		}
 	}()
 
@@ -14,10 +14,10 @@ package bahamut
 import (
 	"context"
 	"crypto/tls"
-	"fmt"
 	"time"
 
 	nats "github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // A NATSOption represents an option to the pubsub backed by nats
@@ -30,6 +30,16 @@ func NATSOptConnectRetryInterval(interval time.Duration) NATSOption {
 	}
 }
 
+// NATSOptMaxReconnects sets the number of times the client tries to
+// reconnect when the connection is lost, before the connection gets
+// closed and replaced by a new one. A negative value makes it try
+// indefinitely. The default is nats.DefaultMaxReconnect.
+func NATSOptMaxReconnects(max int) NATSOption {
+	return func(n *natsPubSub) {
+		n.maxReconnects = max
+	}
+}
+
 // NATSOptCredentials sets the username and password to use to connect to nats.
 func NATSOptCredentials(username string, password string) NATSOption {
 	return func(n *natsPubSub) {
@@ -66,100 +76,103 @@ func NATSErrorHandler(handler func(*nats.Conn, *nats.Subscription, error)) NATSO
 	}
 }
 
-// natsOptClient sets the NATS client that will be used
-// This is useful for unit testing as you can pass in a mocked NATS client
-func natsOptClient(client natsClient) NATSOption {
+// NATSOptMetrics sets the PubSubMetrics used to report the publications,
+// the ACKs, the reply timeouts, the connection events and the number of
+// pending messages of the subscriptions.
+func NATSOptMetrics(metrics PubSubMetrics) NATSOption {
 	return func(n *natsPubSub) {
-		n.client = client
+		n.metrics = metrics
 	}
 }
 
-var ackMessage = []byte("ack")
+// NATSOptTracerProvider sets the OpenTelemetry TracerProvider used
+// to trace the publications and their reception. The trace context
+// is propagated in the TrackingData of the publications.
+func NATSOptTracerProvider(provider trace.TracerProvider) NATSOption {
+	return func(n *natsPubSub) {
+		n.tracerProvider = provider
+	}
+}
 
-type natsSubscribeConfig struct {
-	queueGroup   string
-	replyTimeout time.Duration
+// NATSOptPublicationSigner sets the PublicationSigner used
+// to sign the publications before publishing them.
+func NATSOptPublicationSigner(signer PublicationSigner) NATSOption {
+	return func(n *natsPubSub) {
+		n.security.signer = signer
+	}
 }
 
-func defaultSubscribeConfig() natsSubscribeConfig {
-	return natsSubscribeConfig{
-		replyTimeout: 60 * time.Second,
+// NATSOptPublicationVerifier sets the PublicationVerifier used to verify
+// the signature of the received publications. Once set, the publications
+// that are not signed or have an invalid signature are rejected.
+func NATSOptPublicationVerifier(verifier PublicationVerifier) NATSOption {
+	return func(n *natsPubSub) {
+		n.security.verifier = verifier
 	}
 }
 
-type natsPublishConfig struct {
-	ctx             context.Context
-	desiredResponse ResponseMode
-	responseCh      chan *Publication
+// NATSOptPublicationEncrypter sets the PublicationEncrypter used to
+// encrypt the data of the publications before publishing them, and
+// to decrypt the data of the received ones.
+func NATSOptPublicationEncrypter(encrypter PublicationEncrypter) NATSOption {
+	return func(n *natsPubSub) {
+		n.security.encrypter = encrypter
+	}
 }
 
+// NATSOptConnectionHandler sets the PubSubConnectionHandler called when
+// the client is connected, disconnected, reconnected or when its
+// connection is closed.
+func NATSOptConnectionHandler(handler PubSubConnectionHandler) NATSOption {
+	return func(n *natsPubSub) {
+		n.connection.handler = handler
+	}
+}
+
+// natsOptClient sets the NATS client that will be used
+// This is useful for unit testing as you can pass in a mocked NATS client
+func natsOptClient(client natsClient) NATSOption {
+	return func(n *natsPubSub) {
+		n.client = client
+	}
+}
+
+var ackMessage = []byte("ack")
+
 // NATSOptSubscribeQueue sets the NATS subscriber queue group.
 // In short, this allows to ensure only one subscriber in the
 // queue group with the same name will receive the publication.
 //
+// It is equivalent to PubSubOptSubscribeQueue.
+//
 // See: https://nats.io/documentation/concepts/nats-queueing/
 func NATSOptSubscribeQueue(queueGroup string) PubSubOptSubscribe {
-	return func(c any) {
-		c.(*natsSubscribeConfig).queueGroup = queueGroup
-	}
+	return PubSubOptSubscribeQueue(queueGroup)
 }
 
 // NATSOptSubscribeReplyTimeout sets the duration of time to wait before giving up
 // waiting for a response to publish back to the client that is expecting a response
+//
+// It is equivalent to PubSubOptSubscribeReplyTimeout.
 func NATSOptSubscribeReplyTimeout(t time.Duration) PubSubOptSubscribe {
-	return func(c any) {
-		c.(*natsSubscribeConfig).replyTimeout = t
-	}
+	return PubSubOptSubscribeReplyTimeout(t)
 }
 
 // NATSOptRespondToChannel will send the *Publication received to the provided channel.
 //
-// This is an advanced option which is useful in situations where you want to block until
-// you receive a response. The context parameter allows you to provide a deadline on how long
-// you should wait before considering the request as a failure:
-//
-//	myCtx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-//	respCh := make(chan *Publication)
-//	publishOption := NATSOptRespondToChannel(myCtx, respCh)
+// It is equivalent to PubSubOptRespondToChannel.
 //
 // This option CANNOT be combined with NATSOptPublishRequireAck
 func NATSOptRespondToChannel(ctx context.Context, resp chan *Publication) PubSubOptPublish {
-	return func(c any) {
-		config := c.(*natsPublishConfig)
-
-		switch {
-		case config.desiredResponse != ResponseModeNone:
-			panic(fmt.Sprintf("illegal option: request mode has already been set to %s", config.desiredResponse))
-		case resp == nil:
-			panic("illegal argument: response channel cannot be nil")
-		case ctx == nil:
-			panic("illegal argument: context cannot be nil")
-		}
-
-		config.ctx = ctx
-		config.responseCh = resp
-		config.desiredResponse = ResponseModePublication
-	}
+	return PubSubOptRespondToChannel(ctx, resp)
 }
 
 // NATSOptPublishRequireAck is a helper to require a ack in the limit
-// of the given context.Context. If the other side is bahamut.PubSubClient
-// using the Subscribe method, then it will automatically send back the expected
-// ack.
+// of the given context.Context.
+//
+// It is equivalent to PubSubOptPublishRequireAck.
 //
 // This option CANNOT be combined with NATSOptRespondToChannel
 func NATSOptPublishRequireAck(ctx context.Context) PubSubOptPublish {
-	return func(c any) {
-		config := c.(*natsPublishConfig)
-
-		switch {
-		case config.desiredResponse != ResponseModeNone:
-			panic(fmt.Sprintf("illegal option: request mode has already been set to %s", config.desiredResponse))
-		case ctx == nil:
-			panic("illegal argument: context cannot be nil")
-		}
-
-		config.ctx = ctx
-		config.desiredResponse = ResponseModeACK
-	}
+	return PubSubOptPublishRequireAck(ctx)
 }
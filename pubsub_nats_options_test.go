@@ -19,6 +19,7 @@ import (
 
 	nats "github.com/nats-io/nats.go"
 	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/bahamut/oteltest"
 )
 
 func TestBahamut_NATSOption(t *testing.T) {
@@ -31,6 +32,11 @@ func TestBahamut_NATSOption(t *testing.T) {
 		So(n.password, ShouldEqual, "pass")
 	})
 
+	Convey("Calling NATSOptMaxReconnects should work", t, func() {
+		NATSOptMaxReconnects(-1)(n)
+		So(n.maxReconnects, ShouldEqual, -1)
+	})
+
 	Convey("Calling NATSOptClusterID should work", t, func() {
 		NATSOptClusterID("cid")(n)
 		So(n.clusterID, ShouldEqual, "cid")
@@ -52,11 +58,41 @@ func TestBahamut_NATSOption(t *testing.T) {
 		NATSErrorHandler(f)(n)
 		So(n.errorHandleFunc, ShouldEqual, f)
 	})
+
+	Convey("Calling NATSOptMetrics should work", t, func() {
+		m := newTestPubSubMetrics()
+		NATSOptMetrics(m)(n)
+		So(n.metrics, ShouldEqual, m)
+	})
+
+	Convey("Calling NATSOptTracerProvider should work", t, func() {
+		tp := oteltest.NewTracerProvider()
+		NATSOptTracerProvider(tp)(n)
+		So(n.tracerProvider, ShouldEqual, tp)
+	})
+
+	Convey("Calling the publication security options should work", t, func() {
+		hk, _ := NewHMACPublicationKeyring("k1", map[string][]byte{"k1": []byte("secret")})
+		ek, _ := NewAESGCMPublicationKeyring("e1", map[string][]byte{"e1": make([]byte, 16)})
+		NATSOptPublicationSigner(hk)(n)
+		NATSOptPublicationVerifier(hk)(n)
+		NATSOptPublicationEncrypter(ek)(n)
+		So(n.security.signer, ShouldEqual, hk)
+		So(n.security.verifier, ShouldEqual, hk)
+		So(n.security.encrypter, ShouldEqual, ek)
+	})
+
+	Convey("Calling NATSOptConnectionHandler should work", t, func() {
+		var event string
+		NATSOptConnectionHandler(func(e string, err error) { event = e })(n)
+		n.connection.handler(PubSubConnectionEventReconnected, nil)
+		So(event, ShouldEqual, PubSubConnectionEventReconnected)
+	})
 }
 
 func TestBahamut_PubSubNatsOptionsSubscribe(t *testing.T) {
 
-	c := natsSubscribeConfig{}
+	c := pubSubSubscribeConfig{}
 
 	Convey("Calling NATSOptSubscribeQueue should work", t, func() {
 		NATSOptSubscribeQueue("queueGroup")(&c)
@@ -75,7 +111,7 @@ func TestBahamut_PubSubNatsOptionsPublish(t *testing.T) {
 
 	Convey("Setup", t, func() {
 
-		c := natsPublishConfig{}
+		c := pubSubPublishConfig{}
 
 		Convey("Calling NATSOptPublishRequireAck should work", func() {
 			NATSOptPublishRequireAck(context.TODO())(&c)
@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"net"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -27,6 +29,7 @@ import (
 	natsserver "github.com/nats-io/nats-server/v2/test"
 	nats "github.com/nats-io/nats.go"
 	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/bahamut/oteltest"
 	"go.aporeto.io/elemental"
 )
 
@@ -797,3 +800,483 @@ func newDefaultConnection(t *testing.T) *nats.Conn {
 	}
 	return nc
 }
+
+type testPubSubMetrics struct {
+	published     map[string][]error
+	acks          map[string][]error
+	replyTimeouts map[string]int
+	events        []string
+	pending       map[string]int
+	rejected      map[string][]string
+	sync.Mutex
+}
+
+func newTestPubSubMetrics() *testPubSubMetrics {
+	return &testPubSubMetrics{
+		published:     map[string][]error{},
+		acks:          map[string][]error{},
+		replyTimeouts: map[string]int{},
+		pending:       map[string]int{},
+		rejected:      map[string][]string{},
+	}
+}
+
+func (m *testPubSubMetrics) ObservePublish(topic string, duration time.Duration, err error) {
+	m.Lock()
+	m.published[topic] = append(m.published[topic], err)
+	m.Unlock()
+}
+
+func (m *testPubSubMetrics) ObserveAck(topic string, duration time.Duration, err error) {
+	m.Lock()
+	m.acks[topic] = append(m.acks[topic], err)
+	m.Unlock()
+}
+
+func (m *testPubSubMetrics) RegisterReplyTimeout(topic string) {
+	m.Lock()
+	m.replyTimeouts[topic]++
+	m.Unlock()
+}
+
+func (m *testPubSubMetrics) RegisterConnectionEvent(event string) {
+	m.Lock()
+	m.events = append(m.events, event)
+	m.Unlock()
+}
+
+func (m *testPubSubMetrics) SetSubscriptionPending(topic string, messages int) {
+	m.Lock()
+	m.pending[topic] = messages
+	m.Unlock()
+}
+
+func (m *testPubSubMetrics) RegisterRejectedPublication(topic string, reason string) {
+	m.Lock()
+	m.rejected[topic] = append(m.rejected[topic], reason)
+	m.Unlock()
+}
+
+func TestNats_Instrumentation(t *testing.T) {
+
+	Convey("Given I have a connected nats client with metrics and tracing", t, func() {
+
+		srv := natsserver.RunRandClientPortServer()
+		defer srv.Shutdown()
+
+		metrics := newTestPubSubMetrics()
+		tp := oteltest.NewTracerProvider()
+
+		ps := NewNATSPubSubClient(
+			srv.ClientURL(),
+			NATSOptMetrics(metrics),
+			NATSOptTracerProvider(tp),
+		).(*natsPubSub)
+		ps.pendingInterval = 10 * time.Millisecond
+
+		So(ps.Connect(context.Background()), ShouldBeNil)
+
+		Convey("When I publish a publication requiring an ACK", func() {
+
+			pubs := make(chan *Publication, 1)
+			errs := make(chan error, 1)
+			unsub := ps.Subscribe(pubs, errs, "topic")
+			defer unsub()
+
+			err := ps.Publish(NewPublication("topic"), NATSOptPublishRequireAck(context.Background()))
+			So(err, ShouldBeNil)
+
+			<-pubs
+			time.Sleep(50 * time.Millisecond)
+
+			Convey("Then the publication and the ack should be reported", func() {
+				metrics.Lock()
+				defer metrics.Unlock()
+				So(metrics.published["topic"], ShouldResemble, []error{nil})
+				So(metrics.acks["topic"], ShouldResemble, []error{nil})
+				So(metrics.pending, ShouldContainKey, "topic")
+			})
+
+			Convey("Then the reception should be traced as a child of the publication", func() {
+				spans := tp.Spans()
+				So(len(spans), ShouldEqual, 2)
+				var publish, receive int
+				for i, s := range spans {
+					switch s.Name {
+					case "bahamut.pubsub.publish":
+						publish = i
+					case "bahamut.pubsub.receive":
+						receive = i
+					}
+				}
+				So(spans[receive].Parent.SpanID(), ShouldEqual, spans[publish].SpanContext.SpanID())
+				So(otelAttributesMap(spans[publish].Attributes)["messaging.destination"], ShouldEqual, "topic")
+			})
+		})
+
+		Convey("When a subscriber does not reply on time", func() {
+
+			pubs := make(chan *Publication, 1)
+			errs := make(chan error, 1)
+			unsub := ps.Subscribe(pubs, errs, "topic2", NATSOptSubscribeReplyTimeout(10*time.Millisecond))
+			defer unsub()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			err := ps.Publish(NewPublication("topic2"), NATSOptRespondToChannel(ctx, make(chan *Publication, 1)))
+
+			Convey("Then the reply timeout and the failed publication should be reported", func() {
+				So(err, ShouldNotBeNil)
+				So(<-errs, ShouldNotBeNil)
+				metrics.Lock()
+				defer metrics.Unlock()
+				So(metrics.replyTimeouts["topic2"], ShouldEqual, 1)
+				So(len(metrics.published["topic2"]), ShouldEqual, 1)
+				So(metrics.published["topic2"][0], ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I disconnect", func() {
+
+			So(ps.Disconnect(), ShouldBeNil)
+			time.Sleep(50 * time.Millisecond)
+
+			Convey("Then the closed event should be reported", func() {
+				metrics.Lock()
+				defer metrics.Unlock()
+				So(metrics.events, ShouldContain, PubSubConnectionEventClosed)
+			})
+		})
+	})
+}
+
+func TestNats_ExpirationDeduplication(t *testing.T) {
+
+	Convey("Given I have a connected nats client", t, func() {
+
+		srv := natsserver.RunRandClientPortServer()
+		defer srv.Shutdown()
+
+		ps := NewNATSPubSubClient(srv.ClientURL())
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer ps.Disconnect() // nolint: errcheck
+
+		Convey("When I publish an expired publication", func() {
+
+			pubs := make(chan *Publication, 1)
+			errs := make(chan error, 1)
+			defer ps.Subscribe(pubs, errs, "topic")()
+
+			pub := NewPublication("topic")
+			pub.Timestamp = time.Now().Add(-time.Minute)
+			pub.TTL = time.Second
+			So(ps.Publish(pub), ShouldBeNil)
+
+			Convey("Then it should not be delivered", func() {
+				So(receivePublication(pubs, 200*time.Millisecond), ShouldBeNil)
+			})
+		})
+
+		Convey("When I publish the same publication twice to a deduplicating subscriber", func() {
+
+			pubs := make(chan *Publication, 2)
+			errs := make(chan error, 1)
+			defer ps.Subscribe(pubs, errs, "topic", PubSubOptSubscribeDeduplicate(time.Minute))()
+
+			pub := NewPublication("topic")
+			pub.SetHeader("k", "v")
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			err1 := ps.Publish(pub, PubSubOptPublishRequireAck(ctx))
+			err2 := ps.Publish(pub, PubSubOptPublishRequireAck(ctx))
+
+			Convey("Then it should be acked twice but delivered once", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+				p := receivePublication(pubs, time.Second)
+				So(p, ShouldNotBeNil)
+				So(p.ID, ShouldEqual, pub.ID)
+				So(p.Header("k"), ShouldEqual, "v")
+				So(receivePublication(pubs, 200*time.Millisecond), ShouldBeNil)
+				So(len(errs), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestNats_Compression(t *testing.T) {
+
+	Convey("Given I have a connected nats client", t, func() {
+
+		srv := natsserver.RunRandClientPortServer()
+		defer srv.Shutdown()
+
+		ps := NewNATSPubSubClient(srv.ClientURL())
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer ps.Disconnect() // nolint: errcheck
+
+		pubs := make(chan *Publication, 2)
+		errs := make(chan error, 1)
+		defer ps.Subscribe(pubs, errs, "topic")()
+
+		Convey("When I publish a small and a large publication with a compression threshold", func() {
+
+			small := NewPublication("topic")
+			So(small.Encode(map[string]string{"a": "b"}), ShouldBeNil)
+			So(ps.Publish(small, PubSubOptPublishCompression(PublicationCompressionZstd, 512)), ShouldBeNil)
+
+			large := NewPublication("topic")
+			So(large.Encode(map[string]string{"a": strings.Repeat("b", 1024)}), ShouldBeNil)
+			So(ps.Publish(large, PubSubOptPublishCompression(PublicationCompressionZstd, 512)), ShouldBeNil)
+
+			Convey("Then only the large one should be compressed and both should be decodable", func() {
+				p1 := receivePublication(pubs, time.Second)
+				So(p1, ShouldNotBeNil)
+				So(p1.Compression, ShouldEqual, PublicationCompressionNone)
+				out := map[string]string{}
+				So(p1.Decode(&out), ShouldBeNil)
+				So(out["a"], ShouldEqual, "b")
+
+				p2 := receivePublication(pubs, time.Second)
+				So(p2, ShouldNotBeNil)
+				So(p2.Compression, ShouldEqual, PublicationCompressionZstd)
+				So(p2.Decode(&out), ShouldBeNil)
+				So(out["a"], ShouldEqual, strings.Repeat("b", 1024))
+			})
+		})
+	})
+}
+
+func TestNats_PublicationSecurity(t *testing.T) {
+
+	Convey("Given I have a nats server and keys", t, func() {
+
+		srv := natsserver.RunRandClientPortServer()
+		defer srv.Shutdown()
+
+		hk, err := NewHMACPublicationKeyring("k1", map[string][]byte{"k1": []byte("secret")})
+		So(err, ShouldBeNil)
+		ek, err := NewAESGCMPublicationKeyring("e1", map[string][]byte{"e1": make([]byte, 32)})
+		So(err, ShouldBeNil)
+
+		metrics := newTestPubSubMetrics()
+		subscriber := NewNATSPubSubClient(
+			srv.ClientURL(),
+			NATSOptMetrics(metrics),
+			NATSOptPublicationVerifier(hk),
+			NATSOptPublicationEncrypter(ek),
+		)
+		So(subscriber.Connect(context.Background()), ShouldBeNil)
+		defer subscriber.Disconnect() // nolint: errcheck
+
+		pubs := make(chan *Publication, 1)
+		errs := make(chan error, 1)
+		defer subscriber.Subscribe(pubs, errs, "topic")()
+
+		nc, err := nats.Connect(srv.ClientURL())
+		So(err, ShouldBeNil)
+		defer nc.Close()
+
+		raw, err := nc.SubscribeSync("topic")
+		So(err, ShouldBeNil)
+		So(nc.Flush(), ShouldBeNil)
+
+		Convey("When I publish with a client signing and encrypting", func() {
+
+			publisher := NewNATSPubSubClient(
+				srv.ClientURL(),
+				NATSOptPublicationSigner(hk),
+				NATSOptPublicationEncrypter(ek),
+			)
+			So(publisher.Connect(context.Background()), ShouldBeNil)
+			defer publisher.Disconnect() // nolint: errcheck
+
+			pub := NewPublication("topic")
+			pub.Data = []byte("secret data")
+			So(publisher.Publish(pub), ShouldBeNil)
+
+			Convey("Then the data should be encrypted on the wire", func() {
+				msg, err := raw.NextMsg(time.Second)
+				So(err, ShouldBeNil)
+				So(string(msg.Data), ShouldNotContainSubstring, "secret data")
+			})
+
+			Convey("Then the subscriber should receive the decrypted publication", func() {
+				p := receivePublication(pubs, time.Second)
+				So(p, ShouldNotBeNil)
+				So(string(p.Data), ShouldEqual, "secret data")
+				So(p.SignatureKeyID, ShouldEqual, "k1")
+			})
+		})
+
+		Convey("When I publish with a client that does not sign", func() {
+
+			publisher := NewNATSPubSubClient(srv.ClientURL())
+			So(publisher.Connect(context.Background()), ShouldBeNil)
+			defer publisher.Disconnect() // nolint: errcheck
+
+			So(publisher.Publish(NewPublication("topic")), ShouldBeNil)
+
+			Convey("Then the publication should be rejected and reported", func() {
+				So(receivePublication(pubs, 200*time.Millisecond), ShouldBeNil)
+				metrics.Lock()
+				defer metrics.Unlock()
+				So(metrics.rejected["topic"], ShouldResemble, []string{PubSubRejectionReasonUnsigned})
+			})
+		})
+
+		Convey("When I publish with a client signing with another key", func() {
+
+			other, err := NewHMACPublicationKeyring("k1", map[string][]byte{"k1": []byte("forged")})
+			So(err, ShouldBeNil)
+
+			publisher := NewNATSPubSubClient(srv.ClientURL(), NATSOptPublicationSigner(other))
+			So(publisher.Connect(context.Background()), ShouldBeNil)
+			defer publisher.Disconnect() // nolint: errcheck
+
+			So(publisher.Publish(NewPublication("topic")), ShouldBeNil)
+
+			Convey("Then the publication should be rejected and reported", func() {
+				So(receivePublication(pubs, 200*time.Millisecond), ShouldBeNil)
+				metrics.Lock()
+				defer metrics.Unlock()
+				So(metrics.rejected["topic"], ShouldResemble, []string{PubSubRejectionReasonInvalidSignature})
+			})
+		})
+	})
+}
+
+// waitConnectionEvent returns the next event received
+// from the given channel, or an empty string on timeout.
+func waitConnectionEvent(events chan string, timeout time.Duration) string {
+
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(timeout):
+		return ""
+	}
+}
+
+func TestNats_ConnectionLifecycle(t *testing.T) {
+
+	Convey("Given I have a nats server and a client with a connection handler", t, func() {
+
+		srv := natsserver.RunRandClientPortServer()
+		defer func() { srv.Shutdown() }()
+
+		events := make(chan string, 16)
+		metrics := newTestPubSubMetrics()
+
+		ps := NewNATSPubSubClient(
+			srv.ClientURL(),
+			NATSOptConnectRetryInterval(100*time.Millisecond),
+			NATSOptMetrics(metrics),
+			NATSOptConnectionHandler(func(event string, err error) { events <- event }),
+		)
+
+		Convey("When I ping it before connecting", func() {
+
+			err := ps.(Pinger).Ping(time.Second)
+
+			Convey("Then it should fail", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "not connected")
+			})
+		})
+
+		Convey("When I subscribe before connecting, then connect", func() {
+
+			pubs := make(chan *Publication, 2)
+			qpubs := make(chan *Publication, 2)
+			errs := make(chan error, 2)
+			defer ps.Subscribe(pubs, errs, "topic")()
+			defer ps.Subscribe(qpubs, errs, "topic", PubSubOptSubscribeQueue("queue"))()
+
+			So(<-errs, ShouldNotBeNil)
+			So(<-errs, ShouldNotBeNil)
+
+			So(ps.Connect(context.Background()), ShouldBeNil)
+			defer ps.Disconnect() // nolint: errcheck
+
+			Convey("Then the connected event should be reported", func() {
+				So(waitConnectionEvent(events, time.Second), ShouldEqual, PubSubConnectionEventConnected)
+				So(ps.(Pinger).Ping(time.Second), ShouldBeNil)
+			})
+
+			Convey("Then the subscriptions should be established", func() {
+				So(ps.Publish(NewPublication("topic")), ShouldBeNil)
+				So(receivePublication(pubs, time.Second), ShouldNotBeNil)
+				So(receivePublication(qpubs, time.Second), ShouldNotBeNil)
+			})
+
+			Convey("When the server restarts", func() {
+
+				So(waitConnectionEvent(events, time.Second), ShouldEqual, PubSubConnectionEventConnected)
+
+				port := srv.Addr().(*net.TCPAddr).Port
+				srv.Shutdown()
+
+				So(waitConnectionEvent(events, 5*time.Second), ShouldEqual, PubSubConnectionEventDisconnected)
+
+				err := ps.(Pinger).Ping(time.Second)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldStartWith, "reconnecting")
+
+				opts := natsserver.DefaultTestOptions
+				opts.Port = port
+				srv = natsserver.RunServer(&opts)
+
+				So(waitConnectionEvent(events, 10*time.Second), ShouldEqual, PubSubConnectionEventReconnected)
+
+				Convey("Then the subscriptions should still receive publications", func() {
+					So(ps.(Pinger).Ping(time.Second), ShouldBeNil)
+					So(ps.Publish(NewPublication("topic")), ShouldBeNil)
+					So(receivePublication(pubs, time.Second), ShouldNotBeNil)
+					So(receivePublication(qpubs, time.Second), ShouldNotBeNil)
+				})
+
+				Convey("Then the events should be reported to the metrics", func() {
+					metrics.Lock()
+					defer metrics.Unlock()
+					So(metrics.events, ShouldResemble, []string{
+						PubSubConnectionEventConnected,
+						PubSubConnectionEventDisconnected,
+						PubSubConnectionEventReconnected,
+					})
+				})
+			})
+
+			Convey("When the connection gets closed by something else than Disconnect", func() {
+
+				So(waitConnectionEvent(events, time.Second), ShouldEqual, PubSubConnectionEventConnected)
+				ps.(*natsPubSub).currentClient().Close()
+
+				So(waitConnectionEvent(events, time.Second), ShouldEqual, PubSubConnectionEventDisconnected)
+				So(waitConnectionEvent(events, time.Second), ShouldEqual, PubSubConnectionEventClosed)
+				So(waitConnectionEvent(events, time.Second), ShouldEqual, PubSubConnectionEventReconnected)
+
+				Convey("Then a new connection should be used by the subscriptions", func() {
+					So(ps.(Pinger).Ping(time.Second), ShouldBeNil)
+					So(ps.Publish(NewPublication("topic")), ShouldBeNil)
+					So(receivePublication(pubs, time.Second), ShouldNotBeNil)
+					So(receivePublication(qpubs, time.Second), ShouldNotBeNil)
+				})
+			})
+
+			Convey("When I disconnect", func() {
+
+				So(waitConnectionEvent(events, time.Second), ShouldEqual, PubSubConnectionEventConnected)
+				So(ps.Disconnect(), ShouldBeNil)
+
+				Convey("Then the disconnected and closed events should be reported", func() {
+					So(waitConnectionEvent(events, time.Second), ShouldEqual, PubSubConnectionEventDisconnected)
+					So(waitConnectionEvent(events, time.Second), ShouldEqual, PubSubConnectionEventClosed)
+					So(ps.(Pinger).Ping(time.Second), ShouldNotBeNil)
+				})
+			})
+		})
+	})
+}
@@ -12,7 +12,9 @@
 package bahamut
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -28,3 +30,134 @@ func TestPubsub_NewServer(t *testing.T) {
 		})
 	})
 }
+
+func TestPubsub_Options(t *testing.T) {
+
+	Convey("Given I have a subscribe config", t, func() {
+
+		c := defaultSubscribeConfig()
+
+		Convey("Then the default reply timeout should be correct", func() {
+			So(c.replyTimeout, ShouldEqual, 60*time.Second)
+		})
+
+		Convey("Calling PubSubOptSubscribeQueue should work", func() {
+			PubSubOptSubscribeQueue("queueGroup")(&c)
+			So(c.queueGroup, ShouldEqual, "queueGroup")
+		})
+
+		Convey("Calling PubSubOptSubscribeReplyTimeout should work", func() {
+			PubSubOptSubscribeReplyTimeout(time.Second)(&c)
+			So(c.replyTimeout, ShouldEqual, time.Second)
+		})
+
+		Convey("Calling PubSubOptSubscribeDeduplicate should work", func() {
+			PubSubOptSubscribeDeduplicate(time.Minute)(&c)
+			So(c.dedupWindow, ShouldEqual, time.Minute)
+		})
+	})
+
+	Convey("Given I have a jetstream subscribe config", t, func() {
+
+		c := defaultJetStreamSubscribeConfig()
+
+		Convey("Calling PubSubOptSubscribeQueue should work", func() {
+			PubSubOptSubscribeQueue("queueGroup")(&c)
+			So(c.queueGroup, ShouldEqual, "queueGroup")
+		})
+
+		Convey("Calling PubSubOptSubscribeDeduplicate should work", func() {
+			PubSubOptSubscribeDeduplicate(time.Minute)(&c)
+			So(c.dedupWindow, ShouldEqual, time.Minute)
+		})
+
+		Convey("Calling PubSubOptSubscribeReplyTimeout should do nothing", func() {
+			So(func() { PubSubOptSubscribeReplyTimeout(time.Second)(&c) }, ShouldNotPanic)
+		})
+	})
+
+	Convey("Given I have a publish config", t, func() {
+
+		c := pubSubPublishConfig{}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		Convey("Calling PubSubOptPublishRequireAck should work", func() {
+			PubSubOptPublishRequireAck(ctx)(&c)
+			So(c.ctx, ShouldEqual, ctx)
+			So(c.desiredResponse, ShouldEqual, ResponseModeACK)
+
+			So(func() { PubSubOptRespondToChannel(ctx, make(chan *Publication))(&c) }, ShouldPanicWith, "illegal option: request mode has already been set to ResponseModeACK")
+		})
+
+		Convey("Calling PubSubOptRespondToChannel should work", func() {
+			ch := make(chan *Publication)
+			PubSubOptRespondToChannel(ctx, ch)(&c)
+			So(c.ctx, ShouldEqual, ctx)
+			So(c.responseCh, ShouldEqual, ch)
+			So(c.desiredResponse, ShouldEqual, ResponseModePublication)
+
+			So(func() { PubSubOptPublishRequireAck(ctx)(&c) }, ShouldPanicWith, "illegal option: request mode has already been set to ResponseModePublication")
+		})
+
+		Convey("Calling PubSubOptPublishCompression should work", func() {
+			PubSubOptPublishCompression(PublicationCompressionZstd, 10)(&c)
+			So(c.compression, ShouldEqual, PublicationCompressionZstd)
+			So(c.compressionThreshold, ShouldEqual, 10)
+
+			pub := NewPublication("topic")
+			pub.Data = []byte("short")
+			So(c.compress(pub), ShouldBeNil)
+			So(pub.Compression, ShouldEqual, PublicationCompressionNone)
+
+			pub.Data = []byte("long enough to be compressed")
+			So(c.compress(pub), ShouldBeNil)
+			So(pub.Compression, ShouldEqual, PublicationCompressionZstd)
+		})
+
+		Convey("Calling the options with invalid arguments should panic", func() {
+			So(func() { PubSubOptPublishRequireAck(nil)(&c) }, ShouldPanicWith, "illegal argument: context cannot be nil") // nolint
+			So(func() { PubSubOptRespondToChannel(ctx, nil)(&c) }, ShouldPanicWith, "illegal argument: response channel cannot be nil")
+			So(func() { PubSubOptRespondToChannel(nil, make(chan *Publication))(&c) }, ShouldPanicWith, "illegal argument: context cannot be nil") // nolint
+		})
+	})
+}
+
+func TestPubsub_Deduplicator(t *testing.T) {
+
+	Convey("Given I have a deduplicator", t, func() {
+
+		d := newDeduplicator(time.Minute)
+		now := time.Now()
+
+		Convey("Then an ID should be a duplicate only during the window", func() {
+			So(d.isDuplicate("a", now), ShouldBeFalse)
+			So(d.isDuplicate("a", now.Add(30*time.Second)), ShouldBeTrue)
+			So(d.isDuplicate("b", now.Add(30*time.Second)), ShouldBeFalse)
+			So(d.isDuplicate("a", now.Add(2*time.Minute)), ShouldBeFalse)
+		})
+
+		Convey("Then the IDs older than the window should be removed", func() {
+			So(d.isDuplicate("a", now), ShouldBeFalse)
+			So(d.isDuplicate("b", now.Add(2*time.Minute)), ShouldBeFalse)
+			So(len(d.seen), ShouldEqual, 1)
+			So(d.seen, ShouldContainKey, "b")
+		})
+
+		Convey("Then an empty ID should never be a duplicate", func() {
+			So(d.isDuplicate("", now), ShouldBeFalse)
+			So(d.isDuplicate("", now), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given I create a deduplicator without window", t, func() {
+
+		d := newDeduplicator(0)
+
+		Convey("Then it should be nil and never find duplicates", func() {
+			So(d, ShouldBeNil)
+			So(d.isDuplicate("a", time.Now()), ShouldBeFalse)
+			So(d.isDuplicate("a", time.Now()), ShouldBeFalse)
+		})
+	})
+}
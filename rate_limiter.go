@@ -0,0 +1,446 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/karlseguin/ccache/v2"
+	"golang.org/x/time/rate"
+)
+
+// A RateLimitStatus contains the state of a rate limiter
+// bucket after it evaluated a request.
+type RateLimitStatus struct {
+	// Tier is the name of the tier that has been applied.
+	Tier string
+
+	// Limit is the maximum number of requests allowed in a burst.
+	Limit int
+
+	// Remaining is the number of requests that can still be issued
+	// immediately.
+	Remaining int
+
+	// Reset is the time needed for the bucket to be full again.
+	Reset time.Duration
+
+	// RetryAfter is the time the client must wait before retrying
+	// a limited request. It is 0 if the request was not limited.
+	RetryAfter time.Duration
+}
+
+// A StatusRateLimiter is a RateLimiter that can also report the status
+// of the bucket that has been used for the request. When a
+// StatusRateLimiter is used, bahamut will write the RateLimit-Limit,
+// RateLimit-Remaining, RateLimit-Reset and Retry-After headers.
+type StatusRateLimiter interface {
+	RateLimiter
+	RateLimitWithStatus(*http.Request) (bool, RateLimitStatus, error)
+}
+
+// A RateLimitTier describes the rate and burst applied to a bucket.
+type RateLimitTier struct {
+	Name  string
+	Limit rate.Limit
+	Burst int
+}
+
+// A RateLimitKeyExtractor returns the key used to select the
+// bucket of the given request. If it returns an empty key,
+// the request is not limited.
+type RateLimitKeyExtractor func(*http.Request) (string, error)
+
+// A RateLimitTierResolver returns the RateLimitTier to apply
+// to the given request, identified by the given key.
+type RateLimitTierResolver func(req *http.Request, key string) (RateLimitTier, error)
+
+// RateLimitKeyFromClientIP returns a RateLimitKeyExtractor that uses the
+// IP of the client. If trustedProxies is 0, the remote address of the
+// connection is used. Otherwise, bahamut is expected to run behind the given
+// number of trusted proxies, each one appending the address it received the
+// request from to the X-Forwarded-For header. The address added by the
+// outermost trusted proxy is then used, as the ones before it are set by
+// the client. If the header is not set, the X-Real-IP header is used.
+func RateLimitKeyFromClientIP(trustedProxies int) RateLimitKeyExtractor {
+
+	if trustedProxies < 0 {
+		panic("trustedProxies must be positive")
+	}
+
+	return func(req *http.Request) (string, error) {
+
+		if trustedProxies > 0 {
+
+			if fwd := req.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+
+				addrs := strings.Split(strings.Join(fwd, ","), ",")
+
+				// If there are less addresses than trusted proxies,
+				// they have all been added by trusted proxies.
+				i := len(addrs) - trustedProxies
+				if i < 0 {
+					i = 0
+				}
+
+				return strings.TrimSpace(addrs[i]), nil
+			}
+
+			if rip := req.Header.Get("X-Real-IP"); rip != "" {
+				return strings.TrimSpace(rip), nil
+			}
+		}
+
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return req.RemoteAddr, nil
+		}
+
+		return host, nil
+	}
+}
+
+// RateLimitKeyFromToken returns a RateLimitKeyExtractor that uses a hash
+// of the token of the request, taken from the Authorization header.
+func RateLimitKeyFromToken() RateLimitKeyExtractor {
+
+	return func(req *http.Request) (string, error) {
+
+		token := extractRateLimitToken(req)
+		if token == "" {
+			return "", nil
+		}
+
+		h := sha256.Sum256([]byte(token))
+
+		return hex.EncodeToString(h[:]), nil
+	}
+}
+
+// RateLimitKeyFromNamespace returns a RateLimitKeyExtractor that uses the
+// value of the X-Namespace header.
+func RateLimitKeyFromNamespace() RateLimitKeyExtractor {
+
+	return func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Namespace"), nil
+	}
+}
+
+// RateLimitKeyFromClaims returns a RateLimitKeyExtractor that uses the
+// values of the given keys of the token claims. The requests whose token
+// is not a JWT, like opaque tokens, or cannot be decoded, are not limited
+// by it, so it should be used along with another limiter.
+//
+// The token is decoded but NOT verified: the rate limiter runs before
+// authentication. A client can forge arbitrary claims, so this must
+// only be used to spread legitimate clients across buckets, not to
+// grant them higher limits.
+func RateLimitKeyFromClaims(keys ...string) RateLimitKeyExtractor {
+
+	if len(keys) == 0 {
+		panic("you must provide at least one claim key")
+	}
+
+	return func(req *http.Request) (string, error) {
+
+		token := extractRateLimitToken(req)
+		if token == "" {
+			return "", nil
+		}
+
+		parts := strings.SplitN(token, ".", 3)
+		if len(parts) != 3 {
+			return "", nil
+		}
+
+		data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		if err != nil {
+			return "", nil
+		}
+
+		claims := map[string]any{}
+		if err := json.Unmarshal(data, &claims); err != nil {
+			return "", nil
+		}
+
+		values := make([]string, len(keys))
+		for i, k := range keys {
+			if v, ok := claims[k]; ok {
+				values[i] = fmt.Sprintf("%v", v)
+			}
+		}
+
+		key := strings.Join(values, "|")
+		if key == strings.Repeat("|", len(keys)-1) {
+			return "", nil
+		}
+
+		return key, nil
+	}
+}
+
+// KeyedRateLimiterOption represents an option that can be passed to
+// NewKeyedRateLimiter.
+type KeyedRateLimiterOption func(*keyedRateLimiter)
+
+// KeyedRateLimiterOptTierResolver sets the RateLimitTierResolver used to
+// decide the tier to apply to each request. If not set, or if the resolver
+// returns a tier with an empty name, the default tier is used.
+func KeyedRateLimiterOptTierResolver(resolver RateLimitTierResolver) KeyedRateLimiterOption {
+	return func(l *keyedRateLimiter) {
+		l.tierResolver = resolver
+	}
+}
+
+// KeyedRateLimiterOptMaxKeys sets the maximum number of buckets
+// kept in memory. The least recently used buckets are evicted first.
+// The default is 65536.
+func KeyedRateLimiterOptMaxKeys(max int64) KeyedRateLimiterOption {
+	return func(l *keyedRateLimiter) {
+		l.maxKeys = max
+	}
+}
+
+// KeyedRateLimiterOptKeyTTL sets how long an unused bucket is kept in
+// memory. The default is one hour.
+func KeyedRateLimiterOptKeyTTL(ttl time.Duration) KeyedRateLimiterOption {
+	return func(l *keyedRateLimiter) {
+		l.keyTTL = ttl
+	}
+}
+
+type keyedRateLimiter struct {
+	extractor    RateLimitKeyExtractor
+	defaultTier  RateLimitTier
+	tierResolver RateLimitTierResolver
+	maxKeys      int64
+	keyTTL       time.Duration
+	buckets      *ccache.Cache
+	bucketsLock  sync.Mutex
+	replicas     int32
+}
+
+// NewKeyedRateLimiter returns a StatusRateLimiter that keeps one bucket per
+// key returned by the given extractor. Each bucket uses the tier returned
+// by the tier resolver, or defaultTier if none is configured.
+func NewKeyedRateLimiter(extractor RateLimitKeyExtractor, defaultTier RateLimitTier, options ...KeyedRateLimiterOption) StatusRateLimiter {
+
+	if extractor == nil {
+		panic("extractor must not be nil")
+	}
+
+	l := &keyedRateLimiter{
+		extractor:   extractor,
+		defaultTier: defaultTier,
+		maxKeys:     65536,
+		keyTTL:      time.Hour,
+		replicas:    1,
+	}
+
+	for _, opt := range options {
+		opt(l)
+	}
+
+	l.buckets = ccache.New(ccache.Configure().MaxSize(l.maxKeys))
+
+	return l
+}
+
+// RateLimit is part of the RateLimiter interface.
+func (l *keyedRateLimiter) RateLimit(req *http.Request) (bool, error) {
+
+	limited, _, err := l.RateLimitWithStatus(req)
+
+	return limited, err
+}
+
+// RateLimitWithStatus is part of the StatusRateLimiter interface.
+func (l *keyedRateLimiter) RateLimitWithStatus(req *http.Request) (bool, RateLimitStatus, error) {
+
+	key, err := l.extractor(req)
+	if err != nil {
+		return false, RateLimitStatus{}, err
+	}
+
+	if key == "" {
+		return false, RateLimitStatus{}, nil
+	}
+
+	tier := l.defaultTier
+	if l.tierResolver != nil {
+		t, err := l.tierResolver(req, key)
+		if err != nil {
+			return false, RateLimitStatus{}, err
+		}
+		if t.Name != "" {
+			tier = t
+		}
+	}
+
+	if replicas := int(atomic.LoadInt32(&l.replicas)); replicas > 1 {
+		tier.Limit, tier.Burst = scaleRateLimit(tier.Limit, tier.Burst, replicas)
+	}
+
+	now := time.Now()
+	bucketKey := tier.Name + ":" + key
+
+	rl := l.bucket(bucketKey, tier)
+
+	if rl.Limit() != tier.Limit {
+		rl.SetLimitAt(now, tier.Limit)
+	}
+	if rl.Burst() != tier.Burst {
+		rl.SetBurstAt(now, tier.Burst)
+	}
+
+	return computeRateLimitStatus(rl, tier, now)
+}
+
+// bucket returns the limiter of the given key, creating it if needed.
+// The creation is guarded so concurrent first requests for a key
+// share the same limiter instead of each getting a full burst.
+func (l *keyedRateLimiter) bucket(key string, tier RateLimitTier) *rate.Limiter {
+
+	if item := l.buckets.Get(key); item != nil && !item.Expired() {
+		item.Extend(l.keyTTL)
+		return item.Value().(*rate.Limiter)
+	}
+
+	l.bucketsLock.Lock()
+	defer l.bucketsLock.Unlock()
+
+	if item := l.buckets.Get(key); item != nil && !item.Expired() {
+		item.Extend(l.keyTTL)
+		return item.Value().(*rate.Limiter)
+	}
+
+	rl := rate.NewLimiter(tier.Limit, tier.Burst)
+	l.buckets.Set(key, rl, l.keyTTL)
+
+	return rl
+}
+
+// setReplicas is part of the replicatedRateLimiter interface.
+// The existing buckets are updated the next time they are used.
+func (l *keyedRateLimiter) setReplicas(replicas int) {
+	atomic.StoreInt32(&l.replicas, int32(replicas))
+}
+
+func computeRateLimitStatus(rl *rate.Limiter, tier RateLimitTier, now time.Time) (bool, RateLimitStatus, error) {
+
+	status := RateLimitStatus{
+		Tier:  tier.Name,
+		Limit: tier.Burst,
+	}
+
+	limited := false
+	r := rl.ReserveN(now, 1)
+	switch {
+	case !r.OK():
+		limited = true
+	case r.DelayFrom(now) > 0:
+		limited = true
+		status.RetryAfter = r.DelayFrom(now)
+		r.CancelAt(now)
+	}
+
+	tokens := rl.TokensAt(now)
+	if tokens > 0 {
+		status.Remaining = int(tokens)
+	}
+
+	if tier.Limit != rate.Inf && tier.Limit > 0 {
+		missing := float64(tier.Burst) - tokens
+		if missing > 0 {
+			status.Reset = time.Duration(missing / float64(tier.Limit) * float64(time.Second))
+		}
+	}
+
+	return limited, status, nil
+}
+
+func extractRateLimitToken(req *http.Request) string {
+
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		parts := strings.SplitN(auth, " ", 2)
+		if len(parts) == 2 {
+			return parts[1]
+		}
+		return auth
+	}
+
+	return ""
+}
+
+// applyRateLimiter runs the given RateLimiter and writes the rate limit
+// headers if it is a StatusRateLimiter. It returns the name of the tier
+// that has been applied, if any.
+func applyRateLimiter(rl RateLimiter, w http.ResponseWriter, req *http.Request) (bool, string, error) {
+
+	srl, ok := rl.(StatusRateLimiter)
+	if !ok {
+		limited, err := rl.RateLimit(req)
+		return limited, "", err
+	}
+
+	limited, status, err := srl.RateLimitWithStatus(req)
+	if err != nil {
+		return false, "", err
+	}
+
+	if status.Limit > 0 || limited {
+		writeRateLimitHeaders(w.Header(), status, limited)
+	}
+
+	return limited, status.Tier, nil
+}
+
+// writeRateLimitHeaders writes the rate limit headers. If several limiters
+// applied to the request, the most restrictive one is reported.
+func writeRateLimitHeaders(h http.Header, status RateLimitStatus, limited bool) {
+
+	if !limited {
+		if v := h.Get("RateLimit-Remaining"); v != "" {
+			if current, err := strconv.Atoi(v); err == nil && current <= status.Remaining {
+				return
+			}
+		}
+	}
+
+	h.Set("RateLimit-Limit", strconv.Itoa(status.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(status.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(durationToSeconds(status.Reset)))
+
+	if limited {
+		retry := durationToSeconds(status.RetryAfter)
+		if retry < 1 {
+			retry = 1
+		}
+		h.Set("Retry-After", strconv.Itoa(retry))
+	}
+}
+
+func durationToSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
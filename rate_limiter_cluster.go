@@ -0,0 +1,265 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+type rateLimitPeerStatus int
+
+const (
+	rateLimitPeerStatusGoodbye rateLimitPeerStatus = 0
+	rateLimitPeerStatusHello   rateLimitPeerStatus = 1
+)
+
+type rateLimitPeerPing struct {
+	// Decodable: must be public
+	Status    rateLimitPeerStatus
+	RuntimeID string
+}
+
+type scaledRateLimiter struct {
+	limiter *rate.Limiter
+	limit   rate.Limit
+	burst   int
+}
+
+// A replicatedRateLimiter is a RateLimiter that manages its own
+// buckets and divides their limits by the number of replicas.
+type replicatedRateLimiter interface {
+	setReplicas(int)
+}
+
+// scaleRateLimit divides the given limit and burst by the given
+// number of replicas. The burst is never scaled down to 0.
+func scaleRateLimit(limit rate.Limit, burst int, replicas int) (rate.Limit, int) {
+
+	if limit != rate.Inf {
+		limit = limit / rate.Limit(replicas)
+	}
+
+	scaled := burst / replicas
+	if scaled < 1 && burst > 0 {
+		scaled = 1
+	}
+
+	return limit, scaled
+}
+
+// rateLimitCluster discovers the other replicas of the service
+// over a PubSubClient and divides the configured global, per-api
+// and keyed limits by the number of live replicas.
+type rateLimitCluster struct {
+	pubsub       PubSubClient
+	topic        string
+	pingInterval time.Duration
+	peerTimeout  time.Duration
+	runtimeID    string
+	limiters     []scaledRateLimiter
+	replicated   []replicatedRateLimiter
+	peers        map[string]time.Time
+
+	lock sync.RWMutex
+}
+
+func newRateLimitCluster(cfg config) *rateLimitCluster {
+
+	c := &rateLimitCluster{
+		pubsub:       cfg.rateLimiting.clusterPubSub,
+		topic:        cfg.rateLimiting.clusterTopic,
+		pingInterval: cfg.rateLimiting.clusterPingInterval,
+		peerTimeout:  cfg.rateLimiting.clusterPeerTimeout,
+		runtimeID:    uuid.Must(uuid.NewV4()).String(),
+		peers:        map[string]time.Time{},
+	}
+
+	if c.pingInterval <= 0 {
+		c.pingInterval = 10 * time.Second
+	}
+
+	if c.peerTimeout <= 0 {
+		c.peerTimeout = 3 * c.pingInterval
+	}
+
+	if rl := cfg.rateLimiting.rateLimiter; rl != nil {
+		c.limiters = append(c.limiters, scaledRateLimiter{limiter: rl, limit: rl.Limit(), burst: rl.Burst()})
+	}
+
+	for _, arl := range cfg.rateLimiting.apiRateLimiters {
+		c.limiters = append(c.limiters, scaledRateLimiter{limiter: arl.limiter, limit: arl.limiter.Limit(), burst: arl.limiter.Burst()})
+	}
+
+	for _, rl := range cfg.rateLimiting.rateLimiters {
+		if r, ok := rl.(replicatedRateLimiter); ok {
+			c.replicated = append(c.replicated, r)
+		}
+	}
+
+	return c
+}
+
+// replicas returns the number of live replicas, including
+// the current one.
+func (c *rateLimitCluster) replicas() int {
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return len(c.peers) + 1 // that's us!
+}
+
+func (c *rateLimitCluster) scale() {
+
+	replicas := c.replicas()
+	now := time.Now()
+
+	for _, l := range c.limiters {
+		limit, burst := scaleRateLimit(l.limit, l.burst, replicas)
+		l.limiter.SetLimitAt(now, limit)
+		l.limiter.SetBurstAt(now, burst)
+	}
+
+	for _, r := range c.replicated {
+		r.setReplicas(replicas)
+	}
+}
+
+func (c *rateLimitCluster) makePing(status rateLimitPeerStatus) *Publication {
+
+	pub := NewPublication(c.topic)
+	_ = pub.Encode(rateLimitPeerPing{
+		Status:    status,
+		RuntimeID: c.runtimeID,
+	}) // no error can be returned here
+
+	return pub
+}
+
+// handlePing updates the peer list from the given ping.
+// It returns true if the number of peers changed.
+func (c *rateLimitCluster) handlePing(ping rateLimitPeerPing, now time.Time) bool {
+
+	if ping.RuntimeID == c.runtimeID {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, known := c.peers[ping.RuntimeID]
+
+	switch ping.Status {
+
+	case rateLimitPeerStatusHello:
+		c.peers[ping.RuntimeID] = now
+		return !known
+
+	case rateLimitPeerStatusGoodbye:
+		delete(c.peers, ping.RuntimeID)
+		return known
+	}
+
+	return false
+}
+
+// removeOutdatedPeers removes the peers that did not send a ping
+// since the peer timeout. It returns true if any peer was removed.
+func (c *rateLimitCluster) removeOutdatedPeers(now time.Time) bool {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var removed bool
+	for id, date := range c.peers {
+		if now.After(date.Add(c.peerTimeout)) {
+			delete(c.peers, id)
+			removed = true
+		}
+	}
+
+	return removed
+}
+
+func (c *rateLimitCluster) listen(ctx context.Context) {
+
+	pubs := make(chan *Publication, 1024)
+	errs := make(chan error, 1024)
+
+	unsub := c.pubsub.Subscribe(pubs, errs, c.topic)
+	defer unsub()
+
+	// A new publication is made for every ping, as the
+	// pubsub may deduplicate the publications by ID.
+	if err := c.pubsub.Publish(c.makePing(rateLimitPeerStatusHello)); err != nil {
+		zap.L().Error("Unable to send initial hello to rate limiting peers", zap.Error(err))
+	}
+
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+
+		case <-ticker.C:
+
+			if err := c.pubsub.Publish(c.makePing(rateLimitPeerStatusHello)); err != nil {
+				zap.L().Error("Unable to send hello to rate limiting peers", zap.Error(err))
+			}
+
+			if c.removeOutdatedPeers(time.Now()) {
+				c.scale()
+			}
+
+		case pub := <-pubs:
+
+			// A lost hello is sent again on the next tick and a lost
+			// goodbye is covered by the peer timeout.
+			_ = pub.Ack()
+
+			var ping rateLimitPeerPing
+			if err := pub.Decode(&ping); err != nil {
+				zap.L().Error("Unable to decode rate limiting peer ping", zap.Error(err))
+				break
+			}
+
+			if c.handlePing(ping, time.Now()) {
+				c.scale()
+				zap.L().Debug("Rate limiting peers changed", zap.Int("replicas", c.replicas()))
+			}
+
+		case err := <-errs:
+			zap.L().Error("Received error from rate limiting peers subscription", zap.Error(err))
+
+		case <-ctx.Done():
+
+			if err := c.pubsub.Publish(c.makePing(rateLimitPeerStatusGoodbye)); err != nil {
+				zap.L().Warn("Unable to send goodbye to rate limiting peers", zap.Error(err))
+			}
+
+			// The peers are forgotten so the configured limits
+			// are restored until the cluster listens again.
+			c.lock.Lock()
+			c.peers = map[string]time.Time{}
+			c.lock.Unlock()
+			c.scale()
+
+			return
+		}
+	}
+}
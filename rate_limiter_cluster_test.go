@@ -0,0 +1,249 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/elemental"
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimitCluster(t *testing.T) {
+
+	Convey("Given I have a config with rate limiters", t, func() {
+
+		cfg := config{}
+		OptRateLimiting(100, 10)(&cfg)
+		OptAPIRateLimiting(elemental.MakeIdentity("thing", "things"), 10, 1, nil)(&cfg)
+		OptRateLimitingCluster(NewLocalPubSubClient(), "peers", time.Second, 0)(&cfg)
+
+		c := newRateLimitCluster(cfg)
+
+		Convey("Then the cluster should be correctly initialized", func() {
+			So(c.topic, ShouldEqual, "peers")
+			So(c.pingInterval, ShouldEqual, time.Second)
+			So(c.peerTimeout, ShouldEqual, 3*time.Second)
+			So(c.replicas(), ShouldEqual, 1)
+			So(len(c.limiters), ShouldEqual, 2)
+		})
+
+		Convey("When I receive hellos from two peers", func() {
+
+			now := time.Now()
+			So(c.handlePing(rateLimitPeerPing{Status: rateLimitPeerStatusHello, RuntimeID: "a"}, now), ShouldBeTrue)
+			So(c.handlePing(rateLimitPeerPing{Status: rateLimitPeerStatusHello, RuntimeID: "a"}, now), ShouldBeFalse)
+			So(c.handlePing(rateLimitPeerPing{Status: rateLimitPeerStatusHello, RuntimeID: "b"}, now), ShouldBeTrue)
+			So(c.handlePing(rateLimitPeerPing{Status: rateLimitPeerStatusHello, RuntimeID: c.runtimeID}, now), ShouldBeFalse)
+			c.scale()
+
+			Convey("Then the limits should be divided", func() {
+				So(c.replicas(), ShouldEqual, 3)
+				So(cfg.rateLimiting.rateLimiter.Limit(), ShouldAlmostEqual, rate.Limit(100.0/3))
+				So(cfg.rateLimiting.rateLimiter.Burst(), ShouldEqual, 3)
+				arl := cfg.rateLimiting.apiRateLimiters[elemental.MakeIdentity("thing", "things")].limiter
+				So(arl.Limit(), ShouldAlmostEqual, rate.Limit(10.0/3))
+				So(arl.Burst(), ShouldEqual, 1)
+			})
+
+			Convey("When one peer says goodbye", func() {
+
+				So(c.handlePing(rateLimitPeerPing{Status: rateLimitPeerStatusGoodbye, RuntimeID: "a"}, now), ShouldBeTrue)
+				So(c.handlePing(rateLimitPeerPing{Status: rateLimitPeerStatusGoodbye, RuntimeID: "a"}, now), ShouldBeFalse)
+				c.scale()
+
+				Convey("Then the limits should be updated", func() {
+					So(c.replicas(), ShouldEqual, 2)
+					So(cfg.rateLimiting.rateLimiter.Limit(), ShouldEqual, rate.Limit(50))
+					So(cfg.rateLimiting.rateLimiter.Burst(), ShouldEqual, 5)
+				})
+			})
+
+			Convey("When the peers time out", func() {
+
+				So(c.removeOutdatedPeers(now.Add(time.Second)), ShouldBeFalse)
+				So(c.removeOutdatedPeers(now.Add(4*time.Second)), ShouldBeTrue)
+				c.scale()
+
+				Convey("Then the original limits should be restored", func() {
+					So(c.replicas(), ShouldEqual, 1)
+					So(cfg.rateLimiting.rateLimiter.Limit(), ShouldEqual, rate.Limit(100))
+					So(cfg.rateLimiting.rateLimiter.Burst(), ShouldEqual, 10)
+				})
+			})
+		})
+	})
+
+	Convey("Given I have a config with a keyed rate limiter", t, func() {
+
+		keyed := NewKeyedRateLimiter(
+			func(*http.Request) (string, error) { return "key", nil },
+			RateLimitTier{Name: "default", Limit: 10, Burst: 4},
+		)
+
+		cfg := config{}
+		OptRateLimiters([]RateLimiter{keyed})(&cfg)
+		OptRateLimitingCluster(NewLocalPubSubClient(), "peers", time.Second, 0)(&cfg)
+
+		c := newRateLimitCluster(cfg)
+
+		Convey("When I receive a hello from a peer", func() {
+
+			So(c.handlePing(rateLimitPeerPing{Status: rateLimitPeerStatusHello, RuntimeID: "a"}, time.Now()), ShouldBeTrue)
+			c.scale()
+
+			_, status, err := keyed.RateLimitWithStatus(httptest.NewRequest(http.MethodGet, "/", nil))
+
+			Convey("Then the limits of the buckets should be divided", func() {
+				So(err, ShouldBeNil)
+				So(status.Limit, ShouldEqual, 2)
+				So(status.Remaining, ShouldEqual, 1)
+			})
+		})
+	})
+
+	Convey("Given I have a cluster scaled by a peer", t, func() {
+
+		ps := NewLocalPubSubClient()
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer ps.Disconnect() // nolint: errcheck
+
+		cfg := config{}
+		OptRateLimiting(10, 10)(&cfg)
+		OptRateLimitingCluster(ps, "peers", time.Minute, 0)(&cfg)
+
+		c := newRateLimitCluster(cfg)
+		So(c.handlePing(rateLimitPeerPing{Status: rateLimitPeerStatusHello, RuntimeID: "a"}, time.Now()), ShouldBeTrue)
+		c.scale()
+		So(cfg.rateLimiting.rateLimiter.Burst(), ShouldEqual, 5)
+
+		Convey("When it stops listening and listens again", func() {
+
+			for i := 0; i < 2; i++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				c.listen(ctx)
+			}
+
+			Convey("Then the configured limits should be restored", func() {
+				So(c.replicas(), ShouldEqual, 1)
+				So(cfg.rateLimiting.rateLimiter.Limit(), ShouldEqual, rate.Limit(10))
+				So(cfg.rateLimiting.rateLimiter.Burst(), ShouldEqual, 10)
+			})
+		})
+	})
+
+	Convey("Given I have a cluster and a deduplicating subscriber", t, func() {
+
+		ps := NewLocalPubSubClient()
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer ps.Disconnect() // nolint: errcheck
+
+		pubs := make(chan *Publication, 10)
+		errs := make(chan error, 10)
+		defer ps.Subscribe(pubs, errs, "peers", PubSubOptSubscribeDeduplicate(time.Minute))()
+
+		cfg := config{}
+		OptRateLimiting(10, 10)(&cfg)
+		OptRateLimitingCluster(ps, "peers", 20*time.Millisecond, 0)(&cfg)
+
+		c := newRateLimitCluster(cfg)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go c.listen(ctx)
+
+		Convey("Then every hello should be received", func() {
+
+			for i := 0; i < 2; i++ {
+				select {
+				case pub := <-pubs:
+					var ping rateLimitPeerPing
+					So(pub.Decode(&ping), ShouldBeNil)
+					So(ping.Status, ShouldEqual, rateLimitPeerStatusHello)
+				case <-time.After(time.Second):
+					t.Fatalf("hello %d not received", i)
+				}
+			}
+		})
+	})
+
+	Convey("Given I have two clusters sharing a pubsub", t, func() {
+
+		ps := NewLocalPubSubClient()
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer ps.Disconnect() // nolint: errcheck
+
+		cfg1 := config{}
+		OptRateLimiting(10, 10)(&cfg1)
+		OptRateLimitingCluster(ps, "peers", 50*time.Millisecond, 0)(&cfg1)
+
+		cfg2 := config{}
+		OptRateLimiting(10, 10)(&cfg2)
+		OptRateLimitingCluster(ps, "peers", 50*time.Millisecond, 0)(&cfg2)
+
+		c1 := newRateLimitCluster(cfg1)
+		c2 := newRateLimitCluster(cfg2)
+
+		ctx1, cancel1 := context.WithCancel(context.Background())
+		defer cancel1()
+		ctx2, cancel2 := context.WithCancel(context.Background())
+		defer cancel2()
+
+		go c1.listen(ctx1)
+		go c2.listen(ctx2)
+
+		Convey("Then they should discover each other", func() {
+
+			So(func() bool {
+				deadline := time.Now().Add(2 * time.Second)
+				for time.Now().Before(deadline) {
+					if cfg1.rateLimiting.rateLimiter.Burst() == 5 && cfg2.rateLimiting.rateLimiter.Burst() == 5 {
+						return true
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				return false
+			}(), ShouldBeTrue)
+
+			So(c1.replicas(), ShouldEqual, 2)
+			So(c2.replicas(), ShouldEqual, 2)
+
+			Convey("When one of them stops", func() {
+
+				cancel2()
+
+				Convey("Then the other should restore its limits", func() {
+
+					So(func() bool {
+						deadline := time.Now().Add(2 * time.Second)
+						for time.Now().Before(deadline) {
+							if cfg1.rateLimiting.rateLimiter.Burst() == 10 {
+								return true
+							}
+							time.Sleep(10 * time.Millisecond)
+						}
+						return false
+					}(), ShouldBeTrue)
+
+					So(c1.replicas(), ShouldEqual, 1)
+				})
+			})
+		})
+	})
+}
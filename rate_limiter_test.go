@@ -0,0 +1,408 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/time/rate"
+)
+
+func makeRateLimitTestToken(claims string) string {
+	return "a." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c"
+}
+
+func TestRateLimitKeyExtractors(t *testing.T) {
+
+	Convey("Given I have a request", t, func() {
+
+		req := httptest.NewRequest(http.MethodGet, "/things", nil)
+		req.RemoteAddr = "10.0.0.1:4242"
+
+		Convey("When I use RateLimitKeyFromClientIP without trusting forwarded headers", func() {
+
+			req.Header.Set("X-Forwarded-For", "1.2.3.4")
+			key, err := RateLimitKeyFromClientIP(0)(req)
+
+			Convey("Then the remote address should be used", func() {
+				So(err, ShouldBeNil)
+				So(key, ShouldEqual, "10.0.0.1")
+			})
+		})
+
+		Convey("When I use RateLimitKeyFromClientIP trusting forwarded headers", func() {
+
+			req.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+			req.Header.Add("X-Forwarded-For", "9.9.9.9")
+			key1, err1 := RateLimitKeyFromClientIP(1)(req)
+			key2, err2 := RateLimitKeyFromClientIP(2)(req)
+			key5, err5 := RateLimitKeyFromClientIP(5)(req)
+
+			Convey("Then the address added by the outermost trusted proxy should be used", func() {
+				So(err1, ShouldBeNil)
+				So(key1, ShouldEqual, "9.9.9.9")
+				So(err2, ShouldBeNil)
+				So(key2, ShouldEqual, "5.6.7.8")
+				So(err5, ShouldBeNil)
+				So(key5, ShouldEqual, "1.2.3.4")
+			})
+		})
+
+		Convey("When I call RateLimitKeyFromClientIP with a negative number of proxies", func() {
+
+			Convey("Then it should panic", func() {
+				So(func() { RateLimitKeyFromClientIP(-1) }, ShouldPanicWith, "trustedProxies must be positive")
+			})
+		})
+
+		Convey("When I use RateLimitKeyFromClientIP trusting X-Real-IP", func() {
+
+			req.Header.Set("X-Real-IP", "4.3.2.1")
+			key, err := RateLimitKeyFromClientIP(1)(req)
+
+			Convey("Then the real ip should be used", func() {
+				So(err, ShouldBeNil)
+				So(key, ShouldEqual, "4.3.2.1")
+			})
+		})
+
+		Convey("When I use RateLimitKeyFromToken", func() {
+
+			req.Header.Set("Authorization", "Bearer secret")
+			key, err := RateLimitKeyFromToken()(req)
+
+			Convey("Then the key should be the hash of the token", func() {
+				So(err, ShouldBeNil)
+				So(key, ShouldEqual, "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b")
+			})
+		})
+
+		Convey("When I use RateLimitKeyFromToken with no token", func() {
+
+			key, err := RateLimitKeyFromToken()(req)
+
+			Convey("Then the key should be empty", func() {
+				So(err, ShouldBeNil)
+				So(key, ShouldEqual, "")
+			})
+		})
+
+		Convey("When I use RateLimitKeyFromNamespace", func() {
+
+			req.Header.Set("X-Namespace", "/a/b")
+			key, err := RateLimitKeyFromNamespace()(req)
+
+			Convey("Then the key should be the namespace", func() {
+				So(err, ShouldBeNil)
+				So(key, ShouldEqual, "/a/b")
+			})
+		})
+
+		Convey("When I use RateLimitKeyFromClaims", func() {
+
+			req.Header.Set("Authorization", "Bearer "+makeRateLimitTestToken(`{"sub":"alice","org":"acme"}`))
+			key, err := RateLimitKeyFromClaims("org", "sub")(req)
+
+			Convey("Then the key should be made of the claims", func() {
+				So(err, ShouldBeNil)
+				So(key, ShouldEqual, "acme|alice")
+			})
+		})
+
+		Convey("When I use RateLimitKeyFromClaims with no matching claims", func() {
+
+			req.Header.Set("Authorization", "Bearer "+makeRateLimitTestToken(`{"sub":"alice"}`))
+			key, err := RateLimitKeyFromClaims("org", "team")(req)
+
+			Convey("Then the key should be empty", func() {
+				So(err, ShouldBeNil)
+				So(key, ShouldEqual, "")
+			})
+		})
+
+		Convey("When I use RateLimitKeyFromClaims with an invalid token", func() {
+
+			req.Header.Set("Authorization", "Bearer nope")
+			key, err := RateLimitKeyFromClaims("sub")(req)
+
+			Convey("Then the key should be empty", func() {
+				So(err, ShouldBeNil)
+				So(key, ShouldEqual, "")
+			})
+		})
+
+		Convey("When I call RateLimitKeyFromClaims with no keys", func() {
+
+			Convey("Then it should panic", func() {
+				So(func() { RateLimitKeyFromClaims() }, ShouldPanicWith, "you must provide at least one claim key")
+			})
+		})
+	})
+}
+
+func TestKeyedRateLimiter(t *testing.T) {
+
+	Convey("Given I have a keyed rate limiter", t, func() {
+
+		rl := NewKeyedRateLimiter(
+			RateLimitKeyFromNamespace(),
+			RateLimitTier{Name: "default", Limit: 1, Burst: 2},
+		)
+
+		makeReq := func(ns string) *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/things", nil)
+			req.Header.Set("X-Namespace", ns)
+			return req
+		}
+
+		Convey("When I exhaust the bucket of one key", func() {
+
+			l1, s1, err1 := rl.RateLimitWithStatus(makeReq("/a"))
+			l2, s2, err2 := rl.RateLimitWithStatus(makeReq("/a"))
+			l3, s3, err3 := rl.RateLimitWithStatus(makeReq("/a"))
+
+			Convey("Then the first requests should pass", func() {
+				So(err1, ShouldBeNil)
+				So(l1, ShouldBeFalse)
+				So(s1.Tier, ShouldEqual, "default")
+				So(s1.Limit, ShouldEqual, 2)
+				So(s1.Remaining, ShouldEqual, 1)
+				So(s1.RetryAfter, ShouldEqual, 0)
+				So(err2, ShouldBeNil)
+				So(l2, ShouldBeFalse)
+				So(s2.Remaining, ShouldEqual, 0)
+			})
+
+			Convey("Then the last request should be limited", func() {
+				So(err3, ShouldBeNil)
+				So(l3, ShouldBeTrue)
+				So(s3.Remaining, ShouldEqual, 0)
+				So(s3.RetryAfter, ShouldBeGreaterThan, 0)
+				So(s3.RetryAfter, ShouldBeLessThanOrEqualTo, time.Second)
+				So(s3.Reset, ShouldBeGreaterThan, time.Second)
+			})
+
+			Convey("Then another key should not be limited", func() {
+				limited, err := rl.RateLimit(makeReq("/b"))
+				So(err, ShouldBeNil)
+				So(limited, ShouldBeFalse)
+			})
+		})
+
+		Convey("When concurrent first requests are made for a new key", func() {
+
+			var passed int32
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if limited, _ := rl.RateLimit(makeReq("/concurrent")); !limited {
+						atomic.AddInt32(&passed, 1)
+					}
+				}()
+			}
+			wg.Wait()
+
+			Convey("Then they should share the same bucket", func() {
+				So(passed, ShouldEqual, 2)
+			})
+		})
+
+		Convey("When the request has no key", func() {
+
+			limited, status, err := rl.RateLimitWithStatus(makeReq(""))
+
+			Convey("Then it should not be limited", func() {
+				So(err, ShouldBeNil)
+				So(limited, ShouldBeFalse)
+				So(status, ShouldResemble, RateLimitStatus{})
+			})
+		})
+	})
+
+	Convey("Given I have a keyed rate limiter with a tier resolver", t, func() {
+
+		rl := NewKeyedRateLimiter(
+			RateLimitKeyFromNamespace(),
+			RateLimitTier{Name: "default", Limit: 1, Burst: 1},
+			KeyedRateLimiterOptTierResolver(func(req *http.Request, key string) (RateLimitTier, error) {
+				switch key {
+				case "/premium":
+					return RateLimitTier{Name: "premium", Limit: rate.Inf, Burst: 10}, nil
+				case "/broken":
+					return RateLimitTier{}, fmt.Errorf("boom")
+				default:
+					return RateLimitTier{}, nil
+				}
+			}),
+			KeyedRateLimiterOptMaxKeys(10),
+			KeyedRateLimiterOptKeyTTL(time.Minute),
+		)
+
+		makeReq := func(ns string) *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/things", nil)
+			req.Header.Set("X-Namespace", ns)
+			return req
+		}
+
+		Convey("When I send requests from a premium key", func() {
+
+			var limited bool
+			var status RateLimitStatus
+			for i := 0; i < 20; i++ {
+				limited, status, _ = rl.RateLimitWithStatus(makeReq("/premium"))
+			}
+
+			Convey("Then it should use the premium tier", func() {
+				So(limited, ShouldBeFalse)
+				So(status.Tier, ShouldEqual, "premium")
+				So(status.Reset, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I send requests from another key", func() {
+
+			rl.RateLimitWithStatus(makeReq("/other")) // nolint: errcheck
+			limited, status, err := rl.RateLimitWithStatus(makeReq("/other"))
+
+			Convey("Then it should use the default tier", func() {
+				So(err, ShouldBeNil)
+				So(limited, ShouldBeTrue)
+				So(status.Tier, ShouldEqual, "default")
+			})
+		})
+
+		Convey("When the resolver fails", func() {
+
+			limited, _, err := rl.RateLimitWithStatus(makeReq("/broken"))
+
+			Convey("Then it should return the error", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "boom")
+				So(limited, ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("Calling NewKeyedRateLimiter with a nil extractor should panic", t, func() {
+		So(func() { NewKeyedRateLimiter(nil, RateLimitTier{}) }, ShouldPanicWith, "extractor must not be nil")
+	})
+}
+
+type testSimpleRateLimiter struct {
+	limited bool
+	err     error
+}
+
+func (l *testSimpleRateLimiter) RateLimit(*http.Request) (bool, error) {
+	return l.limited, l.err
+}
+
+func TestApplyRateLimiter(t *testing.T) {
+
+	Convey("Given I have a simple rate limiter", t, func() {
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/things", nil)
+
+		limited, tier, err := applyRateLimiter(&testSimpleRateLimiter{limited: true}, w, req)
+
+		Convey("Then no header should be written", func() {
+			So(err, ShouldBeNil)
+			So(limited, ShouldBeTrue)
+			So(tier, ShouldEqual, "")
+			So(w.Header().Get("RateLimit-Limit"), ShouldEqual, "")
+		})
+	})
+
+	Convey("Given I have a status rate limiter", t, func() {
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/things", nil)
+		req.Header.Set("X-Namespace", "/a")
+
+		rl := NewKeyedRateLimiter(RateLimitKeyFromNamespace(), RateLimitTier{Name: "t", Limit: 0.5, Burst: 1})
+
+		Convey("When the request is allowed", func() {
+
+			limited, tier, err := applyRateLimiter(rl, w, req)
+
+			Convey("Then the headers should be written", func() {
+				So(err, ShouldBeNil)
+				So(limited, ShouldBeFalse)
+				So(tier, ShouldEqual, "t")
+				So(w.Header().Get("RateLimit-Limit"), ShouldEqual, "1")
+				So(w.Header().Get("RateLimit-Remaining"), ShouldEqual, "0")
+				So(w.Header().Get("RateLimit-Reset"), ShouldEqual, "2")
+				So(w.Header().Get("Retry-After"), ShouldEqual, "")
+			})
+
+			Convey("When a second request is limited", func() {
+
+				limited, _, err := applyRateLimiter(rl, w, req)
+
+				Convey("Then Retry-After should be written", func() {
+					So(err, ShouldBeNil)
+					So(limited, ShouldBeTrue)
+					So(w.Header().Get("Retry-After"), ShouldEqual, "2")
+				})
+			})
+		})
+	})
+}
+
+func TestWriteRateLimitHeaders(t *testing.T) {
+
+	Convey("Given I have headers from a previous limiter", t, func() {
+
+		h := http.Header{}
+		writeRateLimitHeaders(h, RateLimitStatus{Limit: 10, Remaining: 3}, false)
+
+		Convey("When I write a less restrictive status", func() {
+
+			writeRateLimitHeaders(h, RateLimitStatus{Limit: 100, Remaining: 50}, false)
+
+			Convey("Then the headers should not change", func() {
+				So(h.Get("RateLimit-Limit"), ShouldEqual, "10")
+				So(h.Get("RateLimit-Remaining"), ShouldEqual, "3")
+			})
+		})
+
+		Convey("When I write a more restrictive status", func() {
+
+			writeRateLimitHeaders(h, RateLimitStatus{Limit: 5, Remaining: 1}, false)
+
+			Convey("Then the headers should change", func() {
+				So(h.Get("RateLimit-Limit"), ShouldEqual, "5")
+				So(h.Get("RateLimit-Remaining"), ShouldEqual, "1")
+			})
+		})
+
+		Convey("When I write a limited status with a short retry", func() {
+
+			writeRateLimitHeaders(h, RateLimitStatus{Limit: 5, RetryAfter: time.Millisecond}, true)
+
+			Convey("Then Retry-After should be at least 1", func() {
+				So(h.Get("Retry-After"), ShouldEqual, "1")
+			})
+		})
+	})
+}
@@ -19,6 +19,7 @@ import (
 	"net"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -42,24 +43,34 @@ var (
 
 // an restServer is the structure serving the api routes.
 type restServer struct {
-	cfg             config
-	multiplexer     *bone.Mux
-	server          *http.Server
-	processorFinder processorFinderFunc
-	pusher          eventPusherFunc
-	customHandlers  retrieveHandlersFunc
+	cfg              config
+	multiplexer      *bone.Mux
+	server           *http.Server
+	processorFinder  processorFinderFunc
+	pusher           eventPusherFunc
+	contextPusher    contextEventPusherFunc
+	customHandlers   retrieveHandlersFunc
+	rateLimitCluster *rateLimitCluster
 }
 
 // newRestServer returns a new apiServer.
 func newRestServer(cfg config, multiplexer *bone.Mux, processorFinder processorFinderFunc, customHandlers retrieveHandlersFunc, pusher eventPusherFunc) *restServer {
 
-	return &restServer{
+	a := &restServer{
 		cfg:             cfg,
 		multiplexer:     multiplexer,
 		processorFinder: processorFinder,
 		pusher:          pusher,
 		customHandlers:  customHandlers,
 	}
+
+	// The cluster is created once so the configured limits are
+	// captured before they are scaled, even if the server restarts.
+	if cfg.rateLimiting.clusterPubSub != nil {
+		a.rateLimitCluster = newRateLimitCluster(cfg)
+	}
+
+	return a
 }
 
 // createSecureHTTPServer returns the main HTTP Server.
@@ -211,6 +222,10 @@ func (a *restServer) start(ctx context.Context, routesInfo map[int][]RouteInfo)
 
 	a.installRoutes(routesInfo)
 
+	if a.rateLimitCluster != nil {
+		go a.rateLimitCluster.listen(ctx)
+	}
+
 	var err error
 	if a.cfg.tls.serverCertificates != nil || a.cfg.tls.serverCertificatesRetrieverFunc != nil {
 		a.server = a.createSecureHTTPServer(a.cfg.restServer.listenAddress)
@@ -292,6 +307,29 @@ func (a *restServer) makeHandler(handler handlerFunc) http.HandlerFunc {
 			measure = a.cfg.healthServer.metricsManager.MeasureRequest(req.Method, req.URL.Path)
 		}
 
+		var accessRecord *AccessLogRecord
+		if accessLog := a.cfg.accessLog.log; accessLog != nil {
+
+			aw := &accessLogResponseWriter{ResponseWriter: w}
+			w = aw
+
+			accessRecord = &AccessLogRecord{
+				Timestamp: time.Now(),
+				Kind:      AccessLogKindRequest,
+				ClientIP:  req.RemoteAddr,
+				Method:    req.Method,
+				Path:      req.URL.Path,
+				Protocol:  req.Proto,
+			}
+
+			defer func() {
+				accessRecord.StatusCode = aw.statusCode
+				accessRecord.Bytes = aw.bytes
+				accessRecord.Duration = time.Since(accessRecord.Timestamp)
+				accessLog.log(accessRecord)
+			}()
+		}
+
 		// Trim our custom prefix out of the request URI.
 		// TODO: The elemental function needs to moved in here
 		// and potentially find a cleaner way rather than triming the prefix here.
@@ -320,7 +358,7 @@ func (a *restServer) makeHandler(handler handlerFunc) http.HandlerFunc {
 				corsPolicy,
 			)
 			if measure != nil {
-				measure(code, nil)
+				measure(code, nil, nil)
 			}
 			return
 		}
@@ -341,7 +379,7 @@ func (a *restServer) makeHandler(handler handlerFunc) http.HandlerFunc {
 				corsPolicy,
 			)
 			if measure != nil {
-				measure(code, nil)
+				measure(code, nil, nil)
 			}
 			return
 		}
@@ -361,17 +399,35 @@ func (a *restServer) makeHandler(handler handlerFunc) http.HandlerFunc {
 				corsPolicy,
 			)
 			if measure != nil {
-				measure(code, nil)
+				measure(code, nil, nil)
 			}
 			return
 		}
 
+		metricsInfo := newRequestMetricsInfo(request)
+
 		ctx := traceRequest(req.Context(), request, a.cfg.opentracing.tracer, a.cfg.opentracing.excludedIdentities, a.cfg.opentracing.traceCleaner)
 		defer finishTracing(ctx)
 
+		ctx = traceRequestOTel(ctx, request, a.cfg.opentelemetry.tracerProvider, a.cfg.opentracing.excludedIdentities, a.cfg.opentracing.traceCleaner)
+		defer finishTracingOTel(ctx)
+
+		if accessRecord != nil {
+			accessRecord.RequestID = request.RequestID
+			if request.ClientIP != "" {
+				accessRecord.ClientIP = request.ClientIP
+			}
+			accessRecord.Namespace = request.Namespace
+			accessRecord.Identity = request.Identity.Name
+			accessRecord.Operation = request.Operation
+			accessRecord.Version = request.Version
+			accessRecord.TraceID = accessLogTraceID(ctx)
+		}
+
 		// Global rate limiting
 		if a.cfg.rateLimiting.rateLimiter != nil {
 			if !a.cfg.rateLimiting.rateLimiter.Allow() {
+				registerRateLimitedRequest(a.cfg.healthServer.metricsManager, "global")
 				code := writeHTTPResponse(
 					w,
 					makeErrorResponse(ctx, elemental.NewResponse(request),
@@ -383,7 +439,7 @@ func (a *restServer) makeHandler(handler handlerFunc) http.HandlerFunc {
 					corsPolicy,
 				)
 				if measure != nil {
-					measure(code, opentracing.SpanFromContext(ctx))
+					measure(code, metricsInfo, opentracing.SpanFromContext(ctx))
 				}
 				return
 			}
@@ -394,6 +450,7 @@ func (a *restServer) makeHandler(handler handlerFunc) http.HandlerFunc {
 			if rlm, ok := a.cfg.rateLimiting.apiRateLimiters[request.Identity]; ok {
 				if rlm.condition == nil || rlm.condition(request) {
 					if !rlm.limiter.Allow() {
+						registerRateLimitedRequest(a.cfg.healthServer.metricsManager, "api")
 						code := writeHTTPResponse(
 							w,
 							makeErrorResponse(
@@ -407,7 +464,7 @@ func (a *restServer) makeHandler(handler handlerFunc) http.HandlerFunc {
 							corsPolicy,
 						)
 						if measure != nil {
-							measure(code, opentracing.SpanFromContext(ctx))
+							measure(code, metricsInfo, opentracing.SpanFromContext(ctx))
 						}
 						return
 					}
@@ -415,9 +472,106 @@ func (a *restServer) makeHandler(handler handlerFunc) http.HandlerFunc {
 			}
 		}
 
-		bctx := newContext(ctx, request)
-		resp := handler(bctx, a.cfg, a.processorFinder, a.pusher)
+		// Additional rate limiters
+		for _, rl := range a.cfg.rateLimiting.rateLimiters {
+
+			limited, tier, err := applyRateLimiter(rl, w, req)
+			if err == nil && !limited {
+				continue
+			}
+
+			if err == nil {
+				err = ErrRateLimit
+				registerRateLimitedRequest(a.cfg.healthServer.metricsManager, tier)
+			}
+
+			code := writeHTTPResponse(
+				w,
+				makeErrorResponse(
+					ctx,
+					elemental.NewResponse(request),
+					err,
+					nil,
+					nil,
+				),
+				req.Header.Get("origin"),
+				corsPolicy,
+			)
+			if measure != nil {
+				measure(code, metricsInfo, opentracing.SpanFromContext(ctx))
+			}
+			return
+		}
+
 		var code int
+		var latency time.Duration
+		start := time.Now()
+
+		// Concurrency limiting
+		if limiter := a.cfg.rateLimiting.concurrencyLimiter; limiter != nil {
+
+			priority := a.cfg.rateLimiting.priorityClassifier(request)
+
+			release, ok := limiter.Acquire(priority)
+			if !ok {
+
+				registerShedRequest(a.cfg.healthServer.metricsManager, priority.String())
+
+				w.Header().Set("Retry-After", strconv.Itoa(durationToSeconds(a.cfg.rateLimiting.concurrencyRetryAfter)))
+
+				code := writeHTTPResponse(
+					w,
+					makeErrorResponse(
+						ctx,
+						elemental.NewResponse(request),
+						ErrOverloaded,
+						nil,
+						nil,
+					),
+					req.Header.Get("origin"),
+					corsPolicy,
+				)
+				if measure != nil {
+					measure(code, metricsInfo, opentracing.SpanFromContext(ctx))
+				}
+				return
+			}
+
+			// The slot is released even if the processor panics,
+			// in which case the request is considered as failed.
+			defer func() {
+				if latency == 0 {
+					latency = time.Since(start)
+				}
+				release(latency, isOverloadFailure(code))
+				setConcurrencyLimit(a.cfg.healthServer.metricsManager, limiter.Limit())
+			}()
+		}
+
+		bctx := newContext(ctx, request)
+		bctx.pushChanges = a.cfg.pushServer.changesEnabled
+
+		pusher := a.pusher
+		if a.contextPusher != nil {
+			pusher = func(events ...*elemental.Event) {
+				pctx := ctx
+				if bctx.pushChanges {
+					pctx = contextWithPushChanges(ctx, bctx.outputDataEvent, bctx.changes)
+				}
+				a.contextPusher(pctx, events...)
+			}
+		}
+
+		resp := handler(bctx, a.cfg, a.processorFinder, pusher)
+		latency = time.Since(start)
+
+		if snapshotter := a.cfg.profilingServer.snapshotter; snapshotter != nil {
+			snapshotter.observeLatency(latency)
+		}
+
+		if accessRecord != nil {
+			accessRecord.Claims = a.cfg.accessLog.log.claimsSubset(bctx.ClaimsMap())
+		}
 
 		switch {
 		case bctx.responseWriter != nil:
@@ -432,7 +586,7 @@ func (a *restServer) makeHandler(handler handlerFunc) http.HandlerFunc {
 		}
 
 		if measure != nil {
-			measure(code, opentracing.SpanFromContext(ctx))
+			measure(code, metricsInfo, opentracing.SpanFromContext(ctx))
 		}
 	})
 
@@ -23,8 +23,9 @@ import (
 
 // Various common errors
 var (
-	ErrNotFound  = elemental.NewError("Not Found", "Unable to find the requested resource", "bahamut", http.StatusNotFound)
-	ErrRateLimit = elemental.NewError("Rate Limit", "You have exceeded your rate limit", "bahamut", http.StatusTooManyRequests)
+	ErrNotFound   = elemental.NewError("Not Found", "Unable to find the requested resource", "bahamut", http.StatusNotFound)
+	ErrRateLimit  = elemental.NewError("Rate Limit", "You have exceeded your rate limit", "bahamut", http.StatusTooManyRequests)
+	ErrOverloaded = elemental.NewError("Service Unavailable", "The server is overloaded. Please retry in a moment", "bahamut", http.StatusServiceUnavailable)
 )
 
 func setCommonHeader(w http.ResponseWriter, encoding elemental.EncodingType) {
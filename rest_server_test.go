@@ -310,11 +310,18 @@ type mockMetricsManager struct {
 func (m *mockMetricsManager) MeasureRequest(method string, url string) FinishMeasurementFunc {
 	return m.measureFunc
 }
-func (m *mockMetricsManager) RegisterWSConnection()                        {}
-func (m *mockMetricsManager) UnregisterWSConnection()                      {}
-func (m *mockMetricsManager) RegisterTCPConnection()                       {}
-func (m *mockMetricsManager) UnregisterTCPConnection()                     {}
-func (m *mockMetricsManager) Write(w http.ResponseWriter, r *http.Request) {}
+func (m *mockMetricsManager) RegisterWSConnection()    {}
+func (m *mockMetricsManager) UnregisterWSConnection()  {}
+func (m *mockMetricsManager) RegisterTCPConnection()   {}
+func (m *mockMetricsManager) UnregisterTCPConnection() {}
+func (m *mockMetricsManager) RegisterPushPublication(identity string, eventType string, failed bool) {
+}
+func (m *mockMetricsManager) RegisterPushDispatch(outcome string, count int)     {}
+func (m *mockMetricsManager) ObservePushDispatchDuration(duration time.Duration) {}
+func (m *mockMetricsManager) ObservePushSessionQueueDepth(depth int)             {}
+func (m *mockMetricsManager) RegisterPushEventDropped()                          {}
+func (m *mockMetricsManager) ObservePushSessionLifetime(duration time.Duration)  {}
+func (m *mockMetricsManager) Write(w http.ResponseWriter, r *http.Request)       {}
 
 func TestServer_MakeHandlers(t *testing.T) {
 
@@ -326,10 +333,15 @@ func TestServer_MakeHandlers(t *testing.T) {
 		}
 
 		var measuredCode int
+		var measuredInfo *RequestMetricsInfo
 		cfg := config{}
 		cfg.model.modelManagers = mm
 		cfg.healthServer.metricsManager = &mockMetricsManager{
-			measureFunc: func(code int, span opentracing.Span) time.Duration { measuredCode = code; return 0 },
+			measureFunc: func(code int, info *RequestMetricsInfo, span opentracing.Span) time.Duration {
+				measuredCode = code
+				measuredInfo = info
+				return 0
+			},
 		}
 
 		Convey("When I create a handler with a bad url", func() {
@@ -343,6 +355,7 @@ func TestServer_MakeHandlers(t *testing.T) {
 
 			So(w.Result().StatusCode, ShouldEqual, http.StatusBadRequest)
 			So(measuredCode, ShouldEqual, http.StatusBadRequest)
+			So(measuredInfo, ShouldBeNil)
 		})
 
 		Convey("When I create a handler with badly versionned api", func() {
@@ -425,6 +438,8 @@ func TestServer_MakeHandlers(t *testing.T) {
 
 			So(w.Result().StatusCode, ShouldEqual, http.StatusTooManyRequests)
 			So(measuredCode, ShouldEqual, http.StatusTooManyRequests)
+			So(measuredInfo, ShouldNotBeNil)
+			So(measuredInfo.Identity, ShouldEqual, testmodel.ListIdentity.Name)
 		})
 
 		Convey("When I create a handler with per api rate limiters and ignore condition", func() {
@@ -450,5 +465,89 @@ func TestServer_MakeHandlers(t *testing.T) {
 			So(w.Result().StatusCode, ShouldEqual, http.StatusInternalServerError) //  this happens be
 			So(measuredCode, ShouldEqual, http.StatusInternalServerError)
 		})
+
+		Convey("When I create a handler with a concurrency limiter", func() {
+
+			limiter := NewAIMDConcurrencyLimiter(AIMDConcurrencyLimiterOptLimits(1, 1, 1))
+			release, _ := limiter.Acquire(RequestPriorityCritical)
+
+			cfg.rateLimiting.concurrencyLimiter = limiter
+			cfg.rateLimiting.priorityClassifier = DefaultRequestPriorityClassifier
+			cfg.rateLimiting.concurrencyRetryAfter = 2 * time.Second
+
+			c := newRestServer(cfg, bone.New(), nil, nil, nil)
+			h := c.makeHandler(handleRetrieve)
+
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("DOG", "http://toto.com/lists", nil) // trick to not go any further
+			h(w, r)
+
+			So(w.Result().StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+			So(w.Result().Header.Get("Retry-After"), ShouldEqual, "2")
+			So(measuredCode, ShouldEqual, http.StatusServiceUnavailable)
+
+			release(0, false)
+
+			w = httptest.NewRecorder()
+			r, _ = http.NewRequest("DOG", "http://toto.com/lists", nil) // trick to not go any further
+			h(w, r)
+
+			So(w.Result().StatusCode, ShouldEqual, http.StatusInternalServerError)
+			So(limiter.InFlight(), ShouldEqual, 0)
+		})
+
+		Convey("When I create a handler with a concurrency limiter and the processor panics", func() {
+
+			limiter := NewAIMDConcurrencyLimiter(AIMDConcurrencyLimiterOptLimits(1, 1, 1))
+
+			cfg.rateLimiting.concurrencyLimiter = limiter
+			cfg.rateLimiting.priorityClassifier = DefaultRequestPriorityClassifier
+
+			c := newRestServer(cfg, bone.New(), nil, nil, nil)
+			h := c.makeHandler(func(*bcontext, config, processorFinderFunc, eventPusherFunc) *elemental.Response {
+				panic("boom")
+			})
+
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("DOG", "http://toto.com/lists", nil) // trick to not go any further
+
+			So(func() { h(w, r) }, ShouldPanicWith, "boom")
+			So(limiter.InFlight(), ShouldEqual, 0)
+		})
+
+		Convey("When I create a handler with keyed rate limiters", func() {
+
+			cfg.rateLimiting.rateLimiters = []RateLimiter{
+				NewKeyedRateLimiter(RateLimitKeyFromNamespace(), RateLimitTier{Name: "default", Limit: 1, Burst: 1}),
+			}
+
+			c := newRestServer(cfg, bone.New(), nil, nil, nil)
+			h := c.makeHandler(handleRetrieve)
+
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("DOG", "http://toto.com/lists", nil) // trick to not go any further
+			r.Header.Set("X-Namespace", "/a")
+			h(w, r)
+
+			So(w.Result().StatusCode, ShouldEqual, http.StatusInternalServerError)
+			So(w.Result().Header.Get("RateLimit-Limit"), ShouldEqual, "1")
+			So(w.Result().Header.Get("RateLimit-Remaining"), ShouldEqual, "0")
+
+			w = httptest.NewRecorder()
+			r, _ = http.NewRequest("DOG", "http://toto.com/lists", nil) // trick to not go any further
+			r.Header.Set("X-Namespace", "/a")
+			h(w, r)
+
+			So(w.Result().StatusCode, ShouldEqual, http.StatusTooManyRequests)
+			So(w.Result().Header.Get("Retry-After"), ShouldEqual, "1")
+			So(measuredCode, ShouldEqual, http.StatusTooManyRequests)
+
+			w = httptest.NewRecorder()
+			r, _ = http.NewRequest("DOG", "http://toto.com/lists", nil) // trick to not go any further
+			r.Header.Set("X-Namespace", "/b")
+			h(w, r)
+
+			So(w.Result().StatusCode, ShouldEqual, http.StatusInternalServerError)
+		})
 	})
 }
@@ -79,6 +79,8 @@ func processError(ctx context.Context, err error) (outError elemental.Errors) {
 		span.LogFields(log.Object("elemental.error", outError))
 	}
 
+	recordErrorOTel(ctx, outError)
+
 	return outError
 }
 
@@ -0,0 +1,228 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.aporeto.io/elemental"
+	"go.uber.org/zap"
+)
+
+const pushSessionsAdminPath = "/_push/sessions"
+
+// A PushSessionsAdminAuthorizer is the type of function used to
+// authorize a request sent to the push sessions admin endpoint.
+// If it returns an error, the request is rejected.
+type PushSessionsAdminAuthorizer func(*http.Request) error
+
+// NewPushSessionsAdminTokenAuthorizer returns a PushSessionsAdminAuthorizer
+// that only accepts requests with the given bearer token in their
+// Authorization header.
+func NewPushSessionsAdminTokenAuthorizer(token string) PushSessionsAdminAuthorizer {
+
+	if token == "" {
+		panic("token must not be empty")
+	}
+
+	return func(r *http.Request) error {
+
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			return fmt.Errorf("invalid token")
+		}
+
+		return nil
+	}
+}
+
+// A PushSessionInfo contains the information
+// about a live push session.
+type PushSessionInfo struct {
+	ID            string                 `json:"ID"`
+	ClientIP      string                 `json:"clientIP"`
+	Claims        []string               `json:"claims"`
+	PushConfig    *elemental.PushConfig  `json:"pushConfig,omitempty"`
+	EncodingRead  elemental.EncodingType `json:"encodingRead"`
+	EncodingWrite elemental.EncodingType `json:"encodingWrite"`
+	StartTime     time.Time              `json:"startTime"`
+	QueueDepth    int                    `json:"queueDepth"`
+	QueueCapacity int                    `json:"queueCapacity"`
+	ErrorState    bool                   `json:"errorState"`
+}
+
+func newPushSessionInfo(session *wsPushSession) PushSessionInfo {
+
+	return PushSessionInfo{
+		ID:            session.Identifier(),
+		ClientIP:      session.ClientIP(),
+		Claims:        session.Claims(),
+		PushConfig:    session.currentPushConfig(),
+		EncodingRead:  session.encodingRead,
+		EncodingWrite: session.encodingWrite,
+		StartTime:     session.startTime,
+		QueueDepth:    len(session.dataCh),
+		QueueCapacity: cap(session.dataCh),
+		ErrorState:    session.inErrorState(),
+	}
+}
+
+// A pushSessionsAdmin serves the admin endpoint used to
+// list and close the live sessions of a pushServer.
+//
+//	GET    /_push/sessions                 lists the sessions.
+//	GET    /_push/sessions?claim=k=v       lists the sessions having all the given claims.
+//	GET    /_push/sessions/<id>            returns the session.
+//	DELETE /_push/sessions/<id>            closes the session.
+//	DELETE /_push/sessions?claim=k=v       closes the sessions having all the given claims.
+type pushSessionsAdmin struct {
+	server     *pushServer
+	authorizer PushSessionsAdminAuthorizer
+}
+
+func newPushSessionsAdmin(server *pushServer, authorizer PushSessionsAdminAuthorizer) *pushSessionsAdmin {
+
+	return &pushSessionsAdmin{
+		server:     server,
+		authorizer: authorizer,
+	}
+}
+
+func (a *pushSessionsAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if err := a.authorizer(r); err != nil {
+		zap.L().Warn("Rejected push sessions admin request",
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.String("remote", r.RemoteAddr),
+			zap.Error(err),
+		)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, pushSessionsAdminPath), "/")
+
+	claims, err := pushSessionsAdminClaims(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+
+	case http.MethodGet:
+
+		if id != "" {
+			session := a.server.session(id)
+			if session == nil {
+				http.Error(w, "Not Found", http.StatusNotFound)
+				return
+			}
+			writePushSessionsAdminResponse(w, newPushSessionInfo(session))
+			return
+		}
+
+		sessions := a.server.matchingSessions(claims)
+		infos := make([]PushSessionInfo, len(sessions))
+		for i, session := range sessions {
+			infos[i] = newPushSessionInfo(session)
+		}
+
+		writePushSessionsAdminResponse(w, infos)
+
+	case http.MethodDelete:
+
+		var sessions []*wsPushSession
+
+		switch {
+
+		case id != "":
+			session := a.server.session(id)
+			if session == nil {
+				http.Error(w, "Not Found", http.StatusNotFound)
+				return
+			}
+			sessions = []*wsPushSession{session}
+
+		case len(claims) == 0:
+			// We never close all the sessions at once.
+			http.Error(w, "You must provide a session ID or at least one claim", http.StatusBadRequest)
+			return
+
+		default:
+			sessions = a.server.matchingSessions(claims)
+		}
+
+		for _, session := range sessions {
+			zap.L().Info("Closing push session from admin endpoint",
+				zap.String("session", session.Identifier()),
+				zap.String("remote", r.RemoteAddr),
+			)
+			session.close(websocket.ClosePolicyViolation)
+		}
+
+		writePushSessionsAdminResponse(w, map[string]int{"closed": len(sessions)})
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// pushSessionsAdminClaims returns the claims passed
+// in the claim query parameters as key=value.
+func pushSessionsAdminClaims(r *http.Request) (map[string]string, error) {
+
+	values := r.URL.Query()["claim"]
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	claims := make(map[string]string, len(values))
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid claim '%s': must be in the form key=value", v)
+		}
+		claims[parts[0]] = parts[1]
+	}
+
+	return claims, nil
+}
+
+// hasClaims returns true if the given session claims
+// contain all the given claims.
+func hasClaims(sessionClaims map[string]string, claims map[string]string) bool {
+
+	for k, v := range claims {
+		if sv, ok := sessionClaims[k]; !ok || sv != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func writePushSessionsAdminResponse(w http.ResponseWriter, data any) {
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		zap.L().Error("Unable to encode push sessions admin response", zap.Error(err))
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-zoo/bone"
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/elemental"
+)
+
+type closeRecorderWebsocket struct {
+	closeCode int
+	sync.Mutex
+}
+
+func (w *closeRecorderWebsocket) Read() chan []byte  { return nil }
+func (w *closeRecorderWebsocket) Write([]byte)       {}
+func (w *closeRecorderWebsocket) Done() chan error   { return nil }
+func (w *closeRecorderWebsocket) Error() chan error  { return nil }
+func (w *closeRecorderWebsocket) Close(code int)     { w.Lock(); w.closeCode = code; w.Unlock() }
+func (w *closeRecorderWebsocket) lastCloseCode() int { w.Lock(); defer w.Unlock(); return w.closeCode }
+
+func TestPushSessionsAdmin(t *testing.T) {
+
+	Convey("Given I have a push server with 3 sessions and an admin", t, func() {
+
+		srv := newPushServer(config{}, bone.New(), nil)
+
+		makeSession := func(claims ...string) (*wsPushSession, *closeRecorderWebsocket) {
+			req, _ := http.NewRequest(http.MethodGet, "http://server/events", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			s := newWSPushSession(req, config{}, nil, elemental.EncodingTypeJSON, elemental.EncodingTypeMSGPACK)
+			s.SetClaims(claims)
+			conn := &closeRecorderWebsocket{}
+			s.setConn(conn)
+			srv.registerSession(s)
+			time.Sleep(time.Millisecond)
+			return s, conn
+		}
+
+		s1, c1 := makeSession("org=a", "user=bob")
+		s2, c2 := makeSession("org=a", "user=alice")
+		s3, c3 := makeSession("org=b", "user=bob")
+		s1.dataCh <- []byte("hello")
+		s3.setErrorState(true)
+
+		admin := newPushSessionsAdmin(srv, NewPushSessionsAdminTokenAuthorizer("secret"))
+
+		do := func(method string, url string, token string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, url, nil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("When I list the sessions without token", func() {
+
+			w := do(http.MethodGet, "/_push/sessions", "")
+
+			Convey("Then it should be forbidden", func() {
+				So(w.Code, ShouldEqual, http.StatusForbidden)
+			})
+		})
+
+		Convey("When I list the sessions with a wrong token", func() {
+
+			w := do(http.MethodGet, "/_push/sessions", "nope")
+
+			Convey("Then it should be forbidden", func() {
+				So(w.Code, ShouldEqual, http.StatusForbidden)
+			})
+		})
+
+		Convey("When I list all the sessions", func() {
+
+			w := do(http.MethodGet, "/_push/sessions", "secret")
+
+			Convey("Then the response should be correct", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+
+				var infos []PushSessionInfo
+				So(json.Unmarshal(w.Body.Bytes(), &infos), ShouldBeNil)
+				So(len(infos), ShouldEqual, 3)
+
+				So(infos[0].ID, ShouldEqual, s1.Identifier())
+				So(infos[0].ClientIP, ShouldEqual, "10.0.0.1:1234")
+				So(infos[0].Claims, ShouldResemble, []string{"org=a", "user=bob"})
+				So(infos[0].EncodingRead, ShouldEqual, elemental.EncodingTypeJSON)
+				So(infos[0].EncodingWrite, ShouldEqual, elemental.EncodingTypeMSGPACK)
+				So(infos[0].QueueDepth, ShouldEqual, 1)
+				So(infos[0].QueueCapacity, ShouldEqual, 64)
+				So(infos[0].ErrorState, ShouldBeFalse)
+
+				So(infos[1].ID, ShouldEqual, s2.Identifier())
+				So(infos[2].ID, ShouldEqual, s3.Identifier())
+				So(infos[2].ErrorState, ShouldBeTrue)
+			})
+		})
+
+		Convey("When I list the sessions matching claims", func() {
+
+			w := do(http.MethodGet, "/_push/sessions?claim=user=bob", "secret")
+
+			Convey("Then the response should be correct", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+
+				var infos []PushSessionInfo
+				So(json.Unmarshal(w.Body.Bytes(), &infos), ShouldBeNil)
+				So(len(infos), ShouldEqual, 2)
+				So(infos[0].ID, ShouldEqual, s1.Identifier())
+				So(infos[1].ID, ShouldEqual, s3.Identifier())
+			})
+		})
+
+		Convey("When I list the sessions with an invalid claim", func() {
+
+			w := do(http.MethodGet, "/_push/sessions?claim=nope", "secret")
+
+			Convey("Then the response should be a bad request", func() {
+				So(w.Code, ShouldEqual, http.StatusBadRequest)
+			})
+		})
+
+		Convey("When I get a session", func() {
+
+			w := do(http.MethodGet, "/_push/sessions/"+s2.Identifier(), "secret")
+
+			Convey("Then the response should be correct", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+
+				info := PushSessionInfo{}
+				So(json.Unmarshal(w.Body.Bytes(), &info), ShouldBeNil)
+				So(info.ID, ShouldEqual, s2.Identifier())
+			})
+		})
+
+		Convey("When I get a missing session", func() {
+
+			w := do(http.MethodGet, "/_push/sessions/nope", "secret")
+
+			Convey("Then the response should be not found", func() {
+				So(w.Code, ShouldEqual, http.StatusNotFound)
+			})
+		})
+
+		Convey("When I close a session", func() {
+
+			w := do(http.MethodDelete, "/_push/sessions/"+s2.Identifier(), "secret")
+
+			Convey("Then only this session should be closed", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Body.String(), ShouldEqual, `{"closed":1}`+"\n")
+				So(c1.lastCloseCode(), ShouldEqual, 0)
+				So(c2.lastCloseCode(), ShouldEqual, websocket.ClosePolicyViolation)
+				So(c3.lastCloseCode(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I close the sessions matching claims", func() {
+
+			w := do(http.MethodDelete, "/_push/sessions?claim=org=a", "secret")
+
+			Convey("Then the matching sessions should be closed", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Body.String(), ShouldEqual, `{"closed":2}`+"\n")
+				So(c1.lastCloseCode(), ShouldEqual, websocket.ClosePolicyViolation)
+				So(c2.lastCloseCode(), ShouldEqual, websocket.ClosePolicyViolation)
+				So(c3.lastCloseCode(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I try to close all the sessions", func() {
+
+			w := do(http.MethodDelete, "/_push/sessions", "secret")
+
+			Convey("Then it should be a bad request", func() {
+				So(w.Code, ShouldEqual, http.StatusBadRequest)
+				So(c1.lastCloseCode(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I send a POST", func() {
+
+			w := do(http.MethodPost, "/_push/sessions", "secret")
+
+			Convey("Then it should not be allowed", func() {
+				So(w.Code, ShouldEqual, http.StatusMethodNotAllowed)
+			})
+		})
+	})
+
+	Convey("Given I have an authorizer returning an error", t, func() {
+
+		admin := newPushSessionsAdmin(
+			newPushServer(config{}, bone.New(), nil),
+			func(*http.Request) error { return fmt.Errorf("nope") },
+		)
+
+		Convey("Then requests should be forbidden", func() {
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_push/sessions", nil))
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+		})
+	})
+
+	Convey("Calling NewPushSessionsAdminTokenAuthorizer with an empty token should panic", t, func() {
+		So(func() { NewPushSessionsAdminTokenAuthorizer("") }, ShouldPanicWith, "token must not be empty")
+	})
+}
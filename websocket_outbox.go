@@ -0,0 +1,417 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.aporeto.io/elemental"
+	"go.uber.org/zap"
+)
+
+const (
+	pushOutboxFileSuffix            = ".pub"
+	pushOutboxPingTimeout           = time.Second
+	pushOutboxFlushRetryInterval    = 500 * time.Millisecond
+	defaultPushOutboxMaxSize        = 64 << 20
+	defaultPushOutboxMaxEvents      = 100000
+	defaultPushOutboxReplayInterval = 5 * time.Second
+)
+
+// errPushOutboxFull is returned when an event cannot be stored
+// because the push outbox has reached its maximum size.
+var errPushOutboxFull = errors.New("push outbox is full")
+
+// PushOutboxStatus contains information about the push outbox.
+type PushOutboxStatus struct {
+	Enabled   bool      `json:"enabled"`
+	Events    int       `json:"events"`
+	Size      int64     `json:"size"`
+	MaxEvents int       `json:"maxEvents"`
+	MaxSize   int64     `json:"maxSize"`
+	Dropped   uint64    `json:"dropped"`
+	Oldest    time.Time `json:"oldest,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// A PushOutboxOption represents an option that can be passed to OptPushOutbox.
+type PushOutboxOption func(*pushOutboxConfig)
+
+type pushOutboxConfig struct {
+	maxSize        int64
+	maxEvents      int
+	replayInterval time.Duration
+}
+
+// PushOutboxOptMaxSize sets the maximum total size in bytes of the
+// events stored in the outbox. The default is 64MiB.
+func PushOutboxOptMaxSize(bytes int64) PushOutboxOption {
+
+	if bytes <= 0 {
+		panic("bytes must be greater than 0")
+	}
+
+	return func(c *pushOutboxConfig) {
+		c.maxSize = bytes
+	}
+}
+
+// PushOutboxOptMaxEvents sets the maximum number of events
+// stored in the outbox. The default is 100000.
+func PushOutboxOptMaxEvents(count int) PushOutboxOption {
+
+	if count <= 0 {
+		panic("count must be greater than 0")
+	}
+
+	return func(c *pushOutboxConfig) {
+		c.maxEvents = count
+	}
+}
+
+// PushOutboxOptReplayInterval sets how often the push server tries
+// to publish the events stored in the outbox. The default is 5s.
+func PushOutboxOptReplayInterval(interval time.Duration) PushOutboxOption {
+
+	if interval <= 0 {
+		panic("interval must be greater than 0")
+	}
+
+	return func(c *pushOutboxConfig) {
+		c.replayInterval = interval
+	}
+}
+
+// pushOutboxEntry is an event stored in the outbox.
+type pushOutboxEntry struct {
+	name string
+	size int64
+	time time.Time
+}
+
+// pushOutbox stores on disk the publications of the events that
+// could not be published, and publishes them once the PubSubClient
+// is available again, in the order they were stored.
+type pushOutbox struct {
+	dir    string
+	config pushOutboxConfig
+
+	entries   []pushOutboxEntry
+	size      int64
+	seq       uint64
+	dropped   uint64
+	lastError string
+	openErr   error
+	openOnce  sync.Once
+	lock      sync.Mutex
+	replayMux sync.Mutex
+
+	// publishMux is held by publish from the moment it checks
+	// whether the outbox is empty until the publication is either
+	// published or stored, so a concurrent push cannot overtake
+	// an event that is about to be stored.
+	publishMux sync.Mutex
+}
+
+func newPushOutbox(dir string, options ...PushOutboxOption) *pushOutbox {
+
+	cfg := pushOutboxConfig{
+		maxSize:        defaultPushOutboxMaxSize,
+		maxEvents:      defaultPushOutboxMaxEvents,
+		replayInterval: defaultPushOutboxReplayInterval,
+	}
+
+	for _, opt := range options {
+		opt(&cfg)
+	}
+
+	return &pushOutbox{
+		dir:    dir,
+		config: cfg,
+	}
+}
+
+// open creates the directory of the outbox if needed,
+// and loads the events stored by a previous run.
+func (o *pushOutbox) open() error {
+
+	o.openOnce.Do(func() {
+
+		if err := os.MkdirAll(o.dir, 0700); err != nil {
+			o.openErr = fmt.Errorf("unable to create push outbox directory: %w", err)
+			return
+		}
+
+		files, err := os.ReadDir(o.dir)
+		if err != nil {
+			o.openErr = fmt.Errorf("unable to read push outbox directory: %w", err)
+			return
+		}
+
+		o.lock.Lock()
+		defer o.lock.Unlock()
+
+		for _, f := range files {
+
+			name := f.Name()
+			if f.IsDir() || !strings.HasSuffix(name, pushOutboxFileSuffix) {
+				continue
+			}
+
+			seq, err := strconv.ParseUint(strings.TrimSuffix(name, pushOutboxFileSuffix), 10, 64)
+			if err != nil {
+				continue
+			}
+
+			info, err := f.Info()
+			if err != nil {
+				continue
+			}
+
+			o.entries = append(o.entries, pushOutboxEntry{name: name, size: info.Size(), time: info.ModTime()})
+			o.size += info.Size()
+
+			if seq > o.seq {
+				o.seq = seq
+			}
+		}
+
+		// The names are zero padded, so they sort like the sequence numbers.
+		sort.Slice(o.entries, func(i, j int) bool { return o.entries[i].name < o.entries[j].name })
+	})
+
+	return o.openErr
+}
+
+// len returns the number of events stored in the outbox.
+func (o *pushOutbox) len() int {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return len(o.entries)
+}
+
+// store stores the given publication at the end of the outbox.
+func (o *pushOutbox) store(publication *Publication) error {
+
+	if err := o.open(); err != nil {
+		return err
+	}
+
+	data, err := elemental.Encode(elemental.EncodingTypeMSGPACK, publication)
+	if err != nil {
+		return fmt.Errorf("unable to encode publication: %w", err)
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if len(o.entries) >= o.config.maxEvents || o.size+int64(len(data)) > o.config.maxSize {
+		o.dropped++
+		return errPushOutboxFull
+	}
+
+	name := fmt.Sprintf("%020d%s", o.seq+1, pushOutboxFileSuffix)
+	path := filepath.Join(o.dir, name)
+
+	// We write to a temporary file first, so a crash
+	// never leaves a partial event in the outbox.
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("unable to write push outbox event: %w", err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("unable to write push outbox event: %w", err)
+	}
+
+	o.seq++
+	o.entries = append(o.entries, pushOutboxEntry{name: name, size: int64(len(data)), time: time.Now()})
+	o.size += int64(len(data))
+
+	return nil
+}
+
+// publish publishes the given publication using the given function,
+// unless some events are waiting in the outbox, in which case it is
+// stored after them to keep the order. It is also stored if the
+// function fails. The event is not lost if it returns nil, so it
+// is not reported as a failed publication.
+func (o *pushOutbox) publish(publication *Publication, publish func() error) error {
+
+	o.publishMux.Lock()
+	defer o.publishMux.Unlock()
+
+	if o.len() == 0 && publish() == nil {
+		return nil
+	}
+
+	if err := o.store(publication); err != nil {
+		return err
+	}
+
+	zap.L().Debug("Event stored in push outbox", zap.String("topic", publication.Topic))
+
+	return nil
+}
+
+// replay publishes the stored events in order using the given
+// PubSubClient, until the outbox is empty, a publication fails
+// or the given context is done.
+func (o *pushOutbox) replay(ctx context.Context, service PubSubClient) error {
+
+	if err := o.open(); err != nil {
+		return err
+	}
+
+	o.replayMux.Lock()
+	defer o.replayMux.Unlock()
+
+	for {
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		o.lock.Lock()
+		if len(o.entries) == 0 {
+			o.lastError = ""
+			o.lock.Unlock()
+			return nil
+		}
+		entry := o.entries[0]
+		o.lock.Unlock()
+
+		path := filepath.Join(o.dir, entry.name)
+		publication := NewPublication("")
+
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = elemental.Decode(elemental.EncodingTypeMSGPACK, data, publication)
+		}
+
+		if err != nil {
+			// There is no point in keeping an event we can't read,
+			// as it would prevent the others from being published.
+			zap.L().Error("Unable to read push outbox event. Event dropped.", zap.String("file", path), zap.Error(err))
+		} else if err := service.Publish(publication); err != nil {
+			o.lock.Lock()
+			o.lastError = err.Error()
+			o.lock.Unlock()
+			return err
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			zap.L().Error("Unable to remove push outbox event", zap.String("file", path), zap.Error(err))
+		}
+
+		o.lock.Lock()
+		o.entries = o.entries[1:]
+		o.size -= entry.size
+		o.lock.Unlock()
+	}
+}
+
+// flush replays the stored events until the outbox is
+// empty or the given context is done.
+func (o *pushOutbox) flush(ctx context.Context, service PubSubClient) error {
+
+	for {
+
+		err := o.replay(ctx, service)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("unable to flush push outbox: %w", err)
+		case <-time.After(pushOutboxFlushRetryInterval):
+		}
+	}
+}
+
+// run periodically replays the stored events until the given
+// context is done. If the PubSubClient is a Pinger, the replay
+// is only attempted when it is healthy.
+func (o *pushOutbox) run(ctx context.Context, service PubSubClient) {
+
+	if err := o.open(); err != nil {
+		zap.L().Error("Unable to open push outbox", zap.Error(err))
+		return
+	}
+
+	ticker := time.NewTicker(o.config.replayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+
+		case <-ticker.C:
+
+			if o.len() == 0 {
+				continue
+			}
+
+			if pinger, ok := service.(Pinger); ok {
+				if err := pinger.Ping(pushOutboxPingTimeout); err != nil {
+					continue
+				}
+			}
+
+			if err := o.replay(ctx, service); err != nil && ctx.Err() == nil {
+				zap.L().Warn("Unable to replay push outbox", zap.Int("events", o.len()), zap.Error(err))
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// status returns the current status of the outbox.
+func (o *pushOutbox) status() PushOutboxStatus {
+
+	_ = o.open()
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	s := PushOutboxStatus{
+		Enabled:   true,
+		Events:    len(o.entries),
+		Size:      o.size,
+		MaxEvents: o.config.maxEvents,
+		MaxSize:   o.config.maxSize,
+		Dropped:   o.dropped,
+		LastError: o.lastError,
+	}
+
+	if len(o.entries) > 0 {
+		s.Oldest = o.entries[0].time
+	}
+
+	if o.openErr != nil {
+		s.LastError = o.openErr.Error()
+	}
+
+	return s
+}
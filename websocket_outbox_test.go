@@ -0,0 +1,347 @@
+// Copyright 2019 Aporeto Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bahamut
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testOutboxPubSub struct {
+	publications []*Publication
+	publishErr   error
+	pingErr      error
+	sync.Mutex
+}
+
+func (p *testOutboxPubSub) Connect(context.Context) error { return nil }
+func (p *testOutboxPubSub) Disconnect() error             { return nil }
+
+func (p *testOutboxPubSub) Publish(publication *Publication, opts ...PubSubOptPublish) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.publishErr != nil {
+		return p.publishErr
+	}
+
+	p.publications = append(p.publications, publication)
+
+	return nil
+}
+
+func (p *testOutboxPubSub) Subscribe(pubs chan *Publication, errors chan error, topic string, opts ...PubSubOptSubscribe) func() {
+	return func() {}
+}
+
+func (p *testOutboxPubSub) Ping(time.Duration) error {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.pingErr
+}
+
+func (p *testOutboxPubSub) setErrors(publishErr error, pingErr error) {
+	p.Lock()
+	p.publishErr = publishErr
+	p.pingErr = pingErr
+	p.Unlock()
+}
+
+func (p *testOutboxPubSub) topics() []string {
+	p.Lock()
+	defer p.Unlock()
+
+	out := make([]string, len(p.publications))
+	for i, pub := range p.publications {
+		out[i] = pub.Topic
+	}
+
+	return out
+}
+
+func TestPushOutbox_Options(t *testing.T) {
+
+	Convey("Given I create a push outbox without option", t, func() {
+
+		o := newPushOutbox("dir")
+
+		Convey("Then the defaults should be set", func() {
+			So(o.dir, ShouldEqual, "dir")
+			So(o.config.maxSize, ShouldEqual, defaultPushOutboxMaxSize)
+			So(o.config.maxEvents, ShouldEqual, defaultPushOutboxMaxEvents)
+			So(o.config.replayInterval, ShouldEqual, defaultPushOutboxReplayInterval)
+		})
+	})
+
+	Convey("Given I create a push outbox with options", t, func() {
+
+		o := newPushOutbox(
+			"dir",
+			PushOutboxOptMaxSize(1024),
+			PushOutboxOptMaxEvents(10),
+			PushOutboxOptReplayInterval(time.Second),
+		)
+
+		Convey("Then the options should be applied", func() {
+			So(o.config.maxSize, ShouldEqual, 1024)
+			So(o.config.maxEvents, ShouldEqual, 10)
+			So(o.config.replayInterval, ShouldEqual, time.Second)
+		})
+	})
+
+	Convey("Calling the options with invalid values should panic", t, func() {
+		So(func() { PushOutboxOptMaxSize(0) }, ShouldPanicWith, "bytes must be greater than 0")
+		So(func() { PushOutboxOptMaxEvents(0) }, ShouldPanicWith, "count must be greater than 0")
+		So(func() { PushOutboxOptReplayInterval(0) }, ShouldPanicWith, "interval must be greater than 0")
+	})
+}
+
+func TestPushOutbox_StoreReplay(t *testing.T) {
+
+	Convey("Given I have a push outbox with some events", t, func() {
+
+		dir := filepath.Join(t.TempDir(), "outbox")
+		o := newPushOutbox(dir, PushOutboxOptMaxEvents(3))
+
+		for _, topic := range []string{"a", "b", "c"} {
+			So(o.store(NewPublication(topic)), ShouldBeNil)
+		}
+
+		Convey("Then the status should be correct", func() {
+			s := o.status()
+			So(s.Enabled, ShouldBeTrue)
+			So(s.Events, ShouldEqual, 3)
+			So(s.Size, ShouldBeGreaterThan, 0)
+			So(s.MaxEvents, ShouldEqual, 3)
+			So(s.Oldest.IsZero(), ShouldBeFalse)
+		})
+
+		Convey("When I store another event", func() {
+
+			err := o.store(NewPublication("d"))
+
+			Convey("Then it should be dropped", func() {
+				So(err, ShouldEqual, errPushOutboxFull)
+				So(o.status().Dropped, ShouldEqual, 1)
+				So(o.len(), ShouldEqual, 3)
+			})
+		})
+
+		Convey("When I open the outbox again", func() {
+
+			o2 := newPushOutbox(dir)
+			service := &testOutboxPubSub{}
+			So(o2.replay(context.Background(), service), ShouldBeNil)
+
+			Convey("Then the events should be published in order", func() {
+				So(service.topics(), ShouldResemble, []string{"a", "b", "c"})
+				So(o2.len(), ShouldEqual, 0)
+			})
+
+			Convey("Then new events should be stored after the previous ones", func() {
+				So(o2.store(NewPublication("e")), ShouldBeNil)
+				So(o2.replay(context.Background(), service), ShouldBeNil)
+				So(service.topics(), ShouldResemble, []string{"a", "b", "c", "e"})
+			})
+		})
+
+		Convey("When I replay while the service fails", func() {
+
+			service := &testOutboxPubSub{publishErr: errors.New("boom")}
+			err := o.replay(context.Background(), service)
+
+			Convey("Then the events should be kept", func() {
+				So(err, ShouldNotBeNil)
+				So(o.len(), ShouldEqual, 3)
+				So(o.status().LastError, ShouldEqual, "boom")
+			})
+
+			Convey("When the service recovers and I replay again", func() {
+
+				service.setErrors(nil, nil)
+				So(o.replay(context.Background(), service), ShouldBeNil)
+
+				Convey("Then the events should be published and removed from disk", func() {
+					So(service.topics(), ShouldResemble, []string{"a", "b", "c"})
+					s := o.status()
+					So(s.Events, ShouldEqual, 0)
+					So(s.Size, ShouldEqual, 0)
+					So(s.LastError, ShouldEqual, "")
+
+					files, err := os.ReadDir(dir)
+					So(err, ShouldBeNil)
+					So(len(files), ShouldEqual, 0)
+				})
+			})
+		})
+
+		Convey("When an event file is corrupted", func() {
+
+			So(os.WriteFile(filepath.Join(dir, o.entries[0].name), []byte("garbage"), 0600), ShouldBeNil)
+
+			service := &testOutboxPubSub{}
+			So(o.replay(context.Background(), service), ShouldBeNil)
+
+			Convey("Then it should be dropped and the others published", func() {
+				So(service.topics(), ShouldResemble, []string{"b", "c"})
+			})
+		})
+	})
+
+	Convey("Given I have a push outbox with a maximum size", t, func() {
+
+		o := newPushOutbox(t.TempDir(), PushOutboxOptMaxSize(10))
+
+		Convey("Then storing an event bigger than the maximum size should fail", func() {
+			So(o.store(NewPublication("a")), ShouldEqual, errPushOutboxFull)
+		})
+	})
+}
+
+func TestPushOutbox_Publish(t *testing.T) {
+
+	Convey("Given I have a push outbox and a pubsub", t, func() {
+
+		o := newPushOutbox(t.TempDir())
+		service := &testOutboxPubSub{}
+
+		Convey("When I publish an event while the outbox is empty", func() {
+
+			pub := NewPublication("a")
+			err := o.publish(pub, func() error { return service.Publish(pub) })
+
+			Convey("Then it should be published directly", func() {
+				So(err, ShouldBeNil)
+				So(service.topics(), ShouldResemble, []string{"a"})
+				So(o.len(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When an event is published while the publication of another one is failing", func() {
+
+			calledA := make(chan struct{})
+			releaseA := make(chan struct{})
+			doneA := make(chan error)
+			doneB := make(chan error)
+
+			pubA := NewPublication("a")
+			go func() {
+				doneA <- o.publish(pubA, func() error {
+					close(calledA)
+					<-releaseA
+					return errors.New("boom")
+				})
+			}()
+
+			<-calledA
+
+			pubB := NewPublication("b")
+			go func() {
+				doneB <- o.publish(pubB, func() error { return service.Publish(pubB) })
+			}()
+
+			// Give b a chance to overtake a.
+			time.Sleep(50 * time.Millisecond)
+			close(releaseA)
+
+			So(<-doneA, ShouldBeNil)
+			So(<-doneB, ShouldBeNil)
+
+			Convey("Then both events should be stored in order", func() {
+				So(service.topics(), ShouldBeEmpty)
+				So(o.len(), ShouldEqual, 2)
+				So(o.replay(context.Background(), service), ShouldBeNil)
+				So(service.topics(), ShouldResemble, []string{"a", "b"})
+			})
+		})
+	})
+}
+
+func TestPushOutbox_FlushRun(t *testing.T) {
+
+	Convey("Given I have a push outbox with an event", t, func() {
+
+		o := newPushOutbox(t.TempDir(), PushOutboxOptReplayInterval(10*time.Millisecond))
+		So(o.store(NewPublication("a")), ShouldBeNil)
+
+		service := &testOutboxPubSub{}
+		service.setErrors(errors.New("boom"), errors.New("down"))
+
+		Convey("When I flush while the service fails", func() {
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			err := o.flush(ctx, service)
+
+			Convey("Then it should fail when the context is done", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "unable to flush push outbox: boom")
+				So(o.len(), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When I flush and the service recovers", func() {
+
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				service.setErrors(nil, nil)
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			err := o.flush(ctx, service)
+
+			Convey("Then the event should be published", func() {
+				So(err, ShouldBeNil)
+				So(service.topics(), ShouldResemble, []string{"a"})
+			})
+		})
+
+		Convey("When I run the outbox", func() {
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go o.run(ctx, service)
+
+			Convey("Then it should not replay while the service is unhealthy", func() {
+				time.Sleep(50 * time.Millisecond)
+				So(o.len(), ShouldEqual, 1)
+				So(o.status().LastError, ShouldEqual, "")
+			})
+
+			Convey("Then it should replay once the service is healthy", func() {
+				service.setErrors(nil, nil)
+				So(func() bool {
+					for i := 0; i < 100; i++ {
+						if o.len() == 0 {
+							return true
+						}
+						time.Sleep(10 * time.Millisecond)
+					}
+					return false
+				}(), ShouldBeTrue)
+				So(service.topics(), ShouldResemble, []string{"a"})
+			})
+		})
+	})
+}
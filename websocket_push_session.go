@@ -125,7 +125,7 @@ func (s *wsPushSession) DirectPush(events ...*elemental.Event) {
 			continue
 		}
 
-		s.send(data)
+		s.sendDirect(data)
 	}
 }
 
@@ -205,9 +205,9 @@ func (s *wsPushSession) sendWSError(ee elemental.Error) {
 
 	switch s.encodingWrite {
 	case elemental.EncodingTypeMSGPACK:
-		s.send(msgpack)
+		s.sendDirect(msgpack)
 	case elemental.EncodingTypeJSON:
-		s.send(json)
+		s.sendDirect(json)
 	}
 }
 
@@ -248,17 +248,34 @@ func (s *wsPushSession) Cookie(name string) (*http.Cookie, error) {
 	return nil, http.ErrNoCookie
 }
 
+// sendDirect sends the given bytes outside of the dispatch
+// of the push events, and reports them to the metrics manager
+// if they have been dropped. The drops of the dispatched events
+// are reported with the dispatch outcomes instead.
+func (s *wsPushSession) sendDirect(data []byte) {
+
+	if !s.send(data) && s.cfg.healthServer.metricsManager != nil {
+		s.cfg.healthServer.metricsManager.RegisterPushEventDropped()
+	}
+}
+
 // send sends the given bytes as is, with no
-// additional checks.
-func (s *wsPushSession) send(data []byte) {
+// additional checks. It returns false if the data
+// has been dropped because the queue is full.
+func (s *wsPushSession) send(data []byte) bool {
 
 	select {
 	case s.dataCh <- data:
+		if s.cfg.healthServer.metricsManager != nil {
+			s.cfg.healthServer.metricsManager.ObservePushSessionQueueDepth(len(s.dataCh))
+		}
+		return true
 	default:
 		zap.L().Warn("Slow consumer. event dropped",
 			zap.String("sessionID", s.id),
 			zap.Strings("claims", s.claims),
 		)
+		return false
 	}
 }
 
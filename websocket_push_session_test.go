@@ -23,6 +23,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
 	. "github.com/smartystreets/goconvey/convey"
 	"go.aporeto.io/elemental"
 	testmodel "go.aporeto.io/elemental/test/model"
@@ -168,8 +169,11 @@ func TestWSPushSession_send(t *testing.T) {
 
 		Convey("When I call directPush and overflow it", func() {
 
+			var sent int
 			for i := 0; i < 2000; i++ {
-				s.send([]byte("hello"))
+				if s.send([]byte("hello")) {
+					sent++
+				}
 			}
 
 			var total int
@@ -184,6 +188,48 @@ func TestWSPushSession_send(t *testing.T) {
 
 			Convey("Then we should get 64 data", func() {
 				So(total, ShouldEqual, 64)
+				So(sent, ShouldEqual, 64)
+			})
+		})
+	})
+
+	Convey("Given I have a session with a metrics manager", t, func() {
+
+		registry := prometheus.NewRegistry()
+		req, _ := http.NewRequest("GET", "bla", nil)
+		cfg := config{}
+		cfg.healthServer.metricsManager = newPrometheusMetricsManager(registry)
+		s := newWSPushSession(req, cfg, nil, elemental.EncodingTypeMSGPACK, elemental.EncodingTypeMSGPACK)
+
+		dropped := func() float64 {
+			data, _ := registry.Gather()
+			for _, m := range data {
+				if m.GetName() == "ws_push_events_dropped_total" {
+					return m.GetMetric()[0].GetCounter().GetValue()
+				}
+			}
+			return -1
+		}
+
+		Convey("When I overflow it with send", func() {
+
+			for i := 0; i < 100; i++ {
+				s.send([]byte("hello"))
+			}
+
+			Convey("Then the drops should be left to the dispatch outcomes", func() {
+				So(dropped(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I overflow it with sendDirect", func() {
+
+			for i := 0; i < 100; i++ {
+				s.sendDirect([]byte("hello"))
+			}
+
+			Convey("Then the drops should be counted", func() {
+				So(dropped(), ShouldEqual, 36)
 			})
 		})
 	})
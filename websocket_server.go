@@ -15,6 +15,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -23,6 +24,9 @@ import (
 	"github.com/gorilla/websocket"
 	"go.aporeto.io/elemental"
 	"go.aporeto.io/wsc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -34,6 +38,7 @@ type pushServer struct {
 	sessionsLock    sync.RWMutex
 	mainContext     context.Context
 	publications    chan *Publication
+	endpoint        string
 }
 
 func newPushServer(cfg config, multiplexer *bone.Mux, processorFinder processorFinderFunc) *pushServer {
@@ -51,6 +56,7 @@ func newPushServer(cfg config, multiplexer *bone.Mux, processorFinder processorF
 	if endpoint == "" {
 		endpoint = "/events"
 	}
+	srv.endpoint = endpoint
 
 	// If push is not completely disabled and dispatching of event is not disabled, we install
 	// the websocket routes.
@@ -79,6 +85,8 @@ func (n *pushServer) registerSession(session *wsPushSession) {
 	if handler := n.cfg.pushServer.dispatchHandler; handler != nil {
 		handler.OnPushSessionStart(session)
 	}
+
+	n.logSessionAccess(session, AccessLogKindPushSessionStart)
 }
 
 func (n *pushServer) unregisterSession(session *wsPushSession) {
@@ -99,7 +107,65 @@ func (n *pushServer) unregisterSession(session *wsPushSession) {
 
 	if n.cfg.healthServer.metricsManager != nil {
 		n.cfg.healthServer.metricsManager.UnregisterWSConnection()
+		n.cfg.healthServer.metricsManager.ObservePushSessionLifetime(time.Since(session.startTime))
+	}
+
+	n.logSessionAccess(session, AccessLogKindPushSessionStop)
+}
+
+// session returns the session with the given ID, or nil.
+func (n *pushServer) session(id string) *wsPushSession {
+
+	n.sessionsLock.RLock()
+	defer n.sessionsLock.RUnlock()
+
+	return n.sessions[id]
+}
+
+// matchingSessions returns the sessions having all the given claims.
+func (n *pushServer) matchingSessions(claims map[string]string) []*wsPushSession {
+
+	n.sessionsLock.RLock()
+	defer n.sessionsLock.RUnlock()
+
+	out := make([]*wsPushSession, 0, len(n.sessions))
+
+	for _, session := range n.sessions {
+		if hasClaims(session.ClaimsMap(), claims) {
+			out = append(out, session)
+		}
 	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].startTime.Before(out[j].startTime) })
+
+	return out
+}
+
+// logSessionAccess writes the access log record for the
+// start or the stop of the given session, if enabled.
+func (n *pushServer) logSessionAccess(session *wsPushSession, kind AccessLogKind) {
+
+	accessLog := n.cfg.accessLog.log
+	if accessLog == nil {
+		return
+	}
+
+	record := &AccessLogRecord{
+		Timestamp:  time.Now(),
+		Kind:       kind,
+		SessionID:  session.Identifier(),
+		ClientIP:   session.ClientIP(),
+		Claims:     accessLog.claimsSubset(session.ClaimsMap()),
+		Method:     http.MethodGet,
+		Path:       n.endpoint,
+		StatusCode: http.StatusSwitchingProtocols,
+	}
+
+	if kind == AccessLogKindPushSessionStop {
+		record.Duration = record.Timestamp.Sub(session.startTime)
+	}
+
+	accessLog.log(record)
 }
 
 func (n *pushServer) authSession(session *wsPushSession) error {
@@ -150,6 +216,14 @@ func (n *pushServer) initPushSession(session *wsPushSession) error {
 
 func (n *pushServer) pushEvents(events ...*elemental.Event) {
 
+	n.pushEventsWithContext(context.Background(), events...)
+}
+
+// pushEventsWithContext pushes the given events. If an OpenTelemetry
+// TracerProvider is configured, the trace context of the given context
+// is propagated in the publications.
+func (n *pushServer) pushEventsWithContext(ctx context.Context, events ...*elemental.Event) {
+
 	// If we don't have a service or publication is explicitly disabled, we do nothing.
 	if n.cfg.pushServer.service == nil || !n.cfg.pushServer.enabled {
 		return
@@ -193,20 +267,79 @@ func (n *pushServer) pushEvents(events ...*elemental.Event) {
 		}
 
 		publication := NewPublication(topic)
+		if err := setPushChangesHeader(ctx, event, publication); err != nil {
+			zap.L().Warn("Unable to attach changes to event", zap.Stringer("event", event), zap.Error(err))
+		}
+
 		if err = publication.Encode(event); err != nil {
 			zap.L().Error("Unable to encode event", zap.Error(err))
+			if n.cfg.healthServer.metricsManager != nil {
+				n.cfg.healthServer.metricsManager.RegisterPushPublication(event.Identity, string(event.Type), true)
+			}
 			break
 		}
 
-		for i := 0; i < 3; i++ {
-			err = n.cfg.pushServer.service.Publish(publication)
+		if c := n.cfg.pushServer.compression; c != PublicationCompressionNone && len(publication.Data) >= n.cfg.pushServer.compressionThreshold {
+			if err = publication.Compress(c); err != nil {
+				zap.L().Error("Unable to compress event", zap.Error(err))
+				if n.cfg.healthServer.metricsManager != nil {
+					n.cfg.healthServer.metricsManager.RegisterPushPublication(event.Identity, string(event.Type), true)
+				}
+				break
+			}
+		}
+
+		var span trace.Span
+		if provider := n.cfg.opentelemetry.tracerProvider; provider != nil {
+			var pctx context.Context
+			pctx, span = provider.Tracer(otelInstrumentationName).Start(
+				ctx,
+				"bahamut.push.publish",
+				trace.WithSpanKind(trace.SpanKindProducer),
+				trace.WithAttributes(
+					attribute.String("topic", topic),
+					attribute.String("event.identity", event.Identity),
+					attribute.String("event.type", string(event.Type)),
+				),
+			)
+			publication.InjectTraceContext(pctx)
+		}
+
+		if outbox := n.cfg.pushServer.outbox; outbox != nil {
+			err = outbox.publish(publication, func() error { return n.publish(publication, event) })
 			if err != nil {
-				zap.L().Warn("Unable to publish event", zap.String("topic", publication.Topic), zap.Stringer("event", event), zap.Error(err))
-				continue
+				zap.L().Error("Unable to store event in push outbox. Event dropped.", zap.String("topic", publication.Topic), zap.Stringer("event", event), zap.Error(err))
 			}
-			break
+		} else {
+			err = n.publish(publication, event)
 		}
+
+		if n.cfg.healthServer.metricsManager != nil {
+			n.cfg.healthServer.metricsManager.RegisterPushPublication(event.Identity, string(event.Type), err != nil)
+		}
+
+		if span != nil {
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			span.End()
+		}
+	}
+}
+
+// publish publishes the given publication of the given
+// event, trying up to 3 times.
+func (n *pushServer) publish(publication *Publication, event *elemental.Event) (err error) {
+
+	for i := 0; i < 3; i++ {
+		if err = n.cfg.pushServer.service.Publish(publication); err == nil {
+			return nil
+		}
+		zap.L().Warn("Unable to publish event", zap.String("topic", publication.Topic), zap.Stringer("event", event), zap.Error(err))
 	}
+
+	return err
 }
 
 func (n *pushServer) handleRequest(w http.ResponseWriter, r *http.Request) {
@@ -350,6 +483,10 @@ func (n *pushServer) start(ctx context.Context) {
 		}
 
 		defer n.cfg.pushServer.service.Subscribe(n.publications, errors, subTopic)()
+
+		if outbox := n.cfg.pushServer.outbox; outbox != nil {
+			go outbox.run(ctx, n.cfg.pushServer.service)
+		}
 	}
 
 	zap.L().Debug("Websocket server started",
@@ -365,15 +502,72 @@ func (n *pushServer) start(ctx context.Context) {
 
 			go func(publication *Publication) {
 
+				// The event is acknowledged once dispatched, for the
+				// clients requiring it, so it is not redelivered.
+				defer func() { _ = publication.Ack() }()
+
+				metricsManager := n.cfg.healthServer.metricsManager
+
 				event := &elemental.Event{}
 				if err := publication.Decode(event); err != nil {
 					zap.L().Error("Unable to decode event",
 						zap.Stringer("event", event),
 						zap.Error(err),
 					)
+					if metricsManager != nil {
+						metricsManager.RegisterPushDispatch(PushDispatchOutcomeDecodeError, 1)
+					}
 					return
 				}
 
+				// We count the outcome of the dispatch for each session
+				// and report them once the fan-out is over.
+				var dispatched, dropped, filtered, rejected, failed int
+				if metricsManager != nil {
+					start := time.Now()
+					defer func() {
+						for outcome, count := range map[string]int{
+							PushDispatchOutcomeDispatched: dispatched,
+							PushDispatchOutcomeDropped:    dropped,
+							PushDispatchOutcomeFiltered:   filtered,
+							PushDispatchOutcomeRejected:   rejected,
+							PushDispatchOutcomeError:      failed,
+						} {
+							if count > 0 {
+								metricsManager.RegisterPushDispatch(outcome, count)
+							}
+						}
+						metricsManager.ObservePushDispatchDuration(time.Since(start))
+					}()
+				}
+
+				// If OpenTelemetry is configured, we trace the dispatch in a new
+				// trace, linked to the one of the request that pushed the event.
+				if provider := n.cfg.opentelemetry.tracerProvider; provider != nil {
+
+					opts := []trace.SpanStartOption{
+						trace.WithSpanKind(trace.SpanKindConsumer),
+						trace.WithAttributes(
+							attribute.String("topic", publication.Topic),
+							attribute.String("event.identity", event.Identity),
+							attribute.String("event.type", string(event.Type)),
+						),
+					}
+
+					if sc := trace.SpanContextFromContext(publication.ExtractTraceContext(context.Background())); sc.IsValid() {
+						opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+					}
+
+					_, span := provider.Tracer(otelInstrumentationName).Start(context.Background(), "bahamut.push.dispatch", opts...)
+					defer func() {
+						span.SetAttributes(
+							attribute.Int("push.dispatched", dispatched),
+							attribute.Int("push.dropped", dropped),
+						)
+						span.End()
+					}()
+				}
+
 				// We prepare the event data in both json and msgpack
 				// once for all.
 				dataMSGPACK, dataJSON, err := prepareEventData(event)
@@ -382,6 +576,7 @@ func (n *pushServer) start(ctx context.Context) {
 						zap.Stringer("event", event),
 						zap.Error(err),
 					)
+					failed++
 					return
 				}
 
@@ -394,6 +589,7 @@ func (n *pushServer) start(ctx context.Context) {
 							zap.Stringer("event", event),
 							zap.Error(err),
 						)
+						failed++
 						return
 					}
 				}
@@ -414,11 +610,13 @@ func (n *pushServer) start(ctx context.Context) {
 					// Client sent an invalid push config, this is a noop as it makes no sense to continue processing;
 					// wait until they send another message that is valid.
 					if session.inErrorState() {
+						filtered++
 						continue
 					}
 
 					// If event happened before session, we don't send it.
 					if event.Timestamp.Before(session.startTime) {
+						filtered++
 						continue
 					}
 
@@ -440,6 +638,7 @@ func (n *pushServer) start(ctx context.Context) {
 						}
 
 						if !ok {
+							filtered++
 							continue
 						}
 					}
@@ -452,19 +651,28 @@ func (n *pushServer) start(ctx context.Context) {
 								zap.L().Error("Error while calling dispatchHandler.ShouldDispatch", zap.Error(err))
 							}
 
+							failed++
 							continue
 						}
 
 						if !dispatch {
+							rejected++
 							continue
 						}
 					}
 
+					var sent bool
 					switch session.encodingWrite {
 					case elemental.EncodingTypeMSGPACK:
-						session.send(dataMSGPACK)
+						sent = session.send(dataMSGPACK)
 					case elemental.EncodingTypeJSON:
-						session.send(dataJSON)
+						sent = session.send(dataJSON)
+					}
+
+					if sent {
+						dispatched++
+					} else {
+						dropped++
 					}
 				}
 			}(p)
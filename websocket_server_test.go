@@ -24,6 +24,8 @@ import (
 	"time"
 
 	"github.com/go-zoo/bone"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	. "github.com/smartystreets/goconvey/convey"
 	"go.aporeto.io/elemental"
 	testmodel "go.aporeto.io/elemental/test/model"
@@ -553,6 +555,85 @@ func TestWebsocketServer_pushEvents(t *testing.T) {
 					elemental.EventCreate))
 			})
 		})
+
+		Convey("When I call pushEvents on a server w/ an outbox and the publication fails", func() {
+
+			srv := &mockPubSubServer{PublishErr: errors.New("boom")}
+
+			cfg := config{}
+			cfg.pushServer.service = srv
+			cfg.pushServer.enabled = true
+			cfg.pushServer.publishEnabled = true
+			cfg.pushServer.dispatchEnabled = true
+			cfg.pushServer.outbox = newPushOutbox(t.TempDir())
+
+			wss := newPushServer(cfg, mux, pf)
+			wss.pushEvents(elemental.NewEvent(elemental.EventCreate, testmodel.NewList()))
+
+			Convey("Then the event should be stored in the outbox", func() {
+				So(len(srv.publications), ShouldEqual, 3)
+				So(cfg.pushServer.outbox.len(), ShouldEqual, 1)
+			})
+
+			Convey("When I push another event after the service recovered", func() {
+
+				srv.PublishErr = nil
+				wss.pushEvents(elemental.NewEvent(elemental.EventUpdate, testmodel.NewList()))
+
+				Convey("Then it should be stored after the first one to keep the order", func() {
+					So(len(srv.publications), ShouldEqual, 3)
+					So(cfg.pushServer.outbox.len(), ShouldEqual, 2)
+				})
+			})
+		})
+
+		Convey("When I call pushEvents on a server w/ compression enabled", func() {
+
+			srv := &mockPubSubServer{}
+
+			cfg := config{}
+			cfg.pushServer.service = srv
+			cfg.pushServer.enabled = true
+			cfg.pushServer.publishEnabled = true
+			cfg.pushServer.dispatchEnabled = true
+			cfg.pushServer.compression = PublicationCompressionGzip
+
+			wss := newPushServer(cfg, mux, pf)
+			evtin := elemental.NewEvent(elemental.EventCreate, testmodel.NewList())
+			wss.pushEvents(evtin)
+
+			Convey("Then I should find one compressed publication", func() {
+				So(len(srv.publications), ShouldEqual, 1)
+				pub := srv.publications[0]
+				So(pub.Compression, ShouldEqual, PublicationCompressionGzip)
+
+				evtout := &elemental.Event{}
+				So(pub.Decode(evtout), ShouldBeNil)
+				So(evtout.Identity, ShouldEqual, evtin.Identity)
+				So(evtout.Type, ShouldEqual, evtin.Type)
+			})
+		})
+
+		Convey("When I call pushEvents on a server w/ compression enabled above a threshold", func() {
+
+			srv := &mockPubSubServer{}
+
+			cfg := config{}
+			cfg.pushServer.service = srv
+			cfg.pushServer.enabled = true
+			cfg.pushServer.publishEnabled = true
+			cfg.pushServer.dispatchEnabled = true
+			cfg.pushServer.compression = PublicationCompressionGzip
+			cfg.pushServer.compressionThreshold = 1 << 20
+
+			wss := newPushServer(cfg, mux, pf)
+			wss.pushEvents(elemental.NewEvent(elemental.EventCreate, testmodel.NewList()))
+
+			Convey("Then I should find one uncompressed publication", func() {
+				So(len(srv.publications), ShouldEqual, 1)
+				So(srv.publications[0].Compression, ShouldEqual, PublicationCompressionNone)
+			})
+		})
 	})
 }
 
@@ -1390,3 +1471,93 @@ func Test_prepareEventData(t *testing.T) {
 		})
 	}
 }
+
+func TestWebsocketServer_metrics(t *testing.T) {
+
+	Convey("Given I have a push server with a metrics manager", t, func() {
+
+		ps := NewLocalPubSubClient()
+		So(ps.Connect(context.Background()), ShouldBeNil)
+		defer ps.Disconnect() // nolint: errcheck
+
+		registry := prometheus.NewRegistry()
+
+		cfg := config{}
+		cfg.pushServer.enabled = true
+		cfg.pushServer.service = ps
+		cfg.pushServer.topic = "events"
+		cfg.healthServer.metricsManager = newPrometheusMetricsManager(registry)
+
+		srv := newPushServer(cfg, bone.New(), nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go srv.start(ctx)
+		time.Sleep(100 * time.Millisecond) // let the push server subscribe
+
+		s1 := newWSPushSession((&http.Request{URL: &url.URL{}}).WithContext(ctx), cfg, nil, elemental.EncodingTypeMSGPACK, elemental.EncodingTypeMSGPACK)
+		s1.id = "s1"
+		s1.setErrorState(true)
+		srv.registerSession(s1)
+
+		s2 := newWSPushSession((&http.Request{URL: &url.URL{}}).WithContext(ctx), cfg, nil, elemental.EncodingTypeMSGPACK, elemental.EncodingTypeMSGPACK)
+		s2.id = "s2"
+		srv.registerSession(s2)
+
+		Convey("When I push an event and unregister the sessions", func() {
+
+			srv.pushEvents(&elemental.Event{
+				Type:      elemental.EventCreate,
+				Identity:  "thing",
+				Encoding:  elemental.EncodingTypeMSGPACK,
+				Timestamp: time.Now().Add(time.Second),
+			})
+
+			select {
+			case <-s2.dataCh:
+			case <-time.After(time.Second):
+				panic("event not dispatched in time")
+			}
+
+			srv.unregisterSession(s1)
+			srv.unregisterSession(s2)
+
+			var metrics map[string]*dto.MetricFamily
+			for i := 0; i < 100; i++ {
+				metrics = map[string]*dto.MetricFamily{}
+				data, _ := registry.Gather()
+				for _, m := range data {
+					metrics[m.GetName()] = m
+				}
+				if m, ok := metrics["ws_push_dispatch_duration_seconds"]; ok && m.GetMetric()[0].GetHistogram().GetSampleCount() == 1 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			Convey("Then the publication should be counted", func() {
+				m := metrics["ws_push_events_published_total"].GetMetric()[0]
+				So(m.GetCounter().GetValue(), ShouldEqual, 1)
+				So(m.Label[0].String(), ShouldEqual, `name:"identity" value:"thing" `)
+				So(m.Label[1].String(), ShouldEqual, `name:"status" value:"success" `)
+				So(m.Label[2].String(), ShouldEqual, `name:"type" value:"create" `)
+			})
+
+			Convey("Then the dispatch outcomes should be counted", func() {
+				m := metrics["ws_push_dispatch_total"].GetMetric()
+				So(len(m), ShouldEqual, 2)
+				So(m[0].Label[0].String(), ShouldEqual, `name:"outcome" value:"dispatched" `)
+				So(m[0].GetCounter().GetValue(), ShouldEqual, 1)
+				So(m[1].Label[0].String(), ShouldEqual, `name:"outcome" value:"filtered" `)
+				So(m[1].GetCounter().GetValue(), ShouldEqual, 1)
+				So(metrics["ws_push_dispatch_duration_seconds"].GetMetric()[0].GetHistogram().GetSampleCount(), ShouldEqual, 1)
+			})
+
+			Convey("Then the session metrics should be collected", func() {
+				So(metrics["ws_push_session_queue_depth"].GetMetric()[0].GetHistogram().GetSampleCount(), ShouldEqual, 1)
+				So(metrics["ws_push_session_lifetime_seconds"].GetMetric()[0].GetHistogram().GetSampleCount(), ShouldEqual, 2)
+				So(metrics["ws_push_events_dropped_total"].GetMetric()[0].GetCounter().GetValue(), ShouldEqual, 0)
+			})
+		})
+	})
+}